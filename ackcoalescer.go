@@ -0,0 +1,31 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+)
+
+// ackCoalescer accumulates received sequence numbers into the ranges of a single ACK, along with the most recent RTT
+// probe to echo.
+//
+type ackCoalescer struct {
+	util.AckCoalescer
+	rtt *uint16
+}
+
+func (ac *ackCoalescer) add(seq int32, rtt *uint16) {
+	if rtt != nil {
+		ac.rtt = rtt
+	}
+	ac.Add(seq)
+}
+
+func (ac *ackCoalescer) take() ([]Ack, *uint16) {
+	ranges := ac.Take()
+	acks := make([]Ack, len(ranges))
+	for i, r := range ranges {
+		acks[i] = Ack{r.Start, r.End}
+	}
+	rtt := ac.rtt
+	ac.rtt = nil
+	return acks, rtt
+}
@@ -0,0 +1,156 @@
+package dilithium
+
+import (
+	"github.com/emirpasic/gods/trees/btree"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAckCoalescer(t *testing.T) {
+	ac := &ackCoalescer{}
+	assert.False(t, ac.Pending())
+
+	rtt0 := uint16(10)
+	rtt1 := uint16(20)
+	ac.add(1, nil)
+	ac.add(2, &rtt0)
+	ac.add(3, &rtt1)
+	ac.add(5, nil)
+	ac.add(2, nil)
+	ac.add(6, nil)
+	assert.True(t, ac.Pending())
+	assert.True(t, ac.Full(6))
+	assert.False(t, ac.Full(7))
+
+	acks, rtt := ac.take()
+	assert.Equal(t, []Ack{{1, 3}, {5, 6}}, acks)
+	assert.Equal(t, &rtt1, rtt)
+	assert.False(t, ac.Pending())
+}
+
+func TestAckCoalescerWrap(t *testing.T) {
+	ac := &ackCoalescer{}
+	ac.add(math.MaxInt32-1, nil)
+	ac.add(math.MaxInt32, nil)
+	ac.add(0, nil)
+	acks, _ := ac.take()
+	assert.Equal(t, []Ack{{math.MaxInt32 - 1, 0}}, acks)
+}
+
+type ackCapturingInstrumentInstance struct {
+	NilInstrumentInstance
+	lock sync.Mutex
+	acks [][]Ack
+}
+
+func (self *ackCapturingInstrumentInstance) TxAck(wm *WireMessage) {
+	acks, _, _, err := wm.asAck()
+	if err == nil {
+		self.lock.Lock()
+		self.acks = append(self.acks, acks)
+		self.lock.Unlock()
+	}
+}
+
+// runDelayedAcks feeds the DATA sequences in seqs through an RxPortal configured with ackDelayMs, and returns the ACKs
+// that it transmits.
+//
+func runDelayedAcks(t *testing.T, ackDelayMs int, seqs []int32) [][]Ack {
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.AckDelayMs = ackDelayMs
+	a, _ := NewEmulatedAdapterPair(util.NewEmulatorConfig(9), util.NewEmulatorConfig(10))
+	defer func() { _ = a.Close() }()
+
+	ii := &ackCapturingInstrumentInstance{}
+	rxp := &RxPortal{
+		adapter:  a,
+		sink:     NewReadSinkAdapter(profile.Txpf),
+		tree:     btree.NewWith(profile.Txpf.MaxTreeSize, util.SeqComparator),
+		accepted: -1,
+		rxs:      make(chan *WireMessage),
+		exited:   make(chan struct{}),
+		ackPool:  NewPool("ackPool", uint32(profile.Txpf.PoolBufferSize), ii),
+		txp:      &TxPortal{alg: NewWestworldAlgorithm(profile, ii)},
+		ii:       ii,
+	}
+	go rxp.run()
+
+	dataPool := NewPool("dataPool", uint32(profile.Txpf.PoolBufferSize), ii)
+	for _, seq := range seqs {
+		wm, err := newData(seq, nil, []byte{byte(seq)}, dataPool)
+		assert.NoError(t, err)
+		rxp.rxs <- wm
+	}
+	time.Sleep(time.Duration(ackDelayMs+50) * time.Millisecond)
+	close(rxp.rxs)
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	return ii.acks
+}
+
+func TestDelayedAcks(t *testing.T) {
+	seqs := make([]int32, 64)
+	for i := range seqs {
+		seqs[i] = int32(i)
+	}
+
+	acks := runDelayedAcks(t, 0, seqs)
+	assert.Equal(t, 64, len(acks))
+
+	acks = runDelayedAcks(t, 10, seqs)
+	assert.Equal(t, [][]Ack{{{0, 15}}, {{16, 31}}, {{32, 47}}, {{48, 63}}}, acks)
+
+	acks = runDelayedAcks(t, 10, seqs[:4])
+	assert.Equal(t, [][]Ack{{{0, 3}}}, acks)
+}
+
+func TestDelayedAcksGap(t *testing.T) {
+	acks := runDelayedAcks(t, 10, []int32{0, 1, 3, 4, 2, 5, 1})
+	assert.Equal(t, [][]Ack{{{0, 1}, {3, 3}}, {{4, 4}}, {{2, 2}, {5, 5}, {1, 1}}}, acks)
+}
+
+func TestHelloAdvertisesAckDelay(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listenerProfile := NewBaselineWestworldProfile()
+	listenerProfile.Txpf.AckDelayMs = 5
+	l, err := Listen(NewFramedListener(tcpListener), listenerProfile, nil)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	dialerProfile := NewBaselineWestworldProfile()
+	dialerProfile.Txpf.AckDelayMs = 20
+	dialed, err := Dial(NewFramedAdapter(tcpConn), dialerProfile, nil)
+	assert.NoError(t, err)
+	defer func() { _ = dialed.Close() }()
+	accepted, err := l.Accept()
+	assert.NoError(t, err)
+	defer func() { _ = accepted.Close() }()
+
+	// each side allows for the delay advertised by its peer, rather than its own
+	assert.Equal(t, 5, dialed.(*conn).txp.monitor.peerAckDelayMs)
+	assert.Equal(t, 20, accepted.(*conn).txp.monitor.peerAckDelayMs)
+}
+
+func TestHelloWithoutAckDelay(t *testing.T) {
+	data := make([]byte, helloSize)
+	_, err := encodeHello(hello{protocolVersion, 25}, data)
+	assert.NoError(t, err)
+	h, _, err := decodeHello(data)
+	assert.NoError(t, err)
+	assert.Equal(t, hello{protocolVersion, 25}, h)
+
+	// a peer that predates the ack delay sends just the version
+	h, sz, err := decodeHello(data[:helloVersionSize])
+	assert.NoError(t, err)
+	assert.Equal(t, hello{version: protocolVersion}, h)
+	assert.Equal(t, uint32(helloVersionSize), sz)
+}
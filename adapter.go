@@ -1,6 +1,9 @@
 package dilithium
 
-import "io"
+import (
+	"io"
+	"net"
+)
 
 // Adapter abstracts the underlying communication mechanism that dilithium is managing. Implementations are free to
 // manage whatever state is necessary, and need to provide a basic `Read`, `Write`, and `Close` facility.
@@ -10,3 +13,31 @@ type Adapter interface {
 	io.Writer
 	io.Closer
 }
+
+// AddressedAdapter is an optional extension of Adapter, implemented by adapters that are able to report the addresses
+// of both ends of the underlying communication mechanism.
+//
+type AddressedAdapter interface {
+	Adapter
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// AdapterListener produces Adapter instances for inbound communications. It wraps whatever mechanism is responsible for
+// accepting new underlying connections, and is consumed by Listen.
+//
+type AdapterListener interface {
+	Accept() (Adapter, error)
+	Close() error
+	Addr() net.Addr
+}
+
+type adapterAddr string
+
+func (self adapterAddr) Network() string {
+	return "dilithium"
+}
+
+func (self adapterAddr) String() string {
+	return string(self)
+}
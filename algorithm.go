@@ -1,6 +1,7 @@
 package dilithium
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -40,9 +41,10 @@ type TxAlgorithm interface {
 	ProbeRTT() bool
 
 	// UpdateRTT pushes a round-trip time probe result onto the algorithm, allowing it to adapt its RetxMs calculation
-	// accordingly.
+	// accordingly. The sample is passed at the full resolution of the probe, so that sub-millisecond round trips are not
+	// truncated.
 	//
-	UpdateRTT(rttMs int)
+	UpdateRTT(rtt time.Duration)
 
 	// RetxMs returns the current timeout value for retransmission events.
 	//
@@ -52,7 +54,7 @@ type TxAlgorithm interface {
 	//
 	RxPortalSize() int
 
-	// UpdateRxPortalSize updates the observed size of the receiver's buffer.
+	// UpdateRxPortalSize updates the observed size of the receiver's buffer. The caller must hold the shared lock.
 	//
 	UpdateRxPortalSize(int)
 
@@ -65,34 +67,145 @@ type TxAlgorithm interface {
 	Profile() *TxProfile
 }
 
+// InterruptibleTxAlgorithm is optionally implemented by a TxAlgorithm whose blocked Tx callers can be released, which
+// allows a TxPortal to honor write deadlines and closure while waiting for capacity.
+//
+type InterruptibleTxAlgorithm interface {
+	// TxInterruptible behaves like Tx, but returns false without consuming any capacity once interrupted returns true.
+	// The interrupted function is evaluated while holding the shared lock.
+	//
+	TxInterruptible(segmentSize int, interrupted func() bool) bool
+
+	// Interrupt wakes any blocked TxInterruptible callers, so that they re-evaluate their interrupted function. The
+	// caller must hold the shared lock.
+	//
+	Interrupt()
+}
+
+// PacingTxAlgorithm is optionally implemented by a TxAlgorithm that can estimate the rate at which the wire drains its
+// portal, which allows a TxPortal to pace its transmissions instead of writing the available capacity in a burst.
+//
+type PacingTxAlgorithm interface {
+	// PacingRate returns the estimated transmission rate in bytes per second, or 0 when there is no estimate yet.
+	//
+	PacingRate() float64
+}
+
 // TxProfile defines all of the configurable values that are requested by a flow control algorithm.
 //
 type TxProfile struct {
-	MaxSegmentSize          int
-	RetxBatchMs             int
-	SendKeepalive           bool
-	ConnectionTimeout       time.Duration
-	MaxTreeSize             int
-	ReadsQueueSize          int
-	PoolBufferSize          int
-	RxPortalPacingThreshold float64
-	CloseCheckMs            int
+	MaxSegmentSize           int
+	RetxBatchMs              int
+	RetxMaxMs                int
+	SendKeepalive            bool
+	ConnectionSetupTimeoutMs int
+	ConnectionTimeout        time.Duration
+	MaxTreeSize              int
+	ReadsQueueSize           int
+	RxQueueSize              int
+	RxQueuePolicy            RxQueuePolicy
+	PoolBufferSize           int
+	RxPortalPacingThreshold  float64
+	CloseCheckMs             int
+	AckDelayMs               int
+	AckCoalesceThreshold     int
+	FastRetxThreshold        int
+	PoolDebug                bool
 }
 
 func DefaultTxProfile() *TxProfile {
 	return &TxProfile{
-		MaxSegmentSize:          64000,
-		RetxBatchMs:             2,
-		SendKeepalive:           true,
-		ConnectionTimeout:       15000,
-		MaxTreeSize:             64 * 1024,
-		ReadsQueueSize:          1024,
-		PoolBufferSize:          64 * 1024,
-		RxPortalPacingThreshold: 0.5,
-		CloseCheckMs:            500,
+		MaxSegmentSize:           64000,
+		RetxBatchMs:              2,
+		RetxMaxMs:                8000,
+		SendKeepalive:            true,
+		ConnectionSetupTimeoutMs: 5000,
+		ConnectionTimeout:        15 * time.Second,
+		MaxTreeSize:              64 * 1024,
+		ReadsQueueSize:           1024,
+		RxQueueSize:              64,
+		RxQueuePolicy:            RxQueueDropNewest,
+		PoolBufferSize:           64 * 1024,
+		RxPortalPacingThreshold:  0.5,
+		CloseCheckMs:             500,
+		AckDelayMs:               0,
+		AckCoalesceThreshold:     16,
+		FastRetxThreshold:        3,
+		PoolDebug:                false,
 	}
 }
 
+// NewPool creates a buffer pool sized for this profile. With PoolDebug, the pool checks every buffer reference (see
+// NewDebugPool).
+//
 func (txp *TxProfile) NewPool(id string, ii InstrumentInstance) *Pool {
+	if txp.PoolDebug {
+		return NewDebugPool(id, uint32(txp.PoolBufferSize), ii)
+	}
 	return NewPool(id, uint32(txp.PoolBufferSize), ii)
 }
+
+// availableCapacity applies the portal capacity calculation shared by the bundled algorithms, which discounts the
+// capacity by the pressure of data buffered at the receiver.
+//
+func availableCapacity(capacity, txPortalSize, rxPortalSize, segmentSize int, rxSizePressureScale float64) bool {
+	return capacity-int(float64(rxPortalSize)*rxSizePressureScale)-(txPortalSize+segmentSize) > 0
+}
+
+// RttEstimator maintains smoothed round-trip time and variance as described in RFC 6298, and derives a retransmission
+// timeout from them. It is shared by the tx algorithms in this package and by the westworld3 portal algorithm.
+//
+type RttEstimator struct {
+	srtt    float64
+	rttvar  float64
+	samples int
+	addMs   int
+	retxMs  int
+}
+
+// NewRttEstimator returns an estimator that reports a retransmission timeout of startMs until the first sample, and
+// adds addMs to every timeout derived from a sample.
+//
+func NewRttEstimator(startMs, addMs int) RttEstimator {
+	return RttEstimator{addMs: addMs, retxMs: startMs}
+}
+
+func (e *RttEstimator) Update(sample time.Duration) {
+	e.UpdateScaled(sample, 1.0)
+}
+
+// UpdateScaled folds sample into the estimate, weighting the smoothed round-trip time by scale when deriving the
+// retransmission timeout.
+//
+func (e *RttEstimator) UpdateScaled(sample time.Duration, scale float64) {
+	rtt := float64(sample) / float64(time.Millisecond)
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		e.rttvar = 0.75*e.rttvar + 0.25*math.Abs(e.srtt-rtt)
+		e.srtt = 0.875*e.srtt + 0.125*rtt
+	}
+	e.samples++
+	e.retxMs = int(e.srtt*scale+4*e.rttvar) + e.addMs
+}
+
+func (e *RttEstimator) RetxMs() int {
+	return e.retxMs
+}
+
+// Rate returns the rate at which capacity bytes are delivered in a smoothed round-trip time, in bytes per second.
+//
+func (e *RttEstimator) Rate(capacity int) float64 {
+	if e.samples == 0 || e.srtt <= 0 {
+		return 0
+	}
+	return float64(capacity) * 1000.0 / e.srtt
+}
+
+func (e *RttEstimator) SrttMs() int {
+	if e.samples == 0 {
+		return e.retxMs
+	}
+	return int(e.srtt)
+}
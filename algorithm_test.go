@@ -0,0 +1,164 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCubicReductionAndRegrowth(t *testing.T) {
+	pf := NewBaselineCubicProfile()
+	ca := NewCubicAlgorithm(pf, &NilInstrumentInstance{}).(*CubicAlgorithm)
+	ca.SetLock(new(sync.Mutex))
+
+	// slow start grows the capacity by each acknowledged segment
+	ca.Tx(pf.SegmentSize)
+	ca.Success(pf.SegmentSize)
+	assert.Equal(t, pf.StartSize+pf.SegmentSize, ca.capacity)
+
+	before := ca.capacity
+	ca.Retransmission(pf.SegmentSize)
+	assert.Equal(t, int(float64(before)*pf.Beta), ca.capacity)
+	assert.Equal(t, ca.capacity, ca.ssthresh)
+
+	// further losses within the same round trip are the same loss episode
+	reduced := ca.capacity
+	ca.Retransmission(pf.SegmentSize)
+	assert.Equal(t, reduced, ca.capacity)
+
+	for i := 0; i < 1000; i++ {
+		ca.Tx(pf.SegmentSize)
+		ca.Success(pf.SegmentSize)
+	}
+	assert.Greater(t, ca.capacity, reduced)
+	assert.LessOrEqual(t, ca.capacity, pf.MaxSize)
+}
+
+func TestCubicMinSize(t *testing.T) {
+	pf := NewBaselineCubicProfile()
+	ca := NewCubicAlgorithm(pf, &NilInstrumentInstance{}).(*CubicAlgorithm)
+	ca.SetLock(new(sync.Mutex))
+
+	for i := 0; i < 32; i++ {
+		ca.lastLoss = time.Time{}
+		ca.Retransmission(pf.SegmentSize)
+	}
+	assert.Equal(t, pf.MinSize, ca.capacity)
+}
+
+func TestWestworldUpdateRTT(t *testing.T) {
+	pf := NewBaselineWestworldProfile()
+	wa := NewWestworldAlgorithm(pf, &NilInstrumentInstance{})
+	assert.Equal(t, pf.RetxStartMs, wa.RetxMs())
+
+	// first sample: srtt = 100, rttvar = 50
+	wa.UpdateRTT(100 * time.Millisecond)
+	assert.Equal(t, 100+4*50+pf.RetxAddMs, wa.RetxMs())
+
+	// rttvar = 0.75 * 50 + 0.25 * |100 - 60| = 47.5, srtt = 0.875 * 100 + 0.125 * 60 = 95
+	wa.UpdateRTT(60 * time.Millisecond)
+	assert.Equal(t, int(95+4*47.5)+pf.RetxAddMs, wa.RetxMs())
+}
+
+func TestBBRMinRtt(t *testing.T) {
+	pf := NewBaselineBBRProfile()
+	ba := NewBBRAlgorithm(pf, &NilInstrumentInstance{}).(*BBRAlgorithm)
+	ba.SetLock(new(sync.Mutex))
+
+	ba.UpdateRTT(40 * time.Millisecond)
+	ba.UpdateRTT(20 * time.Millisecond)
+	ba.UpdateRTT(30 * time.Millisecond)
+	assert.Equal(t, 20*time.Millisecond, ba.minRtt)
+
+	// an expired window accepts a larger minimum
+	ba.minRttStamp = time.Now().Add(-time.Duration(pf.MinRttWindowMs+1) * time.Millisecond)
+	ba.UpdateRTT(30 * time.Millisecond)
+	assert.Equal(t, 30*time.Millisecond, ba.minRtt)
+}
+
+func TestBBRCapacityFollowsBandwidth(t *testing.T) {
+	pf := NewBaselineBBRProfile()
+	ba := NewBBRAlgorithm(pf, &NilInstrumentInstance{}).(*BBRAlgorithm)
+	ba.SetLock(new(sync.Mutex))
+	ba.UpdateRTT(10 * time.Millisecond)
+
+	// 10MB/s at 10ms is a 100KB bandwidth-delay product
+	ba.endRound(10 * 1024 * 1024)
+	assert.Equal(t, bbrStartup, ba.state)
+	assert.Equal(t, int(pf.StartupGain*ba.bdp()), ba.capacity)
+
+	for i := 0; i < pf.StartupFullBwRounds; i++ {
+		ba.endRound(10 * 1024 * 1024)
+	}
+	assert.Equal(t, bbrDrain, ba.state)
+	assert.Less(t, float64(ba.capacity), ba.bdp())
+
+	ba.Success(0)
+	assert.Equal(t, bbrProbeBw, ba.state)
+	assert.Equal(t, int(pf.CwndGain*bbrProbeBwGains[0]*ba.bdp()), ba.capacity)
+
+	// loss is not a congestion signal
+	capacity := ba.capacity
+	ba.Retransmission(1450)
+	assert.Equal(t, capacity, ba.capacity)
+}
+
+func TestPacingRate(t *testing.T) {
+	wpf := NewBaselineWestworldProfile()
+	wa := NewWestworldAlgorithm(wpf, &NilInstrumentInstance{}).(*WestworldAlgorithm)
+	cpf := NewBaselineCubicProfile()
+	ca := NewCubicAlgorithm(cpf, &NilInstrumentInstance{}).(*CubicAlgorithm)
+	for _, alg := range []TxAlgorithm{wa, ca} {
+		pacing := alg.(PacingTxAlgorithm)
+		assert.Equal(t, 0.0, pacing.PacingRate())
+		alg.UpdateRTT(100 * time.Millisecond)
+	}
+	// the portal is delivered once per smoothed round-trip time
+	assert.Equal(t, float64(wa.capacity)*10, wa.PacingRate())
+	assert.Equal(t, float64(ca.capacity)*10, ca.PacingRate())
+}
+
+func TestBBRPacingRate(t *testing.T) {
+	pf := NewBaselineBBRProfile()
+	ba := NewBBRAlgorithm(pf, &NilInstrumentInstance{}).(*BBRAlgorithm)
+	ba.SetLock(new(sync.Mutex))
+	assert.Equal(t, 0.0, ba.PacingRate())
+
+	ba.UpdateRTT(10 * time.Millisecond)
+	assert.Equal(t, float64(ba.capacity)*100, ba.PacingRate())
+
+	ba.endRound(10 * 1024 * 1024)
+	assert.Equal(t, pf.StartupGain*10*1024*1024, ba.PacingRate())
+
+	ba.state = bbrProbeBw
+	ba.cycleIndex = 1
+	assert.Equal(t, bbrProbeBwGains[1]*10*1024*1024, ba.PacingRate())
+}
+
+func TestEmulatedPortalsAlgorithms(t *testing.T) {
+	bbr := NewBaselineBBRProfile()
+	cubic := NewBaselineCubicProfile()
+	profiles := map[string]TxAlgorithmProfile{"bbr": bbr, "cubic": cubic}
+	// small segments, so that every transfer experiences loss; limit the backoff of the resulting retransmissions, so
+	// that the transfers complete quickly
+	for _, txpf := range []*TxProfile{bbr.Txpf, cubic.Txpf} {
+		txpf.MaxSegmentSize = 1450
+		txpf.PoolBufferSize = 2048
+		txpf.RetxMaxMs = 400
+	}
+	for name, profile := range profiles {
+		t.Run(name, func(t *testing.T) {
+			aToB := util.NewEmulatorConfig(7)
+			aToB.LossRate = 0.02
+			aToB.ReorderRate = 0.02
+			ii, a := emulatedProfileTransfer(t, aToB, util.NewEmulatorConfig(8), profile, 1024*1024)
+			defer func() { _ = a.Close() }()
+
+			ii.lock.Lock()
+			defer ii.lock.Unlock()
+			assert.Greater(t, ii.retx, 0)
+		})
+	}
+}
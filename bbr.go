@@ -0,0 +1,281 @@
+package dilithium
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBw
+)
+
+var bbrProbeBwGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// BBRAlgorithm implements a delay-based flow control loosely modeled on BBR. It estimates the bottleneck bandwidth from
+// the delivery rate of acknowledged data and the propagation delay from the minimum observed round-trip time, and sizes
+// the portal as a multiple of their product. Loss is not treated as a congestion signal.
+//
+type BBRAlgorithm struct {
+	capacity       int
+	txPortalSize   int
+	rxPortalSize   int
+	state          bbrState
+	btlBw          float64
+	bwSamples      []float64
+	fullBw         float64
+	fullBwRounds   int
+	cycleIndex     int
+	minRtt         time.Duration
+	minRttStamp    time.Time
+	roundStart     time.Time
+	roundDelivered int
+	lastRttProbe   time.Time
+	rtt            RttEstimator
+	ii             InstrumentInstance
+
+	bpf   *BBRProfile
+	pf    *TxProfile
+	lock  *sync.Mutex
+	ready *sync.Cond
+}
+
+func NewBBRAlgorithm(pf *BBRProfile, ii InstrumentInstance) TxAlgorithm {
+	ba := &BBRAlgorithm{
+		capacity: pf.StartSize,
+		state:    bbrStartup,
+		minRtt:   -1,
+		rtt:      NewRttEstimator(pf.RetxStartMs, pf.RetxAddMs),
+		bpf:      pf,
+		pf:       pf.Txpf,
+		ii:       ii,
+	}
+	ba.ii.TxPortalCapacityChanged(ba.capacity)
+	ba.ii.NewRetxMs(ba.rtt.RetxMs())
+	return ba
+}
+
+func (ba *BBRAlgorithm) SetLock(lock *sync.Mutex) {
+	ba.lock = lock
+	ba.ready = sync.NewCond(lock)
+}
+
+func (ba *BBRAlgorithm) Tx(segmentSize int) {
+	ba.TxInterruptible(segmentSize, func() bool { return false })
+}
+
+func (ba *BBRAlgorithm) TxInterruptible(segmentSize int, interrupted func() bool) bool {
+	for !availableCapacity(ba.capacity, ba.txPortalSize, ba.rxPortalSize, segmentSize, ba.bpf.RxSizePressureScale) {
+		if interrupted() {
+			return false
+		}
+		ba.ready.Wait()
+	}
+	if ba.roundStart.IsZero() {
+		ba.roundStart = time.Now()
+	}
+	ba.txPortalSize += segmentSize
+	ba.ii.TxPortalSzChanged(ba.txPortalSize)
+	return true
+}
+
+func (ba *BBRAlgorithm) Interrupt() {
+	ba.ready.Broadcast()
+}
+
+func (ba *BBRAlgorithm) Success(segmentSize int) {
+	ba.txPortalSize -= segmentSize
+	ba.roundDelivered += segmentSize
+
+	now := time.Now()
+	if elapsed := now.Sub(ba.roundStart); elapsed >= ba.roundDuration() {
+		ba.endRound(float64(ba.roundDelivered) / elapsed.Seconds())
+		ba.roundStart = now
+		ba.roundDelivered = 0
+	}
+
+	if ba.state == bbrDrain && float64(ba.txPortalSize) <= ba.bdp() {
+		ba.state = bbrProbeBw
+		ba.cycleIndex = 0
+		ba.updateCapacity()
+	}
+
+	ba.ready.Broadcast()
+	ba.ii.TxPortalSzChanged(ba.txPortalSize)
+}
+
+func (ba *BBRAlgorithm) DuplicateAck() {
+}
+
+func (ba *BBRAlgorithm) Retransmission(_ int) {
+}
+
+func (ba *BBRAlgorithm) ProbeRTT() bool {
+	if time.Since(ba.lastRttProbe).Milliseconds() >= int64(ba.bpf.RttProbeMs) {
+		ba.lastRttProbe = time.Now()
+		return true
+	}
+	return false
+}
+
+func (ba *BBRAlgorithm) UpdateRTT(rtt time.Duration) {
+	if ba.minRtt < 0 || rtt <= ba.minRtt || time.Since(ba.minRttStamp).Milliseconds() > int64(ba.bpf.MinRttWindowMs) {
+		ba.minRtt = rtt
+		ba.minRttStamp = time.Now()
+	}
+	ba.rtt.Update(rtt)
+	ba.ii.NewRetxMs(ba.rtt.RetxMs())
+}
+
+func (ba *BBRAlgorithm) RetxMs() int {
+	return ba.rtt.RetxMs()
+}
+
+func (ba *BBRAlgorithm) RxPortalSize() int {
+	return ba.rxPortalSize
+}
+
+func (ba *BBRAlgorithm) UpdateRxPortalSize(rxPortalSize int) {
+	ba.rxPortalSize = rxPortalSize
+	ba.ii.TxPortalRxSzChanged(rxPortalSize)
+	ba.ready.Broadcast()
+}
+
+func (ba *BBRAlgorithm) RxPortalPacing(oldSize, newSize int) bool {
+	return oldSize > 4*1024 && newSize < oldSize/2
+}
+
+func (ba *BBRAlgorithm) Profile() *TxProfile {
+	return ba.pf
+}
+
+// PacingRate paces at the bottleneck bandwidth estimate, scaled by the gain of the current state. Until the first
+// round completes, the portal is paced over the smoothed round-trip time.
+//
+func (ba *BBRAlgorithm) PacingRate() float64 {
+	if ba.btlBw <= 0 {
+		return ba.rtt.Rate(ba.capacity)
+	}
+	switch ba.state {
+	case bbrStartup:
+		return ba.bpf.StartupGain * ba.btlBw
+	case bbrDrain:
+		return ba.btlBw / ba.bpf.StartupGain
+	default:
+		return bbrProbeBwGains[ba.cycleIndex] * ba.btlBw
+	}
+}
+
+func (ba *BBRAlgorithm) endRound(deliveryRate float64) {
+	ba.bwSamples = append(ba.bwSamples, deliveryRate)
+	if len(ba.bwSamples) > ba.bpf.BwWindowRounds {
+		ba.bwSamples = ba.bwSamples[1:]
+	}
+	ba.btlBw = 0
+	for _, sample := range ba.bwSamples {
+		ba.btlBw = math.Max(ba.btlBw, sample)
+	}
+
+	switch ba.state {
+	case bbrStartup:
+		if ba.btlBw >= ba.fullBw*1.25 {
+			ba.fullBw = ba.btlBw
+			ba.fullBwRounds = 0
+		} else {
+			ba.fullBwRounds++
+			if ba.fullBwRounds >= ba.bpf.StartupFullBwRounds {
+				ba.state = bbrDrain
+			}
+		}
+
+	case bbrProbeBw:
+		ba.cycleIndex = (ba.cycleIndex + 1) % len(bbrProbeBwGains)
+	}
+
+	ba.updateCapacity()
+}
+
+func (ba *BBRAlgorithm) gain() float64 {
+	switch ba.state {
+	case bbrStartup:
+		return ba.bpf.StartupGain
+	case bbrDrain:
+		return 1 / ba.bpf.StartupGain
+	default:
+		return ba.bpf.CwndGain * bbrProbeBwGains[ba.cycleIndex]
+	}
+}
+
+func (ba *BBRAlgorithm) bdp() float64 {
+	return ba.btlBw * ba.effectiveMinRtt().Seconds()
+}
+
+func (ba *BBRAlgorithm) effectiveMinRtt() time.Duration {
+	if ba.minRtt < time.Millisecond {
+		return time.Millisecond
+	}
+	return ba.minRtt
+}
+
+func (ba *BBRAlgorithm) roundDuration() time.Duration {
+	if ba.minRtt < 0 {
+		return time.Duration(ba.rtt.RetxMs()) * time.Millisecond
+	}
+	return ba.effectiveMinRtt()
+}
+
+func (ba *BBRAlgorithm) updateCapacity() {
+	if ba.btlBw <= 0 {
+		return
+	}
+	ba.capacity = int(ba.gain() * ba.bdp())
+	if ba.capacity < ba.bpf.MinSize {
+		ba.capacity = ba.bpf.MinSize
+	}
+	if ba.capacity > ba.bpf.MaxSize {
+		ba.capacity = ba.bpf.MaxSize
+	}
+	ba.ii.TxPortalCapacityChanged(ba.capacity)
+}
+
+type BBRProfile struct {
+	StartSize           int
+	MinSize             int
+	MaxSize             int
+	StartupGain         float64
+	StartupFullBwRounds int
+	CwndGain            float64
+	BwWindowRounds      int
+	MinRttWindowMs      int
+	RetxStartMs         int
+	RetxAddMs           int
+	RxSizePressureScale float64
+	RttProbeMs          int
+	Txpf                *TxProfile
+}
+
+func NewBaselineBBRProfile() *BBRProfile {
+	return &BBRProfile{
+		StartSize:           96 * 1024,
+		MinSize:             16 * 1024,
+		MaxSize:             4 * 1024 * 1024,
+		StartupGain:         2.885,
+		StartupFullBwRounds: 3,
+		CwndGain:            2,
+		BwWindowRounds:      10,
+		MinRttWindowMs:      10000,
+		RetxStartMs:         200,
+		RetxAddMs:           10,
+		RxSizePressureScale: 2.8911,
+		RttProbeMs:          50,
+		Txpf:                DefaultTxProfile(),
+	}
+}
+
+func (bp *BBRProfile) Create(ii InstrumentInstance) (TxAlgorithm, error) {
+	return NewBBRAlgorithm(bp, ii), nil
+}
@@ -56,6 +56,8 @@ func (c *Closer) run() {
 	logrus.Info("started")
 	defer logrus.Info("exited")
 
+	c.lastEvent = time.Now()
+
 closeWait:
 	for {
 		select {
@@ -107,7 +109,10 @@ closeWait:
 }
 
 func (c *Closer) readyToClose() bool {
-	return (c.txCloseSeq != notClosed && c.rxCloseSeq != notClosed) || time.Since(c.lastEvent).Milliseconds() > int64(c.txp.alg.Profile().ConnectionTimeout)
+	if c.txCloseSeq != notClosed && c.rxCloseSeq != notClosed {
+		return true
+	}
+	return (c.txCloseSeq != notClosed || c.rxCloseSeq != notClosed) && time.Since(c.lastEvent) > c.txp.alg.Profile().ConnectionTimeout
 }
 
 const notClosed = int32(-99)
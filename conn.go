@@ -0,0 +1,296 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"time"
+)
+
+// conn is the net.Conn implementation returned by Dial and Listen. It wires a TxPortal, RxPortal and Closer together
+// on top of an Adapter, once the HELLO handshake has completed.
+//
+type conn struct {
+	adapter        Adapter
+	seq            *util.Sequence
+	alg            TxAlgorithm
+	txp            *TxPortal
+	rxp            *RxPortal
+	sink           *ReadSinkAdapter
+	closer         *Closer
+	pool           *Pool
+	peerAckDelayMs int
+	ii             InstrumentInstance
+}
+
+func newConn(adapter Adapter, profile TxAlgorithmProfile, ii InstrumentInstance) (*conn, error) {
+	alg, err := profile.Create(ii)
+	if err != nil {
+		return nil, errors.Wrap(err, "create algorithm")
+	}
+	return &conn{
+		adapter: adapter,
+		seq:     util.NewSequence(0),
+		alg:     alg,
+		pool:    alg.Profile().NewPool("hello", ii),
+		ii:      ii,
+	}, nil
+}
+
+func (self *conn) Read(p []byte) (int, error) {
+	return self.sink.Read(p)
+}
+
+// WriteTo implements io.WriterTo, allowing io.Copy to write received data straight from the wire buffers.
+//
+func (self *conn) WriteTo(w io.Writer) (int64, error) {
+	return self.sink.WriteTo(w)
+}
+
+func (self *conn) Write(p []byte) (int, error) {
+	return self.txp.Tx(p, self.seq)
+}
+
+func (self *conn) Close() error {
+	logrus.Warnf("close requested")
+	return self.txp.sendClose(self.seq)
+}
+
+func (self *conn) LocalAddr() net.Addr {
+	if aa, ok := self.adapter.(AddressedAdapter); ok {
+		return aa.LocalAddr()
+	}
+	return adapterAddr("local")
+}
+
+func (self *conn) RemoteAddr() net.Addr {
+	if aa, ok := self.adapter.(AddressedAdapter); ok {
+		return aa.RemoteAddr()
+	}
+	return adapterAddr("remote")
+}
+
+func (self *conn) SetDeadline(t time.Time) error {
+	self.sink.SetDeadline(t)
+	self.txp.SetDeadline(t)
+	return nil
+}
+
+func (self *conn) SetReadDeadline(t time.Time) error {
+	self.sink.SetDeadline(t)
+	return nil
+}
+
+func (self *conn) SetWriteDeadline(t time.Time) error {
+	self.txp.SetDeadline(t)
+	return nil
+}
+
+func (self *conn) dialHello() error {
+	logrus.Infof("starting hello process")
+	defer logrus.Infof("completed hello process")
+
+	helloSeq := self.seq.Next()
+	helloWm, err := newHello(helloSeq, newHelloFor(self.alg.Profile()), nil, self.pool)
+	if err != nil {
+		return errors.Wrap(err, "error creating hello message")
+	}
+	defer helloWm.buf.Unref()
+
+	helloAcks := self.helloReader(func(wm *WireMessage) bool {
+		if wm.messageType() != HELLO {
+			return false
+		}
+		h, acks, err := wm.asHello()
+		if err != nil {
+			logrus.Errorf("unexpected hello response (%v)", err)
+			return false
+		}
+		if h.version != protocolVersion {
+			logrus.Errorf("unexpected protocol version [%d != %d]", h.version, protocolVersion)
+			return false
+		}
+		return len(acks) == 1 && acks[0].Start == acks[0].End && acks[0].Start == helloSeq
+	})
+
+	for i := 0; i < connectionSetupAttempts; i++ {
+		if err := writeWireMessage(helloWm, self.adapter); err != nil {
+			return errors.Wrap(err, "write hello")
+		}
+		self.ii.WireMessageTx(helloWm)
+
+		select {
+		case helloAck, ok := <-helloAcks:
+			if !ok {
+				return errors.New("adapter closed during hello")
+			}
+			defer helloAck.buf.Unref()
+
+			finalAck, err := newAck([]Ack{{helloAck.Seq, helloAck.Seq}}, 0, nil, self.pool)
+			if err != nil {
+				return errors.Wrap(err, "new final ack")
+			}
+			defer finalAck.buf.Unref()
+			if err := writeWireMessage(finalAck, self.adapter); err != nil {
+				return errors.Wrap(err, "write final ack")
+			}
+			self.ii.WireMessageTx(finalAck)
+
+			if h, _, err := helloAck.asHello(); err == nil {
+				self.peerAckDelayMs = int(h.ackDelayMs)
+			}
+			self.start(helloAck.Seq)
+			return nil
+
+		case <-time.After(self.setupTimeout()):
+			logrus.Infof("timeout")
+		}
+	}
+
+	_ = self.adapter.Close()
+	return errors.New("connection timeout")
+}
+
+func (self *conn) listenHello() error {
+	logrus.Infof("starting hello process")
+	defer logrus.Infof("completed hello process")
+
+	hellos := self.helloReader(func(wm *WireMessage) bool {
+		return wm.messageType() == HELLO
+	})
+
+	var helloWm *WireMessage
+	select {
+	case wm, ok := <-hellos:
+		if !ok {
+			return errors.New("adapter closed during hello")
+		}
+		helloWm = wm
+
+	case <-time.After(self.setupTimeout()):
+		_ = self.adapter.Close()
+		return errors.New("timeout waiting for hello")
+	}
+
+	h, _, err := helloWm.asHello()
+	dialerSeq := helloWm.Seq
+	helloWm.buf.Unref()
+	if err != nil {
+		_ = self.adapter.Close()
+		return errors.Wrap(err, "expected hello")
+	}
+	if h.version != protocolVersion {
+		_ = self.adapter.Close()
+		return errors.Errorf("unexpected protocol version [%d != %d]", h.version, protocolVersion)
+	}
+	self.peerAckDelayMs = int(h.ackDelayMs)
+
+	helloAckSeq := self.seq.Next()
+	helloAck, err := newHello(helloAckSeq, newHelloFor(self.alg.Profile()), &Ack{dialerSeq, dialerSeq}, self.pool)
+	if err != nil {
+		_ = self.adapter.Close()
+		return errors.Wrap(err, "new hello")
+	}
+	defer helloAck.buf.Unref()
+
+	acks := self.helloReader(func(wm *WireMessage) bool {
+		switch wm.messageType() {
+		case ACK:
+			acks, _, _, err := wm.asAck()
+			return err == nil && len(acks) == 1 && acks[0].Start == helloAckSeq
+
+		case DATA:
+			// the dialer has already started, so the final ACK must have been lost
+			return true
+
+		default:
+			return false
+		}
+	})
+
+	for i := 0; i < connectionSetupAttempts; i++ {
+		if err := writeWireMessage(helloAck, self.adapter); err != nil {
+			_ = self.adapter.Close()
+			return errors.Wrap(err, "write hello ack")
+		}
+		self.ii.WireMessageTx(helloAck)
+
+		select {
+		case wm, ok := <-acks:
+			if !ok {
+				return errors.New("adapter closed during hello")
+			}
+
+			self.start(dialerSeq)
+
+			if wm.messageType() == DATA {
+				if err := self.rxp.Rx(wm); err != nil {
+					logrus.Errorf("error rx-ing (%v)", err)
+				}
+			} else {
+				wm.buf.Unref()
+			}
+			return nil
+
+		case <-time.After(self.setupTimeout()):
+			logrus.Infof("timeout")
+		}
+	}
+
+	_ = self.adapter.Close()
+	return errors.New("connection failed")
+}
+
+// helloReader reads wire messages from the adapter until accept returns true, delivering the accepted message on the
+// returned channel. It exits immediately after that message, so the adapter can be handed over to the RxPortal without
+// losing anything that follows the handshake.
+//
+func (self *conn) helloReader(accept func(wm *WireMessage) bool) chan *WireMessage {
+	out := make(chan *WireMessage, 1)
+	go func() {
+		defer close(out)
+		for {
+			wm, err := readWireMessage(self.adapter, self.pool)
+			if err != nil {
+				self.ii.ReadError(err)
+				return
+			}
+			self.ii.WireMessageRx(wm)
+			if accept(wm) {
+				out <- wm
+				return
+			}
+			wm.buf.Unref()
+		}
+	}()
+	return out
+}
+
+func (self *conn) start(accepted int32) {
+	closeHook := func() {
+		if err := self.adapter.Close(); err != nil {
+			logrus.Errorf("error closing adapter (%v)", err)
+		}
+		self.ii.Shutdown()
+	}
+	self.closer = NewCloser(self.seq, closeHook)
+	self.txp = NewTxPortal(self.adapter, self.alg, self.closer, self.ii)
+	self.txp.monitor.peerAckDelayMs = self.peerAckDelayMs
+	self.closer.txp = self.txp
+	self.sink = NewReadSinkAdapter(self.alg.Profile())
+	self.rxp = NewRxPortal(self.adapter, self.sink, self.txp, self.seq, self.closer, self.ii)
+	self.rxp.SetAccepted(accepted)
+	self.txp.rxp = self.rxp
+	self.closer.rxp = self.rxp
+
+	self.txp.Start()
+	go self.closer.run()
+}
+
+func (self *conn) setupTimeout() time.Duration {
+	return time.Duration(self.alg.Profile().ConnectionSetupTimeoutMs) * time.Millisecond
+}
+
+const connectionSetupAttempts = 5
@@ -0,0 +1,221 @@
+package dilithium
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// CubicAlgorithm implements a loss-based flow control modeled on CUBIC (RFC 8312). The portal capacity grows
+// exponentially until the first loss, and afterwards follows a cubic function of the time since the last loss, centered
+// on the capacity at which that loss occurred.
+//
+type CubicAlgorithm struct {
+	capacity     int
+	txPortalSize int
+	rxPortalSize int
+	ssthresh     int
+	wMax         float64
+	k            float64
+	origin       float64
+	tcpCapacity  float64
+	epochStart   time.Time
+	lastLoss     time.Time
+	lastRttProbe time.Time
+	rtt          RttEstimator
+	ii           InstrumentInstance
+
+	cpf   *CubicProfile
+	pf    *TxProfile
+	lock  *sync.Mutex
+	ready *sync.Cond
+}
+
+func NewCubicAlgorithm(pf *CubicProfile, ii InstrumentInstance) TxAlgorithm {
+	ca := &CubicAlgorithm{
+		capacity: pf.StartSize,
+		ssthresh: pf.MaxSize,
+		rtt:      NewRttEstimator(pf.RetxStartMs, pf.RetxAddMs),
+		cpf:      pf,
+		pf:       pf.Txpf,
+		ii:       ii,
+	}
+	ca.ii.TxPortalCapacityChanged(ca.capacity)
+	ca.ii.NewRetxMs(ca.rtt.RetxMs())
+	return ca
+}
+
+func (ca *CubicAlgorithm) SetLock(lock *sync.Mutex) {
+	ca.lock = lock
+	ca.ready = sync.NewCond(lock)
+}
+
+func (ca *CubicAlgorithm) Tx(segmentSize int) {
+	ca.TxInterruptible(segmentSize, func() bool { return false })
+}
+
+func (ca *CubicAlgorithm) TxInterruptible(segmentSize int, interrupted func() bool) bool {
+	for !availableCapacity(ca.capacity, ca.txPortalSize, ca.rxPortalSize, segmentSize, ca.cpf.RxSizePressureScale) {
+		if interrupted() {
+			return false
+		}
+		ca.ready.Wait()
+	}
+	ca.txPortalSize += segmentSize
+	ca.ii.TxPortalSzChanged(ca.txPortalSize)
+	return true
+}
+
+func (ca *CubicAlgorithm) Interrupt() {
+	ca.ready.Broadcast()
+}
+
+func (ca *CubicAlgorithm) Success(segmentSize int) {
+	ca.txPortalSize -= segmentSize
+	if ca.capacity < ca.ssthresh {
+		ca.updateCapacity(float64(ca.capacity + segmentSize))
+	} else {
+		ca.congestionAvoidance(segmentSize)
+	}
+	ca.ready.Broadcast()
+	ca.ii.TxPortalSzChanged(ca.txPortalSize)
+}
+
+func (ca *CubicAlgorithm) DuplicateAck() {
+	// a duplicate ack reports a spurious retransmission, not a loss
+}
+
+func (ca *CubicAlgorithm) Retransmission(_ int) {
+	// a single reduction for each loss episode, rather than each retransmitted segment
+	if time.Since(ca.lastLoss).Milliseconds() < int64(ca.rtt.SrttMs()) {
+		return
+	}
+	ca.lastLoss = time.Now()
+
+	capacity := float64(ca.capacity)
+	if ca.cpf.FastConvergence && capacity < ca.wMax {
+		ca.wMax = capacity * (1 + ca.cpf.Beta) / 2
+	} else {
+		ca.wMax = capacity
+	}
+	ca.updateCapacity(capacity * ca.cpf.Beta)
+	ca.ssthresh = ca.capacity
+	ca.epochStart = time.Time{}
+}
+
+func (ca *CubicAlgorithm) ProbeRTT() bool {
+	if time.Since(ca.lastRttProbe).Milliseconds() >= int64(ca.cpf.RttProbeMs) {
+		ca.lastRttProbe = time.Now()
+		return true
+	}
+	return false
+}
+
+func (ca *CubicAlgorithm) UpdateRTT(rtt time.Duration) {
+	ca.rtt.Update(rtt)
+	ca.ii.NewRetxMs(ca.rtt.RetxMs())
+}
+
+func (ca *CubicAlgorithm) RetxMs() int {
+	return ca.rtt.RetxMs()
+}
+
+func (ca *CubicAlgorithm) RxPortalSize() int {
+	return ca.rxPortalSize
+}
+
+func (ca *CubicAlgorithm) UpdateRxPortalSize(rxPortalSize int) {
+	ca.rxPortalSize = rxPortalSize
+	ca.ii.TxPortalRxSzChanged(rxPortalSize)
+	ca.ready.Broadcast()
+}
+
+func (ca *CubicAlgorithm) RxPortalPacing(oldSize, newSize int) bool {
+	return oldSize > 4*1024 && newSize < oldSize/2
+}
+
+func (ca *CubicAlgorithm) Profile() *TxProfile {
+	return ca.pf
+}
+
+func (ca *CubicAlgorithm) PacingRate() float64 {
+	return ca.rtt.Rate(ca.capacity)
+}
+
+func (ca *CubicAlgorithm) congestionAvoidance(segmentSize int) {
+	segment := float64(ca.cpf.SegmentSize)
+	capacity := float64(ca.capacity)
+	if ca.epochStart.IsZero() {
+		ca.epochStart = time.Now()
+		if capacity < ca.wMax {
+			ca.k = math.Cbrt((ca.wMax - capacity) / segment / ca.cpf.C)
+			ca.origin = ca.wMax
+		} else {
+			ca.k = 0
+			ca.origin = capacity
+		}
+		ca.tcpCapacity = capacity
+	}
+
+	t := time.Since(ca.epochStart).Seconds() + float64(ca.rtt.SrttMs())/1000.0
+	target := ca.origin + ca.cpf.C*math.Pow(t-ca.k, 3)*segment
+
+	// the standard tcp window, which cubic must never fall behind
+	ca.tcpCapacity += 3 * (1 - ca.cpf.Beta) / (1 + ca.cpf.Beta) * segment * float64(segmentSize) / capacity
+
+	next := capacity
+	if target > capacity {
+		next += math.Min((target-capacity)/capacity*float64(segmentSize), float64(segmentSize))
+	}
+	if ca.tcpCapacity > next {
+		next = ca.tcpCapacity
+	}
+	ca.updateCapacity(next)
+}
+
+func (ca *CubicAlgorithm) updateCapacity(capacity float64) {
+	ca.capacity = int(capacity)
+	if ca.capacity < ca.cpf.MinSize {
+		ca.capacity = ca.cpf.MinSize
+	}
+	if ca.capacity > ca.cpf.MaxSize {
+		ca.capacity = ca.cpf.MaxSize
+	}
+	ca.ii.TxPortalCapacityChanged(ca.capacity)
+}
+
+type CubicProfile struct {
+	StartSize           int
+	MinSize             int
+	MaxSize             int
+	SegmentSize         int
+	C                   float64
+	Beta                float64
+	FastConvergence     bool
+	RetxStartMs         int
+	RetxAddMs           int
+	RxSizePressureScale float64
+	RttProbeMs          int
+	Txpf                *TxProfile
+}
+
+func NewBaselineCubicProfile() *CubicProfile {
+	return &CubicProfile{
+		StartSize:           96 * 1024,
+		MinSize:             16 * 1024,
+		MaxSize:             4 * 1024 * 1024,
+		SegmentSize:         1450,
+		C:                   0.4,
+		Beta:                0.7,
+		FastConvergence:     true,
+		RetxStartMs:         200,
+		RetxAddMs:           10,
+		RxSizePressureScale: 2.8911,
+		RttProbeMs:          50,
+		Txpf:                DefaultTxProfile(),
+	}
+}
+
+func (cp *CubicProfile) Create(ii InstrumentInstance) (TxAlgorithm, error) {
+	return NewCubicAlgorithm(cp, ii), nil
+}
@@ -0,0 +1,67 @@
+package dilithium
+
+import (
+	"errors"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// emulatedConnPair returns a started pair of conns over an emulated network, skipping the HELLO handshake.
+//
+func emulatedConnPair(t *testing.T, profile TxAlgorithmProfile) (*conn, *conn) {
+	a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(21), util.NewEmulatorConfig(22))
+	t.Cleanup(func() { _ = a.Close() })
+	ac, err := newConn(a, profile, &NilInstrumentInstance{})
+	assert.NoError(t, err)
+	bc, err := newConn(b, profile, &NilInstrumentInstance{})
+	assert.NoError(t, err)
+	ac.start(-1)
+	bc.start(-1)
+	return ac, bc
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	ac, bc := emulatedConnPair(t, NewBaselineWestworldProfile())
+
+	start := time.Now()
+	assert.NoError(t, bc.SetReadDeadline(start.Add(100*time.Millisecond)))
+	_, err := bc.Read(make([]byte, 1024))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	assert.NoError(t, bc.SetReadDeadline(time.Time{}))
+	_, err = ac.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(bc, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.ReadsQueueSize = 4
+	ac, _ := emulatedConnPair(t, profile)
+
+	assert.NoError(t, ac.SetWriteDeadline(time.Now().Add(-time.Second)))
+	n, err := ac.Write([]byte("hello"))
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// nobody reads on the b side, so the portal eventually fills and the write blocks
+	data := make([]byte, 32*1024*1024)
+	start := time.Now()
+	assert.NoError(t, ac.SetDeadline(start.Add(500*time.Millisecond)))
+	n, err = ac.Write(data)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Less(t, n, len(data))
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
@@ -0,0 +1,28 @@
+package dilithium
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+)
+
+// Dial performs the HELLO handshake over the provided Adapter, and returns a net.Conn backed by a TxPortal and RxPortal
+// pair using the flow control algorithm created from profile. A nil Instrument disables instrumentation.
+//
+func Dial(adapter Adapter, profile TxAlgorithmProfile, i Instrument) (net.Conn, error) {
+	if i == nil {
+		i = NewNilInstrument()
+	}
+	id := "dialerConn"
+	if aa, ok := adapter.(AddressedAdapter); ok {
+		id = fmt.Sprintf("dialerConn_%s_%s", aa.LocalAddr(), aa.RemoteAddr())
+	}
+	c, err := newConn(adapter, profile, i.NewInstance(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "create conn")
+	}
+	if err := c.dialHello(); err != nil {
+		return nil, errors.Wrap(err, "hello")
+	}
+	return c, nil
+}
@@ -0,0 +1,72 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// EmulatedAdapter is an in-memory Adapter, connected to a peer EmulatedAdapter through a pair of util.EmulatedLink
+// instances. It allows the framework components to be exercised under configurable (and reproducible) network weather
+// without real sockets.
+//
+type EmulatedAdapter struct {
+	local     adapterAddr
+	remote    adapterAddr
+	tx        *util.EmulatedLink
+	rx        *util.EmulatedLink
+	closeOnce sync.Once
+}
+
+// NewEmulatedAdapterPair returns two connected adapters. Datagrams written to the first adapter are subject to the
+// aToB weather, datagrams written to the second are subject to bToA.
+//
+func NewEmulatedAdapterPair(aToB, bToA *util.EmulatorConfig) (*EmulatedAdapter, *EmulatedAdapter) {
+	aToBLink := util.NewEmulatedLink(aToB)
+	bToALink := util.NewEmulatedLink(bToA)
+	a := &EmulatedAdapter{local: "emulated_a", remote: "emulated_b", tx: aToBLink, rx: bToALink}
+	b := &EmulatedAdapter{local: "emulated_b", remote: "emulated_a", tx: bToALink, rx: aToBLink}
+	return a, b
+}
+
+func (self *EmulatedAdapter) Read(p []byte) (int, error) {
+	datagram, err := self.rx.Receive(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	if len(datagram.Data) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, datagram.Data), nil
+}
+
+func (self *EmulatedAdapter) Write(p []byte) (int, error) {
+	if err := self.tx.Send(p, self.local); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (self *EmulatedAdapter) Close() error {
+	self.closeOnce.Do(func() {
+		self.tx.Close()
+		self.rx.Close()
+	})
+	return nil
+}
+
+func (self *EmulatedAdapter) LocalAddr() net.Addr {
+	return self.local
+}
+
+func (self *EmulatedAdapter) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+// TxStats returns the statistics for the link carrying datagrams written to this adapter.
+//
+func (self *EmulatedAdapter) TxStats() util.EmulatorStats {
+	return self.tx.Stats()
+}
@@ -0,0 +1,346 @@
+package dilithium
+
+import (
+	"bytes"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingInstrumentInstance struct {
+	NilInstrumentInstance
+	lock        sync.Mutex
+	retx        int
+	dupAcks     int
+	fastRetx    int
+	timeoutRetx int
+	minCapacity int
+	maxCapacity int
+	allocations int
+	droppedRx   int
+}
+
+func (self *countingInstrumentInstance) WireMessageRetx(*WireMessage) {
+	self.lock.Lock()
+	self.retx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) DuplicateAck(int32) {
+	self.lock.Lock()
+	self.dupAcks++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) FastRetransmit(*WireMessage) {
+	self.lock.Lock()
+	self.fastRetx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) TimeoutRetransmit(*WireMessage) {
+	self.lock.Lock()
+	self.timeoutRetx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) DroppedRx(*WireMessage) {
+	self.lock.Lock()
+	self.droppedRx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) Allocate(string) {
+	self.lock.Lock()
+	self.allocations++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) TxPortalCapacityChanged(capacity int) {
+	self.lock.Lock()
+	if self.minCapacity == 0 || capacity < self.minCapacity {
+		self.minCapacity = capacity
+	}
+	if capacity > self.maxCapacity {
+		self.maxCapacity = capacity
+	}
+	self.lock.Unlock()
+}
+
+// emulatedTransfer wires a pair of portals over an emulated network, skipping the HELLO handshake, and transfers sz
+// bytes from the a side to the b side.
+//
+func emulatedTransfer(t *testing.T, aToB, bToA *util.EmulatorConfig, sz int) (*countingInstrumentInstance, *EmulatedAdapter) {
+	return emulatedProfileTransfer(t, aToB, bToA, NewBaselineWestworldProfile(), sz)
+}
+
+func emulatedProfileTransfer(t *testing.T, aToB, bToA *util.EmulatorConfig, profile TxAlgorithmProfile, sz int) (*countingInstrumentInstance, *EmulatedAdapter) {
+	return emulatedSeqTransfer(t, aToB, bToA, profile, 0, sz)
+}
+
+// emulatedSeqTransfer is emulatedProfileTransfer, with both sides starting their sequences at startSeq.
+//
+func emulatedSeqTransfer(t *testing.T, aToB, bToA *util.EmulatorConfig, profile TxAlgorithmProfile, startSeq int32, sz int) (*countingInstrumentInstance, *EmulatedAdapter) {
+	a, b := NewEmulatedAdapterPair(aToB, bToA)
+	aii := &countingInstrumentInstance{}
+	ac, err := newConn(a, profile, aii)
+	assert.NoError(t, err)
+	bc, err := newConn(b, profile, &countingInstrumentInstance{})
+	assert.NoError(t, err)
+	ac.seq = util.NewSequence(startSeq)
+	bc.seq = util.NewSequence(startSeq)
+	ac.start(startSeq - 1)
+	bc.start(startSeq - 1)
+
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := ac.Write(data)
+		assert.NoError(t, err)
+	}()
+
+	received := make([]byte, sz)
+	_, err = io.ReadFull(bc, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	return aii, a
+}
+
+func TestEmulatedPortalsLossless(t *testing.T) {
+	ii, a := emulatedTransfer(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), 8*1024*1024)
+	defer func() { _ = a.Close() }()
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Equal(t, int64(0), a.TxStats().Dropped)
+	assert.Greater(t, ii.maxCapacity, NewBaselineWestworldProfile().StartSize)
+}
+
+func TestEmulatedPortalsRetransmission(t *testing.T) {
+	aToB := util.NewEmulatorConfig(3)
+	aToB.LossRate = 0.05
+	aToB.ReorderRate = 0.05
+	bToA := util.NewEmulatorConfig(4)
+	bToA.LossRate = 0.05
+	ii, a := emulatedTransfer(t, aToB, bToA, 2*1024*1024)
+	defer func() { _ = a.Close() }()
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, a.TxStats().Dropped, int64(0))
+	assert.Greater(t, ii.retx, 0)
+}
+
+func TestEmulatedPortalsFastRetransmission(t *testing.T) {
+	for _, threshold := range []int{3, 0} {
+		profile := NewBaselineWestworldProfile()
+		profile.Txpf.MaxSegmentSize = 1450
+		profile.Txpf.PoolBufferSize = 2048
+		profile.Txpf.FastRetxThreshold = threshold
+		// limit the backoff of the timeout retransmissions, so that the transfer completes quickly
+		profile.Txpf.RetxMaxMs = 2 * profile.RetxStartMs
+		aToB := util.NewEmulatorConfig(9)
+		aToB.LossRate = 0.02
+		ii, a := emulatedProfileTransfer(t, aToB, util.NewEmulatorConfig(10), profile, 512*1024)
+
+		ii.lock.Lock()
+		if threshold > 0 {
+			assert.Greater(t, ii.fastRetx, 0)
+		} else {
+			assert.Equal(t, 0, ii.fastRetx)
+			assert.Greater(t, ii.timeoutRetx, 0)
+		}
+		assert.Equal(t, ii.retx, ii.fastRetx+ii.timeoutRetx)
+		ii.lock.Unlock()
+		_ = a.Close()
+	}
+}
+
+func TestEmulatedPortalsDuplicateAck(t *testing.T) {
+	aToB := util.NewEmulatorConfig(5)
+	aToB.DuplicateRate = 0.2
+	ii, a := emulatedTransfer(t, aToB, util.NewEmulatorConfig(6), 1024*1024)
+	defer func() { _ = a.Close() }()
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, a.TxStats().Duplicated, int64(0))
+	assert.Greater(t, ii.dupAcks, 0)
+}
+
+// TestEmulatedPortalsSequenceWrap starts the transfer a short distance before the sequence wrap, so that loss,
+// reordering, retransmission and acknowledgement all happen on both sides of it.
+//
+func TestEmulatedPortalsSequenceWrap(t *testing.T) {
+	aToB := util.NewEmulatorConfig(13)
+	aToB.LossRate = 0.02
+	aToB.ReorderRate = 0.05
+	aToB.DuplicateRate = 0.02
+	bToA := util.NewEmulatorConfig(14)
+	bToA.LossRate = 0.02
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.MaxSegmentSize = 1450
+	profile.Txpf.PoolBufferSize = 2048
+	profile.Txpf.AckDelayMs = 5
+	profile.Txpf.RetxMaxMs = 2 * profile.RetxStartMs
+	ii, a := emulatedSeqTransfer(t, aToB, bToA, profile, math.MaxInt32-64, 512*1024)
+	defer func() { _ = a.Close() }()
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.retx, 0)
+	assert.Greater(t, ii.dupAcks, 0)
+}
+
+// TestEmulatedPortalsKeepaliveRxPortalSize holds a stale receiver buffer size on both sides, blocking the a side with
+// nothing in flight. Only keepalives from the b side, which advertise its own (empty) buffer rather than echoing the
+// stale size, can release it.
+//
+func TestEmulatedPortalsKeepaliveRxPortalSize(t *testing.T) {
+	a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(15), util.NewEmulatorConfig(16))
+	defer func() { _ = a.Close() }()
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.ConnectionTimeout = 2 * time.Second
+	ac, err := newConn(a, profile, &countingInstrumentInstance{})
+	assert.NoError(t, err)
+	bc, err := newConn(b, profile, &countingInstrumentInstance{})
+	assert.NoError(t, err)
+	ac.start(-1)
+	bc.start(-1)
+	for _, c := range []*conn{ac, bc} {
+		c.txp.lock.Lock()
+		c.txp.alg.UpdateRxPortalSize(64 * 1024 * 1024)
+		c.txp.lock.Unlock()
+	}
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := ac.Write(data)
+		assert.NoError(t, err)
+	}()
+	done := make(chan struct{})
+	received := make([]byte, len(data))
+	go func() {
+		defer close(done)
+		_, err := io.ReadFull(bc, received)
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+		assert.True(t, bytes.Equal(data, received))
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer blocked by stale rx portal size")
+	}
+}
+
+// TestEmulatedPortalsRxQueuePolicies transfers small segments into a short rx queue under each RxQueuePolicy. Blocking
+// pushes back on the adapter without losing anything; the drop policies lose (and account for) messages, which are
+// recovered by retransmission.
+//
+func TestEmulatedPortalsRxQueuePolicies(t *testing.T) {
+	for _, policy := range []RxQueuePolicy{RxQueueBlock, RxQueueDropOldest, RxQueueDropNewest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			profile := NewBaselineWestworldProfile()
+			profile.Txpf.MaxSegmentSize = 1450
+			profile.Txpf.PoolBufferSize = 2048
+			profile.Txpf.RetxMaxMs = 2 * profile.RetxStartMs
+			profile.Txpf.RxQueueSize = 4
+			profile.Txpf.RxQueuePolicy = policy
+
+			a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(17), util.NewEmulatorConfig(18))
+			defer func() { _ = a.Close() }()
+			aii := &countingInstrumentInstance{}
+			ac, err := newConn(a, profile, aii)
+			assert.NoError(t, err)
+			bii := &countingInstrumentInstance{}
+			bc, err := newConn(b, profile, bii)
+			assert.NoError(t, err)
+			ac.start(-1)
+			bc.start(-1)
+
+			data := make([]byte, 128*1024)
+			rand.New(rand.NewSource(1)).Read(data)
+			go func() {
+				_, err := ac.Write(data)
+				assert.NoError(t, err)
+			}()
+			received := make([]byte, len(data))
+			_, err = io.ReadFull(bc, received)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, received))
+
+			aii.lock.Lock()
+			defer aii.lock.Unlock()
+			bii.lock.Lock()
+			defer bii.lock.Unlock()
+			if policy == RxQueueBlock {
+				assert.Equal(t, 0, bii.droppedRx)
+			} else {
+				assert.Greater(t, bii.droppedRx, 0)
+				assert.Greater(t, aii.retx, 0)
+			}
+		})
+	}
+}
+
+// TestEmulatedPortalsSlowReaderBidirectional stalls the reader on the a side while both sides transfer. Under the
+// default RxQueuePolicy, the unread data backing up on the a side must not stop it from processing the acknowledgements
+// for its own transfer to b.
+//
+func TestEmulatedPortalsSlowReaderBidirectional(t *testing.T) {
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.MaxSegmentSize = 1450
+	profile.Txpf.PoolBufferSize = 2048
+	profile.Txpf.RetxMaxMs = 2 * profile.RetxStartMs
+	profile.Txpf.ReadsQueueSize = 4
+
+	a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(19), util.NewEmulatorConfig(20))
+	defer func() { _ = a.Close() }()
+	ac, err := newConn(a, profile, &countingInstrumentInstance{})
+	assert.NoError(t, err)
+	bc, err := newConn(b, profile, &countingInstrumentInstance{})
+	assert.NoError(t, err)
+	ac.start(-1)
+	bc.start(-1)
+
+	aToB := make([]byte, 128*1024)
+	rand.New(rand.NewSource(1)).Read(aToB)
+	bToA := make([]byte, 128*1024)
+	rand.New(rand.NewSource(2)).Read(bToA)
+
+	go func() {
+		_, err := bc.Write(bToA)
+		assert.NoError(t, err)
+	}()
+	go func() {
+		_, err := ac.Write(aToB)
+		assert.NoError(t, err)
+	}()
+
+	// nothing is read on the a side until b has received everything
+	done := make(chan struct{})
+	receivedByB := make([]byte, len(aToB))
+	go func() {
+		defer close(done)
+		_, err := io.ReadFull(bc, receivedByB)
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+		assert.True(t, bytes.Equal(aToB, receivedByB))
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer to b blocked by the unread data on the a side")
+	}
+
+	receivedByA := make([]byte, len(bToA))
+	_, err = io.ReadFull(ac, receivedByA)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(bToA, receivedByA))
+}
@@ -0,0 +1,104 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// FramedAdapter is an Adapter implementation that carries dilithium wire messages over a stream-oriented net.Conn
+// (a TCP connection, for example). Each message is written as a 4-byte length prefix followed by the message body, so
+// that every Read returns exactly one whole message, just like a datagram transport would.
+//
+type FramedAdapter struct {
+	conn      net.Conn
+	header    []byte
+	writeLock sync.Mutex
+}
+
+func NewFramedAdapter(conn net.Conn) *FramedAdapter {
+	return &FramedAdapter{
+		conn:   conn,
+		header: make([]byte, framedAdapterHeaderSz),
+	}
+}
+
+func (self *FramedAdapter) Read(p []byte) (int, error) {
+	if _, err := io.ReadFull(self.conn, self.header); err != nil {
+		return 0, err
+	}
+	sz := util.ReadUint32(self.header)
+	if sz > uint32(len(p)) {
+		// discard the body, so that the next Read starts at the following frame
+		if _, err := io.CopyN(io.Discard, self.conn, int64(sz)); err != nil {
+			return 0, errors.Wrap(err, "discard frame body")
+		}
+		return 0, errors.Errorf("short read buffer for frame [%d < %d]", len(p), sz)
+	}
+	n, err := io.ReadFull(self.conn, p[:sz])
+	if err != nil {
+		return n, errors.Wrap(err, "frame body")
+	}
+	return n, nil
+}
+
+func (self *FramedAdapter) Write(p []byte) (int, error) {
+	header := make([]byte, framedAdapterHeaderSz)
+	util.WriteUint32(header, uint32(len(p)))
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	buffers := net.Buffers{header, p}
+	n, err := buffers.WriteTo(self.conn)
+	if err != nil {
+		return 0, err
+	}
+	if n != int64(framedAdapterHeaderSz+len(p)) {
+		return 0, errors.Errorf("short frame write [%d != %d]", n, framedAdapterHeaderSz+len(p))
+	}
+	return len(p), nil
+}
+
+func (self *FramedAdapter) Close() error {
+	return self.conn.Close()
+}
+
+func (self *FramedAdapter) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *FramedAdapter) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+// FramedListener is an AdapterListener that wraps every connection accepted from a stream-oriented net.Listener in a
+// FramedAdapter.
+//
+type FramedListener struct {
+	listener net.Listener
+}
+
+func NewFramedListener(listener net.Listener) *FramedListener {
+	return &FramedListener{listener: listener}
+}
+
+func (self *FramedListener) Accept() (Adapter, error) {
+	conn, err := self.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewFramedAdapter(conn), nil
+}
+
+func (self *FramedListener) Close() error {
+	return self.listener.Close()
+}
+
+func (self *FramedListener) Addr() net.Addr {
+	return self.listener.Addr()
+}
+
+const framedAdapterHeaderSz = 4
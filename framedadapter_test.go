@@ -0,0 +1,107 @@
+package dilithium
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func framedAdapterPair(t *testing.T) (*FramedAdapter, *FramedAdapter) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	return NewFramedAdapter(dialed), NewFramedAdapter(<-accepted)
+}
+
+func TestFramedAdapterPreservesBoundaries(t *testing.T) {
+	a, b := framedAdapterPair(t)
+	defer func() { _ = a.Close() }()
+	defer func() { _ = b.Close() }()
+
+	frames := [][]byte{[]byte("alpha"), {}, bytes.Repeat([]byte{0xAB}, 16*1024), []byte("omega")}
+	go func() {
+		for _, frame := range frames {
+			_, err := a.Write(frame)
+			assert.NoError(t, err)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for _, frame := range frames {
+		n, err := b.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, frame, buf[:n])
+	}
+}
+
+func TestFramedAdapterShortBuffer(t *testing.T) {
+	a, b := framedAdapterPair(t)
+	defer func() { _ = a.Close() }()
+	defer func() { _ = b.Close() }()
+
+	go func() {
+		_, _ = a.Write(make([]byte, 128))
+		_, _ = a.Write([]byte("next"))
+	}()
+
+	_, err := b.Read(make([]byte, 64))
+	assert.Error(t, err)
+
+	// the oversized frame was consumed, so the following frame is read intact
+	buf := make([]byte, 64)
+	n, err := b.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "next", string(buf[:n]))
+}
+
+func TestFramedAdapterPortals(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	l, err := Listen(NewFramedListener(tcpListener), NewBaselineWestworldProfile(), nil)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	dialed, err := Dial(NewFramedAdapter(tcpConn), NewBaselineWestworldProfile(), nil)
+	assert.NoError(t, err)
+
+	accepted, err := l.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, tcpConn.LocalAddr().String(), accepted.RemoteAddr().String())
+
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(accepted, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	go func() {
+		_, err := accepted.Write(data[:64*1024])
+		assert.NoError(t, err)
+	}()
+	received = make([]byte, 64*1024)
+	_, err = io.ReadFull(dialed, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data[:64*1024], received))
+}
@@ -1,6 +1,6 @@
 module github.com/openziti/dilithium
 
-go 1.15
+go 1.16
 
 require (
 	github.com/emirpasic/gods v1.12.0
@@ -18,6 +18,7 @@ require (
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.2.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.4.0
 )
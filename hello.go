@@ -3,25 +3,41 @@ package dilithium
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
+	"math"
 )
 
+// hello carries the protocol version, and the longest that the sender will delay its acknowledgements. A peer that
+// predates the ack delay sends only the version, and is taken to acknowledge immediately.
+//
 type hello struct {
-	version uint32
+	version    uint32
+	ackDelayMs uint16
+}
+
+const helloVersionSize = 4
+const helloSize = helloVersionSize + 2
+
+func newHelloFor(profile *TxProfile) hello {
+	return hello{protocolVersion, uint16(math.Min(float64(profile.AckDelayMs), math.MaxUint16))}
 }
 
 func encodeHello(hello hello, data []byte) (n uint32, err error) {
 	dataSize := len(data)
-	if dataSize < 4 {
-		return 0, errors.Errorf("hello too large [%d < 4]", dataSize)
+	if dataSize < helloSize {
+		return 0, errors.Errorf("hello too large [%d < %d]", dataSize, helloSize)
 	}
 	util.WriteUint32(data, hello.version)
-	return 4, nil
+	util.WriteUint16(data[helloVersionSize:], hello.ackDelayMs)
+	return helloSize, nil
 }
 
 func decodeHello(data []byte) (hello, uint32, error) {
 	dataSize := len(data)
-	if dataSize < 5 {
-		return hello{}, 0, errors.Errorf("short hello decode buffer [%d < 4]", dataSize)
+	if dataSize < helloVersionSize {
+		return hello{}, 0, errors.Errorf("short hello decode buffer [%d < %d]", dataSize, helloVersionSize)
+	}
+	if dataSize < helloSize {
+		return hello{version: util.ReadUint32(data)}, helloVersionSize, nil
 	}
-	return hello{util.ReadUint32(data)}, 4, nil
+	return hello{util.ReadUint32(data), util.ReadUint16(data[helloVersionSize:])}, helloSize, nil
 }
@@ -36,10 +36,13 @@ type InstrumentInstance interface {
 	NewRetxMs(retxMs int)
 	NewRetxScale(retxScale float64)
 	DuplicateAck(ack int32)
+	FastRetransmit(wm *WireMessage)
+	TimeoutRetransmit(wm *WireMessage)
 
 	// rxPortal
 	RxPortalSzChanged(capacity int)
 	DuplicateRx(wm *WireMessage)
+	DroppedRx(wm *WireMessage)
 
 	// allocation
 	Allocate(id string)
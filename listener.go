@@ -0,0 +1,99 @@
+package dilithium
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+type listener struct {
+	al          AdapterListener
+	profile     TxAlgorithmProfile
+	acceptQueue chan net.Conn
+	closed      chan struct{}
+	closeOnce   sync.Once
+	i           Instrument
+}
+
+// Listen accepts Adapter instances from the provided AdapterListener, performs the HELLO handshake on each of them, and
+// returns the resulting connections through the net.Listener Accept method. A nil Instrument disables instrumentation.
+//
+func Listen(al AdapterListener, profile TxAlgorithmProfile, i Instrument) (net.Listener, error) {
+	if i == nil {
+		i = NewNilInstrument()
+	}
+	l := &listener{
+		al:          al,
+		profile:     profile,
+		acceptQueue: make(chan net.Conn, acceptQueueLen),
+		closed:      make(chan struct{}),
+		i:           i,
+	}
+	go l.run()
+	return l, nil
+}
+
+func (self *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.acceptQueue:
+		return conn, nil
+	case <-self.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (self *listener) Close() error {
+	self.markClosed()
+	return self.al.Close()
+}
+
+func (self *listener) Addr() net.Addr {
+	return self.al.Addr()
+}
+
+func (self *listener) run() {
+	logrus.Infof("started")
+	defer logrus.Warn("exited")
+	defer self.markClosed()
+
+	for {
+		adapter, err := self.al.Accept()
+		if err != nil {
+			logrus.Errorf("error accepting (%v)", err)
+			return
+		}
+		go self.hello(adapter)
+	}
+}
+
+func (self *listener) hello(adapter Adapter) {
+	id := fmt.Sprintf("listenerConn_%s", self.al.Addr())
+	if aa, ok := adapter.(AddressedAdapter); ok {
+		id = fmt.Sprintf("listenerConn_%s_%s", aa.LocalAddr(), aa.RemoteAddr())
+	}
+	conn, err := newConn(adapter, self.profile, self.i.NewInstance(id))
+	if err != nil {
+		logrus.Errorf("error creating conn (%v)", err)
+		_ = adapter.Close()
+		return
+	}
+	if err := conn.listenHello(); err != nil {
+		logrus.Errorf("error connecting (%v)", err)
+		return
+	}
+
+	select {
+	case self.acceptQueue <- conn:
+	case <-self.closed:
+		_ = conn.Close()
+	}
+}
+
+func (self *listener) markClosed() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+}
+
+const acceptQueueLen = 1024
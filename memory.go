@@ -1,10 +1,16 @@
 package dilithium
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 )
 
+// Buffer is a reference-counted, pooled byte buffer. A Buffer is acquired from its Pool holding a single reference,
+// which is owned by whichever component currently holds the WireMessage wrapping it. Additional owners take a
+// reference with Ref, and every owner releases its reference with Unref. When the last reference is released, the
+// Buffer returns to its Pool, and must no longer be used.
+//
 type Buffer struct {
 	Data []byte
 	Size uint32
@@ -13,6 +19,11 @@ type Buffer struct {
 	pool *Pool
 }
 
+// bufferPoison fills the data of a released Buffer in a debug Pool, so that reads after release are conspicuous, and
+// writes after release can be detected when the Buffer is next acquired.
+//
+const bufferPoison = byte(0xdd)
+
 func NewBuffer(pool *Pool) *Buffer {
 	return &Buffer{
 		Data: make([]byte, pool.bufSize),
@@ -24,13 +35,26 @@ func NewBuffer(pool *Pool) *Buffer {
 }
 
 func (buf *Buffer) Ref() {
-	atomic.AddInt32(&buf.refs, 1)
+	if atomic.AddInt32(&buf.refs, 1) < 2 && buf.pool.debug {
+		panic(fmt.Sprintf("ref of released buffer from pool [%s]", buf.pool.id))
+	}
 }
 
 func (buf *Buffer) Unref() {
-	if atomic.AddInt32(&buf.refs, -1) < 1 {
+	refs := atomic.AddInt32(&buf.refs, -1)
+	if refs == 0 {
 		buf.Used = 0
-		//buf.pool.Put(buf)
+		buf.pool.Put(buf)
+	} else if refs < 0 && buf.pool.debug {
+		panic(fmt.Sprintf("double unref of buffer from pool [%s]", buf.pool.id))
+	}
+}
+
+// releaseOnError returns a buffer acquired by a WireMessage constructor to its pool when the constructor fails.
+//
+func releaseOnError(buf *Buffer, err *error) {
+	if *err != nil {
+		buf.Unref()
 	}
 }
 
@@ -38,6 +62,7 @@ type Pool struct {
 	id      string
 	bufSize uint32
 	store   *sync.Pool
+	debug   bool
 	ii      InstrumentInstance
 }
 
@@ -52,17 +77,45 @@ func NewPool(id string, bufSize uint32, ii InstrumentInstance) *Pool {
 	return pool
 }
 
+// NewDebugPool returns a Pool that checks the use of its buffers. Referencing a released buffer, or releasing a buffer
+// more times than it was referenced, panics. Released buffers are poisoned, and acquiring a buffer that was written to
+// after its release also panics.
+//
+func NewDebugPool(id string, bufSize uint32, ii InstrumentInstance) *Pool {
+	pool := NewPool(id, bufSize, ii)
+	pool.debug = true
+	return pool
+}
+
 func (pool *Pool) Get() *Buffer {
 	buf := pool.store.Get().(*Buffer)
-	buf.Ref()
+	if pool.debug {
+		for _, b := range buf.Data {
+			if b != bufferPoison {
+				panic(fmt.Sprintf("buffer from pool [%s] written after release", pool.id))
+			}
+		}
+	}
+	atomic.StoreInt32(&buf.refs, 1)
 	return buf
 }
 
 func (pool *Pool) Put(buf *Buffer) {
+	if pool.debug {
+		for i := range buf.Data {
+			buf.Data[i] = bufferPoison
+		}
+	}
 	pool.store.Put(buf)
 }
 
 func (pool *Pool) allocate() interface{} {
 	pool.ii.Allocate(pool.id)
-	return NewBuffer(pool)
+	buf := NewBuffer(pool)
+	if pool.debug {
+		for i := range buf.Data {
+			buf.Data[i] = bufferPoison
+		}
+	}
+	return buf
 }
@@ -0,0 +1,125 @@
+package dilithium
+
+import (
+	"bytes"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestPoolRecycles(t *testing.T) {
+	ii := &countingInstrumentInstance{}
+	pool := NewPool("test", 1024, ii)
+	for i := 0; i < 1000; i++ {
+		buf := pool.Get()
+		buf.Ref()
+		buf.Unref()
+		buf.Unref()
+	}
+	// sync.Pool may discard buffers (during garbage collection, or randomly under the race detector)
+	assert.Less(t, ii.allocations, 500)
+}
+
+func TestPoolReleasesOnLastUnref(t *testing.T) {
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+	buf := pool.Get()
+	buf.Used = 16
+	buf.Data[0] = 0x01
+	buf.Ref()
+	buf.Unref()
+	assert.Equal(t, uint32(16), buf.Used)
+	assert.Equal(t, byte(0x01), buf.Data[0])
+	buf.Unref()
+	assert.Equal(t, uint32(0), buf.Used)
+	assert.Equal(t, bufferPoison, buf.Data[0])
+}
+
+func TestPoolDebugDoubleUnref(t *testing.T) {
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+	buf := pool.Get()
+	buf.Unref()
+	assert.Panics(t, func() { buf.Unref() })
+}
+
+func TestPoolDebugRefAfterRelease(t *testing.T) {
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+	buf := pool.Get()
+	buf.Unref()
+	assert.Panics(t, func() { buf.Ref() })
+}
+
+func TestPoolDebugWriteAfterRelease(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector discards pooled buffers")
+	}
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+	buf := pool.Get()
+	buf.Unref()
+	buf.Data[512] = 0x01
+	assert.Panics(t, func() {
+		// the released buffer is the next one handed out, unless sync.Pool discarded it
+		for i := 0; i < 16; i++ {
+			pool.Get()
+		}
+	})
+}
+
+// TestEmulatedPortalsSteadyStateAllocations transfers data in rounds over a duplicating emulated network, with
+// debug pools checking every buffer reference. Once the pools have warmed up, the buffers acquired for each wire message
+// must be recycled rather than allocated.
+//
+func TestEmulatedPortalsSteadyStateAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector discards pooled buffers")
+	}
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.PoolDebug = true
+
+	aToB := util.NewEmulatorConfig(5)
+	aToB.DuplicateRate = 0.02
+	// pace the link, so that the receiver is never overrun and every wire message takes the same path
+	aToB.BandwidthBps = 200 * 1000 * 1000
+	bToA := util.NewEmulatorConfig(6)
+	bToA.DuplicateRate = 0.02
+	a, b := NewEmulatedAdapterPair(aToB, bToA)
+	defer func() { _ = a.Close() }()
+	aii := &countingInstrumentInstance{}
+	ac, err := newConn(a, profile, aii)
+	assert.NoError(t, err)
+	bii := &countingInstrumentInstance{}
+	bc, err := newConn(b, profile, bii)
+	assert.NoError(t, err)
+	ac.start(-1)
+	bc.start(-1)
+
+	allocations := func() int {
+		aii.lock.Lock()
+		defer aii.lock.Unlock()
+		bii.lock.Lock()
+		defer bii.lock.Unlock()
+		return aii.allocations + bii.allocations
+	}
+
+	round := func(sz int) {
+		data := make([]byte, sz)
+		rand.Read(data)
+		go func() {
+			_, err := ac.Write(data)
+			assert.NoError(t, err)
+		}()
+		received := make([]byte, sz)
+		_, err = io.ReadFull(bc, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+	}
+
+	round(4 * 1024 * 1024)
+	warm := allocations()
+	sz := 32 * 1024 * 1024
+	round(sz)
+	messages := sz / profile.Txpf.MaxSegmentSize
+	t.Logf("allocations: %d warm, %d after %d messages", warm, allocations()-warm, messages)
+	assert.Less(t, allocations()-warm, messages/2)
+}
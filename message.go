@@ -65,6 +65,8 @@ func (mt messageType) FlagsString() string {
 
 func readWireMessage(adapter Adapter, pool *Pool) (wm *WireMessage, err error) {
 	buf := pool.Get()
+	defer releaseOnError(buf, &err)
+
 	var n int
 	n, err = adapter.Read(buf.Data)
 	if err != nil {
@@ -101,6 +103,7 @@ func newHello(seq int32, h hello, a *Ack, p *Pool) (wm *WireMessage, err error)
 		Mt:  HELLO,
 		buf: p.Get(),
 	}
+	defer releaseOnError(wm.buf, &err)
 	var ackSize uint32
 	var helloSize uint32
 	if a != nil {
@@ -128,7 +131,10 @@ func (wm *WireMessage) asHello() (h hello, a []Ack, err error) {
 			return hello{}, nil, errors.Wrap(err, "error decoding acks")
 		}
 	}
-	h, _, err = decodeHello(wm.buf.Data[dataStart+i:])
+	if wm.buf.Used < dataStart+i {
+		return hello{}, nil, errors.Errorf("short buffer for hello decode [%d < %d]", wm.buf.Used, dataStart+i)
+	}
+	h, _, err = decodeHello(wm.buf.Data[dataStart+i : wm.buf.Used])
 	if err != nil {
 		return hello{}, nil, errors.Wrap(err, "error decoding hello")
 	}
@@ -141,6 +147,7 @@ func newAck(acks []Ack, rxPortalSize int32, rtt *uint16, pool *Pool) (wm *WireMe
 		Mt:  ACK,
 		buf: pool.Get(),
 	}
+	defer releaseOnError(wm.buf, &err)
 	rttSize := uint32(0)
 	if rtt != nil {
 		if wm.buf.Size < dataStart+2 {
@@ -197,6 +204,7 @@ func newData(seq int32, rtt *uint16, data []byte, pool *Pool) (wm *WireMessage,
 		Mt:  DATA,
 		buf: pool.Get(),
 	}
+	defer releaseOnError(wm.buf, &err)
 	rttSize := uint32(0)
 	if rtt != nil {
 		if wm.buf.Size < dataStart+2 {
@@ -241,6 +249,18 @@ func (wm *WireMessage) asDataSize() (size uint32, err error) {
 	return
 }
 
+// rttProbe returns the RTT probe timestamp carried by a DATA payload, if any.
+//
+func (wm *WireMessage) rttProbe() (uint16, bool) {
+	if wm.messageType() != DATA || !wm.hasFlag(RTT) {
+		return 0, false
+	}
+	if _, rtt, err := wm.asData(); err == nil && rtt != nil {
+		return *rtt, true
+	}
+	return 0, false
+}
+
 func (wm *WireMessage) encodeHeader(dataSize uint16) (*WireMessage, error) {
 	if wm.buf.Size < uint32(dataStart+dataSize) {
 		return nil, errors.Errorf("short buffer for encode [%d < %d]", wm.buf.Size, dataStart+dataSize)
@@ -258,12 +278,15 @@ func newKeepalive(rxPortalSize int, pool *Pool) (wm *WireMessage, err error) {
 		Mt:  KEEPALIVE,
 		buf: pool.Get(),
 	}
+	defer releaseOnError(wm.buf, &err)
 	util.WriteInt32(wm.buf.Data[dataStart:], int32(rxPortalSize))
 	return wm.encodeHeader(4)
 }
 
 func newClose(seq int32, pool *Pool) (wm *WireMessage, err error) {
-	return (&WireMessage{Seq: seq, Mt: CLOSE, buf: pool.Get()}).encodeHeader(0)
+	wm = &WireMessage{Seq: seq, Mt: CLOSE, buf: pool.Get()}
+	defer releaseOnError(wm.buf, &err)
+	return wm.encodeHeader(0)
 }
 
 func (wm *WireMessage) asKeepalive() (rxPortalSize int, err error) {
@@ -194,6 +194,12 @@ func (self *MetricsInstrument) WriteAllSamples() error {
 		if err := util.WriteSamples("dup_acks", outPath, ii.dupAcks); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("fast_retx_msgs", outPath, ii.fastRetxMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("timeout_retx_msgs", outPath, ii.timeoutRetxMsgs); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("rx_portal_sz", outPath, ii.rxPortalSz); err != nil {
 			return err
 		}
@@ -203,6 +209,12 @@ func (self *MetricsInstrument) WriteAllSamples() error {
 		if err := util.WriteSamples("dup_rx_msgs", outPath, ii.dupRxMsgs); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("dropped_rx_bytes", outPath, ii.droppedRxBytes); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("dropped_rx_msgs", outPath, ii.droppedRxMsgs); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("allocations", outPath, ii.allocations); err != nil {
 			return err
 		}
@@ -270,25 +282,33 @@ type metricsInstrumentInstance struct {
 	rxKeepaliveMsgs       []*util.Sample
 	rxKeepaliveMsgsAccum  int64
 
-	txPortalCapacity    []*util.Sample
-	txPortalCapacityVal int64
-	txPortalSz          []*util.Sample
-	txPortalSzVal       int64
-	txPortalRxSz        []*util.Sample
-	txPortalRxSzVal     int64
-	retxMs              []*util.Sample
-	retxMsVal           int64
-	retxScale           []*util.Sample
-	retxScaleVal        int64
-	dupAcks             []*util.Sample
-	dupAcksAccum        int64
-
-	rxPortalSz      []*util.Sample
-	rxPortalSzVal   int64
-	dupRxBytes      []*util.Sample
-	dupRxBytesAccum int64
-	dupRxMsgs       []*util.Sample
-	dupRxMsgsAccum  int64
+	txPortalCapacity     []*util.Sample
+	txPortalCapacityVal  int64
+	txPortalSz           []*util.Sample
+	txPortalSzVal        int64
+	txPortalRxSz         []*util.Sample
+	txPortalRxSzVal      int64
+	retxMs               []*util.Sample
+	retxMsVal            int64
+	retxScale            []*util.Sample
+	retxScaleVal         int64
+	dupAcks              []*util.Sample
+	dupAcksAccum         int64
+	fastRetxMsgs         []*util.Sample
+	fastRetxMsgsAccum    int64
+	timeoutRetxMsgs      []*util.Sample
+	timeoutRetxMsgsAccum int64
+
+	rxPortalSz          []*util.Sample
+	rxPortalSzVal       int64
+	dupRxBytes          []*util.Sample
+	dupRxBytesAccum     int64
+	dupRxMsgs           []*util.Sample
+	dupRxMsgsAccum      int64
+	droppedRxBytes      []*util.Sample
+	droppedRxBytesAccum int64
+	droppedRxMsgs       []*util.Sample
+	droppedRxMsgsAccum  int64
 
 	allocations      []*util.Sample
 	allocationsAccum int64
@@ -435,6 +455,18 @@ func (self *metricsInstrumentInstance) DuplicateAck(int32) {
 	}
 }
 
+func (self *metricsInstrumentInstance) FastRetransmit(*WireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.fastRetxMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TimeoutRetransmit(*WireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.timeoutRetxMsgsAccum, 1)
+	}
+}
+
 /*
  * rxPortal
  */
@@ -451,6 +483,13 @@ func (self *metricsInstrumentInstance) DuplicateRx(wm *WireMessage) {
 	}
 }
 
+func (self *metricsInstrumentInstance) DroppedRx(wm *WireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.droppedRxBytesAccum, int64(wm.buf.Used))
+		atomic.AddInt64(&self.droppedRxMsgsAccum, 1)
+	}
+}
+
 /*
  * allocation
  */
@@ -510,9 +549,13 @@ func (self *metricsInstrumentInstance) snapshot() {
 	self.retxMs = append(self.retxMs, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxMsVal)})
 	self.retxScale = append(self.retxScale, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxScaleVal)})
 	self.dupAcks = append(self.dupAcks, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupAcksAccum, 0)})
+	self.fastRetxMsgs = append(self.fastRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.fastRetxMsgsAccum, 0)})
+	self.timeoutRetxMsgs = append(self.timeoutRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.timeoutRetxMsgsAccum, 0)})
 	self.rxPortalSz = append(self.rxPortalSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.rxPortalSzVal)})
 	self.dupRxBytes = append(self.dupRxBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxBytesAccum, 0)})
 	self.dupRxMsgs = append(self.dupRxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxMsgsAccum, 0)})
+	self.droppedRxBytes = append(self.droppedRxBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.droppedRxBytesAccum, 0)})
+	self.droppedRxMsgs = append(self.droppedRxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.droppedRxMsgsAccum, 0)})
 	self.allocations = append(self.allocations, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.allocationsAccum, 0)})
 	self.errors = append(self.errors, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.errorsAccum, 0)})
 }
@@ -46,10 +46,16 @@ func (n NilInstrumentInstance) NewRetxScale(retxScale float64) {}
 
 func (n NilInstrumentInstance) DuplicateAck(ack int32) {}
 
+func (n NilInstrumentInstance) FastRetransmit(wm *WireMessage) {}
+
+func (n NilInstrumentInstance) TimeoutRetransmit(wm *WireMessage) {}
+
 func (n NilInstrumentInstance) RxPortalSzChanged(capacity int) {}
 
 func (n NilInstrumentInstance) DuplicateRx(wm *WireMessage) {}
 
+func (n NilInstrumentInstance) DroppedRx(wm *WireMessage) {}
+
 func (n NilInstrumentInstance) Allocate(id string) {}
 
 func (n NilInstrumentInstance) Shutdown() {}
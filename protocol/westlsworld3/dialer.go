@@ -1,9 +1,11 @@
 package westlsworld3
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/openziti/dilithium/protocol/westworld3"
 	"net"
+	"time"
 )
 
 func Dial(addr *net.UDPAddr, tlsConfig *tls.Config, profileId byte) (net.Conn, error) {
@@ -13,3 +15,57 @@ func Dial(addr *net.UDPAddr, tlsConfig *tls.Config, profileId byte) (net.Conn, e
 	}
 	return tls.Client(w3Conn, tlsConfig), nil
 }
+
+func DialContext(ctx context.Context, network, address string, tlsConfig *tls.Config, opts ...westworld3.DialOption) (net.Conn, error) {
+	w3Conn, err := westworld3.DialContext(ctx, network, address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(w3Conn, tlsConfig)
+	if err := handshake(ctx, tlsConn, w3Conn); err != nil {
+		_ = w3Conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func handshake(ctx context.Context, tlsConn *tls.Conn, w3Conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := w3Conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		defer func() { _ = w3Conn.SetDeadline(time.Time{}) }()
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tlsConn.Handshake()
+	}()
+	select {
+	case err := <-errs:
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if deadline, ok := ctx.Deadline(); ok && err != nil && !time.Now().Before(deadline) {
+			// the westworld3 deadline can expire just ahead of the context
+			return context.DeadlineExceeded
+		}
+		return err
+	case <-ctx.Done():
+		// expire the westworld3 deadlines to unblock the handshake
+		_ = w3Conn.SetDeadline(time.Now())
+		<-errs
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+package westlsworld3
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/openziti/dilithium/protocol/westworld3"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialContextRoundTrip(t *testing.T) {
+	serverConfig, clientConfig := testTlsConfigs(t)
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	go func() {
+		conn, err := l.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); assert.NoError(t, err) {
+			_, err = conn.Write(buf)
+			assert.NoError(t, err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, "udp4", l.Addr().String(), clientConfig)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.True(t, conn.(*tls.Conn).ConnectionState().HandshakeComplete)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestDialContextVerifiesServerName(t *testing.T) {
+	serverConfig, clientConfig := testTlsConfigs(t)
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	clientConfig.ServerName = "not-localhost"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = DialContext(ctx, "udp4", l.Addr().String(), clientConfig)
+	assert.Error(t, err)
+}
+
+func TestDialContextCancelledDuringHandshake(t *testing.T) {
+	_, clientConfig := testTlsConfigs(t)
+
+	// a westworld3 listener that never answers the tls handshake
+	l, err := westworld3.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = DialContext(ctx, "udp4", l.Addr().String(), clientConfig)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(250*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = DialContext(ctx, "udp4", l.Addr().String(), clientConfig)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func testTlsConfigs(t *testing.T) (server *tls.Config, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots}
+	return
+}
@@ -0,0 +1,28 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+)
+
+type ackCoalescer struct {
+	util.AckCoalescer
+	rtt *rttProbe
+}
+
+func (self *ackCoalescer) add(seq int32, rtt *rttProbe) {
+	if rtt != nil {
+		self.rtt = rtt
+	}
+	self.Add(seq)
+}
+
+func (self *ackCoalescer) take() ([]Ack, *rttProbe) {
+	ranges := self.Take()
+	acks := make([]Ack, len(ranges))
+	for i, r := range ranges {
+		acks[i] = Ack{r.Start, r.End}
+	}
+	rtt := self.rtt
+	self.rtt = nil
+	return acks, rtt
+}
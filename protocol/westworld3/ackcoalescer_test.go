@@ -0,0 +1,50 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestAckCoalescer(t *testing.T) {
+	ac := &ackCoalescer{}
+	assert.False(t, ac.Pending())
+
+	rtt0 := &rttProbe{ts: 10}
+	rtt1 := &rttProbe{ts: 20}
+	ac.add(1, nil)
+	ac.add(2, rtt0)
+	ac.add(3, rtt1)
+	ac.add(5, nil)
+	ac.add(2, nil)
+	ac.add(6, nil)
+	assert.True(t, ac.Pending())
+	assert.True(t, ac.Full(6))
+	assert.False(t, ac.Full(7))
+
+	acks, rtt := ac.take()
+	assert.Equal(t, []Ack{{1, 3}, {5, 6}}, acks)
+	assert.Equal(t, rtt1, rtt)
+	assert.False(t, ac.Pending())
+	assert.False(t, ac.Full(1))
+}
+
+func TestAckCoalescerWrap(t *testing.T) {
+	ac := &ackCoalescer{}
+	ac.add(math.MaxInt32-1, nil)
+	ac.add(math.MaxInt32, nil)
+	ac.add(0, nil)
+	ac.add(1, nil)
+	acks, _ := ac.take()
+	assert.Equal(t, []Ack{{math.MaxInt32 - 1, 1}}, acks)
+}
+
+func TestAckCoalescerMaxRanges(t *testing.T) {
+	ac := &ackCoalescer{}
+	for i := 0; i < util.MaxAckRanges; i++ {
+		assert.False(t, ac.Full(math.MaxInt32))
+		ac.add(int32(i*2), nil)
+	}
+	assert.True(t, ac.Full(math.MaxInt32))
+}
@@ -0,0 +1,258 @@
+package westworld3
+
+import (
+	"github.com/openziti-incubator/cf"
+	"github.com/openziti/dilithium"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+func NewTxAlgorithmProfile(name string, config map[string]interface{}) (dilithium.TxAlgorithmProfile, error) {
+	var p dilithium.TxAlgorithmProfile
+	switch name {
+	case "westworld3":
+		return nil, nil
+	case "westworld":
+		p = dilithium.NewBaselineWestworldProfile()
+	case "bbr":
+		p = dilithium.NewBaselineBBRProfile()
+	case "cubic":
+		p = dilithium.NewBaselineCubicProfile()
+	default:
+		return nil, errors.Errorf("unknown tx algorithm '%s'", name)
+	}
+	if err := cf.Bind(p, config, cf.DefaultOptions()); err != nil {
+		return nil, errors.Wrapf(err, "error configuring tx algorithm '%s'", name)
+	}
+	return p, nil
+}
+
+func newTxAlgorithm(profile *Profile, path *path, ii InstrumentInstance) (dilithium.TxAlgorithm, error) {
+	if profile.txAlgorithm == nil {
+		return newPortalAlgorithm(profile, path, ii), nil
+	}
+	alg, err := profile.txAlgorithm.Create(&algorithmInstrument{path: path, ii: ii})
+	if err != nil {
+		return nil, errors.Wrap(err, "create tx algorithm")
+	}
+	return alg, nil
+}
+
+// portalAlgorithm is the native westworld3 flow control, configured by the tx_portal_* and retx_* profile values.
+type portalAlgorithm struct {
+	capacity          int
+	txPortalSz        int
+	rxPortalSz        int
+	successCt         int
+	successAccum      int
+	dupAckCt          int
+	retxCt            int
+	retxScale         float64
+	lastRetxScaleIncr time.Time
+	lastRetxScaleDecr time.Time
+	lastRttProbe      time.Time
+	rtt               dilithium.RttEstimator
+	ready             *sync.Cond
+	path              *path
+	profile           *Profile
+	ii                InstrumentInstance
+}
+
+func newPortalAlgorithm(profile *Profile, path *path, ii InstrumentInstance) *portalAlgorithm {
+	return &portalAlgorithm{
+		capacity:          profile.TxPortalStartSz,
+		rxPortalSz:        -1,
+		retxScale:         profile.RetxScale,
+		lastRetxScaleIncr: time.Now(),
+		lastRetxScaleDecr: time.Now(),
+		rtt:               dilithium.NewRttEstimator(profile.RetxStartMs, profile.RetxAddMs),
+		path:              path,
+		profile:           profile,
+		ii:                ii,
+	}
+}
+
+func (self *portalAlgorithm) SetLock(lock *sync.Mutex) {
+	self.ready = sync.NewCond(lock)
+}
+
+func (self *portalAlgorithm) Tx(segmentSz int) {
+	self.TxInterruptible(segmentSz, func() bool { return false })
+}
+
+func (self *portalAlgorithm) TxInterruptible(segmentSz int, interrupted func() bool) bool {
+	for self.availableCapacity(segmentSz) < 0 {
+		if interrupted() {
+			return false
+		}
+		self.ready.Wait()
+	}
+	self.txPortalSz += segmentSz
+	self.ii.TxPortalSzChanged(self.path.peer(), self.txPortalSz)
+	return true
+}
+
+func (self *portalAlgorithm) Interrupt() {
+	self.ready.Broadcast()
+}
+
+func (self *portalAlgorithm) Success(sz int) {
+	self.txPortalSz -= sz
+	self.ii.TxPortalSzChanged(self.path.peer(), self.txPortalSz)
+
+	self.successCt++
+	self.successAccum += sz
+	if self.successCt == self.profile.TxPortalIncreaseThresh {
+		newCapacity := self.capacity + int(float64(self.successAccum)*self.profile.TxPortalIncreaseScale)
+		self.updatePortalCapacity(newCapacity)
+		self.successCt = 0
+		self.successAccum = 0
+	}
+
+	if time.Since(self.lastRetxScaleDecr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
+		self.retxScale -= self.profile.RetxEvaluationScaleDecr
+		if self.retxScale < self.profile.RetxScaleFloor {
+			self.retxScale = self.profile.RetxScaleFloor
+		}
+		self.ii.NewRetxScale(self.path.peer(), self.retxScale)
+		self.lastRetxScaleDecr = time.Now()
+	}
+
+	self.ready.Broadcast()
+}
+
+func (self *portalAlgorithm) DuplicateAck() {
+	self.dupAckCt++
+	self.successCt = 0
+	if self.dupAckCt >= self.profile.TxPortalDupAckThresh {
+		newCapacity := int(float64(self.capacity) * self.profile.TxPortalDupAckCapacityScale)
+
+		// #93: Self-Adjusting retxMs
+		if time.Since(self.lastRetxScaleIncr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
+			self.retxScale += self.profile.RetxEvaluationScaleIncr
+			self.lastRetxScaleIncr = time.Now()
+			self.ii.NewRetxScale(self.path.peer(), self.retxScale)
+		}
+
+		self.updatePortalCapacity(newCapacity)
+		self.dupAckCt = 0
+		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalDupAckSuccessScale)
+	}
+}
+
+func (self *portalAlgorithm) Retransmission(_ int) {
+	self.retxCt++
+	self.successCt = 0
+	if self.retxCt >= self.profile.TxPortalRetxThresh {
+		newCapacity := int(float64(self.capacity) * self.profile.TxPortalRetxCapacityScale)
+		self.updatePortalCapacity(newCapacity)
+		self.retxCt = 0
+		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalRetxSuccessScale)
+	}
+}
+
+func (self *portalAlgorithm) ProbeRTT() bool {
+	if time.Since(self.lastRttProbe).Milliseconds() > int64(self.profile.RttProbeMs) {
+		self.lastRttProbe = time.Now()
+		return true
+	}
+	return false
+}
+
+// UpdateRTT feeds the sample to the RFC 6298 estimator shared with the root tx algorithms. The retransmission deadline
+// is the smoothed RTT scaled by retxScale, plus four times the variance.
+func (self *portalAlgorithm) UpdateRTT(sample time.Duration) {
+	self.rtt.UpdateScaled(sample, self.retxScale)
+	self.ii.NewRetxMs(self.path.peer(), self.rtt.RetxMs())
+}
+
+func (self *portalAlgorithm) RetxMs() int {
+	return self.rtt.RetxMs()
+}
+
+func (self *portalAlgorithm) RxPortalSize() int {
+	return self.rxPortalSz
+}
+
+func (self *portalAlgorithm) UpdateRxPortalSize(rxPortalSz int) {
+	self.rxPortalSz = rxPortalSz
+	self.ready.Broadcast()
+	self.ii.TxPortalRxSzChanged(self.path.peer(), rxPortalSz)
+}
+
+func (self *portalAlgorithm) RxPortalPacing(oldSz, newSz int) bool {
+	return oldSz > self.profile.TxPortalMinSz && float64(newSz)/float64(oldSz) < self.profile.RxPortalSzPacingThresh
+}
+
+func (self *portalAlgorithm) Profile() *dilithium.TxProfile {
+	return &dilithium.TxProfile{
+		MaxSegmentSize:           self.profile.MaxSegmentSz,
+		RetxBatchMs:              self.profile.RetxBatchMs,
+		RetxMaxMs:                self.profile.RetxMaxMs,
+		SendKeepalive:            self.profile.SendKeepalive,
+		ConnectionSetupTimeoutMs: self.profile.ConnectionSetupTimeoutMs,
+		ConnectionTimeout:        time.Duration(self.profile.ConnectionInactiveTimeoutMs) * time.Millisecond,
+		MaxTreeSize:              self.profile.TxPortalTreeLen,
+		ReadsQueueSize:           self.profile.ReadsQueueLen,
+		PoolBufferSize:           self.profile.PoolBufferSz,
+		RxPortalPacingThreshold:  self.profile.RxPortalSzPacingThresh,
+		CloseCheckMs:             self.profile.CloseCheckMs,
+		AckDelayMs:               self.profile.AckDelayMs,
+		AckCoalesceThreshold:     self.profile.AckCoalesceThresh,
+		FastRetxThreshold:        self.profile.FastRetxThresh,
+	}
+}
+
+// PacingRate estimates that the portal capacity is delivered once per smoothed RTT.
+func (self *portalAlgorithm) PacingRate() float64 {
+	return self.rtt.Rate(self.capacity)
+}
+
+func (self *portalAlgorithm) updatePortalCapacity(newCapacity int) {
+	oldCapacity := self.capacity
+	self.capacity = newCapacity
+	if self.capacity < self.profile.TxPortalMinSz {
+		self.capacity = self.profile.TxPortalMinSz
+	}
+	if self.capacity > self.profile.TxPortalMaxSz {
+		self.capacity = self.profile.TxPortalMaxSz
+	}
+	if self.capacity != oldCapacity {
+		self.ii.TxPortalCapacityChanged(self.path.peer(), self.capacity)
+	}
+}
+
+func (self *portalAlgorithm) availableCapacity(segmentSz int) int {
+	txPortalCapacity := float64(self.capacity - int(float64(self.rxPortalSz)*self.profile.TxPortalRxSzPressureScale) - (self.txPortalSz + segmentSz))
+	rxPortalCapacity := float64(self.capacity - (self.rxPortalSz + segmentSz))
+	return int(math.Min(txPortalCapacity, rxPortalCapacity))
+}
+
+// algorithmInstrument reports the portal events of a dilithium.TxAlgorithm through a westworld3 InstrumentInstance.
+type algorithmInstrument struct {
+	dilithium.NilInstrumentInstance
+	path *path
+	ii   InstrumentInstance
+}
+
+func (self *algorithmInstrument) TxPortalCapacityChanged(capacity int) {
+	self.ii.TxPortalCapacityChanged(self.path.peer(), capacity)
+}
+
+func (self *algorithmInstrument) TxPortalSzChanged(sz int) {
+	self.ii.TxPortalSzChanged(self.path.peer(), sz)
+}
+
+func (self *algorithmInstrument) TxPortalRxSzChanged(sz int) {
+	self.ii.TxPortalRxSzChanged(self.path.peer(), sz)
+}
+
+func (self *algorithmInstrument) NewRetxMs(retxMs int) {
+	self.ii.NewRetxMs(self.path.peer(), retxMs)
+}
+
+func (self *algorithmInstrument) NewRetxScale(retxScale float64) {
+	self.ii.NewRetxScale(self.path.peer(), retxScale)
+}
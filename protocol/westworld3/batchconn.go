@@ -0,0 +1,311 @@
+package westworld3
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxGsoSz bounds the payload of a single segmentation offload send, keeping it within the limits of a UDP datagram.
+const maxGsoSz = 65000
+
+// maxGsoSegments is the kernel's limit on the number of segments in a single segmentation offload send.
+const maxGsoSegments = 64
+
+// newDatagramConn wraps conn in a batchConn when the profile enables batch_io.
+func newDatagramConn(conn *net.UDPConn, profile *Profile) datagramConn {
+	if profile.BatchIo {
+		return newBatchConn(conn, profile)
+	}
+	return conn
+}
+
+// batchConn is a datagramConn that moves datagrams through the kernel in batches (recvmmsg and sendmmsg on linux).
+// Reads fill a whole batch of buffers and hand out one datagram at a time. Writes are copied onto a queue, which a
+// single txer goroutine flushes as a batch; concurrent writers naturally accumulate into larger batches under load.
+//
+// With udp_offload, equal-sized datagrams queued for the same peer are coalesced into a single segmentation offload
+// (GSO) send, and coalesced receives (GRO) are split back into datagrams.
+type batchConn struct {
+	conn      *net.UDPConn
+	pc        *ipv4.PacketConn
+	batchSz   int
+	rxLock    sync.Mutex
+	rxMsgs    []ipv4.Message
+	rxPending []rxDatagram
+	rxGro     bool
+	txLock    sync.Mutex
+	txReady   *sync.Cond
+	txSpace   *sync.Cond
+	txQueue   []*txDatagram
+	txFree    []*txDatagram
+	txMsgs    []ipv4.Message
+	txSegSz   []int
+	txGsoBufs [][]byte
+	txGso     bool
+	txDone    chan struct{}
+	closed    bool
+	closeOnce sync.Once
+}
+
+type rxDatagram struct {
+	data []byte
+	peer *net.UDPAddr
+}
+
+type txDatagram struct {
+	data []byte
+	peer *net.UDPAddr
+}
+
+func newBatchConn(conn *net.UDPConn, profile *Profile) *batchConn {
+	self := &batchConn{
+		conn:    conn,
+		pc:      ipv4.NewPacketConn(conn),
+		batchSz: profile.BatchIoSz,
+		txDone:  make(chan struct{}),
+	}
+	if self.batchSz < 1 {
+		self.batchSz = 1
+	}
+	if profile.UdpOffload {
+		self.txGso, self.rxGro = enableOffload(conn)
+	}
+	self.txReady = sync.NewCond(&self.txLock)
+	self.txSpace = sync.NewCond(&self.txLock)
+
+	rxBufferSz := int(profile.maxDatagramSz())
+	if self.rxGro {
+		rxBufferSz = 64 * 1024
+	}
+	self.rxMsgs = make([]ipv4.Message, self.batchSz)
+	for i := range self.rxMsgs {
+		self.rxMsgs[i].Buffers = [][]byte{make([]byte, rxBufferSz)}
+		if self.rxGro {
+			self.rxMsgs[i].OOB = make([]byte, groOobSz)
+		}
+	}
+	self.txMsgs = make([]ipv4.Message, 0, self.batchSz)
+	self.txSegSz = make([]int, 0, self.batchSz)
+
+	go self.txer()
+	return self
+}
+
+func (self *batchConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	self.rxLock.Lock()
+	defer self.rxLock.Unlock()
+
+	for len(self.rxPending) < 1 {
+		if err := self.readBatch(); err != nil {
+			return 0, nil, err
+		}
+	}
+	next := self.rxPending[0]
+	self.rxPending[0] = rxDatagram{}
+	self.rxPending = self.rxPending[1:]
+	return copy(b, next.data), next.peer, nil
+}
+
+// readBatch blocks until the kernel delivers at least one datagram, and then queues every datagram in the batch. The
+// pending datagrams refer to the batch buffers, which are only reused once they have all been consumed.
+func (self *batchConn) readBatch() error {
+	n, err := self.pc.ReadBatch(self.rxMsgs, 0)
+	if err != nil {
+		return err
+	}
+	self.rxPending = self.rxPending[:0]
+	for i := 0; i < n; i++ {
+		m := &self.rxMsgs[i]
+		peer, ok := m.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		data := m.Buffers[0][:m.N]
+		segmentSz := len(data)
+		if self.rxGro {
+			if sz := groSegmentSz(m.OOB[:m.NN]); sz > 0 {
+				segmentSz = sz
+			}
+		}
+		for len(data) > 0 {
+			sz := segmentSz
+			if sz > len(data) {
+				sz = len(data)
+			}
+			self.rxPending = append(self.rxPending, rxDatagram{data: data[:sz], peer: peer})
+			data = data[sz:]
+		}
+	}
+	return nil
+}
+
+func (self *batchConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	self.txLock.Lock()
+	defer self.txLock.Unlock()
+
+	for len(self.txQueue) >= self.batchSz && !self.closed {
+		self.txSpace.Wait()
+	}
+	if self.closed {
+		return 0, net.ErrClosed
+	}
+	var d *txDatagram
+	if last := len(self.txFree) - 1; last >= 0 {
+		d = self.txFree[last]
+		self.txFree = self.txFree[:last]
+	} else {
+		d = &txDatagram{}
+	}
+	d.data = append(d.data[:0], b...)
+	d.peer = addr
+	self.txQueue = append(self.txQueue, d)
+	self.txReady.Signal()
+	return len(b), nil
+}
+
+func (self *batchConn) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *batchConn) SetReadDeadline(t time.Time) error {
+	return self.conn.SetReadDeadline(t)
+}
+
+// Close flushes any queued datagrams before closing the underlying socket.
+func (self *batchConn) Close() error {
+	self.closeOnce.Do(func() {
+		self.txLock.Lock()
+		self.closed = true
+		self.txReady.Broadcast()
+		self.txSpace.Broadcast()
+		self.txLock.Unlock()
+		<-self.txDone
+	})
+	return self.conn.Close()
+}
+
+func (self *batchConn) txer() {
+	defer close(self.txDone)
+
+	var batch []*txDatagram
+	for {
+		self.txLock.Lock()
+		for len(self.txQueue) < 1 && !self.closed {
+			self.txReady.Wait()
+		}
+		if len(self.txQueue) < 1 {
+			self.txLock.Unlock()
+			return
+		}
+		batch, self.txQueue = self.txQueue, batch[:0]
+		self.txSpace.Broadcast()
+		self.txLock.Unlock()
+
+		self.flush(batch)
+
+		self.txLock.Lock()
+		for i, d := range batch {
+			d.peer = nil
+			self.txFree = append(self.txFree, d)
+			batch[i] = nil
+		}
+		self.txLock.Unlock()
+	}
+}
+
+func (self *batchConn) flush(batch []*txDatagram) {
+	self.txMsgs = self.txMsgs[:0]
+	self.txSegSz = self.txSegSz[:0]
+	gsoBufs := 0
+	for i := 0; i < len(batch); {
+		j := i + 1
+		if self.txGso {
+			j = coalesce(batch, i)
+		}
+		m := ipv4.Message{Addr: batch[i].peer}
+		if j-i > 1 {
+			if gsoBufs == len(self.txGsoBufs) {
+				self.txGsoBufs = append(self.txGsoBufs, make([]byte, 0, maxGsoSz))
+			}
+			buf := self.txGsoBufs[gsoBufs][:0]
+			for _, d := range batch[i:j] {
+				buf = append(buf, d.data...)
+			}
+			self.txGsoBufs[gsoBufs] = buf
+			gsoBufs++
+			m.Buffers = [][]byte{buf}
+			m.OOB = gsoControl(len(batch[i].data))
+			self.txSegSz = append(self.txSegSz, len(batch[i].data))
+		} else {
+			m.Buffers = [][]byte{batch[i].data}
+			self.txSegSz = append(self.txSegSz, 0)
+		}
+		self.txMsgs = append(self.txMsgs, m)
+		i = j
+	}
+	self.writeBatch(self.txMsgs, self.txSegSz)
+	for i := range self.txMsgs {
+		self.txMsgs[i] = ipv4.Message{}
+	}
+}
+
+// writeBatch sends every message, skipping any message the kernel refuses (datagrams are already allowed to be lost).
+// A refused segmentation offload send disables offload for the connection, and its datagrams are re-sent individually.
+func (self *batchConn) writeBatch(ms []ipv4.Message, segmentSzs []int) {
+	for len(ms) > 0 {
+		n, err := self.pc.WriteBatch(ms, 0)
+		if err != nil {
+			// sendmmsg only fails on the first message of a batch
+			if n < 0 {
+				n = 0
+			}
+			if segmentSzs[n] > 0 {
+				logrus.Warnf("disabling segmentation offload (%v)", err)
+				self.txGso = false
+				data := ms[n].Buffers[0]
+				for len(data) > 0 {
+					sz := segmentSzs[n]
+					if sz > len(data) {
+						sz = len(data)
+					}
+					if _, err := self.conn.WriteTo(data[:sz], ms[n].Addr); err != nil {
+						logrus.Errorf("error writing (%v)", err)
+					}
+					data = data[sz:]
+				}
+			} else {
+				logrus.Errorf("error writing batch (%v)", err)
+			}
+			n++
+		}
+		ms = ms[n:]
+		segmentSzs = segmentSzs[n:]
+	}
+}
+
+// coalesce returns the end of the run of datagrams starting at i that can be sent as a single segmentation offload
+// send: the same peer, the same size (except for a shorter final datagram), and within the kernel's limits.
+func coalesce(batch []*txDatagram, i int) int {
+	segmentSz := len(batch[i].data)
+	total := segmentSz
+	j := i + 1
+	for ; j < len(batch) && j-i < maxGsoSegments; j++ {
+		d := batch[j]
+		if len(d.data) > segmentSz || total+len(d.data) > maxGsoSz || !sameUDPAddr(d.peer, batch[i].peer) {
+			break
+		}
+		total += len(d.data)
+		if len(d.data) < segmentSz {
+			j++
+			break
+		}
+	}
+	return j
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a == b || (a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone)
+}
@@ -0,0 +1,123 @@
+package westworld3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func batchIoProfile(offload bool) *Profile {
+	p := NewBaselineProfile()
+	p.BatchIo = true
+	p.BatchIoSz = 8
+	p.UdpOffload = offload
+	return p
+}
+
+func TestBatchConn(t *testing.T) {
+	for _, offload := range []bool{false, true} {
+		// the receiver is dual-stack, so ipv4 peers arrive as mapped addresses
+		rxConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+		if err != nil {
+			rxConn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		}
+		assert.NoError(t, err)
+		txConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		rx := newBatchConn(rxConn, batchIoProfile(offload))
+		tx := newBatchConn(txConn, batchIoProfile(offload))
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: rxConn.LocalAddr().(*net.UDPAddr).Port}
+
+		// runs of equal sizes followed by a shorter datagram exercise segmentation offload; chunks stay well within
+		// the default socket buffers
+		buf := make([]byte, 64*1024)
+		assert.NoError(t, rx.SetReadDeadline(time.Now().Add(5*time.Second)))
+		for chunk := 0; chunk < 8; chunk++ {
+			var sent [][]byte
+			for i := 0; i < 32; i++ {
+				sz := 1461
+				if i%7 == 6 {
+					sz = 64 + i
+				}
+				data := make([]byte, sz)
+				rand.Read(data)
+				binary.BigEndian.PutUint32(data, uint32(i))
+				sent = append(sent, data)
+				n, err := tx.WriteToUDP(data, to)
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+			}
+			for i := range sent {
+				n, peer, err := rx.ReadFromUDP(buf)
+				if !assert.NoError(t, err, "offload: %v", offload) {
+					break
+				}
+				assert.True(t, bytes.Equal(sent[i], buf[:n]), "datagram %d (offload: %v)", i, offload)
+				assert.True(t, peer.IP.Equal(to.IP))
+				assert.Equal(t, txConn.LocalAddr().(*net.UDPAddr).Port, peer.Port)
+			}
+		}
+
+		assert.NoError(t, tx.Close())
+		assert.NoError(t, rx.Close())
+		_, err = tx.WriteToUDP([]byte{0}, to)
+		assert.Error(t, err)
+	}
+}
+
+func TestBatchConnCloseUnblocksRead(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	bc := newBatchConn(conn, batchIoProfile(false))
+
+	done := make(chan error)
+	go func() {
+		_, _, err := bc.ReadFromUDP(make([]byte, 1500))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, bc.Close())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("read not unblocked")
+	}
+}
+
+func TestBatchIoTransfer(t *testing.T) {
+	for _, offload := range []bool{false, true} {
+		profile := batchIoProfile(offload)
+		lConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		l, err := listen(newDatagramConn(lConn, profile), lConn.LocalAddr().(*net.UDPAddr), profile, 0)
+		assert.NoError(t, err)
+		dConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		dialed, err := dial(context.Background(), newDatagramConn(dConn, profile), l.addr, profile)
+		assert.NoError(t, err)
+		accepted, err := l.Accept()
+		assert.NoError(t, err)
+
+		data := make([]byte, 1024*1024)
+		rand.Read(data)
+		go func() {
+			_, err := dialed.Write(data)
+			assert.NoError(t, err)
+		}()
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(accepted, buf)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, buf), "offload: %v", offload)
+
+		_ = dialed.Close()
+		_ = accepted.Close()
+		_ = l.Close()
+	}
+}
@@ -3,12 +3,14 @@ package westworld3
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 const notClosed = int32(-33)
 
 type closer struct {
+	lock         sync.Mutex
 	seq          *util.Sequence
 	rxCloseSeq   int32
 	rxCloseSeqIn chan int32
@@ -19,6 +21,9 @@ type closer struct {
 	lastEvent    time.Time
 	profile      *Profile
 	closeHook    func()
+	timer        *reactorTimer
+	stopped      chan struct{}
+	stopOnce     sync.Once
 }
 
 func newCloser(seq *util.Sequence, profile *Profile, closeHook func()) *closer {
@@ -30,29 +35,34 @@ func newCloser(seq *util.Sequence, profile *Profile, closeHook func()) *closer {
 		txCloseSeqIn: make(chan int32, 1),
 		profile:      profile,
 		closeHook:    closeHook,
+		stopped:      make(chan struct{}),
 	}
 }
 
 func (self *closer) emergencyStop() {
 	logrus.Infof("broken glass")
-
-	self.txPortal.close()
-	self.rxPortal.close()
-
-	if self.closeHook != nil {
-		self.closeHook()
-	}
+	self.stop()
 }
 
 func (self *closer) timeout() {
 	logrus.Infof("timeout")
+	self.stop()
+}
 
-	self.txPortal.close()
-	self.rxPortal.close()
+func (self *closer) stop() {
+	self.stopOnce.Do(func() {
+		close(self.stopped)
+		if self.timer != nil {
+			self.timer.stop()
+		}
 
-	if self.closeHook != nil {
-		self.closeHook()
-	}
+		self.txPortal.close()
+		self.rxPortal.close()
+
+		if self.closeHook != nil {
+			self.closeHook()
+		}
+	})
 }
 
 func (self *closer) run() {
@@ -67,14 +77,7 @@ closeWait:
 				logrus.Info("unexpected closed rx close seq")
 				break closeWait
 			}
-			self.rxCloseSeq = rxCloseSeq
-			self.lastEvent = time.Now()
-			logrus.Infof("got rx close seq: %d", rxCloseSeq)
-			if self.txCloseSeq == notClosed {
-				if err := self.txPortal.sendClose(self.seq); err != nil {
-					logrus.Errorf("error sending close (%v)", err)
-				}
-			}
+			self.rxClosed(rxCloseSeq)
 			if self.readyToClose() {
 				break closeWait
 			}
@@ -84,9 +87,7 @@ closeWait:
 				logrus.Infof("unexpected closed tx close seq")
 				break closeWait
 			}
-			self.txCloseSeq = txCloseSeq
-			self.lastEvent = time.Now()
-			logrus.Infof("got tx close seq: %d", txCloseSeq)
+			self.txClosed(txCloseSeq)
 			if self.readyToClose() {
 				break closeWait
 			}
@@ -95,21 +96,90 @@ closeWait:
 			if self.readyToClose() {
 				break closeWait
 			}
+
+		case <-self.stopped:
+			logrus.Info("stopped")
+			return
 		}
 	}
 	logrus.Info("ready to close")
 
-	self.txPortal.close()
-	self.rxPortal.close()
+	self.stop()
+
+	logrus.Info("close complete")
+}
+
+// schedule drives the close checks from a reactor timer, rather than from run. Close sequences are then recorded as
+// they arrive, and the timer (idle until the first of them) stops the connection once it is ready to close.
+func (self *closer) schedule(r *reactor) {
+	self.timer = r.schedule(time.Time{}, self.fire)
+}
+
+func (self *closer) fire(now time.Time) time.Time {
+	if isClosed(self.stopped) {
+		return time.Time{}
+	}
+	if self.readyToClose() {
+		logrus.Info("ready to close")
+		self.stop()
+		logrus.Info("close complete")
+		return time.Time{}
+	}
+	return now.Add(self.closeCheck())
+}
+
+func (self *closer) closeCheck() time.Duration {
+	return time.Duration(self.profile.CloseCheckMs) * time.Millisecond
+}
 
-	if self.closeHook != nil {
-		self.closeHook()
+// rxClose receives the sequence of the peer's close.
+func (self *closer) rxClose(seq int32) {
+	if self.timer == nil {
+		self.rxCloseSeqIn <- seq
+		return
 	}
+	self.rxClosed(seq)
+	self.timer.reset(time.Now())
+}
 
-	logrus.Info("close complete")
+// txClose receives the sequence of our own close. It is called with the txPortal's lock held.
+func (self *closer) txClose(seq int32) {
+	if self.timer == nil {
+		self.txCloseSeqIn <- seq
+		return
+	}
+	self.txClosed(seq)
+	self.timer.reset(time.Now())
+}
+
+func (self *closer) rxClosed(seq int32) {
+	self.lock.Lock()
+	self.rxCloseSeq = seq
+	self.lastEvent = time.Now()
+	txClosed := self.txCloseSeq != notClosed
+	self.lock.Unlock()
+
+	logrus.Infof("got rx close seq: %d", seq)
+	if !txClosed {
+		if err := self.txPortal.sendClose(self.seq); err != nil {
+			logrus.Errorf("error sending close (%v)", err)
+		}
+	}
+}
+
+func (self *closer) txClosed(seq int32) {
+	self.lock.Lock()
+	self.txCloseSeq = seq
+	self.lastEvent = time.Now()
+	self.lock.Unlock()
+
+	logrus.Infof("got tx close seq: %d", seq)
 }
 
 func (self *closer) readyToClose() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	if (self.txCloseSeq != notClosed || self.rxCloseSeq != notClosed) && time.Since(self.lastEvent).Milliseconds() > 15000 {
 		return true
 	} else {
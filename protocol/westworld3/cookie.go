@@ -0,0 +1,60 @@
+package westworld3
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+const cookieTimestampSz = 8
+const cookieMacSz = 16
+const cookieSz = cookieTimestampSz + cookieMacSz
+
+type cookieJar struct {
+	key      []byte
+	lifetime time.Duration
+}
+
+func newCookieJar(lifetimeMs int) (*cookieJar, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "cookie key")
+	}
+	return &cookieJar{key: key, lifetime: time.Duration(lifetimeMs) * time.Millisecond}, nil
+}
+
+func (self *cookieJar) issue(peer *net.UDPAddr) []byte {
+	return self.bake(peer, time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+func (self *cookieJar) verify(peer *net.UDPAddr, cookie []byte) bool {
+	if len(cookie) != cookieSz {
+		return false
+	}
+	issuedMs := util.ReadInt64(cookie)
+	age := time.Now().Sub(time.Unix(0, issuedMs*int64(time.Millisecond)))
+	if age < -time.Second || age > self.lifetime {
+		return false
+	}
+	return hmac.Equal(cookie, self.bake(peer, issuedMs))
+}
+
+func (self *cookieJar) bake(peer *net.UDPAddr, issuedMs int64) []byte {
+	cookie := make([]byte, cookieSz)
+	util.WriteInt64(cookie, issuedMs)
+
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write(canonicalIP(peer.IP))
+	port := make([]byte, 2)
+	util.WriteUint16(port, uint16(peer.Port))
+	mac.Write(port)
+	mac.Write([]byte(peer.Zone))
+	mac.Write(cookie[:cookieTimestampSz])
+	copy(cookie[cookieTimestampSz:], mac.Sum(nil))
+
+	return cookie
+}
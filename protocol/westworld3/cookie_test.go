@@ -0,0 +1,48 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar, err := newCookieJar(5000)
+	assert.NoError(t, err)
+
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	cookie := jar.issue(peer)
+	assert.Equal(t, cookieSz, len(cookie))
+	assert.True(t, jar.verify(peer, cookie))
+	assert.True(t, jar.verify(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6262}, cookie))
+
+	assert.False(t, jar.verify(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}, cookie))
+	assert.False(t, jar.verify(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6263}, cookie))
+	assert.False(t, jar.verify(peer, cookie[:cookieSz-1]))
+
+	tampered := append([]byte{}, cookie...)
+	tampered[cookieSz-1] ^= 0xFF
+	assert.False(t, jar.verify(peer, tampered))
+
+	otherJar, err := newCookieJar(5000)
+	assert.NoError(t, err)
+	assert.False(t, otherJar.verify(peer, cookie))
+}
+
+func TestCookieJarExpiry(t *testing.T) {
+	jar, err := newCookieJar(1000)
+	assert.NoError(t, err)
+
+	peer := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6262}
+	stale := jar.bake(peer, time.Now().Add(-2*time.Second).UnixNano()/int64(time.Millisecond))
+	assert.False(t, jar.verify(peer, stale))
+	future := jar.bake(peer, time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond))
+	assert.False(t, jar.verify(peer, future))
+
+	// the timestamp is covered by the mac
+	forged := jar.issue(peer)
+	util.WriteInt64(forged, util.ReadInt64(forged)-1)
+	assert.False(t, jar.verify(peer, forged))
+}
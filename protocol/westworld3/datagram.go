@@ -0,0 +1,16 @@
+package westworld3
+
+import (
+	"net"
+	"time"
+)
+
+// datagramConn is the subset of *net.UDPConn used by westworld3. It allows the protocol machinery to run over
+// alternative datagram implementations (network emulation in tests, for example).
+type datagramConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
@@ -0,0 +1,78 @@
+package westworld3
+
+import (
+	"sync"
+	"time"
+)
+
+type deadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+	wake   func()
+}
+
+func newDeadline(wake func()) *deadline {
+	return &deadline{cancel: make(chan struct{}), wake: wake}
+}
+
+func (self *deadline) set(t time.Time) {
+	expiredNow := false
+
+	self.lock.Lock()
+	if self.timer != nil && !self.timer.Stop() {
+		<-self.cancel // timer fired; wait for it to close the channel
+	}
+	self.timer = nil
+
+	closed := isClosed(self.cancel)
+	if t.IsZero() {
+		if closed {
+			self.cancel = make(chan struct{})
+		}
+
+	} else if until := time.Until(t); until > 0 {
+		if closed {
+			self.cancel = make(chan struct{})
+		}
+		cancel := self.cancel
+		self.timer = time.AfterFunc(until, func() {
+			close(cancel)
+			self.expire()
+		})
+
+	} else if !closed {
+		close(self.cancel)
+		expiredNow = true
+	}
+	self.lock.Unlock()
+
+	if expiredNow {
+		self.expire()
+	}
+}
+
+func (self *deadline) wait() chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.cancel
+}
+
+func (self *deadline) expired() bool {
+	return isClosed(self.wait())
+}
+
+func (self *deadline) expire() {
+	if self.wake != nil {
+		self.wake()
+	}
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
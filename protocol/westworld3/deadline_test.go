@@ -0,0 +1,70 @@
+package westworld3
+
+import (
+	"errors"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadDeadline(t *testing.T) {
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+
+	start := time.Now()
+	assert.NoError(t, accepted.SetReadDeadline(start.Add(100*time.Millisecond)))
+	_, err := accepted.Read(make([]byte, 1024))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	_, err = accepted.Read(make([]byte, 1024))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	assert.NoError(t, accepted.SetReadDeadline(time.Time{}))
+	_, err = dialed.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestReadDeadlineExtended(t *testing.T) {
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(5*time.Second)))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := dialed.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(accepted, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestWriteDeadline(t *testing.T) {
+	dialed, _, _ := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+
+	assert.NoError(t, dialed.SetWriteDeadline(time.Now().Add(-time.Second)))
+	n, err := dialed.Write([]byte("hello"))
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// nobody reads on the accepted side, so the portal eventually fills and the write blocks
+	data := make([]byte, 32*1024*1024)
+	start := time.Now()
+	assert.NoError(t, dialed.SetDeadline(start.Add(500*time.Millisecond)))
+	n, err = dialed.Write(data)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Less(t, n, len(data))
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
@@ -1,36 +1,234 @@
 package westworld3
 
 import (
+	"context"
 	"github.com/pkg/errors"
 	"net"
+	"strings"
+	"sync"
 )
 
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	profileId byte
+	localAddr *net.UDPAddr
+	iface     string
+	resolver  *net.Resolver
+}
+
+func WithProfile(profileId byte) DialOption {
+	return func(o *dialOptions) {
+		o.profileId = profileId
+	}
+}
+
+func WithLocalAddr(addr *net.UDPAddr) DialOption {
+	return func(o *dialOptions) {
+		o.localAddr = addr
+	}
+}
+
+func WithInterface(name string) DialOption {
+	return func(o *dialOptions) {
+		o.iface = name
+	}
+}
+
+func WithResolver(resolver *net.Resolver) DialOption {
+	return func(o *dialOptions) {
+		o.resolver = resolver
+	}
+}
+
 func Dial(addr *net.UDPAddr, profileId byte) (conn net.Conn, err error) {
+	return dialUDP(context.Background(), addr, nil, profileId)
+}
+
+func DialContext(ctx context.Context, network, address string, opts ...DialOption) (net.Conn, error) {
+	options := &dialOptions{resolver: net.DefaultResolver}
+	for _, opt := range opts {
+		opt(options)
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errors.Errorf("unsupported network [%s]", network)
+	}
+	if options.localAddr != nil && options.iface != "" {
+		return nil, errors.New("local address and interface are mutually exclusive")
+	}
+
+	addr, err := resolveUDPAddr(ctx, options.resolver, network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve")
+	}
+	localAddr := options.localAddr
+	if options.iface != "" {
+		if localAddr, err = interfaceAddr(options.iface, addr); err != nil {
+			return nil, errors.Wrap(err, "interface")
+		}
+	}
+
+	return dialUDP(ctx, addr, localAddr, options.profileId)
+}
+
+func dialUDP(ctx context.Context, addr, localAddr *net.UDPAddr, profileId byte) (net.Conn, error) {
 	profile, found := profileRegistry[profileId]
 	if !found {
 		return nil, errors.Errorf("no profile [%d]", profileId)
 	}
 
-	var lConn *net.UDPConn
-	lConn, err = net.ListenUDP("udp", nil)
+	lConn, err := net.ListenUDP(udpNetwork(addr), localAddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "listen")
 	}
 	if err := lConn.SetReadBuffer(profile.RxBufferSz); err != nil {
+		_ = lConn.Close()
 		return nil, errors.Wrap(err, "rx buffer")
 	}
 	if err := lConn.SetWriteBuffer(profile.TxBufferSz); err != nil {
+		_ = lConn.Close()
 		return nil, errors.Wrap(err, "tx buffer")
 	}
+	if profile.PmtuDiscovery {
+		if err := setDontFragment(lConn); err != nil {
+			_ = lConn.Close()
+			return nil, errors.Wrap(err, "dont fragment")
+		}
+	}
+
+	dConn := newDatagramConn(lConn, profile)
+
+	conn, err := dial(ctx, dConn, addr, profile)
+	if err != nil {
+		_ = dConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	var dConn *dialerConn
-	dConn, err = newDialerConn(lConn, addr, profile)
+func dial(ctx context.Context, conn datagramConn, addr *net.UDPAddr, profile *Profile) (net.Conn, error) {
+	dConn, err := newDialerConn(conn, addr, profile)
 	if err != nil {
 		return nil, errors.Wrap(err, "create dialer conn")
 	}
-	if err = dConn.hello(); err != nil {
+
+	// closing the conn is the only way to unblock a pending read on every datagramConn
+	var lock sync.Mutex
+	finished := false
+	interrupted := false
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			lock.Lock()
+			if !finished {
+				interrupted = true
+				_ = conn.Close()
+			}
+			lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	err = dConn.hello(ctx)
+
+	lock.Lock()
+	finished = true
+	lock.Unlock()
+
+	if interrupted {
+		err = ctx.Err()
+	}
+	if err != nil {
+		dConn.closer.emergencyStop()
 		return nil, errors.Wrap(err, "hello")
 	}
 
 	return dConn, nil
 }
+
+func resolveUDPAddr(ctx context.Context, resolver *net.Resolver, network, address string) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := resolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	if ip, zone := splitZone(host); net.ParseIP(ip) != nil {
+		addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port, Zone: zone}
+		if !matchesNetwork(network, addr.IP) {
+			return nil, errors.Errorf("address [%s] does not match network [%s]", address, network)
+		}
+		return addr, nil
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if matchesNetwork(network, ip.IP) {
+			return &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}, nil
+		}
+	}
+	return nil, errors.Errorf("no [%s] addresses for [%s]", network, host)
+}
+
+func interfaceAddr(name string, peer *net.UDPAddr) (*net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	peerIs4 := peer.IP.To4() != nil
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != peerIs4 {
+			continue
+		}
+		if !peerIs4 && ipNet.IP.IsLinkLocalUnicast() != peer.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		local := &net.UDPAddr{IP: ipNet.IP}
+		if ipNet.IP.IsLinkLocalUnicast() && !peerIs4 {
+			local.Zone = name
+		}
+		return local, nil
+	}
+	return nil, errors.Errorf("no address on [%s] for peer [%s]", name, peer)
+}
+
+func matchesNetwork(network string, ip net.IP) bool {
+	switch network {
+	case "udp4":
+		return ip.To4() != nil
+	case "udp6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+func splitZone(host string) (string, string) {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	if addr.IP.To16() != nil {
+		return "udp6"
+	}
+	return "udp"
+}
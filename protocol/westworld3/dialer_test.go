@@ -0,0 +1,72 @@
+package westworld3
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialContextCancelledDuringHello(t *testing.T) {
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer func() { _ = silent.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = DialContext(ctx, "udp4", silent.LocalAddr().String())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = DialContext(ctx, "udp4", silent.LocalAddr().String())
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
+
+func TestDialContextResolvesAndBinds(t *testing.T) {
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	port := strconv.Itoa(l.Addr().(*net.UDPAddr).Port)
+
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	dialed, err := DialContext(context.Background(), "udp4", net.JoinHostPort("localhost", port), WithLocalAddr(local), WithProfile(0))
+	assert.NoError(t, err)
+	accepted, err := l.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, dialed.LocalAddr().String(), accepted.RemoteAddr().String())
+
+	go func() {
+		_, err := dialed.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	if _, err := net.InterfaceByName("lo"); err == nil {
+		dialed, err := DialContext(context.Background(), "udp4", l.Addr().String(), WithInterface("lo"))
+		assert.NoError(t, err)
+		assert.True(t, dialed.LocalAddr().(*net.UDPAddr).IP.IsLoopback())
+		_, err = l.Accept()
+		assert.NoError(t, err)
+	}
+}
+
+func TestDialContextOptions(t *testing.T) {
+	_, err := DialContext(context.Background(), "tcp", "127.0.0.1:6262")
+	assert.Error(t, err)
+	_, err = DialContext(context.Background(), "udp4", "[::1]:6262")
+	assert.Error(t, err)
+	_, err = DialContext(context.Background(), "udp", "127.0.0.1:6262", WithLocalAddr(&net.UDPAddr{}), WithInterface("lo"))
+	assert.Error(t, err)
+	_, err = DialContext(context.Background(), "udp", "127.0.0.1:6262", WithProfile(254))
+	assert.Error(t, err)
+}
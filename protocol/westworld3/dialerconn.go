@@ -1,20 +1,20 @@
 package westworld3
 
 import (
-	"crypto/rand"
+	"context"
 	"fmt"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"math"
-	"math/big"
+	"io"
 	"net"
 	"time"
 )
 
 type dialerConn struct {
-	conn     *net.UDPConn
+	conn     datagramConn
 	peer     *net.UDPAddr
+	path     *path
 	seq      *util.Sequence
 	txPortal *txPortal
 	rxPortal *rxPortal
@@ -24,30 +24,30 @@ type dialerConn struct {
 	ii       InstrumentInstance
 }
 
-func newDialerConn(conn *net.UDPConn, peer *net.UDPAddr, profile *Profile) (*dialerConn, error) {
-	sSeq := int64(0)
-	if profile.RandomizeSeq {
-		randSeq, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
-		if err != nil {
-			return nil, errors.Wrap(err, "random sequence")
-		}
-		sSeq = randSeq.Int64()
+func newDialerConn(conn datagramConn, peer *net.UDPAddr, profile *Profile) (*dialerConn, error) {
+	sSeq, err := profile.startSeq()
+	if err != nil {
+		return nil, err
 	}
 	dc := &dialerConn{
 		conn:    conn,
 		peer:    peer,
-		seq:     util.NewSequence(int32(sSeq)),
+		path:    newPath(conn, peer),
+		seq:     util.NewSequence(sSeq),
 		profile: profile,
 	}
 	id := fmt.Sprintf("dialerConn_%s_%s", conn.LocalAddr(), peer)
 	dc.ii = profile.i.NewInstance(id, peer)
-	dc.pool = newPool(id, uint32(dataStart+profile.MaxSegmentSz), dc.ii)
+	dc.pool = newPool(id, profile.maxDatagramSz(), dc.ii)
 	closeHook := func() {
 		dc.ii.Shutdown()
 	}
 	dc.closer = newCloser(dc.seq, dc.profile, closeHook)
-	dc.txPortal = newTxPortal(conn, peer, dc.closer, profile, dc.pool, dc.ii)
-	dc.rxPortal = newRxPortal(conn, peer, dc.txPortal, dc.seq, dc.closer, profile, dc.ii)
+	if dc.txPortal, err = newTxPortal(dc.path, dc.closer, profile, dc.pool, dc.ii); err != nil {
+		return nil, errors.Wrap(err, "tx portal")
+	}
+	dc.rxPortal = newRxPortal(dc.path, dc.txPortal, dc.seq, dc.closer, profile, dc.ii)
+	dc.txPortal.rxPortal = dc.rxPortal
 	dc.closer.txPortal = dc.txPortal
 	dc.closer.rxPortal = dc.rxPortal
 	return dc, nil
@@ -57,6 +57,11 @@ func (self *dialerConn) Read(p []byte) (int, error) {
 	return self.rxPortal.read(p)
 }
 
+// WriteTo implements io.WriterTo, allowing io.Copy to write received data straight from the wire buffers.
+func (self *dialerConn) WriteTo(w io.Writer) (int64, error) {
+	return self.rxPortal.writeTo(w)
+}
+
 func (self *dialerConn) Write(p []byte) (int, error) {
 	return self.txPortal.tx(p, self.seq)
 }
@@ -74,16 +79,20 @@ func (self *dialerConn) LocalAddr() net.Addr {
 	return self.conn.LocalAddr()
 }
 
-func (self *dialerConn) SetDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetDeadline(t time.Time) error {
+	self.rxPortal.deadline.set(t)
+	self.txPortal.deadline.set(t)
+	return nil
 }
 
-func (self *dialerConn) SetReadDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetReadDeadline(t time.Time) error {
+	self.rxPortal.deadline.set(t)
+	return nil
 }
 
-func (self *dialerConn) SetWriteDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetWriteDeadline(t time.Time) error {
+	self.txPortal.deadline.set(t)
+	return nil
 }
 
 func (self *dialerConn) rxer() {
@@ -92,6 +101,11 @@ func (self *dialerConn) rxer() {
 
 	for {
 		wm, peer, err := readWireMessage(self.conn, self.pool)
+		if errors.Is(err, errMalformed) {
+			logrus.Errorf("error decoding (%v)", err)
+			self.ii.ReadError(peer, err)
+			continue
+		}
 		if err != nil {
 			logrus.Errorf("error reading (%v)", err)
 			self.ii.ReadError(self.peer, err)
@@ -102,14 +116,6 @@ func (self *dialerConn) rxer() {
 
 		switch wm.messageType() {
 		case DATA:
-			_, rttTs, err := wm.asData()
-			if err != nil {
-				logrus.Errorf("as data error (%v)", err)
-				continue
-			}
-			if rttTs != nil {
-				self.txPortal.rtt(*rttTs)
-			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error rx-ing (%v)", err)
 				continue
@@ -122,7 +128,7 @@ func (self *dialerConn) rxer() {
 				continue
 			}
 			if rttTs != nil {
-				self.txPortal.rtt(*rttTs)
+				self.txPortal.rtt(rttTs)
 			}
 			self.txPortal.updateRxPortalSz(int(rxPortalSz))
 			if err := self.txPortal.ack(acks); err != nil {
@@ -133,6 +139,11 @@ func (self *dialerConn) rxer() {
 			wm.buffer.unref()
 
 		case KEEPALIVE:
+			if wm.hasFlag(PMTU) {
+				self.txPortal.rxPmtuProbe(wm)
+				wm.buffer.unref()
+				continue
+			}
 			rxPortalSz, err := wm.asKeepalive()
 			if err != nil {
 				logrus.Errorf("as keepalive error (%v)", err)
@@ -151,6 +162,24 @@ func (self *dialerConn) rxer() {
 				logrus.Errorf("error rx-ing close (%v)", err)
 			}
 
+		case PATH_CHALLENGE:
+			token, err := wm.asPathToken()
+			if err != nil {
+				logrus.Errorf("as path challenge error (%v)", err)
+				wm.buffer.unref()
+				continue
+			}
+			if response, err := newPathResponse(token, self.pool); err == nil {
+				if err := self.path.write(response); err != nil {
+					logrus.Errorf("error sending path response (%v)", err)
+				}
+				self.ii.WireMessageTx(self.peer, response)
+				response.buffer.unref()
+			} else {
+				logrus.Errorf("error creating path response (%v)", err)
+			}
+			wm.buffer.unref()
+
 		default:
 			logrus.Errorf("unexpected message type: %d", wm.mt)
 			self.ii.UnexpectedMessageType(peer, wm.mt)
@@ -159,67 +188,62 @@ func (self *dialerConn) rxer() {
 	}
 }
 
-func (self *dialerConn) hello() error {
+func (self *dialerConn) hello(ctx context.Context) error {
 	logrus.Infof("starting hello process")
 	defer logrus.Infof("completed hello process")
 
+	version := protocolVersion
+	if self.profile.RttProbeUs {
+		version = protocolVersionRttUs
+	}
+
 	helloSeq := self.seq.Next()
-	hello, err := newHello(helloSeq, hello{protocolVersion, 0}, nil, self.pool)
+	helloWm, err := newHello(helloSeq, hello{version, 0, 0, ackDelayMs(self.profile)}, nil, self.pool)
 	if err != nil {
 		return errors.Wrap(err, "error creating hello message")
 	}
-	defer hello.buffer.unref()
+	defer func() { helloWm.buffer.unref() }()
 
 	count := 0
 	for {
-		if err := writeWireMessage(hello, self.conn, self.peer); err != nil {
+		if err := self.path.write(helloWm); err != nil {
 			return errors.Wrap(err, "write hello")
 		}
-		self.ii.WireMessageTx(self.peer, hello)
+		self.ii.WireMessageTx(self.peer, helloWm)
 
-		if err := self.conn.SetReadDeadline(time.Now().Add(time.Duration(self.profile.ConnectionSetupTimeoutMs) * time.Millisecond)); err != nil {
+		readDeadline := time.Now().Add(time.Duration(self.profile.ConnectionSetupTimeoutMs) * time.Millisecond)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(readDeadline) {
+			readDeadline = ctxDeadline
+		}
+		if err := self.conn.SetReadDeadline(readDeadline); err != nil {
 			return errors.Wrap(err, "set read deadline")
 		}
 
 		helloAck, peer, err := readWireMessage(self.conn, self.pool)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ctxDeadline, ok := ctx.Deadline(); ok && !time.Now().Before(ctxDeadline) {
+				return context.DeadlineExceeded
+			}
 			return errors.Wrap(err, "read hello ack")
 		}
 		self.ii.WireMessageRx(peer, helloAck)
-		defer helloAck.buffer.unref()
-
-		if err := self.conn.SetReadDeadline(time.Time{}); err != nil {
-			return errors.Wrap(err, "clear read deadline")
-		}
 
-		h, acks, err := helloAck.asHello()
+		cookieHello, done, err := self.helloResponse(helloAck, helloSeq, version)
+		helloAck.buffer.unref()
 		if err != nil {
-			return errors.Wrap(err, "unexpected response")
-		}
-
-		if h.version != protocolVersion {
-			return errors.New("unexpected protocol version")
+			return err
 		}
-
-		if len(acks) == 1 && acks[0].Start == acks[0].End && acks[0].Start == helloSeq {
-			// Set next highest sequence
-			self.rxPortal.setAccepted(helloAck.seq)
-
-			finalAcks := []Ack{{helloAck.seq, helloAck.seq}}
-			finalAck, err := newAck(finalAcks, 0, nil, self.pool)
-			if err != nil {
-				return errors.Wrap(err, "new final ack")
-			}
-			if err := writeWireMessage(finalAck, self.conn, self.peer); err != nil {
-				return errors.Wrap(err, "write final ack")
-			}
-			self.ii.WireMessageTx(self.peer, finalAck)
-
-			go self.rxer()
-			go self.txPortal.start()
-			go self.closer.run()
+		if done {
 			return nil
 		}
+		if cookieHello != nil {
+			// listener requires a cookie; echo it back with our hello
+			helloWm.buffer.unref()
+			helloWm = cookieHello
+		}
 
 		count++
 		if count > 5 {
@@ -229,3 +253,67 @@ func (self *dialerConn) hello() error {
 		}
 	}
 }
+
+// helloResponse handles a listener's response to our hello. It returns a hello carrying the listener's cookie when
+// the listener asks for one, or done once the connection is established.
+func (self *dialerConn) helloResponse(helloAck *wireMessage, helloSeq int32, version uint32) (cookieHello *wireMessage, done bool, err error) {
+	if err := self.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, false, errors.Wrap(err, "clear read deadline")
+	}
+
+	if helloAck.messageType() == REJECT {
+		reason, err := helloAck.asReject()
+		if err != nil {
+			return nil, false, errors.Wrap(err, "unexpected reject")
+		}
+		err = errors.Errorf("connection rejected (%s)", reason)
+		self.ii.ConnectionError(self.peer, err)
+		return nil, false, err
+	}
+
+	h, acks, err := helloAck.asHello()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "unexpected response")
+	}
+
+	if h.version != protocolVersion && h.version != version {
+		return nil, false, errors.New("unexpected protocol version")
+	}
+
+	if helloAck.hasFlag(COOKIE) {
+		cookie, err := helloAck.asHelloCookie()
+		if err != nil {
+			return nil, false, errors.Wrap(err, "unexpected cookie")
+		}
+		cookieHello, err := newHelloCookie(helloSeq, hello{version, 0, 0, ackDelayMs(self.profile)}, cookie, self.pool)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "error creating cookie hello message")
+		}
+		return cookieHello, false, nil
+	}
+
+	if len(acks) == 1 && acks[0].Start == acks[0].End && acks[0].Start == helloSeq {
+		// Set next highest sequence
+		self.rxPortal.setAccepted(helloAck.seq)
+		self.path.connId = h.connId
+		self.txPortal.wideRtt = h.version == protocolVersionRttUs
+		self.txPortal.monitor.peerAckDelayMs = int(h.ackDelayMs)
+
+		finalAcks := []Ack{{helloAck.seq, helloAck.seq}}
+		finalAck, err := newAck(finalAcks, 0, nil, self.pool)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "new final ack")
+		}
+		if err := self.path.write(finalAck); err != nil {
+			return nil, false, errors.Wrap(err, "write final ack")
+		}
+		self.ii.WireMessageTx(self.peer, finalAck)
+
+		go self.rxer()
+		go self.txPortal.start()
+		go self.closer.run()
+		return nil, true, nil
+	}
+
+	return nil, false, nil
+}
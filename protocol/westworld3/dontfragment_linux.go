@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package westworld3
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the DF bit on outbound datagrams, and disables the kernel's own path MTU discovery, so that
+// oversized probes are dropped rather than fragmented.
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "syscall conn")
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		v4Err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		v6Err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		// dual-stack sockets accept both options; single-stack sockets only need to accept their own
+		if v4Err != nil && v6Err != nil {
+			sockErr = v4Err
+		}
+	}); err != nil {
+		return errors.Wrap(err, "control")
+	}
+	if sockErr != nil {
+		return errors.Wrap(sockErr, "set mtu discover")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package westworld3
+
+import "net"
+
+// setDontFragment is only supported on linux; elsewhere, probes are subject to the platform's fragmentation defaults.
+func setDontFragment(*net.UDPConn) error {
+	return nil
+}
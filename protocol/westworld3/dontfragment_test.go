@@ -0,0 +1,16 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestSetDontFragment(t *testing.T) {
+	for _, network := range []string{"udp", "udp4"} {
+		conn, err := net.ListenUDP(network, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, setDontFragment(conn), network)
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,592 @@
+package westworld3
+
+import (
+	"bytes"
+	"context"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type emulatedNetwork struct {
+	lock  sync.Mutex
+	conns map[string]*emulatedUDPConn
+}
+
+func newEmulatedNetwork() *emulatedNetwork {
+	return &emulatedNetwork{conns: make(map[string]*emulatedUDPConn)}
+}
+
+// bind creates an emulatedUDPConn at addr. Datagrams arriving at the conn are subject to the inbound weather.
+func (self *emulatedNetwork) bind(addr *net.UDPAddr, inbound *util.EmulatorConfig) *emulatedUDPConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	conn := &emulatedUDPConn{network: self, addr: addr, link: util.NewEmulatedLink(inbound)}
+	self.conns[addr.String()] = conn
+	return conn
+}
+
+func (self *emulatedNetwork) lookup(addr *net.UDPAddr) *emulatedUDPConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.conns[addr.String()]
+}
+
+type emulatedUDPConn struct {
+	network      *emulatedNetwork
+	addr         *net.UDPAddr
+	link         *util.EmulatedLink
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func (self *emulatedUDPConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	self.lock.Lock()
+	deadline := self.readDeadline
+	self.lock.Unlock()
+
+	datagram, err := self.link.Receive(deadline)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(datagram.Data) > len(b) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	return copy(b, datagram.Data), datagram.Source.(*net.UDPAddr), nil
+}
+
+func (self *emulatedUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	peer := self.network.lookup(addr)
+	if peer == nil {
+		// nothing bound at addr; the datagram is lost, as it would be on a real network
+		return len(b), nil
+	}
+	if err := peer.link.Send(b, self.LocalAddr()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (self *emulatedUDPConn) LocalAddr() net.Addr {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.addr
+}
+
+// rebind moves the conn to a new address, as a NAT rebinding would.
+func (self *emulatedUDPConn) rebind(addr *net.UDPAddr) {
+	self.network.lock.Lock()
+	self.lock.Lock()
+	delete(self.network.conns, self.addr.String())
+	self.addr = addr
+	self.network.conns[addr.String()] = self
+	self.lock.Unlock()
+	self.network.lock.Unlock()
+}
+
+func (self *emulatedUDPConn) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.readDeadline = t
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *emulatedUDPConn) Close() error {
+	self.network.lock.Lock()
+	delete(self.network.conns, self.LocalAddr().String())
+	self.network.lock.Unlock()
+	self.link.Close()
+	return nil
+}
+
+type countingInstrument struct {
+	ii *countingInstrumentInstance
+}
+
+func (self *countingInstrument) NewInstance(string, *net.UDPAddr) InstrumentInstance {
+	return self.ii
+}
+
+type countingInstrumentInstance struct {
+	nilInstrumentInstance
+	lock             sync.Mutex
+	retx             int
+	dupAcks          int
+	fastRetx         int
+	timeoutRetx      int
+	maxCapacity      int
+	maxPacingRate    int
+	maxSegmentSz     int
+	txAcks           int
+	outOfWindowRx    int
+	dataTx           []time.Time
+	connectionErrors []error
+}
+
+func (self *countingInstrumentInstance) WireMessageTx(_ *net.UDPAddr, wm *wireMessage) {
+	if wm.messageType() == DATA {
+		self.lock.Lock()
+		self.dataTx = append(self.dataTx, time.Now())
+		self.lock.Unlock()
+	}
+}
+
+// maxDataTxPerMs returns the largest number of DATA segments first transmitted within any one millisecond, over the
+// second half of the transfer.
+func (self *countingInstrumentInstance) maxDataTxPerMs() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	txs := self.dataTx[len(self.dataTx)/2:]
+	max := 0
+	for i, j := 0, 0; i < len(txs); i++ {
+		for txs[i].Sub(txs[j]) > time.Millisecond {
+			j++
+		}
+		if i-j+1 > max {
+			max = i - j + 1
+		}
+	}
+	return max
+}
+
+func (self *countingInstrumentInstance) TxAck(*net.UDPAddr, *wireMessage) {
+	self.lock.Lock()
+	self.txAcks++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) OutOfWindowRx(*net.UDPAddr, *wireMessage) {
+	self.lock.Lock()
+	self.outOfWindowRx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) WireMessageRetx(*net.UDPAddr, *wireMessage) {
+	self.lock.Lock()
+	self.retx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) DuplicateAck(*net.UDPAddr, int32) {
+	self.lock.Lock()
+	self.dupAcks++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) FastRetransmit(*net.UDPAddr, *wireMessage) {
+	self.lock.Lock()
+	self.fastRetx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) TimeoutRetransmit(*net.UDPAddr, *wireMessage) {
+	self.lock.Lock()
+	self.timeoutRetx++
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) ConnectionError(_ *net.UDPAddr, err error) {
+	self.lock.Lock()
+	self.connectionErrors = append(self.connectionErrors, err)
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) PacingRateChanged(_ *net.UDPAddr, bytesPerSec int) {
+	self.lock.Lock()
+	if bytesPerSec > self.maxPacingRate {
+		self.maxPacingRate = bytesPerSec
+	}
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) MaxSegmentSzChanged(_ *net.UDPAddr, maxSegmentSz int) {
+	self.lock.Lock()
+	self.maxSegmentSz = maxSegmentSz
+	self.lock.Unlock()
+}
+
+func (self *countingInstrumentInstance) TxPortalCapacityChanged(_ *net.UDPAddr, capacity int) {
+	self.lock.Lock()
+	if capacity > self.maxCapacity {
+		self.maxCapacity = capacity
+	}
+	self.lock.Unlock()
+}
+
+// emulatedPair dials a listener across an emulated network, returning the dialed and accepted connections.
+func emulatedPair(t *testing.T, toListener, toDialer *util.EmulatorConfig, listenerProfile, dialerProfile *Profile) (net.Conn, net.Conn, *listener) {
+	network := newEmulatedNetwork()
+	listenerAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	dialerAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}
+
+	l, err := listen(network.bind(listenerAddr, toListener), listenerAddr, listenerProfile, 0)
+	assert.NoError(t, err)
+
+	dialed, err := dial(context.Background(), network.bind(dialerAddr, toDialer), listenerAddr, dialerProfile)
+	assert.NoError(t, err)
+	accepted, err := l.Accept()
+	assert.NoError(t, err)
+
+	return dialed, accepted, l
+}
+
+// emulatedTransfer transfers sz bytes from the dialer to the listener across an emulated network. The returned
+// instrument instance observes the dialer (transmitting) side.
+func emulatedTransfer(t *testing.T, toListener, toDialer *util.EmulatorConfig, sz int) *countingInstrumentInstance {
+	return emulatedProfileTransfer(t, toListener, toDialer, NewBaselineProfile(), sz)
+}
+
+func emulatedProfileTransfer(t *testing.T, toListener, toDialer *util.EmulatorConfig, dialerProfile *Profile, sz int) *countingInstrumentInstance {
+	ii := &countingInstrumentInstance{}
+	dialerProfile.i = &countingInstrument{ii}
+	dialed, accepted, _ := emulatedPair(t, toListener, toDialer, NewBaselineProfile(), dialerProfile)
+
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, sz)
+	_, err := io.ReadFull(accepted, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	return ii
+}
+
+func TestEmulatedLossless(t *testing.T) {
+	ii := emulatedTransfer(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), 8*1024*1024)
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.maxCapacity, NewBaselineProfile().TxPortalStartSz)
+}
+
+func TestEmulatedRetransmission(t *testing.T) {
+	toListener := util.NewEmulatorConfig(3)
+	toListener.LossRate = 0.01
+	toListener.ReorderRate = 0.01
+	toDialer := util.NewEmulatorConfig(4)
+	toDialer.LossRate = 0.01
+	ii := emulatedTransfer(t, toListener, toDialer, 512*1024)
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.retx, 0)
+}
+
+func TestEmulatedFastRetransmission(t *testing.T) {
+	for _, fastRetxThresh := range []int{3, 0} {
+		dialerProfile := NewBaselineProfile()
+		dialerProfile.FastRetxThresh = fastRetxThresh
+		toListener := util.NewEmulatorConfig(30)
+		toListener.LossRate = 0.01
+		ii := emulatedProfileTransfer(t, toListener, util.NewEmulatorConfig(31), dialerProfile, 1024*1024)
+
+		ii.lock.Lock()
+		if fastRetxThresh > 0 {
+			assert.Greater(t, ii.fastRetx, 0)
+		} else {
+			assert.Equal(t, 0, ii.fastRetx)
+			assert.Greater(t, ii.timeoutRetx, 0)
+		}
+		assert.Equal(t, ii.retx, ii.fastRetx+ii.timeoutRetx)
+		ii.lock.Unlock()
+	}
+}
+
+func TestEmulatedDuplicateAck(t *testing.T) {
+	toListener := util.NewEmulatorConfig(5)
+	toListener.DuplicateRate = 0.2
+	ii := emulatedTransfer(t, toListener, util.NewEmulatorConfig(6), 1024*1024)
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.dupAcks, 0)
+}
+
+func TestEmulatedSequenceWrap(t *testing.T) {
+	// both sides start just short of the wrap, so that sequences, acks and the trees span it
+	defer func(f func() (int32, error)) { randomSeq = f }(randomSeq)
+	randomSeq = func() (int32, error) { return math.MaxInt32 - 64, nil }
+
+	toListener := util.NewEmulatorConfig(40)
+	toListener.LossRate = 0.02
+	toListener.ReorderRate = 0.05
+	toListener.DuplicateRate = 0.02
+	toDialer := util.NewEmulatorConfig(41)
+	toDialer.LossRate = 0.02
+
+	ii := &countingInstrumentInstance{}
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.RandomizeSeq = true
+	listenerProfile.AckDelayMs = 5
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.RandomizeSeq = true
+	dialerProfile.AckDelayMs = 5
+	dialerProfile.i = &countingInstrument{ii}
+	dialed, accepted, _ := emulatedPair(t, toListener, toDialer, listenerProfile, dialerProfile)
+
+	sz := 512 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	go func() {
+		_, err := accepted.Write(data)
+		assert.NoError(t, err)
+	}()
+	for _, conn := range []net.Conn{accepted, dialed} {
+		received := make([]byte, sz)
+		_, err := io.ReadFull(conn, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+	}
+
+	assert.NoError(t, dialed.Close())
+	_, err := accepted.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.retx, 0)
+}
+
+func TestEmulatedKeepaliveRxPortalSz(t *testing.T) {
+	// a stale receiver buffer size, held by both sides, blocks the dialer with nothing in flight; only the listener's
+	// keepalives, which advertise its own (empty) buffer rather than echoing the stale size, can release it
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.ConnectionInactiveTimeoutMs = 2000
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.ConnectionInactiveTimeoutMs = 2000
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(42), util.NewEmulatorConfig(43), listenerProfile, dialerProfile)
+	dialed.(*dialerConn).txPortal.updateRxPortalSz(64 * 1024 * 1024)
+	accepted.(*listenerConn).txPortal.updateRxPortalSz(64 * 1024 * 1024)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(10*time.Second)))
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(accepted, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+}
+
+func TestEmulatedTxAlgorithms(t *testing.T) {
+	for i, name := range []string{"westworld3", "westworld", "bbr", "cubic"} {
+		t.Run(name, func(t *testing.T) {
+			txAlgorithm, err := NewTxAlgorithmProfile(name, nil)
+			assert.NoError(t, err)
+			dialerProfile := NewBaselineProfile()
+			dialerProfile.SetTxAlgorithm(txAlgorithm)
+
+			toListener := util.NewEmulatorConfig(int64(10 + i))
+			toListener.LossRate = 0.01
+			toListener.ReorderRate = 0.01
+			ii := emulatedProfileTransfer(t, toListener, util.NewEmulatorConfig(int64(20+i)), dialerProfile, 1024*1024)
+
+			ii.lock.Lock()
+			defer ii.lock.Unlock()
+			assert.Greater(t, ii.retx, 0)
+			if txAlgorithm != nil {
+				// the native portal only reports capacity after tx_portal_increase_thresh uninterrupted successes
+				assert.Greater(t, ii.maxCapacity, 0)
+			}
+		})
+	}
+}
+
+func TestEmulatedDelayedAcks(t *testing.T) {
+	for _, ackDelayMs := range []int{0, 5} {
+		ii := &countingInstrumentInstance{}
+		listenerProfile := NewBaselineProfile()
+		listenerProfile.AckDelayMs = ackDelayMs
+		listenerProfile.i = &countingInstrument{ii}
+		dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(7), util.NewEmulatorConfig(8), listenerProfile, NewBaselineProfile())
+
+		sz := 2 * 1024 * 1024
+		data := make([]byte, sz)
+		rand.New(rand.NewSource(1)).Read(data)
+		go func() {
+			_, err := dialed.Write(data)
+			assert.NoError(t, err)
+		}()
+		received := make([]byte, sz)
+		_, err := io.ReadFull(accepted, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+
+		segments := sz / NewBaselineProfile().MaxSegmentSz
+		ii.lock.Lock()
+		if ackDelayMs == 0 {
+			assert.GreaterOrEqual(t, ii.txAcks, segments)
+		} else {
+			assert.Less(t, ii.txAcks, segments/10)
+		}
+		ii.lock.Unlock()
+	}
+}
+
+func TestEmulatedRttProbeUsNegotiation(t *testing.T) {
+	for _, c := range []struct{ listener, dialer, wide bool }{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	} {
+		listenerProfile := NewBaselineProfile()
+		listenerProfile.RttProbeUs = c.listener
+		dialerProfile := NewBaselineProfile()
+		dialerProfile.RttProbeUs = c.dialer
+		dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(40), util.NewEmulatorConfig(41), listenerProfile, dialerProfile)
+		assert.Equal(t, c.wide, dialed.(*dialerConn).txPortal.wideRtt, "%+v", c)
+		assert.Equal(t, c.wide, accepted.(*listenerConn).txPortal.wideRtt, "%+v", c)
+
+		sz := 256 * 1024
+		data := make([]byte, sz)
+		rand.New(rand.NewSource(1)).Read(data)
+		go func() {
+			_, err := dialed.Write(data)
+			assert.NoError(t, err)
+		}()
+		received := make([]byte, sz)
+		_, err := io.ReadFull(accepted, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+	}
+}
+
+func TestEmulatedPacing(t *testing.T) {
+	// a fixed portal across a link with a shallow buffer, which overflows when a whole portal arrives at once
+	transfer := func(pacing bool) *countingInstrumentInstance {
+		dialerProfile := NewBaselineProfile()
+		dialerProfile.TxPacing = pacing
+		dialerProfile.TxPortalStartSz = 64 * 1024
+		dialerProfile.TxPortalMinSz = 64 * 1024
+		dialerProfile.TxPortalMaxSz = 64 * 1024
+		toListener := util.NewEmulatorConfig(50)
+		toListener.BandwidthBps = 64 * 1024 * 1024
+		toListener.QueueLen = 16
+		toDialer := util.NewEmulatorConfig(51)
+		toDialer.DelayMs = 5
+		return emulatedProfileTransfer(t, toListener, toDialer, dialerProfile, 1024*1024)
+	}
+	unpaced := transfer(false)
+	paced := transfer(true)
+
+	paced.lock.Lock()
+	assert.Greater(t, paced.maxPacingRate, 0)
+	pacedRetx := paced.retx
+	paced.lock.Unlock()
+	unpaced.lock.Lock()
+	unpacedRetx := unpaced.retx
+	unpaced.lock.Unlock()
+
+	// segments released by an ack are spaced out, rather than written back-to-back
+	assert.Less(t, paced.maxDataTxPerMs(), unpaced.maxDataTxPerMs()/2)
+	assert.Less(t, pacedRetx, unpacedRetx/2)
+}
+
+func TestEmulatedPmtuBlackHole(t *testing.T) {
+	ii := &countingInstrumentInstance{}
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.PmtuDiscovery = true
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.PmtuDiscovery = true
+	dialerProfile.PmtuProbeMs = 20
+	dialerProfile.i = &countingInstrument{ii}
+	toListener := util.NewEmulatorConfig(62)
+	toListener.MaxDatagramSz = 4000
+	toDialer := util.NewEmulatorConfig(63)
+	toDialer.MaxDatagramSz = 4000
+	dialed, accepted, l := emulatedPair(t, toListener, toDialer, listenerProfile, dialerProfile)
+	assert.Eventually(t, func() bool {
+		ii.lock.Lock()
+		defer ii.lock.Unlock()
+		return ii.maxSegmentSz > 4000-dataStart-4-pmtudResolution
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sz := 4 * 1024 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, sz)
+	_, err := io.ReadFull(accepted, received[:sz/4])
+	assert.NoError(t, err)
+
+	// the path shrinks with segments of the discovered size in flight, which can only be delivered in fragments
+	l.conn.(*emulatedUDPConn).link.SetMaxDatagramSz(1500)
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(30*time.Second)))
+	_, err = io.ReadFull(accepted, received[sz/4:])
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.LessOrEqual(t, ii.maxSegmentSz, 1500-dataStart-4)
+}
+
+func TestEmulatedPmtuDiscovery(t *testing.T) {
+	maxDatagramSz := 4000
+	// the search converges to the largest segment that fits the path's datagrams, when both peers are able to receive
+	// the probes; otherwise, the segment size remains at max_segment_sz
+	for _, listenerPmtud := range []bool{true, false} {
+		ii := &countingInstrumentInstance{}
+		listenerProfile := NewBaselineProfile()
+		listenerProfile.PmtuDiscovery = listenerPmtud
+		dialerProfile := NewBaselineProfile()
+		dialerProfile.PmtuDiscovery = true
+		dialerProfile.PmtuProbeMs = 20
+		dialerProfile.i = &countingInstrument{ii}
+		toListener := util.NewEmulatorConfig(60)
+		toListener.MaxDatagramSz = maxDatagramSz
+		toDialer := util.NewEmulatorConfig(61)
+		toDialer.MaxDatagramSz = maxDatagramSz
+		dialed, accepted, _ := emulatedPair(t, toListener, toDialer, listenerProfile, dialerProfile)
+
+		if listenerPmtud {
+			expected := maxDatagramSz - dataStart - 4
+			assert.Eventually(t, func() bool {
+				ii.lock.Lock()
+				defer ii.lock.Unlock()
+				return ii.maxSegmentSz > expected-pmtudResolution
+			}, 5*time.Second, 10*time.Millisecond)
+			ii.lock.Lock()
+			assert.LessOrEqual(t, ii.maxSegmentSz, expected)
+			ii.lock.Unlock()
+		} else {
+			time.Sleep(time.Duration(dialerProfile.PmtuMaxProbes*dialerProfile.PmtuProbeMs*4) * time.Millisecond)
+			ii.lock.Lock()
+			assert.Equal(t, 0, ii.maxSegmentSz)
+			ii.lock.Unlock()
+		}
+
+		sz := 1024 * 1024
+		data := make([]byte, sz)
+		rand.New(rand.NewSource(1)).Read(data)
+		go func() {
+			_, err := dialed.Write(data)
+			assert.NoError(t, err)
+		}()
+		received := make([]byte, sz)
+		_, err := io.ReadFull(accepted, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+	}
+}
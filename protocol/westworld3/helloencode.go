@@ -3,27 +3,46 @@ package westworld3
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
+	"math"
 )
 
+// hello carries the sender's protocol version, profile and connection id, followed by the longest that the sender
+// will delay its acks. A peer that predates the ack delay omits it, and is taken to ack immediately.
 type hello struct {
-	version uint32
-	profile uint8
+	version    uint32
+	profile    uint8
+	connId     uint32
+	ackDelayMs uint16
+}
+
+const helloMinSz = 9
+const helloSz = helloMinSz + 2
+
+func ackDelayMs(profile *Profile) uint16 {
+	return uint16(math.Min(float64(profile.AckDelayMs), math.MaxUint16))
 }
 
 func encodeHello(hello hello, data []byte) (n uint32, err error) {
 	dataSz := len(data)
-	if dataSz < 5 {
-		return 0, errors.Errorf("hello too large [%d < 5]", dataSz)
+	if dataSz < helloSz {
+		return 0, errors.Errorf("hello too large [%d < %d]", dataSz, helloSz)
 	}
 	util.WriteUint32(data, hello.version)
 	data[4] = hello.profile
-	return 5, nil
+	util.WriteUint32(data[5:], hello.connId)
+	util.WriteUint16(data[helloMinSz:], hello.ackDelayMs)
+	return helloSz, nil
 }
 
 func decodeHello(data []byte) (hello, uint32, error) {
 	dataSz := len(data)
-	if dataSz < 5 {
-		return hello{}, 0, errors.Errorf("short hello buffer [%d < 5]", dataSz)
+	if dataSz < helloMinSz {
+		return hello{}, 0, errors.Errorf("short hello buffer [%d < %d]", dataSz, helloMinSz)
+	}
+	h := hello{util.ReadUint32(data), data[4], util.ReadUint32(data[5:]), 0}
+	if dataSz < helloSz {
+		return h, helloMinSz, nil
 	}
-	return hello{util.ReadUint32(data), data[4]}, 5, nil
+	h.ackDelayMs = util.ReadUint16(data[helloMinSz:])
+	return h, helloSz, nil
 }
@@ -3,15 +3,16 @@ package westworld3
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/openziti/dilithium/util"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestHelloEncodeDecode(t *testing.T) {
-	data := make([]byte, 5)
-	sz, err := encodeHello(hello{9006, 0xF}, data)
+	data := make([]byte, helloSz)
+	sz, err := encodeHello(hello{9006, 0xF, 0xCAFEBABE, 250}, data)
 	assert.NoError(t, err)
-	assert.Equal(t, uint32(5), sz)
+	assert.Equal(t, uint32(helloSz), sz)
 
 	fmt.Println(hex.Dump(data))
 
@@ -19,4 +20,31 @@ func TestHelloEncodeDecode(t *testing.T) {
 	assert.NoError(t, err2)
 	assert.Equal(t, uint32(9006), outHello.version)
 	assert.Equal(t, uint8(0xF), outHello.profile)
+	assert.Equal(t, uint32(0xCAFEBABE), outHello.connId)
+	assert.Equal(t, uint16(250), outHello.ackDelayMs)
+}
+
+func TestHelloDecodeWithoutAckDelay(t *testing.T) {
+	data := make([]byte, helloSz)
+	_, err := encodeHello(hello{protocolVersion, 1, 0xCAFEBABE, 250}, data)
+	assert.NoError(t, err)
+
+	// a peer that predates the ack delay sends only the first helloMinSz bytes
+	outHello, sz, err := decodeHello(data[:helloMinSz])
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(helloMinSz), sz)
+	assert.Equal(t, hello{protocolVersion, 1, 0xCAFEBABE, 0}, outHello)
+}
+
+func TestHelloAdvertisesAckDelay(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.AckDelayMs = 5
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.AckDelayMs = 20
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), listenerProfile, dialerProfile)
+
+	// each side allows for the ack delay advertised by its peer, rather than its own
+	assert.Equal(t, 5, dialed.(*dialerConn).txPortal.monitor.peerAckDelayMs)
+	assert.Equal(t, 20, accepted.(*listenerConn).txPortal.monitor.peerAckDelayMs)
+	transferEmulated(t, dialed, accepted, 64*1024)
 }
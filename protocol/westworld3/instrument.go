@@ -38,10 +38,15 @@ type InstrumentInstance interface {
 	NewRetxMs(peer *net.UDPAddr, retxMs int)
 	NewRetxScale(peer *net.UDPAddr, retxScale float64)
 	DuplicateAck(peer *net.UDPAddr, ack int32)
+	FastRetransmit(peer *net.UDPAddr, wm *wireMessage)
+	TimeoutRetransmit(peer *net.UDPAddr, wm *wireMessage)
+	PacingRateChanged(peer *net.UDPAddr, bytesPerSec int)
+	MaxSegmentSzChanged(peer *net.UDPAddr, maxSegmentSz int)
 
 	// rxPortal
 	RxPortalSzChanged(peer *net.UDPAddr, capacity int)
 	DuplicateRx(peer *net.UDPAddr, wm *wireMessage)
+	OutOfWindowRx(peer *net.UDPAddr, wm *wireMessage)
 
 	// allocation
 	Allocate(id string)
@@ -1,12 +1,17 @@
 package westworld3
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
 	"github.com/emirpasic/gods/trees/btree"
+	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
 type listener struct {
@@ -14,10 +19,18 @@ type listener struct {
 	profile     *Profile
 	profileId   byte
 	peers       *btree.Tree
+	connIds     map[uint32]*listenerConn
+	removed     chan struct{}
 	acceptQueue chan net.Conn
-	conn        *net.UDPConn
+	conn        datagramConn
 	addr        *net.UDPAddr
 	pool        *pool
+	cookies     *cookieJar
+	limiter     *rateLimiter
+	reactor     *reactor
+	pending     int
+	closed      chan struct{}
+	closeOnce   sync.Once
 	ii          InstrumentInstance
 }
 
@@ -38,32 +51,67 @@ func Listen(addr *net.UDPAddr, profileId byte) (net.Listener, error) {
 	if err := conn.SetWriteBuffer(profile.TxBufferSz); err != nil {
 		return nil, errors.Wrap(err, "set tx buffer size")
 	}
+	if profile.PmtuDiscovery {
+		if err := setDontFragment(conn); err != nil {
+			return nil, errors.Wrap(err, "set dont fragment")
+		}
+	}
+	return listen(newDatagramConn(conn, profile), conn.LocalAddr().(*net.UDPAddr), profile, profileId)
+}
+
+func listen(conn datagramConn, addr *net.UDPAddr, profile *Profile, profileId byte) (*listener, error) {
 	l := &listener{
 		lock:        new(sync.Mutex),
 		profile:     profile,
 		profileId:   profileId,
 		peers:       btree.NewWith(profile.ListenerPeersTreeLen, addrComparator),
+		connIds:     make(map[uint32]*listenerConn),
+		removed:     make(chan struct{}, 1),
 		acceptQueue: make(chan net.Conn, profile.AcceptQueueLen),
 		conn:        conn,
 		addr:        addr,
+		closed:      make(chan struct{}),
+	}
+	if profile.HelloCookies {
+		cookies, err := newCookieJar(profile.HelloCookieLifetimeMs)
+		if err != nil {
+			return nil, errors.Wrap(err, "cookie jar")
+		}
+		l.cookies = cookies
+	}
+	if profile.ListenerHelloRatePerIp > 0 {
+		l.limiter = newRateLimiter(profile.ListenerHelloRatePerIp, profile.ListenerHelloBurstPerIp, profile.ListenerHelloMaxIps)
+	}
+	if profile.ListenerReactor {
+		l.reactor = newReactor(profile.ListenerReactorWorkers)
 	}
 	listenerId := fmt.Sprintf("listener_%s", addr)
 	l.ii = profile.i.NewInstance(listenerId, addr)
-	l.pool = newPool(listenerId, uint32(dataStart+profile.MaxSegmentSz), l.ii)
+	l.pool = newPool(listenerId, profile.maxDatagramSz(), l.ii)
 	go l.run()
 	return l, nil
 }
 
 func (self *listener) Accept() (net.Conn, error) {
-	conn, ok := <-self.acceptQueue
-	if !ok {
-		return nil, errors.New("listener closed")
+	select {
+	case conn := <-self.acceptQueue:
+		return conn, nil
+	case <-self.closed:
+		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
 func (self *listener) Close() error {
-	return errors.Errorf("close not implemented")
+	err := net.ErrClosed
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.drain()
+		err = self.conn.Close()
+		if self.reactor != nil {
+			self.reactor.close()
+		}
+	})
+	return err
 }
 
 func (self *listener) Addr() net.Addr {
@@ -77,15 +125,33 @@ func (self *listener) run() {
 
 	for {
 		if wm, peer, err := readWireMessage(self.conn, self.pool); err == nil {
-			conn, found := self.peers.Get(peer)
-			if found {
-				lc := conn.(*listenerConn)
+			if lc := self.route(wm, peer); lc != nil {
+				if wm.messageType() == PATH_RESPONSE {
+					self.ii.WireMessageRx(peer, wm)
+					if lc.validate(peer, wm) {
+						self.migrate(lc, peer)
+					}
+					wm.buffer.unref()
+					continue
+				}
+				if addrComparator(peer, lc.path.peer()) != 0 {
+					// nothing from an address is processed until it has answered a path challenge, so that a spoofed
+					// source can neither inject data nor redirect the session; the peer retransmits after migrating
+					self.ii.WireMessageRx(peer, wm)
+					lc.challenge(peer)
+					wm.buffer.unref()
+					continue
+				}
 				lc.queue(wm)
 
 			} else {
 				self.ii.WireMessageRx(peer, wm)
-				if wm.messageType() == HELLO {
-					go self.hello(wm, peer)
+				if wm.messageType() == HELLO && !isClosed(self.closed) {
+					if self.admit(wm, peer) {
+						go self.hello(wm, peer)
+					} else {
+						wm.buffer.unref()
+					}
 
 				} else {
 					self.ii.UnknownPeer(peer)
@@ -93,18 +159,137 @@ func (self *listener) run() {
 				}
 			}
 		} else {
+			if isClosed(self.closed) {
+				return
+			}
 			self.ii.ReadError(peer, err)
 		}
 	}
 }
 
+func (self *listener) admit(wm *wireMessage, peer *net.UDPAddr) bool {
+	if self.cookies != nil && !self.checkCookie(wm, peer) {
+		return false
+	}
+	if reason, ok := self.reserve(peer); !ok {
+		if self.cookies != nil {
+			self.reject(peer, reason)
+		} else {
+			// without a cookie, the source address is unvalidated, and a REJECT could be reflected at a spoofed victim
+			self.ii.ConnectionError(peer, errors.Errorf("dropped hello (%s)", reason))
+		}
+		return false
+	}
+	return true
+}
+
+func (self *listener) checkCookie(wm *wireMessage, peer *net.UDPAddr) bool {
+	if wm.hasFlag(COOKIE) {
+		if cookie, err := wm.asHelloCookie(); err == nil && self.cookies.verify(peer, cookie) {
+			return true
+		}
+		self.ii.ConnectionError(peer, errors.New("invalid hello cookie"))
+		return false
+	}
+	if wm.buffer.uz < dataStart+helloPaddedSz {
+		// a retry is never larger than the hello that prompted it, so that it cannot be used for amplification
+		self.ii.ConnectionError(peer, errors.New("unpadded hello"))
+		return false
+	}
+
+	retry, err := newHelloCookie(-1, hello{protocolVersion, self.profileId, 0, 0}, self.cookies.issue(peer), self.pool)
+	if err != nil {
+		self.ii.ConnectionError(peer, errors.Wrap(err, "new hello cookie"))
+		return false
+	}
+	defer retry.buffer.unref()
+	if err := writeWireMessage(retry, self.conn, peer); err != nil {
+		self.ii.ConnectionError(peer, errors.Wrap(err, "write hello cookie"))
+		return false
+	}
+	self.ii.WireMessageTx(peer, retry)
+	return false
+}
+
+// reserve claims a handshake slot for peer. Pending handshakes also hold a slot in the accept queue, so that a completed
+// handshake never blocks waiting for Accept.
+func (self *listener) reserve(peer *net.UDPAddr) (rejectReason, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.limiter != nil && !self.limiter.allow(peer.IP, time.Now()) {
+		return rejectRateLimited, false
+	}
+	if self.profile.ListenerMaxPendingHellos > 0 && self.pending >= self.profile.ListenerMaxPendingHellos {
+		return rejectBusy, false
+	}
+	if self.pending+len(self.acceptQueue) >= cap(self.acceptQueue) {
+		return rejectBusy, false
+	}
+	self.pending++
+	return 0, true
+}
+
+func (self *listener) release() {
+	self.lock.Lock()
+	self.pending--
+	self.lock.Unlock()
+}
+
+func (self *listener) reject(peer *net.UDPAddr, reason rejectReason) {
+	self.ii.ConnectionError(peer, errors.Errorf("rejected hello (%s)", reason))
+
+	wm, err := newReject(reason, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating reject (%v)", err)
+		return
+	}
+	defer wm.buffer.unref()
+	if err := writeWireMessage(wm, self.conn, peer); err != nil {
+		logrus.Errorf("error writing reject (%v)", err)
+		return
+	}
+	self.ii.WireMessageTx(peer, wm)
+}
+
+func (self *listener) route(wm *wireMessage, peer *net.UDPAddr) *listenerConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if wm.connId != 0 {
+		return self.connIds[wm.connId]
+	}
+	if conn, found := self.peers.Get(peer); found {
+		return conn.(*listenerConn)
+	}
+	return nil
+}
+
+func (self *listener) migrate(conn *listenerConn, peer *net.UDPAddr) {
+	self.lock.Lock()
+	oldPeer := conn.path.peer()
+	self.peers.Remove(oldPeer)
+	conn.path.migrate(peer)
+	self.peers.Put(peer, conn)
+	self.lock.Unlock()
+	logrus.Infof("migrated peer [%s] -> [%s]", oldPeer, peer)
+}
+
 func (self *listener) hello(hello *wireMessage, peer *net.UDPAddr) {
+	defer self.release()
+
+	var conn *listenerConn
 	hook := func() {
 		self.lock.Lock()
-		self.peers.Remove(peer)
+		self.peers.Remove(conn.path.peer())
+		delete(self.connIds, conn.path.connId)
 		logrus.Infof("remaining peers: %d", self.peers.Size())
 		self.lock.Unlock()
-		logrus.Infof("removed peer [%s]", peer)
+		select {
+		case self.removed <- struct{}{}:
+		default:
+		}
+		logrus.Infof("removed peer [%s]", conn.path.peer())
 	}
 	conn, err := newListenerConn(self, self.conn, peer, self.profile, hook)
 	if err != nil {
@@ -113,8 +298,17 @@ func (self *listener) hello(hello *wireMessage, peer *net.UDPAddr) {
 	}
 
 	self.lock.Lock()
-	self.peers.Put(peer, conn)
+	connId, err := self.newConnId()
+	if err == nil {
+		conn.path.connId = connId
+		self.peers.Put(peer, conn)
+		self.connIds[connId] = conn
+	}
 	self.lock.Unlock()
+	if err != nil {
+		self.ii.ConnectionError(peer, err)
+		return
+	}
 
 	if err := conn.hello(hello); err != nil {
 		logrus.Errorf("error connecting (%v)", err)
@@ -122,21 +316,69 @@ func (self *listener) hello(hello *wireMessage, peer *net.UDPAddr) {
 		return
 	}
 
-	self.acceptQueue <- conn
+	select {
+	case self.acceptQueue <- conn:
+		self.ii.Connected(peer)
+	case <-self.closed:
+		conn.closer.emergencyStop()
+		self.ii.ConnectionError(peer, net.ErrClosed)
+	default:
+		conn.closer.emergencyStop()
+		self.ii.ConnectionError(peer, errors.New("accept queue full"))
+	}
+}
+
+func (self *listener) drain() {
+	if self.profile.ListenerDrainMs > 0 {
+		for _, conn := range self.conns() {
+			if err := conn.Close(); err != nil {
+				logrus.Errorf("error closing [%s] (%v)", conn.path.peer(), err)
+			}
+		}
+		timeout := time.NewTimer(time.Duration(self.profile.ListenerDrainMs) * time.Millisecond)
+		defer timeout.Stop()
+	drain:
+		for len(self.conns()) > 0 {
+			select {
+			case <-self.removed:
+			case <-timeout.C:
+				break drain
+			}
+		}
+	}
+	for _, conn := range self.conns() {
+		conn.closer.emergencyStop()
+	}
+}
+
+func (self *listener) conns() []*listenerConn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var conns []*listenerConn
+	for _, v := range self.peers.Values() {
+		conns = append(conns, v.(*listenerConn))
+	}
+	return conns
+}
 
-	self.ii.Connected(peer)
+func (self *listener) newConnId() (uint32, error) {
+	id := make([]byte, 4)
+	for {
+		if _, err := rand.Read(id); err != nil {
+			return 0, errors.Wrap(err, "connection id")
+		}
+		connId := util.ReadUint32(id)
+		if _, found := self.connIds[connId]; connId != 0 && !found {
+			return connId, nil
+		}
+	}
 }
 
 func addrComparator(i, j interface{}) int {
 	ai := i.(*net.UDPAddr)
 	aj := j.(*net.UDPAddr)
-	for l := 0; l < 4; l++ {
-		if ai.IP[l] < aj.IP[l] {
-			return -1
-		}
-		if ai.IP[l] > aj.IP[l] {
-			return 1
-		}
+	if c := bytes.Compare(canonicalIP(ai.IP), canonicalIP(aj.IP)); c != 0 {
+		return c
 	}
 	if ai.Port < aj.Port {
 		return -1
@@ -144,5 +386,12 @@ func addrComparator(i, j interface{}) int {
 	if ai.Port > aj.Port {
 		return 1
 	}
-	return 0
+	return strings.Compare(ai.Zone, aj.Zone)
+}
+
+func canonicalIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
 }
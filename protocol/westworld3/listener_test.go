@@ -0,0 +1,311 @@
+package westworld3
+
+import (
+	"context"
+	"errors"
+	"github.com/emirpasic/gods/trees/btree"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerCloseUnblocksAccept(t *testing.T) {
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, NewBaselineProfile(), 0)
+	assert.NoError(t, err)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, l.Close())
+	select {
+	case err := <-accepted:
+		assert.True(t, errors.Is(err, net.ErrClosed))
+	case <-time.After(time.Second):
+		assert.Fail(t, "accept not unblocked")
+	}
+	assert.Nil(t, network.lookup(addr))
+
+	_, err = l.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	assert.True(t, errors.Is(l.Close(), net.ErrClosed))
+}
+
+func TestListenerCloseWithoutDrain(t *testing.T) {
+	_, accepted, l := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+	assert.NoError(t, l.Close())
+	assert.Equal(t, 0, len(l.conns()))
+
+	_, err := accepted.Read(make([]byte, 1024))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenerCloseDrains(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.ListenerDrainMs = 5000
+	listenerProfile.CloseWaitMs = 100
+	listenerProfile.CloseCheckMs = 50
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.CloseWaitMs = 100
+	dialerProfile.CloseCheckMs = 50
+	dialed, accepted, l := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), listenerProfile, dialerProfile)
+
+	go func() {
+		_, err := accepted.Write([]byte("goodbye"))
+		assert.NoError(t, err)
+	}()
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(dialed, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "goodbye", string(buf))
+
+	start := time.Now()
+	assert.NoError(t, l.Close())
+	assert.True(t, time.Since(start) < time.Duration(listenerProfile.ListenerDrainMs)*time.Millisecond)
+	assert.Equal(t, 0, len(l.conns()))
+
+	_, err = dialed.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAddrComparator(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6262}
+	v4Mapped := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	assert.Equal(t, 0, addrComparator(v4, v4Mapped))
+	assert.Equal(t, 0, addrComparator(v4Mapped, v4))
+
+	otherPort := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6263}
+	assert.Equal(t, -1, addrComparator(v4, otherPort))
+	assert.Equal(t, 1, addrComparator(otherPort, v4))
+
+	a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6262}
+	b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 6262}
+	assert.Equal(t, -1, addrComparator(a, b))
+	assert.Equal(t, 1, addrComparator(b, a))
+	assert.NotEqual(t, 0, addrComparator(v4, a))
+	assert.Equal(t, -addrComparator(v4, a), addrComparator(a, v4))
+
+	eth0 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}
+	eth1 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth1"}
+	assert.Equal(t, -1, addrComparator(eth0, eth1))
+	assert.Equal(t, 0, addrComparator(eth0, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}))
+}
+
+func TestPeersMixedFamilies(t *testing.T) {
+	peers := btree.NewWith(16, addrComparator)
+	addrs := []*net.UDPAddr{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6262},
+		{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6262},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6262},
+		{IP: net.ParseIP("2001:db8::1:1"), Port: 6262},
+		{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"},
+		{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth1"},
+	}
+	for i, addr := range addrs {
+		peers.Put(addr, i)
+	}
+	assert.Equal(t, len(addrs), peers.Size())
+	for i, addr := range addrs {
+		v, found := peers.Get(addr)
+		assert.True(t, found)
+		assert.Equal(t, i, v)
+	}
+
+	// IPv4 peers reported in 16-byte form by a dual-stack socket must find the same entries
+	v, found := peers.Get(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262})
+	assert.True(t, found)
+	assert.Equal(t, 1, v)
+}
+
+func TestDualStackListener(t *testing.T) {
+	l, err := Listen(&net.UDPAddr{IP: net.IPv6unspecified}, 0)
+	if err != nil {
+		t.Skipf("dual-stack unavailable (%v)", err)
+	}
+	defer func() { _ = l.Close() }()
+	port := l.Addr().(*net.UDPAddr).Port
+	assert.NotEqual(t, 0, port)
+
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		ip := ip
+		dialed, err := Dial(&net.UDPAddr{IP: ip, Port: port}, 0)
+		assert.NoError(t, err)
+		defer func() { _ = dialed.Close() }()
+		accepted, err := l.Accept()
+		assert.NoError(t, err)
+		defer func() { _ = accepted.Close() }()
+
+		go func() {
+			_, err := dialed.Write([]byte(ip.String()))
+			assert.NoError(t, err)
+		}()
+		buf := make([]byte, len(ip.String()))
+		_, err = io.ReadFull(accepted, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, ip.String(), string(buf))
+		assert.True(t, accepted.RemoteAddr().(*net.UDPAddr).IP.Equal(ip))
+	}
+	assert.Equal(t, 2, len(l.(*listener).conns()))
+}
+
+func TestListenerHelloCookies(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.HelloCookies = true
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), listenerProfile, NewBaselineProfile())
+	transferEmulated(t, dialed, accepted, 64*1024)
+}
+
+func TestListenerHelloCookiesStateless(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.HelloCookies = true
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, listenerProfile, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	pool := newPool("flood", uint32(dataStart+listenerProfile.MaxSegmentSz), NewNilInstrument().NewInstance("", nil))
+	for i := 0; i < 16; i++ {
+		spoofed := network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 6262}, util.NewEmulatorConfig(int64(i)))
+		spoofedPath := newPath(spoofed, addr)
+
+		wm, err := newHello(0, hello{protocolVersion, 0, 0, 0}, nil, pool)
+		assert.NoError(t, err)
+		assert.NoError(t, spoofedPath.write(wm))
+
+		assert.NoError(t, spoofed.SetReadDeadline(time.Now().Add(time.Second)))
+		retry, _, err := readWireMessage(spoofed, pool)
+		assert.NoError(t, err)
+		assert.Equal(t, HELLO, retry.messageType())
+		assert.True(t, retry.hasFlag(COOKIE))
+		assert.True(t, retry.buffer.uz <= wm.buffer.uz)
+		_, err = retry.asHelloCookie()
+		assert.NoError(t, err)
+
+		forged, err := newHelloCookie(0, hello{protocolVersion, 0, 0, 0}, make([]byte, cookieSz), pool)
+		assert.NoError(t, err)
+		assert.NoError(t, spoofedPath.write(forged))
+	}
+
+	// a hello that is not padded to the size of a retry gets no response
+	unpadded := network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 2, 1), Port: 6262}, util.NewEmulatorConfig(99))
+	wm := &wireMessage{seq: 0, mt: HELLO, buffer: pool.get()}
+	helloSz, err := encodeHello(hello{protocolVersion, 0, 0, 0}, wm.buffer.data[dataStart:])
+	assert.NoError(t, err)
+	wm, err = wm.encodeHeader(uint16(helloSz))
+	assert.NoError(t, err)
+	assert.NoError(t, newPath(unpadded, addr).write(wm))
+	assert.NoError(t, unpadded.SetReadDeadline(time.Now().Add(250*time.Millisecond)))
+	_, _, err = readWireMessage(unpadded, pool)
+	assert.Error(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(l.conns()))
+}
+
+func TestListenerRejectsWhenAcceptQueueFull(t *testing.T) {
+	ii := &countingInstrumentInstance{}
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.AcceptQueueLen = 1
+	listenerProfile.HelloCookies = true
+	listenerProfile.i = &countingInstrument{ii}
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, listenerProfile, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}, util.NewEmulatorConfig(2)), addr, NewBaselineProfile())
+	assert.NoError(t, err)
+
+	// the accept queue is full, so the next dialer is turned away rather than left hanging
+	start := time.Now()
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6262}, util.NewEmulatorConfig(3)), addr, NewBaselineProfile())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), rejectBusy.String())
+	assert.True(t, time.Since(start) < time.Duration(NewBaselineProfile().ConnectionSetupTimeoutMs)*time.Millisecond)
+	ii.lock.Lock()
+	assert.Equal(t, 1, len(ii.connectionErrors))
+	ii.lock.Unlock()
+
+	_, err = l.Accept()
+	assert.NoError(t, err)
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 6262}, util.NewEmulatorConfig(4)), addr, NewBaselineProfile())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(l.conns()))
+}
+
+func TestListenerHelloRateLimit(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.HelloCookies = true
+	listenerProfile.ListenerHelloRatePerIp = 0.001
+	listenerProfile.ListenerHelloBurstPerIp = 1
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, listenerProfile, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}, util.NewEmulatorConfig(2)), addr, NewBaselineProfile())
+	assert.NoError(t, err)
+
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6263}, util.NewEmulatorConfig(3)), addr, NewBaselineProfile())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), rejectRateLimited.String())
+
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6262}, util.NewEmulatorConfig(4)), addr, NewBaselineProfile())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(l.conns()))
+}
+
+func TestListenerHelloRateLimitNoReject(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.ListenerHelloRatePerIp = 0.001
+	listenerProfile.ListenerHelloBurstPerIp = 1
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, listenerProfile, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	_, err = dial(context.Background(), network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}, util.NewEmulatorConfig(2)), addr, NewBaselineProfile())
+	assert.NoError(t, err)
+
+	// without cookies, the source is unvalidated, so a limited hello is dropped rather than rejected
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = dial(ctx, network.bind(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6263}, util.NewEmulatorConfig(3)), addr, NewBaselineProfile())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 1, len(l.conns()))
+}
+
+func TestListenerMaxPendingHellos(t *testing.T) {
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.ListenerMaxPendingHellos = 2
+	network := newEmulatedNetwork()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	l, err := listen(network.bind(addr, util.NewEmulatorConfig(1)), addr, listenerProfile, 0)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}
+	for i := 0; i < 2; i++ {
+		_, ok := l.reserve(peer)
+		assert.True(t, ok)
+	}
+	reason, ok := l.reserve(peer)
+	assert.False(t, ok)
+	assert.Equal(t, rejectBusy, reason)
+
+	l.release()
+	_, ok = l.reserve(peer)
+	assert.True(t, ok)
+}
@@ -1,13 +1,13 @@
 package westworld3
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"math"
-	"math/big"
+	"io"
 	"net"
 	"sync/atomic"
 	"time"
@@ -15,10 +15,11 @@ import (
 
 type listenerConn struct {
 	listener      *listener
-	conn          *net.UDPConn
-	peer          *net.UDPAddr
+	conn          datagramConn
+	path          *path
 	rxQueue       chan *wireMessage
 	rxQueueClosed int32
+	rxQueueDone   chan struct{}
 	seq           *util.Sequence
 	txPortal      *txPortal
 	rxPortal      *rxPortal
@@ -26,41 +27,45 @@ type listenerConn struct {
 	pool          *pool
 	profile       *Profile
 	ii            InstrumentInstance
+
+	challengePeer  *net.UDPAddr
+	challengeToken []byte
+	challengeSent  time.Time
 }
 
-func newListenerConn(listener *listener, conn *net.UDPConn, peer *net.UDPAddr, profile *Profile, callerHook func()) (*listenerConn, error) {
-	startSeq := int64(0)
-	if profile.RandomizeSeq {
-		randomSeq, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
-		if err != nil {
-			return nil, errors.Wrap(err, "randomize sequence")
-		}
-		startSeq = randomSeq.Int64()
+func newListenerConn(listener *listener, conn datagramConn, peer *net.UDPAddr, profile *Profile, callerHook func()) (*listenerConn, error) {
+	startSeq, err := profile.startSeq()
+	if err != nil {
+		return nil, err
 	}
 	lc := &listenerConn{
 		listener:      listener,
 		conn:          conn,
-		peer:          peer,
+		path:          newPath(conn, peer),
 		rxQueue:       make(chan *wireMessage, profile.ListenerRxQueueLen),
 		rxQueueClosed: 0,
-		seq:           util.NewSequence(int32(startSeq)),
+		rxQueueDone:   make(chan struct{}),
+		seq:           util.NewSequence(startSeq),
 		profile:       profile,
 	}
 	id := fmt.Sprintf("listenerConn_%s_%s", listener.addr, peer)
 	lc.ii = profile.i.NewInstance(id, peer)
-	lc.pool = newPool(id, uint32(dataStart+profile.MaxSegmentSz), lc.ii)
+	lc.pool = newPool(id, profile.maxDatagramSz(), lc.ii)
 	closeHook := func() {
 		lc.ii.Shutdown()
 		if atomic.CompareAndSwapInt32(&lc.rxQueueClosed, 0, 1) {
-			close(lc.rxQueue)
+			close(lc.rxQueueDone)
 		}
 		if callerHook != nil {
 			callerHook()
 		}
 	}
 	lc.closer = newCloser(lc.seq, lc.profile, closeHook)
-	lc.txPortal = newTxPortal(conn, peer, lc.closer, profile, lc.pool, lc.ii)
-	lc.rxPortal = newRxPortal(conn, peer, lc.txPortal, lc.seq, lc.closer, profile, lc.ii)
+	if lc.txPortal, err = newTxPortal(lc.path, lc.closer, profile, lc.pool, lc.ii); err != nil {
+		return nil, errors.Wrap(err, "tx portal")
+	}
+	lc.rxPortal = newRxPortal(lc.path, lc.txPortal, lc.seq, lc.closer, profile, lc.ii)
+	lc.txPortal.rxPortal = lc.rxPortal
 	lc.closer.txPortal = lc.txPortal
 	lc.closer.rxPortal = lc.rxPortal
 	return lc, nil
@@ -70,6 +75,11 @@ func (self *listenerConn) Read(p []byte) (int, error) {
 	return self.rxPortal.read(p)
 }
 
+// WriteTo implements io.WriterTo, allowing io.Copy to write received data straight from the wire buffers.
+func (self *listenerConn) WriteTo(w io.Writer) (int64, error) {
+	return self.rxPortal.writeTo(w)
+}
+
 func (self *listenerConn) Write(p []byte) (int, error) {
 	return self.txPortal.tx(p, self.seq)
 }
@@ -80,7 +90,7 @@ func (self *listenerConn) Close() error {
 }
 
 func (self *listenerConn) RemoteAddr() net.Addr {
-	return self.peer
+	return self.path.peer()
 }
 
 func (self *listenerConn) LocalAddr() net.Addr {
@@ -88,19 +98,68 @@ func (self *listenerConn) LocalAddr() net.Addr {
 }
 
 func (self *listenerConn) SetDeadline(t time.Time) error {
+	self.rxPortal.deadline.set(t)
+	self.txPortal.deadline.set(t)
 	return nil
 }
 
 func (self *listenerConn) SetReadDeadline(t time.Time) error {
+	self.rxPortal.deadline.set(t)
 	return nil
 }
 
 func (self *listenerConn) SetWriteDeadline(t time.Time) error {
+	self.txPortal.deadline.set(t)
 	return nil
 }
 
 func (self *listenerConn) queue(wm *wireMessage) {
-	self.rxQueue <- wm
+	select {
+	case self.rxQueue <- wm:
+	case <-self.rxQueueDone:
+		wm.buffer.unref()
+	}
+}
+
+func (self *listenerConn) challenge(peer *net.UDPAddr) {
+	if self.challengePeer != nil && addrComparator(peer, self.challengePeer) == 0 && time.Since(self.challengeSent).Milliseconds() < int64(self.profile.RetxStartMs) {
+		return
+	}
+
+	token := make([]byte, pathTokenSz)
+	if _, err := rand.Read(token); err != nil {
+		logrus.Errorf("error creating path token (%v)", err)
+		return
+	}
+	challenge, err := newPathChallenge(token, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating path challenge (%v)", err)
+		return
+	}
+	defer challenge.buffer.unref()
+	if err := self.path.writeTo(challenge, peer); err != nil {
+		logrus.Errorf("error sending path challenge to [%s] (%v)", peer, err)
+		return
+	}
+	self.ii.WireMessageTx(peer, challenge)
+
+	self.challengePeer = peer
+	self.challengeToken = token
+	self.challengeSent = time.Now()
+}
+
+func (self *listenerConn) validate(peer *net.UDPAddr, response *wireMessage) bool {
+	token, err := response.asPathToken()
+	if err != nil {
+		logrus.Errorf("as path response error (%v)", err)
+		return false
+	}
+	if self.challengePeer == nil || addrComparator(peer, self.challengePeer) != 0 || !bytes.Equal(token, self.challengeToken) {
+		return false
+	}
+	self.challengePeer = nil
+	self.challengeToken = nil
+	return true
 }
 
 func (self *listenerConn) rxer() {
@@ -108,22 +167,16 @@ func (self *listenerConn) rxer() {
 	defer logrus.Warn("exited")
 
 	for {
-		wm, ok := <-self.rxQueue
-		if !ok {
+		var wm *wireMessage
+		select {
+		case wm = <-self.rxQueue:
+		case <-self.rxQueueDone:
 			return
 		}
-		self.ii.WireMessageRx(self.peer, wm)
+		self.ii.WireMessageRx(self.path.peer(), wm)
 
 		switch wm.messageType() {
 		case DATA:
-			_, rttTs, err := wm.asData()
-			if err != nil {
-				logrus.Errorf("as data error (%v)", err)
-				continue
-			}
-			if rttTs != nil {
-				self.txPortal.rtt(*rttTs)
-			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error rx-ing (%v)", err)
 				continue
@@ -136,17 +189,22 @@ func (self *listenerConn) rxer() {
 				continue
 			}
 			if rttTs != nil {
-				self.txPortal.rtt(*rttTs)
+				self.txPortal.rtt(rttTs)
 			}
 			self.txPortal.updateRxPortalSz(int(rxPortalSz))
 			if err := self.txPortal.ack(acks); err != nil {
 				logrus.Errorf("error acking (%v)", err)
 				continue
 			}
-			self.ii.RxAck(self.peer, wm)
+			self.ii.RxAck(self.path.peer(), wm)
 			wm.buffer.unref()
 
 		case KEEPALIVE:
+			if wm.hasFlag(PMTU) {
+				self.txPortal.rxPmtuProbe(wm)
+				wm.buffer.unref()
+				continue
+			}
 			rxPortalSz, err := wm.asKeepalive()
 			if err != nil {
 				logrus.Errorf("as keepalive error (%v)", err)
@@ -157,7 +215,7 @@ func (self *listenerConn) rxer() {
 				logrus.Errorf("error forwarding keepalive to rxPortal (%v)", err)
 				continue
 			}
-			self.ii.RxKeepalive(self.peer, wm)
+			self.ii.RxKeepalive(self.path.peer(), wm)
 			wm.buffer.unref()
 
 		case CLOSE:
@@ -167,7 +225,7 @@ func (self *listenerConn) rxer() {
 
 		default:
 			logrus.Errorf("unexpected message type: %d", wm.mt)
-			self.ii.UnexpectedMessageType(self.peer, wm.mt)
+			self.ii.UnexpectedMessageType(self.path.peer(), wm.mt)
 			wm.buffer.unref()
 		}
 	}
@@ -182,34 +240,41 @@ func (self *listenerConn) hello(wm *wireMessage) error {
 		self.rxPortal.setAccepted(wm.seq)
 		wm.buffer.unref()
 
+		hello.connId = self.path.connId
+		if hello.version != protocolVersionRttUs || !self.profile.RttProbeUs {
+			hello.version = protocolVersion
+		}
+		self.txPortal.wideRtt = hello.version == protocolVersionRttUs
+		self.txPortal.monitor.peerAckDelayMs = int(hello.ackDelayMs)
+		hello.ackDelayMs = ackDelayMs(self.profile)
 		helloAckSeq := self.seq.Next()
 		helloAck, err := newHello(helloAckSeq, hello, &Ack{wm.seq, wm.seq}, self.pool)
 		if err != nil {
 			err = errors.Wrap(err, "new hello")
-			self.ii.ConnectionError(self.peer, err)
+			self.ii.ConnectionError(self.path.peer(), err)
 			return err
 		}
 		defer helloAck.buffer.unref()
 
 		for i := 0; i < 5; i++ {
 			// Send Hello Ack
-			if err := writeWireMessage(helloAck, self.conn, self.peer); err != nil {
+			if err := self.path.write(helloAck); err != nil {
 				err = errors.Wrap(err, "write hello ack")
-				self.ii.ConnectionError(self.peer, err)
+				self.ii.ConnectionError(self.path.peer(), err)
 				return err
 			}
-			self.ii.WireMessageTx(self.peer, helloAck)
+			self.ii.WireMessageTx(self.path.peer(), helloAck)
 
 			// Receive Response Ack
 			select {
-			case ackWm, ok := <-self.rxQueue:
-				if !ok {
-					err = errors.New("rx queue closed")
-					self.ii.ConnectionError(self.peer, err)
-					return err
-				}
+			case <-self.rxQueueDone:
+				err = errors.New("rx queue closed")
+				self.ii.ConnectionError(self.path.peer(), err)
+				return err
+
+			case ackWm := <-self.rxQueue:
 				defer ackWm.buffer.unref()
-				self.ii.WireMessageRx(self.peer, ackWm)
+				self.ii.WireMessageRx(self.path.peer(), ackWm)
 
 				if ackWm.mt != ACK {
 					logrus.Errorf("expected ACK, got [%d]", ackWm.messageType())
@@ -223,9 +288,14 @@ func (self *listenerConn) hello(wm *wireMessage) error {
 						}
 
 						// connection established, now we can start
+						if r := self.listener.reactor; r != nil {
+							self.txPortal.schedule(r)
+							self.closer.schedule(r)
+						} else {
+							go self.txPortal.start()
+							go self.closer.run()
+						}
 						go self.rxer()
-						go self.txPortal.start()
-						go self.closer.run()
 
 						return nil
 					}
@@ -237,12 +307,12 @@ func (self *listenerConn) hello(wm *wireMessage) error {
 		}
 
 		err = errors.New("connection failed")
-		self.ii.ConnectionError(self.peer, err)
+		self.ii.ConnectionError(self.path.peer(), err)
 		return err
 
 	} else {
 		err = errors.Wrap(err, "expected hello")
-		self.ii.ConnectionError(self.peer, err)
+		self.ii.ConnectionError(self.path.peer(), err)
 		return err
 	}
 }
@@ -3,6 +3,7 @@ package westworld3
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
+	"math"
 	"net"
 	"strings"
 )
@@ -10,6 +11,7 @@ import (
 type wireMessage struct {
 	seq    int32
 	mt     messageType
+	connId uint32
 	buffer *buffer
 }
 
@@ -22,6 +24,9 @@ const (
 	DATA
 	KEEPALIVE
 	CLOSE
+	PATH_CHALLENGE
+	PATH_RESPONSE
+	REJECT
 )
 
 const messageTypeMask = byte(0x7)
@@ -32,11 +37,31 @@ const (
 	// 0x8 ... 0x80
 	RTT        messageFlag = 0x8
 	INLINE_ACK messageFlag = 0x10
+	COOKIE     messageFlag = 0x20
+	RTT_US     messageFlag = 0x40
+	PMTU       messageFlag = 0x80
 )
 
-const dataStart = 7
+const connIdStart = 7
+const dataStart = 11
 
-func readWireMessage(conn *net.UDPConn, pool *pool) (wm *wireMessage, peer *net.UDPAddr, err error) {
+const pathTokenSz = 8
+
+// helloPaddedSz is the minimum payload of a dialer's HELLO, which is padded to the size of a cookie retry, so that a
+// listener never answers a HELLO with a larger datagram.
+const helloPaddedSz = helloSz + cookieSz
+
+type rejectReason uint8
+
+const (
+	rejectBusy rejectReason = iota
+	rejectRateLimited
+)
+
+// errMalformed reports a datagram that was read, but could not be decoded (truncated by a short buffer, for example).
+var errMalformed = errors.New("malformed wire message")
+
+func readWireMessage(conn datagramConn, pool *pool) (wm *wireMessage, peer *net.UDPAddr, err error) {
 	buffer := pool.get()
 	var n int
 	n, peer, err = conn.ReadFromUDP(buffer.data)
@@ -47,13 +72,14 @@ func readWireMessage(conn *net.UDPConn, pool *pool) (wm *wireMessage, peer *net.
 
 	wm, err = decodeHeader(buffer)
 	if err != nil {
-		return nil, peer, errors.Wrap(err, "decode")
+		buffer.unref()
+		return nil, peer, errors.Wrapf(errMalformed, "decode (%v)", err)
 	}
 
 	return
 }
 
-func writeWireMessage(wm *wireMessage, conn *net.UDPConn, peer *net.UDPAddr) error {
+func writeWireMessage(wm *wireMessage, conn datagramConn, peer *net.UDPAddr) error {
 	if wm.buffer.uz < dataStart {
 		return errors.New("truncated buffer")
 	}
@@ -88,9 +114,49 @@ func newHello(seq int32, h hello, a *Ack, p *pool) (wm *wireMessage, err error)
 	if err != nil {
 		return nil, errors.Wrap(err, "error encoding hello")
 	}
+	if a == nil {
+		if wm.buffer.sz < dataStart+helloPaddedSz {
+			return nil, errors.Errorf("short buffer for hello padding [%d < %d]", wm.buffer.sz, dataStart+helloPaddedSz)
+		}
+		for i := dataStart + helloSz; i < dataStart+helloPaddedSz; i++ {
+			wm.buffer.data[i] = 0
+		}
+		helloSz = helloPaddedSz
+	}
 	return wm.encodeHeader(uint16(acksSz + helloSz))
 }
 
+func newHelloCookie(seq int32, h hello, cookie []byte, p *pool) (wm *wireMessage, err error) {
+	if len(cookie) != cookieSz {
+		return nil, errors.Errorf("invalid cookie length [%d != %d]", len(cookie), cookieSz)
+	}
+	wm = &wireMessage{
+		seq:    seq,
+		mt:     HELLO,
+		buffer: p.get(),
+	}
+	wm.setFlag(COOKIE)
+	helloSz, err := encodeHello(h, wm.buffer.data[dataStart:])
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding hello")
+	}
+	if wm.buffer.sz < dataStart+helloSz+cookieSz {
+		return nil, errors.Errorf("short buffer for cookie [%d < %d]", wm.buffer.sz, dataStart+helloSz+cookieSz)
+	}
+	copy(wm.buffer.data[dataStart+helloSz:], cookie)
+	return wm.encodeHeader(uint16(helloSz + cookieSz))
+}
+
+func (self *wireMessage) asHelloCookie() (cookie []byte, err error) {
+	if self.messageType() != HELLO || !self.hasFlag(COOKIE) || self.hasFlag(INLINE_ACK) {
+		return nil, errors.New("expected HELLO with COOKIE")
+	}
+	if self.buffer.uz < dataStart+helloSz+cookieSz {
+		return nil, errors.Errorf("short buffer for cookie decode [%d < %d]", self.buffer.uz, dataStart+helloSz+cookieSz)
+	}
+	return self.buffer.data[dataStart+helloSz : dataStart+helloSz+cookieSz], nil
+}
+
 func (self *wireMessage) asHello() (h hello, a []Ack, err error) {
 	if self.messageType() != HELLO {
 		return hello{}, nil, errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
@@ -102,14 +168,17 @@ func (self *wireMessage) asHello() (h hello, a []Ack, err error) {
 			return hello{}, nil, errors.Wrap(err, "error decoding acks")
 		}
 	}
-	h, _, err = decodeHello(self.buffer.data[dataStart+i:])
+	if self.buffer.uz < dataStart+i {
+		return hello{}, nil, errors.Errorf("short buffer for hello decode [%d < %d]", self.buffer.uz, dataStart+i)
+	}
+	h, _, err = decodeHello(self.buffer.data[dataStart+i : self.buffer.uz])
 	if err != nil {
 		return hello{}, nil, errors.Wrap(err, "error decoding hello")
 	}
 	return
 }
 
-func newAck(acks []Ack, rxPortalSz int32, rtt *uint16, p *pool) (wm *wireMessage, err error) {
+func newAck(acks []Ack, rxPortalSz int32, rtt *rttProbe, p *pool) (wm *wireMessage, err error) {
 	wm = &wireMessage{
 		seq:    -1,
 		mt:     ACK,
@@ -117,12 +186,11 @@ func newAck(acks []Ack, rxPortalSz int32, rtt *uint16, p *pool) (wm *wireMessage
 	}
 	rttSz := uint32(0)
 	if rtt != nil {
-		if wm.buffer.sz < dataStart+2 {
-			return nil, errors.Errorf("short buffer for ack [%d < %d]", wm.buffer.sz, dataStart+2)
+		rttSz = rtt.sz()
+		if wm.buffer.sz < dataStart+rttSz {
+			return nil, errors.Errorf("short buffer for ack [%d < %d]", wm.buffer.sz, dataStart+rttSz)
 		}
-		wm.setFlag(RTT)
-		util.WriteUint16(wm.buffer.data[dataStart:], *rtt)
-		rttSz = 2
+		rtt.write(wm, wm.buffer.data[dataStart:])
 	}
 	acksSz := uint32(0)
 	if len(acks) > 0 {
@@ -138,18 +206,17 @@ func newAck(acks []Ack, rxPortalSz int32, rtt *uint16, p *pool) (wm *wireMessage
 	return wm.encodeHeader(uint16(rttSz + acksSz + 4))
 }
 
-func (self *wireMessage) asAck() (a []Ack, rxPortalSz int32, rtt *uint16, err error) {
+func (self *wireMessage) asAck() (a []Ack, rxPortalSz int32, rtt *rttProbe, err error) {
 	if self.messageType() != ACK {
 		return nil, 0, nil, errors.Errorf("unexpected message type [%d], expected ACK", self.messageType())
 	}
 	i := uint32(0)
-	if self.hasFlag(RTT) {
-		if self.buffer.uz < dataStart+2 {
-			return nil, 0, nil, errors.Errorf("short buffer for ack decode [%d < %d]", self.buffer.uz, dataStart+2)
+	if rttSz := rttProbeSz(self); rttSz > 0 {
+		if self.buffer.uz < dataStart+rttSz {
+			return nil, 0, nil, errors.Errorf("short buffer for ack decode [%d < %d]", self.buffer.uz, dataStart+rttSz)
 		}
-		rtt = new(uint16)
-		*rtt = util.ReadUint16(self.buffer.data[dataStart:])
-		i += 2
+		rtt = readRttProbe(self, self.buffer.data[dataStart:])
+		i += rttSz
 	}
 	var acksSz uint32
 	a, acksSz, err = DecodeAcks(self.buffer.data[dataStart+i:])
@@ -164,7 +231,7 @@ func (self *wireMessage) asAck() (a []Ack, rxPortalSz int32, rtt *uint16, err er
 	return
 }
 
-func newData(seq int32, rtt *uint16, data []byte, p *pool) (wm *wireMessage, err error) {
+func newData(seq int32, rtt *rttProbe, data []byte, p *pool) (wm *wireMessage, err error) {
 	dataSz := uint32(len(data))
 	wm = &wireMessage{
 		seq:    seq,
@@ -173,12 +240,11 @@ func newData(seq int32, rtt *uint16, data []byte, p *pool) (wm *wireMessage, err
 	}
 	rttSz := uint32(0)
 	if rtt != nil {
-		if wm.buffer.sz < dataStart+2 {
-			return nil, errors.Errorf("short buffer for rtt [%d < %d]", wm.buffer.sz, dataStart+2)
+		rttSz = rtt.sz()
+		if wm.buffer.sz < dataStart+rttSz {
+			return nil, errors.Errorf("short buffer for rtt [%d < %d]", wm.buffer.sz, dataStart+rttSz)
 		}
-		wm.setFlag(RTT)
-		util.WriteUint16(wm.buffer.data[dataStart:], *rtt)
-		rttSz = 2
+		rtt.write(wm, wm.buffer.data[dataStart:])
 	}
 	if wm.buffer.sz < dataStart+rttSz+dataSz {
 		return nil, errors.Errorf("short buffer for data [%d < %d]", wm.buffer.sz, dataStart+rttSz+dataSz)
@@ -187,18 +253,16 @@ func newData(seq int32, rtt *uint16, data []byte, p *pool) (wm *wireMessage, err
 	return wm.encodeHeader(uint16(rttSz + dataSz))
 }
 
-func (self *wireMessage) asData() (data []byte, rtt *uint16, err error) {
+func (self *wireMessage) asData() (data []byte, rtt *rttProbe, err error) {
 	if self.messageType() != DATA {
 		return nil, nil, errors.Errorf("unexpected message type [%d], expected DATA", self.messageType())
 	}
-	rttSz := uint32(0)
-	if self.hasFlag(RTT) {
-		if self.buffer.uz < dataStart+2 {
-			return nil, nil, errors.Errorf("short buffer for data decode [%d < %d]", self.buffer.uz, dataStart+2)
+	rttSz := rttProbeSz(self)
+	if rttSz > 0 {
+		if self.buffer.uz < dataStart+rttSz {
+			return nil, nil, errors.Errorf("short buffer for data decode [%d < %d]", self.buffer.uz, dataStart+rttSz)
 		}
-		rtt = new(uint16)
-		*rtt = util.ReadUint16(self.buffer.data[dataStart:])
-		rttSz = 2
+		rtt = readRttProbe(self, self.buffer.data[dataStart:])
 	}
 	return self.buffer.data[dataStart+rttSz : self.buffer.uz], rtt, nil
 }
@@ -207,11 +271,49 @@ func (self *wireMessage) asDataSize() (sz uint32, err error) {
 	if self.messageType() != DATA {
 		return 0, errors.Errorf("unexpected message type [%d], expected DATA", self.messageType())
 	}
-	rttSz := uint32(0)
-	if self.hasFlag(RTT) {
-		rttSz = 2
+	return self.buffer.uz - (dataStart + rttProbeSz(self)), nil
+}
+
+// dataFragmentHeaderSz is the size of the offset and total size that prefix the payload of a DATA fragment.
+const dataFragmentHeaderSz = 4
+
+// newDataFragment creates a DATA message flagged PMTU, carrying the part of the payload of segment seq that starts at
+// offset. A segment that no longer fits the path (after a path MTU black hole) is retransmitted as fragments, which the
+// peer reassembles before acknowledging the segment.
+func newDataFragment(seq int32, offset, total int, data []byte, p *pool) (wm *wireMessage, err error) {
+	if offset < 0 || offset+len(data) > total || total > math.MaxUint16 {
+		return nil, errors.Errorf("invalid data fragment [%d+%d > %d]", offset, len(data), total)
 	}
-	return self.buffer.uz - (dataStart + rttSz), nil
+	wm = &wireMessage{
+		seq:    seq,
+		mt:     DATA,
+		buffer: p.get(),
+	}
+	wm.setFlag(PMTU)
+	if wm.buffer.sz < uint32(dataStart+dataFragmentHeaderSz+len(data)) {
+		wm.buffer.unref()
+		return nil, errors.Errorf("short buffer for data fragment [%d < %d]", wm.buffer.sz, dataStart+dataFragmentHeaderSz+len(data))
+	}
+	util.WriteUint16(wm.buffer.data[dataStart:], uint16(offset))
+	util.WriteUint16(wm.buffer.data[dataStart+2:], uint16(total))
+	copy(wm.buffer.data[dataStart+dataFragmentHeaderSz:], data)
+	return wm.encodeHeader(uint16(dataFragmentHeaderSz + len(data)))
+}
+
+func (self *wireMessage) asDataFragment() (offset, total int, data []byte, err error) {
+	if self.messageType() != DATA || !self.hasFlag(PMTU) {
+		return 0, 0, nil, errors.Errorf("unexpected message type [%d], expected DATA with PMTU", self.messageType())
+	}
+	if self.buffer.uz < dataStart+dataFragmentHeaderSz {
+		return 0, 0, nil, errors.Errorf("short buffer for data fragment decode [%d < %d]", self.buffer.uz, dataStart+dataFragmentHeaderSz)
+	}
+	offset = int(util.ReadUint16(self.buffer.data[dataStart:]))
+	total = int(util.ReadUint16(self.buffer.data[dataStart+2:]))
+	data = self.buffer.data[dataStart+dataFragmentHeaderSz : self.buffer.uz]
+	if offset+len(data) > total {
+		return 0, 0, nil, errors.Errorf("data fragment overflow [%d+%d > %d]", offset, len(data), total)
+	}
+	return offset, total, data, nil
 }
 
 func newKeepalive(rxPortalSz int, p *pool) (wm *wireMessage, err error) {
@@ -235,29 +337,136 @@ func (self *wireMessage) asKeepalive() (rxPortalSz int, err error) {
 	return rxPortalSz, nil
 }
 
+// newPmtuProbe creates a KEEPALIVE padded to the size of a DATA message carrying probeSz bytes and a wide RTT probe.
+func newPmtuProbe(probeSz int, p *pool) (wm *wireMessage, err error) {
+	if probeSz < 4 {
+		return nil, errors.Errorf("invalid pmtu probe size [%d]", probeSz)
+	}
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     KEEPALIVE,
+		buffer: p.get(),
+	}
+	wm.setFlag(PMTU)
+	if wm.buffer.sz < uint32(dataStart+4+probeSz) {
+		wm.buffer.unref()
+		return nil, errors.Errorf("short buffer for pmtu probe [%d < %d]", wm.buffer.sz, dataStart+4+probeSz)
+	}
+	util.WriteUint32(wm.buffer.data[dataStart:], uint32(probeSz))
+	for i := dataStart + 4; i < dataStart+4+probeSz; i++ {
+		wm.buffer.data[i] = 0
+	}
+	return wm.encodeHeader(uint16(4 + probeSz))
+}
+
+func newPmtuProbeAck(probeSz int, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     KEEPALIVE,
+		buffer: p.get(),
+	}
+	wm.setFlag(PMTU)
+	wm.setFlag(INLINE_ACK)
+	util.WriteUint32(wm.buffer.data[dataStart:], uint32(probeSz))
+	return wm.encodeHeader(4)
+}
+
+func (self *wireMessage) asPmtuProbe() (probeSz int, err error) {
+	if self.messageType() != KEEPALIVE || !self.hasFlag(PMTU) {
+		return 0, errors.Errorf("unexpected message type [%d], expected KEEPALIVE with PMTU", self.messageType())
+	}
+	if self.buffer.uz < dataStart+4 {
+		return 0, errors.Errorf("short buffer for pmtu probe decode [%d < %d]", self.buffer.uz, dataStart+4)
+	}
+	probeSz = int(util.ReadUint32(self.buffer.data[dataStart:]))
+	if !self.hasFlag(INLINE_ACK) && self.buffer.uz != uint32(dataStart+4+probeSz) {
+		return 0, errors.Errorf("pmtu probe size mismatch [%d != %d]", self.buffer.uz, dataStart+4+probeSz)
+	}
+	return probeSz, nil
+}
+
 func newClose(seq int32, p *pool) (wm *wireMessage, err error) {
 	return (&wireMessage{seq: seq, mt: CLOSE, buffer: p.get()}).encodeHeader(0)
 }
 
+func newPathChallenge(token []byte, p *pool) (wm *wireMessage, err error) {
+	return newPathMessage(PATH_CHALLENGE, token, p)
+}
+
+func newPathResponse(token []byte, p *pool) (wm *wireMessage, err error) {
+	return newPathMessage(PATH_RESPONSE, token, p)
+}
+
+func newPathMessage(mt messageType, token []byte, p *pool) (wm *wireMessage, err error) {
+	if len(token) != pathTokenSz {
+		return nil, errors.Errorf("invalid path token length [%d != %d]", len(token), pathTokenSz)
+	}
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     mt,
+		buffer: p.get(),
+	}
+	if wm.buffer.sz < dataStart+pathTokenSz {
+		return nil, errors.Errorf("short buffer for path token [%d < %d]", wm.buffer.sz, dataStart+pathTokenSz)
+	}
+	copy(wm.buffer.data[dataStart:], token)
+	return wm.encodeHeader(pathTokenSz)
+}
+
+func (self *wireMessage) asPathToken() (token []byte, err error) {
+	if self.messageType() != PATH_CHALLENGE && self.messageType() != PATH_RESPONSE {
+		return nil, errors.Errorf("unexpected message type [%d], expected PATH_CHALLENGE or PATH_RESPONSE", self.messageType())
+	}
+	if self.buffer.uz < dataStart+pathTokenSz {
+		return nil, errors.Errorf("short buffer for path token decode [%d < %d]", self.buffer.uz, dataStart+pathTokenSz)
+	}
+	return self.buffer.data[dataStart : dataStart+pathTokenSz], nil
+}
+
+func newReject(reason rejectReason, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     REJECT,
+		buffer: p.get(),
+	}
+	wm.buffer.data[dataStart] = byte(reason)
+	return wm.encodeHeader(1)
+}
+
+func (self *wireMessage) asReject() (reason rejectReason, err error) {
+	if self.messageType() != REJECT {
+		return 0, errors.Errorf("unexpected message type [%d], expected REJECT", self.messageType())
+	}
+	if self.buffer.uz < dataStart+1 {
+		return 0, errors.Errorf("short buffer for reject decode [%d < %d]", self.buffer.uz, dataStart+1)
+	}
+	return rejectReason(self.buffer.data[dataStart]), nil
+}
+
 func (self *wireMessage) encodeHeader(dataSz uint16) (*wireMessage, error) {
 	if self.buffer.sz < uint32(dataStart+dataSz) {
 		return nil, errors.Errorf("short buffer for encode [%d < %d]", self.buffer.sz, dataStart+dataSz)
 	}
 	util.WriteInt32(self.buffer.data[0:4], self.seq)
 	self.buffer.data[4] = byte(self.mt)
-	util.WriteUint16(self.buffer.data[5:dataStart], dataSz)
+	util.WriteUint16(self.buffer.data[5:connIdStart], dataSz)
+	util.WriteUint32(self.buffer.data[connIdStart:dataStart], self.connId)
 	self.buffer.uz = uint32(dataStart + dataSz)
 	return self, nil
 }
 
 func decodeHeader(buffer *buffer) (*wireMessage, error) {
-	sz := util.ReadUint16(buffer.data[5:dataStart])
+	if buffer.uz < dataStart {
+		return nil, errors.Errorf("short header read [%d < %d]", buffer.uz, dataStart)
+	}
+	sz := util.ReadUint16(buffer.data[5:connIdStart])
 	if uint32(dataStart+sz) > buffer.uz {
 		return nil, errors.Errorf("short buffer read [%d != %d]", buffer.sz, dataStart+sz)
 	}
 	wm := &wireMessage{
 		seq:    util.ReadInt32(buffer.data[0:4]),
 		mt:     messageType(buffer.data[4]),
+		connId: util.ReadUint32(buffer.data[connIdStart:dataStart]),
 		buffer: buffer,
 	}
 	return wm, nil
@@ -321,6 +530,12 @@ func (mt messageType) String() string {
 		return "KEEPALIVE"
 	case CLOSE:
 		return "CLOSE"
+	case PATH_CHALLENGE:
+		return "PATH_CHALLENGE"
+	case PATH_RESPONSE:
+		return "PATH_RESPONSE"
+	case REJECT:
+		return "REJECT"
 	default:
 		return "???"
 	}
@@ -334,5 +549,25 @@ func (mt messageType) FlagsString() string {
 	if messageFlag(mt)&RTT == RTT {
 		flags += " RTT"
 	}
+	if messageFlag(mt)&RTT_US == RTT_US {
+		flags += " RTT_US"
+	}
+	if messageFlag(mt)&COOKIE == COOKIE {
+		flags += " COOKIE"
+	}
+	if messageFlag(mt)&PMTU == PMTU {
+		flags += " PMTU"
+	}
 	return strings.TrimSpace(flags)
 }
+
+func (reason rejectReason) String() string {
+	switch reason {
+	case rejectBusy:
+		return "busy"
+	case rejectRateLimited:
+		return "rate limited"
+	default:
+		return "???"
+	}
+}
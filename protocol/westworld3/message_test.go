@@ -3,6 +3,7 @@ package westworld3
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/openziti/dilithium/util"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -19,10 +20,10 @@ var wireMessageBenchmarkPool *pool
 
 func TestHello(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	wm, err := newHello(11, hello{protocolVersion, 6}, nil, p)
+	wm, err := newHello(11, hello{protocolVersion, 6, 0, 0}, nil, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
-	assert.Equal(t, uint32(dataStart+5), wm.buffer.uz)
+	assert.Equal(t, uint32(dataStart+helloPaddedSz), wm.buffer.uz)
 
 	wmOut, err := decodeHeader(wm.buffer)
 	assert.NoError(t, err)
@@ -37,10 +38,10 @@ func TestHello(t *testing.T) {
 
 func TestHelloResponse(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	wm, err := newHello(12, hello{protocolVersion, 6}, &Ack{11, 11}, p)
+	wm, err := newHello(12, hello{protocolVersion, 6, 0xCAFEBABE, 0}, &Ack{11, 11}, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
-	assert.Equal(t, uint32(dataStart+4+5), wm.buffer.uz)
+	assert.Equal(t, uint32(dataStart+4+helloSz), wm.buffer.uz)
 	assert.True(t, wm.hasFlag(INLINE_ACK))
 
 	wmOut, err := decodeHeader(wm.buffer)
@@ -51,6 +52,7 @@ func TestHelloResponse(t *testing.T) {
 	assert.Equal(t, HELLO, wmOut.messageType())
 	assert.Equal(t, protocolVersion, h.version)
 	assert.Equal(t, uint8(6), h.profile)
+	assert.Equal(t, uint32(0xCAFEBABE), h.connId)
 	assert.Equal(t, 1, len(a))
 	assert.Equal(t, int32(11), a[0].Start)
 	assert.Equal(t, int32(11), a[0].End)
@@ -58,8 +60,8 @@ func TestHelloResponse(t *testing.T) {
 
 func TestAck(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	rtt := uint16(332)
-	wm, err := newAck([]Ack{{1, 1}, {3, 5}}, 10240, &rtt, p)
+	rtt := &rttProbe{ts: 332}
+	wm, err := newAck([]Ack{{1, 1}, {3, 5}}, 10240, rtt, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
 
@@ -76,7 +78,24 @@ func TestAck(t *testing.T) {
 	assert.Equal(t, int32(5), a[1].End)
 	assert.Equal(t, int32(10240), rxPortalSz)
 	assert.NotNil(t, rttOut)
-	assert.Equal(t, rtt, *rttOut)
+	assert.Equal(t, rtt, rttOut)
+}
+
+func TestAckWideRTT(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	rtt := &rttProbe{ts: 0xCAFEBABE, wide: true}
+	wm, err := newAck([]Ack{{1, 1}}, 10240, rtt, p)
+	assert.NoError(t, err)
+	assert.True(t, wm.hasFlag(RTT))
+	assert.True(t, wm.hasFlag(RTT_US))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	a, rxPortalSz, rttOut, err := wmOut.asAck()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(a))
+	assert.Equal(t, int32(10240), rxPortalSz)
+	assert.Equal(t, rtt, rttOut)
 }
 
 func TestAckNoRTT(t *testing.T) {
@@ -103,8 +122,7 @@ func TestData(t *testing.T) {
 	_, err := newData(64, nil, wireMessageBenchmarkData[:], p)
 	assert.Error(t, err)
 	p = newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
-	rttIn := new(uint16)
-	*rttIn = 200
+	rttIn := &rttProbe{ts: 200}
 	wm, err2 := newData(64, rttIn, wireMessageBenchmarkData[:], p)
 	assert.NoError(t, err2)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
@@ -117,6 +135,45 @@ func TestData(t *testing.T) {
 	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
 }
 
+func TestDataWideRTT(t *testing.T) {
+	p := newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
+	rttIn := &rttProbe{ts: 0xCAFEBABE, wide: true}
+	wm, err := newData(64, rttIn, wireMessageBenchmarkData[:], p)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(dataStart+4+len(wireMessageBenchmarkData)), wm.buffer.uz)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	data, rttOut, err := wmOut.asData()
+	assert.NoError(t, err)
+	assert.Equal(t, rttIn, rttOut)
+	assert.Equal(t, rttIn, wmOut.rttProbe())
+	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
+}
+
+func TestDataFragment(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	_, err := newDataFragment(1, 3000, 3001, []byte{0x01, 0x02}, p)
+	assert.Error(t, err)
+
+	wm, err := newDataFragment(1, 1450, 4000, []byte{0x01, 0x02}, p)
+	assert.NoError(t, err)
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, DATA, wmOut.messageType())
+	assert.True(t, wmOut.hasFlag(PMTU))
+	offset, total, data, err := wmOut.asDataFragment()
+	assert.NoError(t, err)
+	assert.Equal(t, 1450, offset)
+	assert.Equal(t, 4000, total)
+	assert.Equal(t, []byte{0x01, 0x02}, data)
+
+	// a fragment overflowing its segment is refused
+	util.WriteUint16(wm.buffer.data[dataStart+2:], 1451)
+	_, _, _, err = wmOut.asDataFragment()
+	assert.Error(t, err)
+}
+
 func TestKeepalive(t *testing.T) {
 	p := newPool("test", dataStart+4, NewNilInstrument().NewInstance("", nil))
 	wm, err := newKeepalive(23411, p)
@@ -132,6 +189,37 @@ func TestKeepalive(t *testing.T) {
 	assert.Equal(t, 23411, rxPortalSz)
 }
 
+func TestPmtuProbe(t *testing.T) {
+	p := newPool("test", 4096, NewNilInstrument().NewInstance("", nil))
+	_, err := newPmtuProbe(4096, p)
+	assert.Error(t, err)
+
+	wm, err := newPmtuProbe(2000, p)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(dataStart+4+2000), wm.buffer.uz)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, KEEPALIVE, wmOut.messageType())
+	probeSz, err := wmOut.asPmtuProbe()
+	assert.NoError(t, err)
+	assert.Equal(t, 2000, probeSz)
+
+	ack, err := newPmtuProbeAck(2000, p)
+	assert.NoError(t, err)
+	ackOut, err := decodeHeader(ack.buffer)
+	assert.NoError(t, err)
+	assert.True(t, ackOut.hasFlag(INLINE_ACK))
+	probeSz, err = ackOut.asPmtuProbe()
+	assert.NoError(t, err)
+	assert.Equal(t, 2000, probeSz)
+
+	// a truncated probe does not confirm its size
+	ackOut.clearFlag(INLINE_ACK)
+	_, err = ackOut.asPmtuProbe()
+	assert.Error(t, err)
+}
+
 func TestClose(t *testing.T) {
 	p := newPool("test", dataStart, NewNilInstrument().NewInstance("", nil))
 	wm, err := newClose(10233, p)
@@ -144,6 +232,56 @@ func TestClose(t *testing.T) {
 	assert.Equal(t, CLOSE, wmOut.mt)
 }
 
+func TestPathChallenge(t *testing.T) {
+	p := newPool("test", dataStart+pathTokenSz, NewNilInstrument().NewInstance("", nil))
+	token := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	wm, err := newPathChallenge(token, p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, PATH_CHALLENGE, wmOut.messageType())
+	tokenOut, err := wmOut.asPathToken()
+	assert.NoError(t, err)
+	assert.Equal(t, token, tokenOut)
+
+	_, err = newPathResponse(token[:4], p)
+	assert.Error(t, err)
+}
+
+func TestReject(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	wm, err := newReject(rejectRateLimited, p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, REJECT, wmOut.messageType())
+	reason, err := wmOut.asReject()
+	assert.NoError(t, err)
+	assert.Equal(t, rejectRateLimited, reason)
+
+	_, _, err = wmOut.asHello()
+	assert.Error(t, err)
+}
+
+func TestConnIdHeader(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	wm, err := newClose(10233, p)
+	assert.NoError(t, err)
+	util.WriteUint32(wm.buffer.data[connIdStart:dataStart], 0xCAFEBABE)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0xCAFEBABE), wmOut.connId)
+
+	wm.buffer.uz = dataStart - 1
+	_, err = decodeHeader(wm.buffer)
+	assert.Error(t, err)
+}
+
 func TestWireMessageInsertData(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
 	wm := &wireMessage{seq: 0, mt: DATA, buffer: p.get()}
@@ -169,6 +169,18 @@ func (self *metricsInstrument) writeAllSamples() error {
 		if err := util.WriteSamples("dup_acks", outPath, ii.dupAcks); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("fast_retx_msgs", outPath, ii.fastRetxMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("timeout_retx_msgs", outPath, ii.timeoutRetxMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("pacing_rate", outPath, ii.pacingRate); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("max_segment_sz", outPath, ii.maxSegmentSz); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("rx_portal_sz", outPath, ii.rxPortalSz); err != nil {
 			return err
 		}
@@ -178,6 +190,12 @@ func (self *metricsInstrument) writeAllSamples() error {
 		if err := util.WriteSamples("dup_rx_msgs", outPath, ii.dupRxMsgs); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("out_of_window_rx_bytes", outPath, ii.outOfWindowRxBytes); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("out_of_window_rx_msgs", outPath, ii.outOfWindowRxMsgs); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("allocations", outPath, ii.allocations); err != nil {
 			return err
 		}
@@ -247,25 +265,37 @@ type metricsInstrumentInstance struct {
 	rxKeepaliveMsgs       []*util.Sample
 	rxKeepaliveMsgsAccum  int64
 
-	txPortalCapacity    []*util.Sample
-	txPortalCapacityVal int64
-	txPortalSz          []*util.Sample
-	txPortalSzVal       int64
-	txPortalRxSz        []*util.Sample
-	txPortalRxSzVal     int64
-	retxMs              []*util.Sample
-	retxMsVal           int64
-	retxScale           []*util.Sample
-	retxScaleVal        int64
-	dupAcks             []*util.Sample
-	dupAcksAccum        int64
-
-	rxPortalSz      []*util.Sample
-	rxPortalSzVal   int64
-	dupRxBytes      []*util.Sample
-	dupRxBytesAccum int64
-	dupRxMsgs       []*util.Sample
-	dupRxMsgsAccum  int64
+	txPortalCapacity     []*util.Sample
+	txPortalCapacityVal  int64
+	txPortalSz           []*util.Sample
+	txPortalSzVal        int64
+	txPortalRxSz         []*util.Sample
+	txPortalRxSzVal      int64
+	retxMs               []*util.Sample
+	retxMsVal            int64
+	retxScale            []*util.Sample
+	retxScaleVal         int64
+	dupAcks              []*util.Sample
+	dupAcksAccum         int64
+	fastRetxMsgs         []*util.Sample
+	fastRetxMsgsAccum    int64
+	timeoutRetxMsgs      []*util.Sample
+	timeoutRetxMsgsAccum int64
+	pacingRate           []*util.Sample
+	pacingRateVal        int64
+	maxSegmentSz         []*util.Sample
+	maxSegmentSzVal      int64
+
+	rxPortalSz              []*util.Sample
+	rxPortalSzVal           int64
+	dupRxBytes              []*util.Sample
+	dupRxBytesAccum         int64
+	dupRxMsgs               []*util.Sample
+	dupRxMsgsAccum          int64
+	outOfWindowRxBytes      []*util.Sample
+	outOfWindowRxBytesAccum int64
+	outOfWindowRxMsgs       []*util.Sample
+	outOfWindowRxMsgsAccum  int64
 
 	allocations      []*util.Sample
 	allocationsAccum int64
@@ -407,6 +437,30 @@ func (self *metricsInstrumentInstance) DuplicateAck(*net.UDPAddr, int32) {
 	}
 }
 
+func (self *metricsInstrumentInstance) FastRetransmit(*net.UDPAddr, *wireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.fastRetxMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TimeoutRetransmit(*net.UDPAddr, *wireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.timeoutRetxMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) PacingRateChanged(_ *net.UDPAddr, bytesPerSec int) {
+	if self.config.Enabled {
+		atomic.StoreInt64(&self.pacingRateVal, int64(bytesPerSec))
+	}
+}
+
+func (self *metricsInstrumentInstance) MaxSegmentSzChanged(_ *net.UDPAddr, maxSegmentSz int) {
+	if self.config.Enabled {
+		atomic.StoreInt64(&self.maxSegmentSzVal, int64(maxSegmentSz))
+	}
+}
+
 /*
  * rxPortal
  */
@@ -423,6 +477,13 @@ func (self *metricsInstrumentInstance) DuplicateRx(_ *net.UDPAddr, wm *wireMessa
 	}
 }
 
+func (self *metricsInstrumentInstance) OutOfWindowRx(_ *net.UDPAddr, wm *wireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.outOfWindowRxBytesAccum, int64(wm.buffer.uz))
+		atomic.AddInt64(&self.outOfWindowRxMsgsAccum, 1)
+	}
+}
+
 /*
  * allocation
  */
@@ -482,9 +543,15 @@ func (self *metricsInstrumentInstance) snapshot() {
 	self.retxMs = append(self.retxMs, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxMsVal)})
 	self.retxScale = append(self.retxScale, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxScaleVal)})
 	self.dupAcks = append(self.dupAcks, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupAcksAccum, 0)})
+	self.fastRetxMsgs = append(self.fastRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.fastRetxMsgsAccum, 0)})
+	self.timeoutRetxMsgs = append(self.timeoutRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.timeoutRetxMsgsAccum, 0)})
+	self.pacingRate = append(self.pacingRate, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.pacingRateVal)})
+	self.maxSegmentSz = append(self.maxSegmentSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.maxSegmentSzVal)})
 	self.rxPortalSz = append(self.rxPortalSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.rxPortalSzVal)})
 	self.dupRxBytes = append(self.dupRxBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxBytesAccum, 0)})
 	self.dupRxMsgs = append(self.dupRxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxMsgsAccum, 0)})
+	self.outOfWindowRxBytes = append(self.outOfWindowRxBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.outOfWindowRxBytesAccum, 0)})
+	self.outOfWindowRxMsgs = append(self.outOfWindowRxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.outOfWindowRxMsgsAccum, 0)})
 	self.allocations = append(self.allocations, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.allocationsAccum, 0)})
 	self.errors = append(self.errors, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.errorsAccum, 0)})
 }
@@ -44,12 +44,16 @@ func (self *nilInstrumentInstance) RxKeepalive(*net.UDPAddr, *wireMessage) {}
 /*
  * txPortal
  */
-func (self *nilInstrumentInstance) TxPortalCapacityChanged(*net.UDPAddr, int) {}
-func (self *nilInstrumentInstance) TxPortalSzChanged(*net.UDPAddr, int)       {}
-func (self *nilInstrumentInstance) TxPortalRxSzChanged(*net.UDPAddr, int)     {}
-func (self *nilInstrumentInstance) NewRetxMs(*net.UDPAddr, int)               {}
-func (self *nilInstrumentInstance) NewRetxScale(*net.UDPAddr, float64)        {}
-func (self *nilInstrumentInstance) DuplicateAck(*net.UDPAddr, int32)          {}
+func (self *nilInstrumentInstance) TxPortalCapacityChanged(*net.UDPAddr, int)    {}
+func (self *nilInstrumentInstance) TxPortalSzChanged(*net.UDPAddr, int)          {}
+func (self *nilInstrumentInstance) TxPortalRxSzChanged(*net.UDPAddr, int)        {}
+func (self *nilInstrumentInstance) NewRetxMs(*net.UDPAddr, int)                  {}
+func (self *nilInstrumentInstance) NewRetxScale(*net.UDPAddr, float64)           {}
+func (self *nilInstrumentInstance) DuplicateAck(*net.UDPAddr, int32)             {}
+func (self *nilInstrumentInstance) FastRetransmit(*net.UDPAddr, *wireMessage)    {}
+func (self *nilInstrumentInstance) TimeoutRetransmit(*net.UDPAddr, *wireMessage) {}
+func (self *nilInstrumentInstance) PacingRateChanged(*net.UDPAddr, int)          {}
+func (self *nilInstrumentInstance) MaxSegmentSzChanged(*net.UDPAddr, int)        {}
 
 /*
  * rxPortal
@@ -57,6 +61,8 @@ func (self *nilInstrumentInstance) DuplicateAck(*net.UDPAddr, int32)          {}
 func (self *nilInstrumentInstance) RxPortalSzChanged(*net.UDPAddr, int)    {}
 func (self *nilInstrumentInstance) DuplicateRx(*net.UDPAddr, *wireMessage) {}
 
+func (self *nilInstrumentInstance) OutOfWindowRx(*net.UDPAddr, *wireMessage) {}
+
 /*
  * allocation
  */
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package westworld3
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// socket options from linux/udp.h, which the syscall package does not define
+const (
+	udpSegment = 103
+	udpGro     = 104
+)
+
+// groOobSz is the control buffer required to receive the UDP_GRO segment size.
+var groOobSz = syscall.CmsgSpace(4)
+
+// enableOffload reports whether the kernel supports UDP segmentation offload for conn, and enables receive offload.
+func enableOffload(conn *net.UDPConn) (gso, gro bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	_ = rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment)
+		gso = err == nil
+		gro = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGro, 1) == nil
+	})
+	return gso, gro
+}
+
+// gsoControl builds the UDP_SEGMENT control message that asks the kernel to split a send into segmentSz datagrams.
+func gsoControl(segmentSz int) []byte {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(segmentSz)
+	return oob
+}
+
+// groSegmentSz extracts the size of the datagrams coalesced into a receive, or 0 if the receive was not coalesced.
+func groSegmentSz(oob []byte) int {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level == syscall.IPPROTO_UDP && cmsg.Header.Type == udpGro && len(cmsg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+		}
+	}
+	return 0
+}
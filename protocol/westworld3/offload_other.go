@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package westworld3
+
+import "net"
+
+const groOobSz = 0
+
+// enableOffload is only supported on linux; elsewhere, batch_io moves individual datagrams.
+func enableOffload(*net.UDPConn) (gso, gro bool) {
+	return false, false
+}
+
+func gsoControl(int) []byte {
+	return nil
+}
+
+func groSegmentSz([]byte) int {
+	return 0
+}
@@ -0,0 +1,42 @@
+package westworld3
+
+import (
+	"math"
+	"time"
+)
+
+// pacer is a token bucket that spaces transmissions at a multiple of the tx algorithm's estimated rate, so that the
+// available portal capacity is not written to the wire in a single burst. Up to burst bytes may be sent back-to-back.
+type pacer struct {
+	gain   float64
+	burst  float64
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(gain float64, burst int) *pacer {
+	return &pacer{gain: gain, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// update sets the pacing rate from the algorithm's estimate in bytes per second, returning true when it changed.
+func (self *pacer) update(estimate float64) bool {
+	rate := estimate * self.gain
+	changed := int(rate) != int(self.rate)
+	self.rate = rate
+	return changed
+}
+
+// delay takes sz bytes from the bucket, returning how long the transmitter must wait to repay any shortfall.
+func (self *pacer) delay(sz int, now time.Time) time.Duration {
+	elapsed := now.Sub(self.last)
+	self.last = now
+	if self.rate <= 0 {
+		return 0
+	}
+	self.tokens = math.Min(self.tokens+elapsed.Seconds()*self.rate, self.burst) - float64(sz)
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
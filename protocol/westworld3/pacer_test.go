@@ -0,0 +1,84 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	p := newPacer(1.0, 3000)
+	now := time.Now()
+
+	// no rate estimate, no pacing
+	assert.Equal(t, time.Duration(0), p.delay(100000, now))
+
+	assert.True(t, p.update(1000000))
+	assert.False(t, p.update(1000000))
+
+	// the burst is sent immediately, after which each byte waits 1us
+	assert.Equal(t, time.Duration(0), p.delay(1500, now))
+	assert.Equal(t, time.Duration(0), p.delay(1500, now))
+	assert.Equal(t, 1500*time.Microsecond, p.delay(1500, now))
+
+	// after repaying the shortfall, transmission continues at the rate
+	now = now.Add(1500 * time.Microsecond)
+	assert.Equal(t, 1500*time.Microsecond, p.delay(1500, now))
+
+	// idle time refills no more than the burst
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), p.delay(3000, now))
+	assert.Equal(t, time.Millisecond, p.delay(1000, now))
+}
+
+func TestPacerGain(t *testing.T) {
+	p := newPacer(1.25, 0)
+	p.update(1000000)
+	assert.Equal(t, 1250000.0, p.rate)
+	assert.Equal(t, time.Millisecond, p.delay(1250, time.Now()))
+}
+
+func TestPortalAlgorithmPacingRate(t *testing.T) {
+	profile := NewBaselineProfile()
+	alg := newTestRetxMonitor(profile).alg.(*portalAlgorithm)
+	assert.Equal(t, 0.0, alg.PacingRate())
+
+	alg.UpdateRTT(100 * time.Millisecond)
+	assert.Equal(t, float64(profile.TxPortalStartSz)*10, alg.PacingRate())
+}
+
+func TestTxPortalPaceInterrupted(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.TxPacing = true
+	conn := newEmulatedNetwork().bind(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6161}, util.NewEmulatorConfig(0))
+	p := newPath(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6262})
+	ii := &nilInstrumentInstance{}
+
+	for _, interrupt := range []func(*txPortal){
+		func(txp *txPortal) { txp.close() },
+		func(txp *txPortal) { txp.deadline.set(time.Now()) },
+	} {
+		txp, err := newTxPortal(p, nil, profile, newPool("test", 1024, ii), ii)
+		assert.NoError(t, err)
+		// paced at the start portal per 10 seconds, a megabyte waits for minutes
+		txp.alg.UpdateRTT(10 * time.Second)
+
+		paced := make(chan bool)
+		go func() {
+			txp.lock.Lock()
+			defer txp.lock.Unlock()
+			paced <- txp.pace(1024 * 1024)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		interrupt(txp)
+
+		select {
+		case ok := <-paced:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			assert.Fail(t, "pacing was not interrupted")
+		}
+	}
+}
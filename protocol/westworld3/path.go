@@ -0,0 +1,40 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"net"
+	"sync/atomic"
+)
+
+type path struct {
+	conn   datagramConn
+	connId uint32
+	addr   atomic.Value
+}
+
+func newPath(conn datagramConn, peer *net.UDPAddr) *path {
+	p := &path{conn: conn}
+	p.addr.Store(peer)
+	return p
+}
+
+func (self *path) peer() *net.UDPAddr {
+	return self.addr.Load().(*net.UDPAddr)
+}
+
+func (self *path) migrate(peer *net.UDPAddr) {
+	self.addr.Store(peer)
+}
+
+func (self *path) write(wm *wireMessage) error {
+	return self.writeTo(wm, self.peer())
+}
+
+func (self *path) writeTo(wm *wireMessage, peer *net.UDPAddr) error {
+	if wm.buffer.uz < dataStart {
+		return errors.New("truncated buffer")
+	}
+	util.WriteUint32(wm.buffer.data[connIdStart:dataStart], self.connId)
+	return writeWireMessage(wm, self.conn, peer)
+}
@@ -0,0 +1,81 @@
+package westworld3
+
+import (
+	"bytes"
+	"errors"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func transferEmulated(t *testing.T, from, to net.Conn, sz int) {
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(int64(sz))).Read(data)
+	go func() {
+		_, err := from.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, sz)
+	_, err := io.ReadFull(to, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+}
+
+func TestConnectionMigration(t *testing.T) {
+	dialed, accepted, l := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+	transferEmulated(t, dialed, accepted, 64*1024)
+	transferEmulated(t, accepted, dialed, 64*1024)
+
+	rebound := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 7000}
+	dialed.(*dialerConn).conn.(*emulatedUDPConn).rebind(rebound)
+
+	transferEmulated(t, dialed, accepted, 64*1024)
+	transferEmulated(t, accepted, dialed, 64*1024)
+
+	assert.Equal(t, rebound.String(), accepted.RemoteAddr().String())
+	assert.Equal(t, 1, len(l.conns()))
+	_, found := l.peers.Get(rebound)
+	assert.True(t, found)
+}
+
+func TestPathValidationRejectsSpoofedPeer(t *testing.T) {
+	dialed, accepted, l := emulatedPair(t, util.NewEmulatorConfig(1), util.NewEmulatorConfig(2), NewBaselineProfile(), NewBaselineProfile())
+	transferEmulated(t, dialed, accepted, 1024)
+	peer := accepted.RemoteAddr().String()
+
+	attackerAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 6262}
+	attacker := l.conn.(*emulatedUDPConn).network.bind(attackerAddr, util.NewEmulatorConfig(3))
+	attackerPath := newPath(attacker, l.addr)
+	attackerPath.connId = accepted.(*listenerConn).path.connId
+	pool := newPool("attacker", uint32(dataStart+NewBaselineProfile().MaxSegmentSz), NewNilInstrument().NewInstance("", nil))
+
+	keepalive, err := newKeepalive(0, pool)
+	assert.NoError(t, err)
+	assert.NoError(t, attackerPath.write(keepalive))
+
+	// the attacker is challenged, and a response with the wrong token does not migrate the connection
+	assert.NoError(t, attacker.SetReadDeadline(time.Now().Add(time.Second)))
+	challenge, _, err := readWireMessage(attacker, pool)
+	assert.NoError(t, err)
+	assert.Equal(t, PATH_CHALLENGE, challenge.messageType())
+	response, err := newPathResponse(make([]byte, pathTokenSz), pool)
+	assert.NoError(t, err)
+	assert.NoError(t, attackerPath.write(response))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, peer, accepted.RemoteAddr().String())
+	transferEmulated(t, accepted, dialed, 1024)
+
+	// data from the unvalidated address is not delivered, even at the next expected sequence
+	data, err := newData(dialed.(*dialerConn).seq.Next(), nil, []byte("injected"), pool)
+	assert.NoError(t, err)
+	assert.NoError(t, attackerPath.write(data))
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(250*time.Millisecond)))
+	_, err = accepted.Read(make([]byte, 64))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
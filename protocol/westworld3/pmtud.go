@@ -0,0 +1,104 @@
+package westworld3
+
+import "time"
+
+// pmtudResolution is the precision, in bytes, to which the path MTU search converges.
+const pmtudResolution = 16
+
+// pmtud is a datagram packetization layer path MTU discovery (RFC 8899) search for the largest segment size that the
+// path will deliver. Candidate sizes are probed with padded probes, which the peer acknowledges. The search starts from
+// MaxSegmentSz, which is assumed to be deliverable on any path, and is bounded by PmtuMaxSegmentSz.
+type pmtud struct {
+	segmentSz   int
+	high        int
+	probeSz     int
+	probeCt     int
+	lastProbe   time.Time
+	searched    time.Time
+	blackHoleCt int
+	profile     *Profile
+}
+
+func newPmtud(profile *Profile) *pmtud {
+	p := &pmtud{profile: profile}
+	p.reset()
+	return p
+}
+
+// reset returns to the base segment size, and restarts the search.
+func (self *pmtud) reset() {
+	self.segmentSz = self.profile.MaxSegmentSz
+	self.high = self.profile.PmtuMaxSegmentSz
+	self.probeSz = 0
+	self.probeCt = 0
+	self.searched = time.Time{}
+	self.blackHoleCt = 0
+}
+
+// next returns the size of the probe that is due at now, or 0 when no probe is due. A probe that is unacknowledged
+// after PmtuMaxProbes attempts bounds the search below its size.
+func (self *pmtud) next(now time.Time) int {
+	if !self.searched.IsZero() {
+		if now.Sub(self.searched) < time.Duration(self.profile.PmtuRaiseMs)*time.Millisecond {
+			return 0
+		}
+		// the path may have changed; search above the current segment size again
+		self.high = self.profile.PmtuMaxSegmentSz
+		self.searched = time.Time{}
+	}
+	if self.probeSz != 0 {
+		if now.Sub(self.lastProbe) < time.Duration(self.profile.PmtuProbeMs)*time.Millisecond {
+			return 0
+		}
+		if self.probeCt >= self.profile.PmtuMaxProbes {
+			self.high = self.probeSz - 1
+			self.probeSz = 0
+		}
+	}
+	if self.probeSz == 0 {
+		if self.high-self.segmentSz < pmtudResolution {
+			self.searched = now
+			return 0
+		}
+		self.probeSz = self.segmentSz + (self.high-self.segmentSz+1)/2
+		self.probeCt = 0
+	}
+	self.probeCt++
+	self.lastProbe = now
+	return self.probeSz
+}
+
+// ack confirms that the path delivered a probe of probeSz, returning true when the segment size grows.
+func (self *pmtud) ack(probeSz int) bool {
+	if probeSz <= self.segmentSz || probeSz > self.high {
+		return false
+	}
+	self.segmentSz = probeSz
+	if probeSz >= self.probeSz {
+		self.probeSz = 0
+	}
+	self.blackHoleCt = 0
+	return true
+}
+
+// delivered notes that a segment of segmentSz was acknowledged.
+func (self *pmtud) delivered(segmentSz int) {
+	if segmentSz > self.profile.MaxSegmentSz {
+		self.blackHoleCt = 0
+	}
+}
+
+// lost notes that a segment of segmentSz timed out. When PmtuMaxProbes segments larger than MaxSegmentSz time out
+// without any of them being delivered, the path is assumed to have become a black hole for the current segment size,
+// and the search restarts from MaxSegmentSz. Returns true when the segment size was reset.
+func (self *pmtud) lost(segmentSz int) bool {
+	if segmentSz <= self.profile.MaxSegmentSz || self.segmentSz == self.profile.MaxSegmentSz {
+		return false
+	}
+	self.blackHoleCt++
+	if self.blackHoleCt >= self.profile.PmtuMaxProbes {
+		self.reset()
+		return true
+	}
+	return false
+}
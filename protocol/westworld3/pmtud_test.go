@@ -0,0 +1,66 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// pmtudSearch runs the search against a path delivering probes up to pathSz, returning the converged segment size.
+func pmtudSearch(p *pmtud, pathSz int, now time.Time) (int, time.Time) {
+	for i := 0; i < 1000; i++ {
+		now = now.Add(time.Duration(p.profile.PmtuProbeMs) * time.Millisecond)
+		probeSz := p.next(now)
+		if probeSz == 0 && !p.searched.IsZero() {
+			break
+		}
+		if probeSz > 0 && probeSz <= pathSz {
+			p.ack(probeSz)
+		}
+	}
+	return p.segmentSz, now
+}
+
+func TestPmtudConverges(t *testing.T) {
+	profile := NewBaselineProfile()
+	for _, pathSz := range []int{profile.MaxSegmentSz, 1500, 4000, profile.PmtuMaxSegmentSz, 65000} {
+		p := newPmtud(profile)
+		segmentSz, _ := pmtudSearch(p, pathSz, time.Now())
+		expected := pathSz
+		if expected > profile.PmtuMaxSegmentSz {
+			expected = profile.PmtuMaxSegmentSz
+		}
+		assert.LessOrEqual(t, segmentSz, expected, "path %d", pathSz)
+		assert.Greater(t, segmentSz, expected-pmtudResolution, "path %d", pathSz)
+	}
+}
+
+func TestPmtudRaise(t *testing.T) {
+	profile := NewBaselineProfile()
+	p := newPmtud(profile)
+	segmentSz, now := pmtudSearch(p, 1500, time.Now())
+	assert.Equal(t, 0, p.next(now.Add(time.Duration(profile.PmtuRaiseMs-1)*time.Millisecond)))
+
+	// after the raise timer, the search resumes above the current segment size
+	now = now.Add(time.Duration(profile.PmtuRaiseMs) * time.Millisecond)
+	assert.Greater(t, p.next(now), segmentSz)
+	raised, _ := pmtudSearch(p, 4000, now)
+	assert.Greater(t, raised, 4000-pmtudResolution)
+}
+
+func TestPmtudBlackHole(t *testing.T) {
+	profile := NewBaselineProfile()
+	p := newPmtud(profile)
+	segmentSz, _ := pmtudSearch(p, 4000, time.Now())
+
+	// base size and delivered segments do not count towards a black hole
+	assert.False(t, p.lost(profile.MaxSegmentSz))
+	assert.False(t, p.lost(segmentSz))
+	p.delivered(segmentSz)
+	for i := 0; i < profile.PmtuMaxProbes-1; i++ {
+		assert.False(t, p.lost(segmentSz))
+	}
+	assert.True(t, p.lost(segmentSz))
+	assert.Equal(t, profile.MaxSegmentSz, p.segmentSz)
+	assert.False(t, p.lost(segmentSz))
+}
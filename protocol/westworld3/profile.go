@@ -1,8 +1,12 @@
 package westworld3
 
 import (
+	"crypto/rand"
 	"github.com/openziti-incubator/cf"
+	"github.com/openziti/dilithium"
 	"github.com/pkg/errors"
+	"math"
+	"math/big"
 	"reflect"
 )
 
@@ -36,10 +40,19 @@ func GetProfile(id byte) *Profile {
 type Profile struct {
 	RandomizeSeq                bool    `cf:"randomize_seq"`
 	ConnectionSetupTimeoutMs    int     `cf:"connection_setup_timeout_ms"`
+	HelloCookies                bool    `cf:"hello_cookies"`
+	HelloCookieLifetimeMs       int     `cf:"hello_cookie_lifetime_ms"`
 	ConnectionInactiveTimeoutMs int     `cf:"connection_inactive_timeout_ms"`
 	SendKeepalive               bool    `cf:"send_keepalive"`
 	CloseWaitMs                 int     `cf:"close_wait_ms"`
 	CloseCheckMs                int     `cf:"close_check_ms"`
+	ListenerDrainMs             int     `cf:"listener_drain_ms"`
+	ListenerMaxPendingHellos    int     `cf:"listener_max_pending_hellos"`
+	ListenerHelloRatePerIp      float64 `cf:"listener_hello_rate_per_ip"`
+	ListenerHelloBurstPerIp     int     `cf:"listener_hello_burst_per_ip"`
+	ListenerHelloMaxIps         int     `cf:"listener_hello_max_ips"`
+	ListenerReactor             bool    `cf:"listener_reactor"`
+	ListenerReactorWorkers      int     `cf:"listener_reactor_workers"`
 	TxPortalStartSz             int     `cf:"tx_portal_start_sz"`
 	TxPortalMinSz               int     `cf:"tx_portal_min_sz"`
 	TxPortalMaxSz               int     `cf:"tx_portal_max_sz"`
@@ -52,21 +65,39 @@ type Profile struct {
 	TxPortalRetxCapacityScale   float64 `cf:"tx_portal_retx_capacity_scale"`
 	TxPortalRetxSuccessScale    float64 `cf:"tx_portal_retx_success_scale"`
 	TxPortalRxSzPressureScale   float64 `cf:"tx_portal_rx_sz_pressure_scale"`
+	TxPacing                    bool    `cf:"tx_pacing"`
+	TxPacingGain                float64 `cf:"tx_pacing_gain"`
+	TxPacingBurstSz             int     `cf:"tx_pacing_burst_sz"`
 	RetxStartMs                 int     `cf:"retx_start_ms"`
 	RetxScale                   float64 `cf:"retx_scale"`
 	RetxScaleFloor              float64 `cf:"retx_scale_floor"`
 	RetxAddMs                   int     `cf:"retx_add_ms"`
+	RetxMaxMs                   int     `cf:"retx_max_ms"`
 	RetxEvaluationMs            int     `cf:"retx_evaluation_ms"`
 	RetxEvaluationScaleIncr     float64 `cf:"retx_evaluation_scale_incr"`
 	RetxEvaluationScaleDecr     float64 `cf:"retx_evaluation_scale_decr"`
 	RetxBatchMs                 int     `cf:"retx_batch_ms"`
+	FastRetxThresh              int     `cf:"fast_retx_thresh"`
 	RttProbeMs                  int     `cf:"rtt_probe_ms"`
-	RttProbeAvg                 int     `cf:"rtt_probe_avg"`
+	RttProbeAvg                 int     `cf:"rtt_probe_avg"` // Deprecated: ignored; retx is derived from the smoothed RTT
+	RttProbeUs                  bool    `cf:"rtt_probe_us"`
 	RxPortalSzPacingThresh      float64 `cf:"rx_portal_sz_pacing_thresh"`
+	RxWindowSz                  int     `cf:"rx_window_sz"`
+	RxWindowSeqs                int     `cf:"rx_window_seqs"`
+	AckDelayMs                  int     `cf:"ack_delay_ms"`
+	AckCoalesceThresh           int     `cf:"ack_coalesce_thresh"`
 	MaxSegmentSz                int     `cf:"max_segment_sz"`
+	PmtuDiscovery               bool    `cf:"pmtu_discovery"`
+	PmtuMaxSegmentSz            int     `cf:"pmtu_max_segment_sz"`
+	PmtuProbeMs                 int     `cf:"pmtu_probe_ms"`
+	PmtuMaxProbes               int     `cf:"pmtu_max_probes"`
+	PmtuRaiseMs                 int     `cf:"pmtu_raise_ms"`
 	PoolBufferSz                int     `cf:"pool_buffer_sz"`
 	RxBufferSz                  int     `cf:"rx_buffer_sz"`
 	TxBufferSz                  int     `cf:"tx_buffer_sz"`
+	BatchIo                     bool    `cf:"batch_io"`
+	BatchIoSz                   int     `cf:"batch_io_sz"`
+	UdpOffload                  bool    `cf:"udp_offload"`
 	TxPortalTreeLen             int     `cf:"tx_portal_tree_len"`
 	RetxMonitorTreeLen          int     `cf:"retx_monitor_tree_len"`
 	RxPortalTreeLen             int     `cf:"rx_portal_tree_len"`
@@ -75,16 +106,26 @@ type Profile struct {
 	ListenerRxQueueLen          int     `cf:"listener_rx_queue_len"`
 	AcceptQueueLen              int     `cf:"accept_queue_len"`
 	i                           Instrument
+	txAlgorithm                 dilithium.TxAlgorithmProfile
 }
 
 func NewBaselineProfile() *Profile {
 	return &Profile{
 		RandomizeSeq:                false,
 		ConnectionSetupTimeoutMs:    5000,
+		HelloCookies:                false,
+		HelloCookieLifetimeMs:       5000,
 		ConnectionInactiveTimeoutMs: 15000,
 		SendKeepalive:               true,
 		CloseWaitMs:                 5000,
 		CloseCheckMs:                500,
+		ListenerDrainMs:             0,
+		ListenerMaxPendingHellos:    128,
+		ListenerHelloRatePerIp:      0,
+		ListenerHelloBurstPerIp:     16,
+		ListenerHelloMaxIps:         64 * 1024,
+		ListenerReactor:             false,
+		ListenerReactorWorkers:      2,
 		TxPortalStartSz:             96 * 1024,
 		TxPortalMinSz:               16 * 1024,
 		TxPortalMaxSz:               4 * 1024 * 1024,
@@ -97,21 +138,39 @@ func NewBaselineProfile() *Profile {
 		TxPortalRetxCapacityScale:   0.75,
 		TxPortalRetxSuccessScale:    0.825,
 		TxPortalRxSzPressureScale:   2.8911,
+		TxPacing:                    false,
+		TxPacingGain:                1.25,
+		TxPacingBurstSz:             16 * 1024,
 		RetxStartMs:                 200,
 		RetxScale:                   1.5,
 		RetxScaleFloor:              1.0,
 		RetxAddMs:                   0,
+		RetxMaxMs:                   8000,
 		RetxEvaluationMs:            2000,
 		RetxEvaluationScaleIncr:     0.15,
 		RetxEvaluationScaleDecr:     0.01,
 		RetxBatchMs:                 2,
+		FastRetxThresh:              3,
 		RttProbeMs:                  50,
 		RttProbeAvg:                 8,
+		RttProbeUs:                  false,
 		RxPortalSzPacingThresh:      0.5,
+		RxWindowSz:                  8 * 1024 * 1024,
+		RxWindowSeqs:                32 * 1024,
+		AckDelayMs:                  0,
+		AckCoalesceThresh:           16,
 		MaxSegmentSz:                1450,
+		PmtuDiscovery:               false,
+		PmtuMaxSegmentSz:            8900,
+		PmtuProbeMs:                 500,
+		PmtuMaxProbes:               3,
+		PmtuRaiseMs:                 600000,
 		PoolBufferSz:                64 * 1024,
 		RxBufferSz:                  16 * 1024 * 1024,
 		TxBufferSz:                  16 * 1024 * 1024,
+		BatchIo:                     false,
+		BatchIoSz:                   64,
+		UdpOffload:                  false,
 		TxPortalTreeLen:             16 * 1024,
 		RetxMonitorTreeLen:          64 * 1024,
 		RxPortalTreeLen:             16 * 1024,
@@ -159,9 +218,62 @@ func (self *Profile) Load(data map[string]interface{}) error {
 			return errors.New("invalid instrument map")
 		}
 	}
+	if v, found := data["tx_algorithm"]; found {
+		submap, oks := v.(map[string]interface{})
+		if !oks {
+			submap = cf.MapIToMapS(v.(map[interface{}]interface{}))
+			oks = true
+		}
+		if oks {
+			if v, found := submap["name"]; found {
+				if name, ok := v.(string); ok {
+					if p, err := NewTxAlgorithmProfile(name, submap); err == nil {
+						self.txAlgorithm = p
+					} else {
+						return errors.Wrap(err, "error configuring tx algorithm")
+					}
+				} else {
+					return errors.New("invalid 'name' field")
+				}
+			} else {
+				return errors.New("tx_algorithm missing 'name' field")
+			}
+		} else {
+			return errors.New("invalid tx_algorithm map")
+		}
+	}
 	return cf.Bind(self, data, cf.DefaultOptions())
 }
 
+func (self *Profile) SetTxAlgorithm(p dilithium.TxAlgorithmProfile) {
+	self.txAlgorithm = p
+}
+
+// randomSeq chooses the starting sequence of a connection with randomize_seq.
+var randomSeq = func() (int32, error) {
+	seq, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+	if err != nil {
+		return 0, errors.Wrap(err, "random sequence")
+	}
+	return int32(seq.Int64()), nil
+}
+
+func (self *Profile) startSeq() (int32, error) {
+	if self.RandomizeSeq {
+		return randomSeq()
+	}
+	return 0, nil
+}
+
+// maxDatagramSz is the size of the largest datagram that is sent or received. With pmtu_discovery, segments may grow to
+// pmtu_max_segment_sz, and probes are padded to also fit a wide RTT probe.
+func (self *Profile) maxDatagramSz() uint32 {
+	if self.PmtuDiscovery {
+		return uint32(dataStart + 4 + self.PmtuMaxSegmentSz)
+	}
+	return uint32(dataStart + self.MaxSegmentSz)
+}
+
 func (self *Profile) Dump() string {
 	return cf.Dump(self, cf.DefaultOptions())
 }
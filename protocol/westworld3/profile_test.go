@@ -3,6 +3,7 @@ package westworld3
 import (
 	"fmt"
 	"github.com/openziti-incubator/cf"
+	"github.com/openziti/dilithium"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -13,6 +14,7 @@ func TestProfileLoad(t *testing.T) {
 	d["randomize_seq"] = true
 	d["tx_portal_start_sz"] = 17 * 1024
 	d["tx_portal_dupack_capacity_scale"] = 4.5
+	d["rtt_probe_avg"] = 4
 	assert.False(t, p.RandomizeSeq)
 	assert.Equal(t, 96*1024, p.TxPortalStartSz)
 	assert.Equal(t, 0.9, p.TxPortalDupAckCapacityScale)
@@ -21,9 +23,32 @@ func TestProfileLoad(t *testing.T) {
 	assert.True(t, p.RandomizeSeq)
 	assert.Equal(t, 17*1024, p.TxPortalStartSz)
 	assert.Equal(t, 4.5, p.TxPortalDupAckCapacityScale)
+	assert.Equal(t, 4, p.RttProbeAvg)
 	fmt.Println(p.Dump())
 }
 
+func TestProfileLoadTxAlgorithm(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["tx_algorithm"] = map[interface{}]interface{}{"name": "cubic", "beta": 0.5}
+	err := p.Load(d)
+	assert.NoError(t, err)
+	cp, ok := p.txAlgorithm.(*dilithium.CubicProfile)
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, cp.Beta)
+	assert.Equal(t, 0.4, cp.C)
+
+	d["tx_algorithm"] = map[string]interface{}{"name": "westworld3"}
+	err = p.Load(d)
+	assert.NoError(t, err)
+	assert.Nil(t, p.txAlgorithm)
+
+	d["tx_algorithm"] = map[string]interface{}{"name": "reno"}
+	err = p.Load(d)
+	assert.Error(t, err)
+}
+
 func TestAddProfile(t *testing.T) {
 	p := NewBaselineProfile()
 	id, err := AddProfile(p)
@@ -0,0 +1,92 @@
+package westworld3
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per source IP address, holding at most maxBuckets of them. Buckets are kept in least
+// recently used order, so that idle buckets are forgotten a few at a time as new ones are created, rather than by
+// periodically walking all of them. Once maxBuckets addresses are being tracked, any further addresses share a single
+// overflow bucket, which fails closed under a flood of distinct sources.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	maxBuckets int
+	idle       time.Duration
+	buckets    map[string]*list.Element
+	lru        *list.List
+	overflow   *tokenBucket
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(ratePerSecond float64, burst, maxBuckets int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if maxBuckets < 1 {
+		maxBuckets = 1
+	}
+	return &rateLimiter{
+		rate:       ratePerSecond,
+		burst:      float64(burst),
+		maxBuckets: maxBuckets,
+		idle:       time.Duration(float64(burst) / ratePerSecond * float64(time.Second)),
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (self *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	self.expire(now)
+
+	key := string(canonicalIP(ip))
+	var bucket *tokenBucket
+	if e, found := self.buckets[key]; found {
+		bucket = e.Value.(*tokenBucket)
+		self.lru.MoveToFront(e)
+	} else if len(self.buckets) < self.maxBuckets {
+		bucket = &tokenBucket{key: key, tokens: self.burst, last: now}
+		self.buckets[key] = self.lru.PushFront(bucket)
+	} else {
+		if self.overflow == nil {
+			self.overflow = &tokenBucket{tokens: self.burst, last: now}
+		}
+		bucket = self.overflow
+	}
+	bucket.tokens = self.refill(bucket, now)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (self *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.last).Seconds()*self.rate
+	if tokens > self.burst {
+		tokens = self.burst
+	}
+	return tokens
+}
+
+// expire forgets the least recently used buckets that have been idle long enough to refill completely, as they are
+// indistinguishable from new ones.
+func (self *rateLimiter) expire(now time.Time) {
+	for e := self.lru.Back(); e != nil; e = self.lru.Back() {
+		bucket := e.Value.(*tokenBucket)
+		if now.Sub(bucket.last) < self.idle {
+			return
+		}
+		self.lru.Remove(e)
+		delete(self.buckets, bucket.key)
+	}
+}
@@ -0,0 +1,50 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3, 16)
+	now := time.Now()
+	a := net.IPv4(10, 0, 0, 1)
+	b := net.ParseIP("2001:db8::1")
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, rl.allow(a, now))
+	}
+	assert.False(t, rl.allow(a, now))
+	assert.False(t, rl.allow(a.To4(), now))
+	assert.True(t, rl.allow(b, now))
+
+	// 2 per second refills a single token in 500ms
+	assert.False(t, rl.allow(a, now.Add(250*time.Millisecond)))
+	assert.True(t, rl.allow(a, now.Add(500*time.Millisecond)))
+	assert.False(t, rl.allow(a, now.Add(500*time.Millisecond)))
+
+	// idle buckets are forgotten once they have refilled
+	assert.True(t, rl.allow(a, now.Add(2*time.Second)))
+	assert.Equal(t, 1, len(rl.buckets))
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	rl := newRateLimiter(1, 1, 2)
+	now := time.Now()
+
+	assert.True(t, rl.allow(net.IPv4(10, 0, 0, 1), now))
+	assert.True(t, rl.allow(net.IPv4(10, 0, 0, 2), now))
+
+	// addresses beyond the cap share a single bucket
+	assert.True(t, rl.allow(net.IPv4(10, 0, 0, 3), now))
+	assert.False(t, rl.allow(net.IPv4(10, 0, 0, 4), now))
+	assert.Equal(t, 2, len(rl.buckets))
+
+	// once the tracked buckets go idle, their slots are reused
+	later := now.Add(time.Second)
+	assert.True(t, rl.allow(net.IPv4(10, 0, 0, 4), later))
+	assert.Equal(t, 1, len(rl.buckets))
+	assert.False(t, rl.allow(net.IPv4(10, 0, 0, 4), later))
+}
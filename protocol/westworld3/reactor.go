@@ -0,0 +1,224 @@
+package westworld3
+
+import (
+	"container/heap"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// reactor drives the timers (retransmission, keepalive, path MTU probing and close checks) of all of a listener's
+// connections from a single heap, in place of a sleeping goroutine per timer per connection. A scheduler goroutine
+// waits for the earliest deadline, and hands due timers to a small pool of workers.
+type reactor struct {
+	lock    sync.Mutex
+	timers  reactorHeap
+	due     chan *reactorTimer
+	wake    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	workers sync.WaitGroup
+}
+
+// reactorTimer is a connection timer. Its callback returns the time at which it should next fire, or the zero time to
+// go idle until reset. A timer never fires on more than one worker at a time.
+type reactorTimer struct {
+	r       *reactor
+	at      time.Time
+	f       func(now time.Time) time.Time
+	index   int
+	running bool
+	rearm   time.Time
+	stopped bool
+}
+
+func newReactor(workers int) *reactor {
+	if workers < 1 {
+		workers = 1
+	}
+	self := &reactor{
+		due:    make(chan *reactorTimer, workers),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	self.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go self.worker()
+	}
+	go self.run()
+	return self
+}
+
+// schedule creates a timer that first fires at at, or that stays idle until reset when at is the zero time.
+func (self *reactor) schedule(at time.Time, f func(now time.Time) time.Time) *reactorTimer {
+	t := &reactorTimer{r: self, f: f, index: -1}
+	t.reset(at)
+	return t
+}
+
+func (self *reactor) close() {
+	self.once.Do(func() {
+		close(self.closed)
+	})
+	self.workers.Wait()
+}
+
+func (self *reactor) size() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.timers)
+}
+
+func (self *reactor) run() {
+	logrus.Info("started")
+	defer logrus.Info("exited")
+
+	sleep := time.NewTimer(time.Hour)
+	defer sleep.Stop()
+	for {
+		self.lock.Lock()
+		now := time.Now()
+		for len(self.timers) > 0 && !self.timers[0].at.After(now) {
+			t := heap.Pop(&self.timers).(*reactorTimer)
+			t.running = true
+			self.lock.Unlock()
+			select {
+			case self.due <- t:
+			case <-self.closed:
+				return
+			}
+			self.lock.Lock()
+		}
+		wait := time.Hour
+		if len(self.timers) > 0 {
+			wait = time.Until(self.timers[0].at)
+		}
+		self.lock.Unlock()
+
+		if !sleep.Stop() {
+			select {
+			case <-sleep.C:
+			default:
+			}
+		}
+		sleep.Reset(wait)
+		select {
+		case <-sleep.C:
+		case <-self.wake:
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *reactor) worker() {
+	defer self.workers.Done()
+	for {
+		select {
+		case t := <-self.due:
+			t.fire()
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *reactor) notify() {
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reset makes the timer fire no later than at. A timer reset while it is firing is re-armed once its callback returns.
+func (self *reactorTimer) reset(at time.Time) {
+	self.r.lock.Lock()
+	defer self.r.lock.Unlock()
+
+	if self.stopped || at.IsZero() {
+		return
+	}
+	if self.running {
+		if self.rearm.IsZero() || at.Before(self.rearm) {
+			self.rearm = at
+		}
+		return
+	}
+	if self.index >= 0 {
+		if !at.Before(self.at) {
+			return
+		}
+		self.at = at
+		heap.Fix(&self.r.timers, self.index)
+	} else {
+		self.at = at
+		heap.Push(&self.r.timers, self)
+	}
+	if self.index == 0 {
+		self.r.notify()
+	}
+}
+
+func (self *reactorTimer) stop() {
+	self.r.lock.Lock()
+	defer self.r.lock.Unlock()
+
+	self.stopped = true
+	if self.index >= 0 {
+		heap.Remove(&self.r.timers, self.index)
+	}
+}
+
+func (self *reactorTimer) fire() {
+	next := self.f(time.Now())
+
+	self.r.lock.Lock()
+	defer self.r.lock.Unlock()
+
+	self.running = false
+	if !self.rearm.IsZero() && (next.IsZero() || self.rearm.Before(next)) {
+		next = self.rearm
+	}
+	self.rearm = time.Time{}
+	if self.stopped || next.IsZero() {
+		return
+	}
+	self.at = next
+	heap.Push(&self.r.timers, self)
+	if self.index == 0 {
+		self.r.notify()
+	}
+}
+
+// reactorHeap implements heap.Interface, ordering timers by their next deadline.
+type reactorHeap []*reactorTimer
+
+func (self reactorHeap) Len() int {
+	return len(self)
+}
+
+func (self reactorHeap) Less(i, j int) bool {
+	return self[i].at.Before(self[j].at)
+}
+
+func (self reactorHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *reactorHeap) Push(x interface{}) {
+	t := x.(*reactorTimer)
+	t.index = len(*self)
+	*self = append(*self, t)
+}
+
+func (self *reactorHeap) Pop() interface{} {
+	old := *self
+	last := len(old) - 1
+	t := old[last]
+	old[last] = nil
+	t.index = -1
+	*self = old[:last]
+	return t
+}
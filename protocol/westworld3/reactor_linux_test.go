@@ -0,0 +1,294 @@
+//go:build linux
+// +build linux
+
+package westworld3
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The listener connection benchmarks establish many connections to a listener, with and without listener_reactor,
+// and then exchange a single segment in each direction on every connection per op. The peers are synthetic, answering
+// the listener synchronously from its own writes, so that only the listener's goroutines and timers are measured.
+// Besides ns/op, they report the goroutines per connection, and the process CPU time (user and system) consumed per
+// second while the connections are idle.
+//
+//   go test -run NONE -bench ListenerConnections ./protocol/westworld3/
+//
+
+func BenchmarkListenerConnections(b *testing.B) {
+	for _, conns := range []int{1000, 10000} {
+		for _, reactor := range []bool{false, true} {
+			b.Run(fmt.Sprintf("conns=%d/reactor=%v", conns, reactor), func(b *testing.B) {
+				benchmarkListenerConnections(b, conns, reactor)
+			})
+		}
+	}
+}
+
+func benchmarkListenerConnections(b *testing.B, conns int, reactor bool) {
+	profile := NewBaselineProfile()
+	profile.ListenerReactor = reactor
+	profile.ListenerMaxPendingHellos = 0
+	profile.AcceptQueueLen = conns
+	// keep the per-connection queues and trees small, so that memory does not limit the connection count
+	profile.ReadsQueueLen = 16
+	profile.ListenerRxQueueLen = 16
+	profile.TxPortalTreeLen = 16
+	profile.RxPortalTreeLen = 16
+	profile.ListenerPeersTreeLen = 1024
+
+	peers := newBenchPeers(conns)
+	goroutines := runtime.NumGoroutine()
+	l, err := listen(peers, peers.addr, profile, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	var accepted []net.Conn
+	for i := 0; i < conns; i += 256 {
+		batch := peers.peers[i:]
+		if len(batch) > 256 {
+			batch = batch[:256]
+		}
+		peers.expect(len(batch))
+		for _, peer := range batch {
+			peers.hello(peer)
+		}
+		peers.wait(b)
+		for range batch {
+			conn, err := l.Accept()
+			if err != nil {
+				b.Fatal(err)
+			}
+			accepted = append(accepted, conn)
+		}
+	}
+	goroutinesPerConn := float64(runtime.NumGoroutine()-goroutines) / float64(conns)
+
+	startCpu := cpuTime()
+	time.Sleep(2 * time.Second)
+	idleCpu := cpuTime() - startCpu
+
+	buf := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a data segment to each connection, acked by the listener; and a reply from each connection, acked by the peer
+		peers.expect(2 * conns)
+		for _, peer := range peers.peers {
+			peers.data(peer)
+		}
+		for _, conn := range accepted {
+			if _, err := conn.Read(buf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(buf[:1]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		peers.wait(b)
+	}
+	b.StopTimer()
+	b.ReportMetric(goroutinesPerConn, "goroutines/conn")
+	b.ReportMetric(float64(idleCpu.Milliseconds())/2, "idle-cpu-ms/s")
+}
+
+// benchPeers is a datagramConn for a listener, behind which synthetic peers answer hellos, acknowledge data and echo
+// keepalives, from within the listener's writes.
+type benchPeers struct {
+	addr    *net.UDPAddr
+	peers   []*benchPeer
+	inbound chan benchDatagram
+	pool    *pool
+	pending int64
+	done    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type benchPeer struct {
+	addr   *net.UDPAddr
+	lock   sync.Mutex
+	connId uint32
+	seq    int32
+	acked  int32
+	rxSeq  int32
+}
+
+type benchDatagram struct {
+	data []byte
+	peer *net.UDPAddr
+}
+
+func newBenchPeers(n int) *benchPeers {
+	self := &benchPeers{
+		addr:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262},
+		inbound: make(chan benchDatagram, 4*n+1024),
+		pool:    newPool("benchPeers", NewBaselineProfile().maxDatagramSz(), NewNilInstrument().NewInstance("", nil)),
+		done:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 6262}
+		self.peers = append(self.peers, &benchPeer{addr: addr, acked: -1, rxSeq: -1})
+	}
+	return self
+}
+
+func (self *benchPeers) expect(n int) {
+	atomic.StoreInt64(&self.pending, int64(n))
+}
+
+func (self *benchPeers) wait(b *testing.B) {
+	select {
+	case <-self.done:
+	case <-time.After(30 * time.Second):
+		b.Fatalf("timeout with [%d] pending", atomic.LoadInt64(&self.pending))
+	}
+}
+
+func (self *benchPeers) complete() {
+	if atomic.AddInt64(&self.pending, -1) == 0 {
+		self.done <- struct{}{}
+	}
+}
+
+func (self *benchPeers) hello(peer *benchPeer) {
+	wm, err := newHello(peer.seq, hello{protocolVersion, 0, 0, 0}, nil, self.pool)
+	if err != nil {
+		panic(err)
+	}
+	self.send(wm, peer)
+}
+
+func (self *benchPeers) data(peer *benchPeer) {
+	peer.lock.Lock()
+	peer.seq++
+	seq := peer.seq
+	peer.lock.Unlock()
+	wm, err := newData(seq, nil, []byte{0}, self.pool)
+	if err != nil {
+		panic(err)
+	}
+	self.send(wm, peer)
+}
+
+func (self *benchPeers) ack(seq int32, peer *benchPeer) {
+	wm, err := newAck([]Ack{{seq, seq}}, 0, nil, self.pool)
+	if err != nil {
+		panic(err)
+	}
+	self.send(wm, peer)
+}
+
+func (self *benchPeers) send(wm *wireMessage, peer *benchPeer) {
+	peer.lock.Lock()
+	connId := peer.connId
+	peer.lock.Unlock()
+	wm.connId = connId
+	if _, err := wm.encodeHeader(uint16(wm.buffer.uz - dataStart)); err != nil {
+		panic(err)
+	}
+	data := make([]byte, wm.buffer.uz)
+	copy(data, wm.buffer.data)
+	wm.buffer.unref()
+	select {
+	case self.inbound <- benchDatagram{data, peer.addr}:
+	default:
+	}
+}
+
+func (self *benchPeers) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case d := <-self.inbound:
+		return copy(b, d.data), d.peer, nil
+	case <-self.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (self *benchPeers) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	i := int(addr.IP.To4()[2])<<8 | int(addr.IP.To4()[3])
+	if i >= len(self.peers) {
+		return len(b), nil
+	}
+	peer := self.peers[i]
+
+	buf := self.pool.get()
+	buf.uz = uint32(copy(buf.data, b))
+	wm, err := decodeHeader(buf)
+	if err != nil {
+		buf.unref()
+		return len(b), nil
+	}
+	defer buf.unref()
+
+	switch wm.messageType() {
+	case HELLO:
+		if h, _, err := wm.asHello(); err == nil {
+			peer.lock.Lock()
+			peer.connId = h.connId
+			peer.lock.Unlock()
+			self.ack(wm.seq, peer)
+			self.complete()
+		}
+
+	case ACK:
+		if acks, _, _, err := wm.asAck(); err == nil {
+			peer.lock.Lock()
+			acked := false
+			for _, a := range acks {
+				if peer.seq > peer.acked && peer.seq >= a.Start && peer.seq <= a.End {
+					peer.acked = peer.seq
+					acked = true
+				}
+			}
+			peer.lock.Unlock()
+			if acked {
+				self.complete()
+			}
+		}
+
+	case DATA:
+		self.ack(wm.seq, peer)
+		peer.lock.Lock()
+		fresh := wm.seq > peer.rxSeq
+		if fresh {
+			peer.rxSeq = wm.seq
+		}
+		peer.lock.Unlock()
+		if fresh {
+			self.complete()
+		}
+
+	case KEEPALIVE:
+		if !wm.hasFlag(PMTU) {
+			if keepalive, err := newKeepalive(0, self.pool); err == nil {
+				self.send(keepalive, peer)
+			}
+		}
+	}
+	return len(b), nil
+}
+
+func (self *benchPeers) LocalAddr() net.Addr {
+	return self.addr
+}
+
+func (self *benchPeers) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (self *benchPeers) Close() error {
+	self.once.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
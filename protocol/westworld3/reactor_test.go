@@ -0,0 +1,167 @@
+package westworld3
+
+import (
+	"bytes"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReactorFiresInOrder(t *testing.T) {
+	r := newReactor(1)
+	defer r.close()
+
+	var lock sync.Mutex
+	var fired []int
+	done := make(chan struct{})
+	now := time.Now()
+	for _, i := range []int{4, 1, 3, 0, 2} {
+		i := i
+		r.schedule(now.Add(time.Duration(i*20)*time.Millisecond), func(time.Time) time.Time {
+			lock.Lock()
+			defer lock.Unlock()
+			fired = append(fired, i)
+			if len(fired) == 5 {
+				close(done)
+			}
+			return time.Time{}
+		})
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timers not fired")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, fired)
+	assert.Equal(t, 0, r.size())
+}
+
+func TestReactorTimerReset(t *testing.T) {
+	r := newReactor(1)
+	defer r.close()
+
+	fired := make(chan time.Time, 16)
+	count := 0
+	timer := r.schedule(time.Now().Add(time.Hour), func(now time.Time) time.Time {
+		fired <- now
+		count++
+		if count < 3 {
+			return now.Add(10 * time.Millisecond)
+		}
+		return time.Time{}
+	})
+
+	// resetting to a later time does not postpone the timer; resetting to an earlier time brings it forward
+	start := time.Now()
+	timer.reset(time.Now().Add(2 * time.Hour))
+	timer.reset(time.Now().Add(10 * time.Millisecond))
+	for i := 0; i < 3; i++ {
+		select {
+		case <-fired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timer not fired")
+		}
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// idle until reset
+	select {
+	case <-fired:
+		t.Fatal("idle timer fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+	timer.reset(time.Now())
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer not fired")
+	}
+
+	timer.stop()
+	timer.reset(time.Now())
+	select {
+	case <-fired:
+		t.Fatal("stopped timer fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 0, r.size())
+}
+
+func TestReactorTimerResetWhileFiring(t *testing.T) {
+	r := newReactor(2)
+	defer r.close()
+
+	var timer *reactorTimer
+	var lock sync.Mutex
+	fired := make(chan struct{}, 16)
+	first := true
+	lock.Lock()
+	timer = r.schedule(time.Now(), func(time.Time) time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		if first {
+			first = false
+			timer.reset(time.Now())
+		}
+		fired <- struct{}{}
+		return time.Time{}
+	})
+	lock.Unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timer not re-armed")
+		}
+	}
+}
+
+func TestReactorTransfer(t *testing.T) {
+	toListener := util.NewEmulatorConfig(3)
+	toListener.LossRate = 0.01
+	toDialer := util.NewEmulatorConfig(4)
+	toDialer.LossRate = 0.01
+
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.ListenerReactor = true
+	listenerProfile.CloseWaitMs = 100
+	listenerProfile.CloseCheckMs = 50
+	dialerProfile := NewBaselineProfile()
+	dialerProfile.CloseWaitMs = 100
+	dialerProfile.CloseCheckMs = 50
+	dialed, accepted, l := emulatedPair(t, toListener, toDialer, listenerProfile, dialerProfile)
+
+	// the accepted side transmits, so that its retransmissions are driven by the reactor
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := accepted.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(dialed, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	// the close process completes through the reactor, removing the connection from the listener and retiring its
+	// timers
+	assert.NoError(t, accepted.Close())
+	_, err = dialed.Read(received)
+	assert.Equal(t, io.EOF, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(l.conns()) > 0 || l.reactor.size() > 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(l.conns()))
+	assert.Equal(t, 0, l.reactor.size())
+
+	assert.NoError(t, l.Close())
+}
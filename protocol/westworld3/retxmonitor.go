@@ -1,140 +1,290 @@
 package westworld3
 
 import (
-	"github.com/openziti/dilithium/util"
+	"github.com/openziti/dilithium"
 	"github.com/sirupsen/logrus"
-	"net"
+	"math"
 	"sync"
 	"time"
 )
 
 type retxMonitor struct {
-	profile  *Profile
-	rttAvg   []uint16
-	retxMs   int
-	conn     *net.UDPConn
-	peer     *net.UDPAddr
-	waitlist waitlist
-	lock     *sync.Mutex
-	ready    *sync.Cond
-	closed   bool
-	retxF    func()
-	ii       InstrumentInstance
-}
-
-func newRetxMonitor(profile *Profile, conn *net.UDPConn, peer *net.UDPAddr, lock *sync.Mutex, ii InstrumentInstance) *retxMonitor {
+	profile        *Profile
+	alg            dilithium.TxAlgorithm
+	path           *path
+	waitlist       waitlist
+	lock           *sync.Mutex
+	ready          *sync.Cond
+	closed         bool
+	backoff        map[*wireMessage]uint
+	probes         map[uint32]*wireMessage
+	retxF          func(int)
+	timeoutF       func(int)
+	segmentSzF     func() int
+	probeF         func(time.Time) time.Time
+	nextProbe      time.Time
+	sleeping       time.Time
+	timer          *reactorTimer
+	peerAckDelayMs int
+	pool           *pool
+	ii             InstrumentInstance
+}
+
+func newRetxMonitor(profile *Profile, path *path, lock *sync.Mutex, alg dilithium.TxAlgorithm, pool *pool, ii InstrumentInstance) *retxMonitor {
 	rm := &retxMonitor{
 		profile:  profile,
-		retxMs:   profile.RetxStartMs,
-		conn:     conn,
-		peer:     peer,
-		waitlist: newArrayWaitlist(),
+		alg:      alg,
+		path:     path,
+		waitlist: newHeapWaitlist(),
 		lock:     lock,
 		ready:    sync.NewCond(lock),
+		backoff:  make(map[*wireMessage]uint),
+		probes:   make(map[uint32]*wireMessage),
+		pool:     pool,
 		ii:       ii,
 	}
 	return rm
 }
 
-func (self *retxMonitor) setRetxF(f func()) {
+func (self *retxMonitor) setRetxF(f func(int)) {
 	self.retxF = f
 }
 
+func (self *retxMonitor) setTimeoutF(f func(int)) {
+	self.timeoutF = f
+}
+
+// setSegmentSzF supplies the path's current segment size. A segment that has grown larger than it (after a path MTU
+// black hole) is retransmitted in fragments.
+func (self *retxMonitor) setSegmentSzF(f func() int) {
+	self.segmentSzF = f
+}
+
+// setProbeF drives path MTU probing from the monitor's timer, starting at first. f is called with the lock held, and
+// returns the time of the next probe.
+func (self *retxMonitor) setProbeF(f func(time.Time) time.Time, first time.Time) {
+	self.probeF = f
+	self.nextProbe = first
+}
+
 func (self *retxMonitor) start() {
 	go self.run()
 }
 
-func (self *retxMonitor) updateRttMs(rttMs uint16) {
-	self.rttAvg = append(self.rttAvg, rttMs)
-	if len(self.rttAvg) > self.profile.RttProbeAvg {
-		self.rttAvg = self.rttAvg[1:]
-	}
-	accum := 0
-	for _, rttMs := range self.rttAvg {
-		accum += int(rttMs)
+// schedule drives the monitor from a reactor timer, rather than from its own goroutine.
+func (self *retxMonitor) schedule(r *reactor) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.timer = r.schedule(self.nextDeadline(), self.fire)
+}
+
+// rtt samples the round-trip time of an echoed probe. Probes are only sampled from segments that have not been
+// retransmitted (Karn's algorithm), as the echo cannot be attributed to a specific transmission.
+func (self *retxMonitor) rtt(probe *rttProbe, now time.Time) {
+	if _, found := self.probes[probe.ts]; found {
+		delete(self.probes, probe.ts)
+		self.updateRtt(probe.rttAt(now))
 	}
-	accum /= len(self.rttAvg)
-	self.retxMs = int(float64(accum)*self.profile.RetxScale) + self.profile.RetxAddMs
+}
+
+// updateRtt re-times the in-flight segments; as in RFC 6298, a fresh RTT sample replaces any backed-off timeouts
+func (self *retxMonitor) updateRtt(rtt time.Duration) {
+	self.alg.UpdateRTT(rtt)
+	self.backoff = make(map[*wireMessage]uint)
 	self.waitlist.Update(self.retxMs)
-	self.ii.NewRetxMs(self.peer, self.retxMs)
+	self.wake()
 }
 
 func (self *retxMonitor) add(wm *wireMessage) {
-	self.waitlist.Add(wm, self.retxMs, self.deadline())
-	self.ready.Broadcast()
+	if probe := wm.rttProbe(); probe != nil {
+		self.probes[probe.ts] = wm
+	}
+	self.waitlist.Add(wm, self.retxMs(wm), self.deadline(wm))
+	self.wake()
 }
 
 func (self *retxMonitor) remove(wm *wireMessage) {
 	self.waitlist.Remove(wm)
+	delete(self.backoff, wm)
+	self.forgetProbe(wm)
+}
+
+func (self *retxMonitor) forgetProbe(wm *wireMessage) {
+	if probe := wm.rttProbe(); probe != nil && self.probes[probe.ts] == wm {
+		delete(self.probes, probe.ts)
+	}
 }
 
 func (self *retxMonitor) close() {
 	self.closed = true
 	self.ready.Broadcast()
+	if self.timer != nil {
+		self.timer.reset(time.Now())
+	}
+}
+
+// wake re-arms the reactor timer for the next deadline, which may have moved earlier, or wakes the monitor's goroutine
+// when it is idle. A goroutine that is already waiting keeps to its deadline, picking up any earlier ones when it wakes.
+func (self *retxMonitor) wake() {
+	next := self.nextDeadline()
+	if next.IsZero() {
+		return
+	}
+	if self.timer != nil {
+		self.timer.reset(next)
+	} else if self.sleeping.IsZero() {
+		self.ready.Broadcast()
+	}
+}
+
+// nextDeadline returns the earlier of the head of the waitlist and the next path MTU probe.
+func (self *retxMonitor) nextDeadline() time.Time {
+	_, headline := self.waitlist.Peek()
+	if !self.nextProbe.IsZero() && (headline.IsZero() || self.nextProbe.Before(headline)) {
+		return self.nextProbe
+	}
+	return headline
+}
+
+// fire is the reactor timer callback, retransmitting the segments that are due and returning the next deadline.
+func (self *retxMonitor) fire(now time.Time) time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		self.ii.Closed(self.path.peer())
+		self.timer.stop()
+		return time.Time{}
+	}
+	self.due(now)
+	return self.nextDeadline()
+}
+
+// due retransmits the segments that are due at now, and sends a path MTU probe if one is due.
+func (self *retxMonitor) due(now time.Time) {
+	if _, headline := self.waitlist.Peek(); !headline.IsZero() && !headline.After(now) {
+		self.retxDue(headline)
+	}
+	if self.probeF != nil && !self.nextProbe.IsZero() && !self.nextProbe.After(now) {
+		self.nextProbe = self.probeF(now)
+	}
 }
 
 func (self *retxMonitor) run() {
 	logrus.Info("started")
 	defer logrus.Warn("exited")
 
-	for {
-		var headline time.Time
-		var timeout time.Duration
-
+	// the condition has no timeout of its own, so a timer armed for the next deadline wakes it
+	timer := time.AfterFunc(time.Hour, func() {
 		self.lock.Lock()
-		{
-			for self.waitlist.Size() < 1 && !self.closed {
-				self.ready.Wait()
-			}
+		self.ready.Broadcast()
+		self.lock.Unlock()
+	})
+	timer.Stop()
+	defer timer.Stop()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		if self.closed {
+			self.ii.Closed(self.path.peer())
+			return
+		}
+		now := time.Now()
+		self.due(now)
+		self.sleeping = self.nextDeadline()
+		if !self.sleeping.IsZero() {
+			timer.Reset(self.sleeping.Sub(now))
+		}
+		self.ready.Wait()
+		timer.Stop()
+	}
+}
 
-			if self.closed {
-				self.ii.Closed(self.peer)
-				self.lock.Unlock()
-				return
+// retxDue retransmits the segments with deadlines within RetxBatchMs of headline, backing off their next deadlines.
+func (self *retxMonitor) retxDue(headline time.Time) {
+	x := self.waitlist.Size()
+	for i := 0; i < x; i++ {
+		_, t := self.waitlist.Peek()
+		delta := t.Sub(headline).Milliseconds()
+		if delta <= int64(self.profile.RetxBatchMs) {
+			wm, _ := self.waitlist.Next()
+			self.retx(wm)
+			self.ii.TimeoutRetransmit(self.path.peer(), wm)
+			if self.timeoutF != nil {
+				if sz, err := wm.asDataSize(); err == nil {
+					self.timeoutF(int(sz))
+				}
 			}
+			self.backoff[wm]++
+			self.waitlist.Add(wm, self.retxMs(wm), self.deadline(wm))
 
-			_, headline = self.waitlist.Peek()
-			timeout = time.Until(headline)
+		} else {
+			break
 		}
-		self.lock.Unlock()
+	}
+}
 
-		time.Sleep(timeout)
+// fastRetx retransmits wm ahead of its deadline, when later sequences have already been acked
+func (self *retxMonitor) fastRetx(wm *wireMessage) {
+	self.waitlist.Remove(wm)
+	self.retx(wm)
+	self.ii.FastRetransmit(self.path.peer(), wm)
+	self.waitlist.Add(wm, self.retxMs(wm), self.deadline(wm))
+	self.wake()
+}
 
-		self.lock.Lock()
-		{
-			if self.waitlist.Size() > 0 {
-				i := 0
-				x := self.waitlist.Size()
-				for ; i < x; i++ {
-					_, t := self.waitlist.Peek()
-					delta := t.Sub(headline).Milliseconds()
-					if delta <= int64(self.profile.RetxBatchMs) {
-						wm, _ := self.waitlist.Next()
-						if wm.hasFlag(RTT) {
-							util.WriteUint16(wm.buffer.data[dataStart:], uint16(time.Now().UnixNano()/int64(time.Millisecond)))
-						}
-
-						if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
-							logrus.Errorf("retx (%v)", err)
-						} else {
-							self.ii.WireMessageRetx(self.peer, wm)
-						}
-						if self.retxF != nil {
-							self.retxF()
-						}
-
-						self.waitlist.Add(wm, self.retxMs, self.deadline())
-
-					} else {
-						break
-					}
+func (self *retxMonitor) retx(wm *wireMessage) {
+	self.forgetProbe(wm)
+
+	if err := self.write(wm); err != nil {
+		logrus.Errorf("retx (%v)", err)
+	} else {
+		self.ii.WireMessageRetx(self.path.peer(), wm)
+	}
+	if self.retxF != nil {
+		sz, _ := wm.asDataSize()
+		self.retxF(int(sz))
+	}
+}
+
+// write sends wm, splitting a DATA segment that is larger than the path's current segment size into fragments of
+// MaxSegmentSz, which every path is assumed to deliver.
+func (self *retxMonitor) write(wm *wireMessage) error {
+	if self.segmentSzF != nil && wm.messageType() == DATA {
+		if data, _, err := wm.asData(); err == nil && len(data) > self.segmentSzF() {
+			for offset := 0; offset < len(data); offset += self.profile.MaxSegmentSz {
+				end := int(math.Min(float64(offset+self.profile.MaxSegmentSz), float64(len(data))))
+				fragment, err := newDataFragment(wm.seq, offset, len(data), data[offset:end], self.pool)
+				if err != nil {
+					return err
+				}
+				err = self.path.write(fragment)
+				fragment.buffer.unref()
+				if err != nil {
+					return err
 				}
 			}
+			return nil
 		}
-		self.lock.Unlock()
 	}
+	return self.path.write(wm)
 }
 
-func (self *retxMonitor) deadline() time.Time {
-	return time.Now().Add(time.Duration(self.retxMs) * time.Millisecond)
+func (self *retxMonitor) deadline(wm *wireMessage) time.Time {
+	return time.Now().Add(time.Duration(self.retxMs(wm)) * time.Millisecond)
+}
+
+// retxMs allows for the peer to delay its acks by up to the AckDelayMs that it advertised in its hello, and doubles for
+// every timeout retransmission of wm, up to RetxMaxMs. A sub-millisecond path can yield a zero timeout, which is raised
+// to 1ms, so that the backoff still grows.
+func (self *retxMonitor) retxMs(wm *wireMessage) int {
+	retxMs := self.alg.RetxMs() + self.peerAckDelayMs
+	if retxMs < 1 {
+		retxMs = 1
+	}
+	for i := uint(0); i < self.backoff[wm] && retxMs < self.profile.RetxMaxMs; i++ {
+		retxMs = int(math.Min(float64(retxMs*2), float64(self.profile.RetxMaxMs)))
+	}
+	return retxMs
 }
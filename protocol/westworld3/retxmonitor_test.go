@@ -0,0 +1,82 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRetxMonitor creates a retxMonitor whose retransmissions are written to a peer that isn't bound, and are lost.
+func newTestRetxMonitor(profile *Profile) *retxMonitor {
+	conn := newEmulatedNetwork().bind(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6161}, util.NewEmulatorConfig(0))
+	p := newPath(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6262})
+	ii := &nilInstrumentInstance{}
+	return newRetxMonitor(profile, p, new(sync.Mutex), newPortalAlgorithm(profile, p, ii), newPool("test", uint32(profile.PoolBufferSz), ii), ii)
+}
+
+func TestRetxMonitorBackoff(t *testing.T) {
+	profile := NewBaselineProfile()
+	rm := newTestRetxMonitor(profile)
+	wm := &wireMessage{seq: int32(1)}
+
+	assert.Equal(t, profile.RetxStartMs, rm.retxMs(wm))
+	rm.backoff[wm] = 1
+	assert.Equal(t, 2*profile.RetxStartMs, rm.retxMs(wm))
+	rm.backoff[wm] = 3
+	assert.Equal(t, 8*profile.RetxStartMs, rm.retxMs(wm))
+	rm.backoff[wm] = 64
+	assert.Equal(t, profile.RetxMaxMs, rm.retxMs(wm))
+
+	rm.remove(wm)
+	assert.Equal(t, profile.RetxStartMs, rm.retxMs(wm))
+}
+
+func TestRetxMonitorUpdateRttRetimes(t *testing.T) {
+	profile := NewBaselineProfile()
+	rm := newTestRetxMonitor(profile)
+	a := &wireMessage{seq: int32(1)}
+	b := &wireMessage{seq: int32(2)}
+	rm.add(a)
+	rm.backoff[b] = 2
+	rm.add(b)
+	_, before := rm.waitlist.Peek()
+
+	rm.updateRtt(20 * time.Millisecond)
+	retxMs := rm.alg.RetxMs()
+	assert.Less(t, retxMs, profile.RetxStartMs)
+
+	wmOut, after := rm.waitlist.Next()
+	assert.Equal(t, a, wmOut)
+	assert.Equal(t, before.Add(time.Duration(retxMs-profile.RetxStartMs)*time.Millisecond), after)
+
+	// the backed-off segment is re-timed against the fresh RTT sample, without its backoff
+	wmOut, after = rm.waitlist.Next()
+	assert.Equal(t, b, wmOut)
+	assert.Equal(t, 0, len(rm.backoff))
+	assert.True(t, after.Before(before.Add(time.Duration(retxMs)*time.Millisecond)))
+}
+
+func TestPortalAlgorithmRtt(t *testing.T) {
+	profile := NewBaselineProfile()
+	alg := newTestRetxMonitor(profile).alg
+
+	// first sample: srtt = 100, rttvar = 50
+	alg.UpdateRTT(100 * time.Millisecond)
+	assert.Equal(t, int(100*profile.RetxScale)+4*50, alg.RetxMs())
+
+	// rttvar = 0.75 * 50 + 0.25 * |100 - 60| = 47.5, srtt = 0.875 * 100 + 0.125 * 60 = 95
+	alg.UpdateRTT(60 * time.Millisecond)
+	assert.Equal(t, int(95*profile.RetxScale+4*47.5), alg.RetxMs())
+}
+
+func TestPortalAlgorithmSubMillisecondRtt(t *testing.T) {
+	alg := newTestRetxMonitor(NewBaselineProfile()).alg.(*portalAlgorithm)
+
+	// microsecond probes are not truncated to whole milliseconds
+	alg.UpdateRTT(500 * time.Microsecond)
+	assert.Equal(t, float64(alg.capacity)*1000.0/0.5, alg.PacingRate())
+	assert.Equal(t, int(0.5*alg.retxScale+4*0.25)+alg.profile.RetxAddMs, alg.RetxMs())
+}
@@ -0,0 +1,75 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"time"
+)
+
+// rttProbe is a round-trip time probe timestamp, transmitted with DATA and echoed back unchanged with the ACK. Wide
+// probes (RTT_US, protocol version 3) carry a 32-bit microsecond timestamp, which wraps every 71 minutes. Otherwise,
+// probes carry a 16-bit millisecond timestamp, which wraps every 65 seconds.
+type rttProbe struct {
+	ts   uint32
+	wide bool
+}
+
+func newRttProbe(wide bool) *rttProbe {
+	return newRttProbeAt(time.Now(), wide)
+}
+
+func newRttProbeAt(t time.Time, wide bool) *rttProbe {
+	if wide {
+		return &rttProbe{uint32(t.UnixNano() / int64(time.Microsecond)), true}
+	}
+	return &rttProbe{uint32(uint16(t.UnixNano() / int64(time.Millisecond))), false}
+}
+
+func readRttProbe(wm *wireMessage, data []byte) *rttProbe {
+	if wm.hasFlag(RTT_US) {
+		return &rttProbe{util.ReadUint32(data), true}
+	}
+	return &rttProbe{uint32(util.ReadUint16(data)), false}
+}
+
+func (self *rttProbe) write(wm *wireMessage, data []byte) {
+	wm.setFlag(RTT)
+	if self.wide {
+		wm.setFlag(RTT_US)
+		util.WriteUint32(data, self.ts)
+	} else {
+		util.WriteUint16(data, uint16(self.ts))
+	}
+}
+
+func (self *rttProbe) sz() uint32 {
+	if self.wide {
+		return 4
+	}
+	return 2
+}
+
+// rttAt returns the round-trip time from the transmission of the probe until t, allowing for the timestamp wrapping.
+func (self *rttProbe) rttAt(t time.Time) time.Duration {
+	now := newRttProbeAt(t, self.wide)
+	if self.wide {
+		return time.Duration(now.ts-self.ts) * time.Microsecond
+	}
+	return time.Duration(uint16(now.ts)-uint16(self.ts)) * time.Millisecond
+}
+
+func rttProbeSz(wm *wireMessage) uint32 {
+	if !wm.hasFlag(RTT) {
+		return 0
+	}
+	if wm.hasFlag(RTT_US) {
+		return 4
+	}
+	return 2
+}
+
+func (self *wireMessage) rttProbe() *rttProbe {
+	if rttProbeSz(self) == 0 || self.buffer.uz < dataStart+rttProbeSz(self) {
+		return nil
+	}
+	return readRttProbe(self, self.buffer.data[dataStart:])
+}
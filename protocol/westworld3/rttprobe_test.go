@@ -0,0 +1,67 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRttProbeWrap(t *testing.T) {
+	for _, wide := range []bool{false, true} {
+		var wrapAt time.Duration
+		if wide {
+			wrapAt = (1 << 32) * time.Microsecond
+		} else {
+			wrapAt = (1 << 16) * time.Millisecond
+		}
+		// just before the timestamp wraps
+		sent := time.Unix(0, 0).Add(10*wrapAt - 5*time.Millisecond)
+		probe := newRttProbeAt(sent, wide)
+		assert.Equal(t, 20*time.Millisecond, probe.rttAt(sent.Add(20*time.Millisecond)), "wide = %v", wide)
+	}
+}
+
+func TestRttProbeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, wide := range []bool{false, true} {
+		resolution := time.Millisecond
+		if wide {
+			resolution = time.Microsecond
+		}
+		for i := 0; i < 1024; i++ {
+			sent := time.Unix(0, r.Int63())
+			rtt := time.Duration(r.Intn(48000)) * time.Millisecond
+			measured := newRttProbeAt(sent, wide).rttAt(sent.Add(rtt))
+			assert.InDelta(t, int64(rtt), int64(measured), float64(resolution), "wide = %v", wide)
+		}
+	}
+}
+
+func TestRttProbeKarn(t *testing.T) {
+	profile := NewBaselineProfile()
+	rm := newTestRetxMonitor(profile)
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+
+	sent := time.Now().Add(-100 * time.Millisecond)
+	a, err := newData(1, newRttProbeAt(sent, true), []byte{0x01}, p)
+	assert.NoError(t, err)
+	rm.add(a)
+	b, err := newData(2, newRttProbeAt(sent.Add(time.Millisecond), true), []byte{0x02}, p)
+	assert.NoError(t, err)
+	rm.add(b)
+
+	// the retransmitted segment's echo is ambiguous, and is discarded
+	rm.retx(b)
+	rm.rtt(b.rttProbe(), time.Now())
+	assert.Equal(t, profile.RetxStartMs, rm.alg.RetxMs())
+
+	rm.rtt(a.rttProbe(), time.Now())
+	assert.Greater(t, rm.alg.RetxMs(), profile.RetxStartMs)
+	assert.Equal(t, 0, len(rm.probes))
+
+	// a duplicate echo is only sampled once
+	retxMs := rm.alg.RetxMs()
+	rm.rtt(a.rttProbe(), time.Now().Add(time.Second))
+	assert.Equal(t, retxMs, rm.alg.RetxMs())
+}
@@ -1,16 +1,14 @@
 package westworld3
 
 import (
-	"bytes"
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
-	"math"
-	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,118 +17,175 @@ type rxPortal struct {
 	accepted   int32
 	rxs        chan *wireMessage
 	reads      chan *rxRead
-	readBuffer *bytes.Buffer
+	readLock   sync.Mutex
+	current    *rxRead
+	eof        bool
+	done       chan struct{}
+	deadline   *deadline
 	rxPortalSz int
-	readPool   *sync.Pool
+	advertised int32
 	ackPool    *pool
-	conn       *net.UDPConn
-	peer       *net.UDPAddr
+	path       *path
 	txPortal   *txPortal
 	seq        *util.Sequence
 	closer     *closer
 	profile    *Profile
+	acks       ackCoalescer
+	fragments  map[int32]*reassembly
+	ready      []*rxRead
 	closed     bool
 	ii         InstrumentInstance
 }
 
+// reassembly collects the fragments of a segment that was retransmitted in pieces, after a path MTU black hole. The
+// transmitter always splits a segment at the same offsets, so the fragments of different retransmissions coincide.
+type reassembly struct {
+	data     []byte
+	offsets  map[int]bool
+	received int
+}
+
+// maxReassemblies bounds the segments that may be partially reassembled at once; further fragments are dropped, and
+// retransmitted.
+const maxReassemblies = 64
+
+// rxRead is an in-order segment queued for the reader. The reader owns the segment's buffer, and copies directly from
+// the unread remainder of its data.
 type rxRead struct {
-	buf []byte
-	sz  int
-	eof bool
+	wm   *wireMessage
+	data []byte
 }
 
-func newRxPortal(conn *net.UDPConn, peer *net.UDPAddr, txPortal *txPortal, seq *util.Sequence, closer *closer, profile *Profile, ii InstrumentInstance) *rxPortal {
+func newRxPortal(path *path, txPortal *txPortal, seq *util.Sequence, closer *closer, profile *Profile, ii InstrumentInstance) *rxPortal {
 	rx := &rxPortal{
-		tree:       btree.NewWith(profile.RxPortalTreeLen, utils.Int32Comparator),
-		accepted:   -1,
-		rxs:        make(chan *wireMessage),
-		reads:      make(chan *rxRead, profile.ReadsQueueLen),
-		readBuffer: new(bytes.Buffer),
-		readPool:   new(sync.Pool),
-		ackPool:    newPool("ackPool", uint32(profile.PoolBufferSz), ii),
-		conn:       conn,
-		peer:       peer,
-		txPortal:   txPortal,
-		seq:        seq,
-		closer:     closer,
-		profile:    profile,
-		ii:         ii,
-	}
-	rx.readPool.New = func() interface{} {
-		return make([]byte, profile.PoolBufferSz)
+		tree:     btree.NewWith(profile.RxPortalTreeLen, util.SeqComparator),
+		accepted: -1,
+		rxs:      make(chan *wireMessage),
+		reads:    make(chan *rxRead, profile.ReadsQueueLen),
+		done:     make(chan struct{}),
+		deadline: newDeadline(nil),
+		ackPool:  newPool("ackPool", uint32(profile.PoolBufferSz), ii),
+		path:     path,
+		txPortal: txPortal,
+		seq:      seq,
+		closer:   closer,
+		profile:  profile,
+		ii:       ii,
 	}
 	go rx.run()
 	return rx
 }
 
 func (self *rxPortal) read(p []byte) (int, error) {
-preread:
-	for {
-		select {
-		case read, ok := <-self.reads:
-			if !ok {
-				logrus.Error("!ok(1)")
-				return 0, io.EOF
-			}
-			if !read.eof {
-				n, err := self.readBuffer.Write(read.buf[:read.sz])
-				if err != nil {
-					logrus.Error("buffer")
-					return 0, errors.Wrap(err, "buffer")
-				}
-				if n != read.sz {
-					logrus.Errorf("short read")
-					return 0, errors.New("short read")
-				}
-			} else {
-				logrus.Error("read EOF(1)")
-				return 0, io.EOF
-			}
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
 
-		default:
-			break preread
+	if self.deadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if self.current == nil {
+		if _, err := self.next(true); err != nil {
+			return 0, err
 		}
 	}
-	if self.readBuffer.Len() > 0 {
-		n, err := self.readBuffer.Read(p)
-		if err == io.EOF {
-			logrus.Error("!buffer")
+	n := 0
+	for {
+		c := copy(p[n:], self.current.data)
+		n += c
+		self.current.data = self.current.data[c:]
+		if len(self.current.data) > 0 {
+			return n, nil
 		}
-		return n, err
-	} else {
-		read, ok := <-self.reads
-		if !ok {
-			logrus.Error("!ok")
-			return 0, io.EOF
+		self.current.wm.buffer.unref()
+		self.current = nil
+		// keep filling p from segments that have already arrived
+		if n == len(p) {
+			return n, nil
 		}
-		if !read.eof {
-			n, err := self.readBuffer.Write(read.buf[:read.sz])
-			if err != nil {
-				return 0, errors.Wrap(err, "buffer")
-			}
-			if n != read.sz {
-				return 0, errors.Wrap(err, "short buffer")
-			}
-			self.readPool.Put(read.buf)
+		if ok, _ := self.next(false); !ok {
+			return n, nil
+		}
+	}
+}
 
-			return self.readBuffer.Read(p)
+// writeTo writes every segment directly from its wire buffer to w, until EOF or an error.
+func (self *rxPortal) writeTo(w io.Writer) (int64, error) {
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
 
-		} else {
-			logrus.Errorf("close notified")
-			close(self.reads)
-			return 0, io.EOF
+	var n int64
+	for {
+		if self.deadline.expired() {
+			return n, os.ErrDeadlineExceeded
+		}
+		if self.current == nil {
+			if _, err := self.next(true); err != nil {
+				if err == io.EOF {
+					return n, nil
+				}
+				return n, err
+			}
 		}
+		c, err := w.Write(self.current.data)
+		n += int64(c)
+		self.current.data = self.current.data[c:]
+		if err != nil {
+			return n, err
+		}
+		self.current.wm.buffer.unref()
+		self.current = nil
 	}
 }
 
-func (self *rxPortal) rx(wm *wireMessage) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.Wrap(err, "send on closed rxs")
+// next makes the next queued segment current. Unless block is set, it returns false immediately when no segment is
+// queued. Segments queued before the portal closed are still returned, ahead of io.EOF.
+func (self *rxPortal) next(block bool) (bool, error) {
+	if self.eof {
+		return false, io.EOF
+	}
+	var read *rxRead
+	select {
+	case read = <-self.reads:
+	default:
+		if !block {
+			return false, nil
 		}
-	}()
-	self.rxs <- wm
-	return err
+		select {
+		case read = <-self.reads:
+		case <-self.done:
+			select {
+			case read = <-self.reads:
+			default:
+				self.eof = true
+				return false, io.EOF
+			}
+		case <-self.deadline.wait():
+			return false, os.ErrDeadlineExceeded
+		}
+	}
+	self.current = read
+	return true, nil
+}
+
+func (self *rxPortal) rx(wm *wireMessage) error {
+	select {
+	case self.rxs <- wm:
+		return nil
+	case <-self.done:
+		wm.buffer.unref()
+		return errors.New("rx portal closed")
+	}
+}
+
+func (self *rxPortal) setRxPortalSz(rxPortalSz int) {
+	self.rxPortalSz = rxPortalSz
+	atomic.StoreInt32(&self.advertised, int32(rxPortalSz))
+	self.ii.RxPortalSzChanged(self.path.peer(), rxPortalSz)
+}
+
+// size returns the buffered out-of-order data, for advertising to the peer from outside of the rxPortal.
+func (self *rxPortal) size() int {
+	return int(atomic.LoadInt32(&self.advertised))
 }
 
 func (self *rxPortal) setAccepted(accepted int32) {
@@ -139,9 +194,8 @@ func (self *rxPortal) setAccepted(accepted int32) {
 
 func (self *rxPortal) close() {
 	if !self.closed {
-		self.reads <- &rxRead{nil, 0, true}
 		self.closed = true
-		close(self.rxs)
+		close(self.done)
 	}
 }
 
@@ -155,14 +209,19 @@ func (self *rxPortal) run() {
 		}
 	}()
 
+	var ackDelay <-chan time.Time
 	for {
 		var wm *wireMessage
-		var ok bool
 		select {
-		case wm, ok = <-self.rxs:
-			if !ok {
-				return
-			}
+		case wm = <-self.rxs:
+
+		case <-self.done:
+			return
+
+		case <-ackDelay:
+			ackDelay = nil
+			self.flushAcks()
+			continue
 
 		case <-time.After(time.Duration(self.profile.ConnectionInactiveTimeoutMs) * time.Millisecond):
 			self.closer.timeout()
@@ -171,20 +230,34 @@ func (self *rxPortal) run() {
 
 		switch wm.messageType() {
 		case DATA:
+			if wm.hasFlag(PMTU) {
+				if wm = self.reassemble(wm); wm == nil {
+					continue
+				}
+			}
 			_, found := self.tree.Get(wm.seq)
-			if !found && (wm.seq > self.accepted || (wm.seq == 0 && self.accepted == math.MaxInt32)) {
+			if !found && !self.inWindow(wm) {
+				// not acknowledged; the transmitter retransmits once the window has advanced
+				self.ii.OutOfWindowRx(self.path.peer(), wm)
+				wm.buffer.unref()
+				continue
+			}
+			duplicate := false
+			kept := false
+			if !found && util.SeqLess(self.accepted, wm.seq) {
 				if sz, err := wm.asDataSize(); err == nil {
 					self.tree.Put(wm.seq, wm)
-					self.rxPortalSz += int(sz)
-					self.ii.RxPortalSzChanged(self.peer, self.rxPortalSz)
+					kept = true
+					self.setRxPortalSz(self.rxPortalSz + int(sz))
 				} else {
 					logrus.Errorf("unexpected mt [%d] (%v)", wm.messageType(), err)
 				}
 			} else {
-				self.ii.DuplicateRx(self.peer, wm)
+				self.ii.DuplicateRx(self.path.peer(), wm)
+				duplicate = true
 			}
 
-			var rtt *uint16
+			var rtt *rttProbe
 			if wm.hasFlag(RTT) {
 				if _, rttIn, err := wm.asData(); err == nil {
 					rtt = rttIn
@@ -193,85 +266,89 @@ func (self *rxPortal) run() {
 				}
 			}
 
-			if ack, err := newAck([]Ack{{wm.seq, wm.seq}}, int32(self.rxPortalSz), rtt, self.ackPool); err == nil {
-				if err := writeWireMessage(ack, self.conn, self.peer); err != nil {
-					logrus.Errorf("error sending ack (%v)", err)
-				}
-				self.ii.WireMessageTx(self.peer, ack)
-				self.ii.TxAck(self.peer, ack)
-				ack.buffer.unref()
-			}
-
-			if found {
+			seq := wm.seq
+			if !kept {
 				wm.buffer.unref()
 			}
 
-			if self.tree.Size() > 0 {
-				startingRxPortalSz := self.rxPortalSz
-
-				var next int32
-				if self.accepted < math.MaxInt32 {
-					next = self.accepted + 1
-				} else {
-					next = 0
-				}
+			/*
+			 * Take the in-order segments out of the tree ahead of delivering them, so that the ack advertises the
+			 * rxPortalSz that follows delivery.
+			 */
+			buffered := self.tree.Size() > 0
+			startingRxPortalSz := self.rxPortalSz
+			ready := self.ready[:0]
+			if buffered {
+				next := util.SeqNext(self.accepted)
 
 				keys := self.tree.Keys()
 				for _, key := range keys {
 					if key.(int32) == next {
 						v, _ := self.tree.Get(key)
 						wm := v.(*wireMessage)
-						buf := self.readPool.Get().([]byte)
 						if data, _, err := wm.asData(); err == nil {
-							n := copy(buf, data)
-							self.reads <- &rxRead{buf, n, false}
+							ready = append(ready, &rxRead{wm: wm, data: data})
 
 							self.tree.Remove(key)
-							self.rxPortalSz -= len(data)
-							self.ii.RxPortalSzChanged(self.peer, self.rxPortalSz)
-							wm.buffer.unref()
+							self.setRxPortalSz(self.rxPortalSz - len(data))
 							self.accepted = next
-							if next < math.MaxInt32 {
-								next++
-							} else {
-								next = 0
-							}
+							next = util.SeqNext(next)
 						} else {
 							logrus.Errorf("unexpected mt [%d]", wm.mt)
 						}
 					}
 				}
+			}
 
+			/*
+			 * Ack before delivering to the reader, which blocks while the reads queue is full; a slow reader must not hold
+			 * back the acks for data that has already arrived.
+			 */
+			if self.profile.AckDelayMs > 0 {
+				self.acks.add(seq, rtt)
 				/*
-				 * Send "pacing" KEEPALIVE when buffer size changes more than RxPortalSzPacingThresh.
+				 * Duplicates and gaps are acked immediately, so the transmitter learns of loss without delay. RTT probes are
+				 * acked immediately, so they measure the path rather than the ack delay.
 				 */
-				if startingRxPortalSz > self.profile.TxPortalMinSz && float64(self.rxPortalSz)/float64(startingRxPortalSz) < self.profile.RxPortalSzPacingThresh {
-					if keepalive, err := newKeepalive(self.rxPortalSz, self.ackPool); err == nil {
-						if err := writeWireMessage(keepalive, self.conn, self.peer); err != nil {
-							logrus.Errorf("error sending pacing keepalive (%v)", err)
-						}
-						self.ii.WireMessageTx(self.peer, keepalive)
-						self.ii.TxKeepalive(self.peer, keepalive)
-						keepalive.buffer.unref()
+				if duplicate || rtt != nil || self.tree.Size() > 0 || self.acks.Full(self.profile.AckCoalesceThresh) {
+					ackDelay = nil
+					self.flushAcks()
+				} else if ackDelay == nil {
+					ackDelay = time.After(time.Duration(self.profile.AckDelayMs) * time.Millisecond)
+				}
+			} else {
+				self.sendAck([]Ack{{seq, seq}}, rtt)
+			}
+
+			/*
+			 * Send "pacing" KEEPALIVE when buffer size changes more than RxPortalSzPacingThresh.
+			 */
+			if buffered && self.txPortal.alg.RxPortalPacing(startingRxPortalSz, self.rxPortalSz) {
+				if keepalive, err := newKeepalive(self.rxPortalSz, self.ackPool); err == nil {
+					if err := self.path.write(keepalive); err != nil {
+						logrus.Errorf("error sending pacing keepalive (%v)", err)
 					}
+					self.ii.WireMessageTx(self.path.peer(), keepalive)
+					self.ii.TxKeepalive(self.path.peer(), keepalive)
+					keepalive.buffer.unref()
 				}
 			}
 
+			for i, read := range ready {
+				// the reader takes over the tree's reference to the buffer
+				self.reads <- read
+				ready[i] = nil
+			}
+			self.ready = ready
+
 		case KEEPALIVE:
 			//
 
 		case CLOSE:
-			closeAck, err := newAck([]Ack{{wm.seq, wm.seq}}, int32(self.rxPortalSz), nil, self.ackPool)
-			if err == nil {
-				if err := writeWireMessage(closeAck, self.conn, self.peer); err != nil {
-					logrus.Errorf("error writing close ack (%v)", err)
-				}
-				self.ii.WireMessageTx(self.peer, closeAck)
-				self.ii.TxAck(self.peer, closeAck)
-			} else {
-				logrus.Errorf("error creating close ack (%v)", err)
-			}
-			self.closer.rxCloseSeqIn <- wm.seq
+			ackDelay = nil
+			self.flushAcks()
+			self.sendAck([]Ack{{wm.seq, wm.seq}}, nil)
+			self.closer.rxClose(wm.seq)
 			wm.buffer.unref()
 
 		default:
@@ -280,3 +357,96 @@ func (self *rxPortal) run() {
 		}
 	}
 }
+
+// reassemble takes a DATA fragment, returning the reassembled segment once every fragment has arrived, or nil. A
+// fragment of a segment that has already been accepted returns a segment immediately, so that it is acknowledged again.
+func (self *rxPortal) reassemble(fragment *wireMessage) *wireMessage {
+	defer fragment.buffer.unref()
+
+	offset, total, data, err := fragment.asDataFragment()
+	if err != nil {
+		logrus.Errorf("as data fragment error (%v)", err)
+		return nil
+	}
+	seq := fragment.seq
+	for pending := range self.fragments {
+		if !util.SeqLess(self.accepted, pending) {
+			delete(self.fragments, pending)
+		}
+	}
+	r, found := self.fragments[seq]
+	if !found {
+		if util.SeqLess(self.accepted, seq) {
+			if len(self.fragments) >= maxReassemblies {
+				return nil
+			}
+			if self.fragments == nil {
+				self.fragments = make(map[int32]*reassembly)
+			}
+			r = &reassembly{data: make([]byte, total), offsets: make(map[int]bool)}
+			self.fragments[seq] = r
+		} else {
+			r = &reassembly{data: make([]byte, total), offsets: make(map[int]bool), received: total}
+		}
+	}
+	if len(r.data) != total {
+		logrus.Errorf("data fragment size mismatch [%d != %d]", total, len(r.data))
+		return nil
+	}
+	if !r.offsets[offset] && r.received < total {
+		copy(r.data[offset:], data)
+		r.offsets[offset] = true
+		r.received += len(data)
+	}
+	if r.received < total {
+		return nil
+	}
+	delete(self.fragments, seq)
+
+	wm, err := newData(seq, nil, r.data, self.ackPool)
+	if err != nil {
+		logrus.Errorf("error reassembling data (%v)", err)
+		return nil
+	}
+	return wm
+}
+
+// inWindow reports whether a segment falls within the receive window; no more than rx_window_seqs sequences ahead of
+// the last accepted sequence, and not growing the buffered out-of-order data beyond rx_window_sz. The next expected
+// sequence is always in the window, so that a full window can drain. Sequences already accepted are not windowed.
+func (self *rxPortal) inWindow(wm *wireMessage) bool {
+	ahead := util.SeqDiff(wm.seq, self.accepted)
+	if ahead <= 1 {
+		return true
+	}
+	if self.profile.RxWindowSeqs > 0 && ahead > int32(self.profile.RxWindowSeqs) {
+		return false
+	}
+	if self.profile.RxWindowSz > 0 {
+		if sz, err := wm.asDataSize(); err == nil && self.rxPortalSz+int(sz) > self.profile.RxWindowSz {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *rxPortal) flushAcks() {
+	if self.acks.Pending() {
+		acks, rtt := self.acks.take()
+		self.sendAck(acks, rtt)
+	}
+}
+
+func (self *rxPortal) sendAck(acks []Ack, rtt *rttProbe) {
+	ack, err := newAck(acks, int32(self.rxPortalSz), rtt, self.ackPool)
+	if err != nil {
+		logrus.Errorf("error creating ack (%v)", err)
+		return
+	}
+	if err := self.path.write(ack); err != nil {
+		logrus.Errorf("error sending ack (%v)", err)
+	}
+	self.ii.WireMessageTx(self.path.peer(), ack)
+	self.ii.TxAck(self.path.peer(), ack)
+	ack.buffer.unref()
+}
@@ -0,0 +1,246 @@
+package westworld3
+
+import (
+	"bytes"
+	"errors"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var errEnough = errors.New("enough")
+
+// collector accepts writes until it holds sz bytes.
+type collector struct {
+	bytes.Buffer
+	sz     int
+	writes int
+}
+
+func (self *collector) Write(p []byte) (int, error) {
+	self.writes++
+	n, _ := self.Buffer.Write(p)
+	if self.Len() >= self.sz {
+		return n, errEnough
+	}
+	return n, nil
+}
+
+func TestRxPortalWriteTo(t *testing.T) {
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(40), util.NewEmulatorConfig(41), NewBaselineProfile(), NewBaselineProfile())
+	_, ok := accepted.(io.WriterTo)
+	assert.True(t, ok)
+
+	sz := 1024 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+
+	c := &collector{sz: sz}
+	n, err := io.Copy(c, accepted)
+	assert.Equal(t, errEnough, err)
+	assert.Equal(t, int64(sz), n)
+	assert.True(t, bytes.Equal(data, c.Bytes()))
+	// one write per segment, straight from the wire buffers
+	assert.Equal(t, (sz+NewBaselineProfile().MaxSegmentSz-1)/NewBaselineProfile().MaxSegmentSz, c.writes)
+}
+
+func TestRxPortalReadSpansSegments(t *testing.T) {
+	dialed, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(42), util.NewEmulatorConfig(43), NewBaselineProfile(), NewBaselineProfile())
+
+	sz := 256 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(2)).Read(data)
+	_, err := dialed.Write(data)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	received := make([]byte, 0, sz)
+	read := func(readSz int) int {
+		p := make([]byte, readSz)
+		n, err := accepted.Read(p)
+		assert.NoError(t, err)
+		received = append(received, p[:n]...)
+		return n
+	}
+	// small reads consume a segment across calls; large reads gather every segment that has arrived
+	for i := 0; i < 20; i++ {
+		read(100)
+	}
+	for i := 0; i < 20; i++ {
+		read(4000)
+	}
+	assert.Greater(t, read(sz), NewBaselineProfile().MaxSegmentSz)
+	for len(received) < sz {
+		read(sz)
+	}
+	assert.True(t, bytes.Equal(data, received))
+}
+
+func TestRxPortalReadDeadline(t *testing.T) {
+	_, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(44), util.NewEmulatorConfig(45), NewBaselineProfile(), NewBaselineProfile())
+
+	assert.NoError(t, accepted.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := io.Copy(io.Discard, accepted)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestRxPortalWindow(t *testing.T) {
+	// a window well below the transmitter's starting portal; out-of-window segments are dropped, and recovered by
+	// retransmission
+	ii := &countingInstrumentInstance{}
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.RxWindowSz = 32 * 1024
+	listenerProfile.RxWindowSeqs = 16
+	listenerProfile.i = &countingInstrument{ii}
+	toListener := util.NewEmulatorConfig(46)
+	toListener.LossRate = 0.01
+	toListener.ReorderRate = 0.05
+	dialed, accepted, _ := emulatedPair(t, toListener, util.NewEmulatorConfig(47), listenerProfile, NewBaselineProfile())
+
+	sz := 512 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(3)).Read(data)
+	go func() {
+		_, err := dialed.Write(data)
+		assert.NoError(t, err)
+	}()
+	received := make([]byte, sz)
+	_, err := io.ReadFull(accepted, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	ii.lock.Lock()
+	defer ii.lock.Unlock()
+	assert.Greater(t, ii.outOfWindowRx, 0)
+}
+
+func TestRxPortalRejectsOutOfWindow(t *testing.T) {
+	ii := &countingInstrumentInstance{}
+	listenerProfile := NewBaselineProfile()
+	listenerProfile.i = &countingInstrument{ii}
+	_, accepted, _ := emulatedPair(t, util.NewEmulatorConfig(48), util.NewEmulatorConfig(49), listenerProfile, NewBaselineProfile())
+	rxp := accepted.(*listenerConn).rxPortal
+	pool := newPool("test", uint32(listenerProfile.PoolBufferSz), NewNilInstrument().NewInstance("", nil))
+
+	// beyond rx_window_seqs, up to half of the sequence space ahead
+	for _, ahead := range []int32{int32(listenerProfile.RxWindowSeqs) + 1, 1 << 20, 1<<30 - 1} {
+		wm, err := newData(util.SeqAdd(0, ahead), nil, make([]byte, 1024), pool)
+		assert.NoError(t, err)
+		assert.NoError(t, rxp.rx(wm))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ii.lock.Lock()
+		dropped := ii.outOfWindowRx
+		ii.lock.Unlock()
+		if dropped == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ii.lock.Lock()
+	assert.Equal(t, 3, ii.outOfWindowRx)
+	ii.lock.Unlock()
+	assert.NoError(t, accepted.Close())
+}
+
+func TestRxPortalCloseWithFullReads(t *testing.T) {
+	rx := &rxPortal{
+		rxs:      make(chan *wireMessage),
+		reads:    make(chan *rxRead, 1),
+		done:     make(chan struct{}),
+		deadline: newDeadline(nil),
+	}
+	buf := newPool("test", 64, &nilInstrumentInstance{}).get()
+	rx.reads <- &rxRead{wm: &wireMessage{buffer: buf}, data: []byte("queued")}
+	rx.close()
+
+	// data queued ahead of the close is read first, then io.EOF
+	p := make([]byte, 16)
+	n, err := rx.read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "queued", string(p[:n]))
+	_, err = rx.read(p)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRxPortalReassemble(t *testing.T) {
+	p := newPool("test", 4096, NewNilInstrument().NewInstance("", nil))
+	rxp := &rxPortal{accepted: -1, ackPool: p}
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(3)).Read(data)
+	fragment := func(seq int32, offset, end int) *wireMessage {
+		wm, err := newDataFragment(seq, offset, len(data), data[offset:end], p)
+		assert.NoError(t, err)
+		return wm
+	}
+
+	// out of order, and duplicated by a retransmission
+	assert.Nil(t, rxp.reassemble(fragment(0, 2900, 3000)))
+	assert.Nil(t, rxp.reassemble(fragment(0, 0, 1450)))
+	assert.Nil(t, rxp.reassemble(fragment(0, 0, 1450)))
+	assert.Nil(t, rxp.reassemble(fragment(1, 0, 1450)))
+	wm := rxp.reassemble(fragment(0, 1450, 2900))
+	if assert.NotNil(t, wm) {
+		assert.Equal(t, int32(0), wm.seq)
+		assert.False(t, wm.hasFlag(PMTU))
+		out, _, err := wm.asData()
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, out))
+	}
+	assert.Equal(t, 1, len(rxp.fragments))
+
+	// partial segments are forgotten once accepted
+	rxp.accepted = 1
+	wm = rxp.reassemble(fragment(1, 1450, 2900))
+	assert.NotNil(t, wm)
+	assert.Equal(t, 0, len(rxp.fragments))
+}
+
+func TestRxPortalAcksAheadOfBlockedRead(t *testing.T) {
+	network := newEmulatedNetwork()
+	peerAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6464}
+	conn := network.bind(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6363}, util.NewEmulatorConfig(0))
+	peer := network.bind(peerAddr, util.NewEmulatorConfig(0))
+	profile := NewBaselineProfile()
+	profile.ReadsQueueLen = 1
+	profile.AckDelayMs = 0
+	ii := &nilInstrumentInstance{}
+	pool := newPool("test", uint32(profile.PoolBufferSz), ii)
+	p := newPath(conn, peerAddr)
+	txp, err := newTxPortal(p, nil, profile, pool, ii)
+	assert.NoError(t, err)
+	rxp := newRxPortal(p, txp, nil, nil, profile, ii)
+
+	// nothing is read; the first segment fills the reads queue, and the portal blocks delivering the second
+	for seq := int32(0); seq < 2; seq++ {
+		wm, err := newData(seq, nil, []byte{0x01}, pool)
+		assert.NoError(t, err)
+		assert.NoError(t, rxp.rx(wm))
+	}
+	assert.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for seq := int32(0); seq < 2; seq++ {
+		wm, _, err := readWireMessage(peer, pool)
+		if !assert.NoError(t, err) {
+			return
+		}
+		acks, _, _, err := wm.asAck()
+		assert.NoError(t, err)
+		assert.Equal(t, []Ack{{seq, seq}}, acks)
+		wm.buffer.unref()
+	}
+
+	for i := 0; i < 2; i++ {
+		(<-rxp.reads).wm.buffer.unref()
+	}
+	rxp.close()
+}
@@ -206,6 +206,38 @@ func (self *traceInstrumentInstance) DuplicateAck(peer *net.UDPAddr, seq int32)
 	}
 }
 
+func (self *traceInstrumentInstance) FastRetransmit(peer *net.UDPAddr, wm *wireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s FAST RETX: #%d", self.id, wm.seq))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TimeoutRetransmit(peer *net.UDPAddr, wm *wireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TIMEOUT RETX: #%d", self.id, wm.seq))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) PacingRateChanged(peer *net.UDPAddr, bytesPerSec int) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s PACING RATE: %d", self.id, bytesPerSec))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) MaxSegmentSzChanged(peer *net.UDPAddr, maxSegmentSz int) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s MAX SEGMENT SZ: %d", self.id, maxSegmentSz))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * rxPortal
  */
@@ -225,6 +257,14 @@ func (self *traceInstrumentInstance) DuplicateRx(peer *net.UDPAddr, wm *wireMess
 	}
 }
 
+func (self *traceInstrumentInstance) OutOfWindowRx(peer *net.UDPAddr, wm *wireMessage) {
+	if self.i.config.RxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s OUT OF WINDOW RX: #%d", self.id, wm.seq))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * allocation
  */
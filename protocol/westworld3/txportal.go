@@ -2,65 +2,78 @@ package westworld3
 
 import (
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
+	"github.com/openziti/dilithium"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
 	"math"
-	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 type txPortal struct {
-	lock              *sync.Mutex
-	tree              *btree.Tree
-	capacity          int
-	ready             *sync.Cond
-	txPortalSz        int
-	rxPortalSz        int
-	successCt         int
-	successAccum      int
-	dupAckCt          int
-	retxCt            int
-	startRetxScale    float64
-	lastRetxScaleIncr time.Time
-	lastRetxScaleDecr time.Time
-	lastRttProbe      time.Time
-	lastTx            time.Time
-	monitor           *retxMonitor
-	closer            *closer
-	closeSent         bool
-	closed            bool
-	conn              *net.UDPConn
-	peer              *net.UDPAddr
-	pool              *pool
-	profile           *Profile
-	ii                InstrumentInstance
+	lock         *sync.Mutex
+	tree         *btree.Tree
+	alg          dilithium.TxAlgorithm
+	deadline     *deadline
+	lastTx       time.Time
+	monitor      *retxMonitor
+	highestAcked int32
+	fastRetxSeq  int32
+	wideRtt      bool
+	pacer        *pacer
+	paceWake     chan struct{}
+	pmtud        *pmtud
+	timers       []*reactorTimer
+	closer       *closer
+	rxPortal     *rxPortal
+	closeSent    bool
+	closed       bool
+	path         *path
+	pool         *pool
+	profile      *Profile
+	ii           InstrumentInstance
 }
 
-func newTxPortal(conn *net.UDPConn, peer *net.UDPAddr, closer *closer, profile *Profile, pool *pool, ii InstrumentInstance) *txPortal {
+func newTxPortal(path *path, closer *closer, profile *Profile, pool *pool, ii InstrumentInstance) (*txPortal, error) {
+	alg, err := newTxAlgorithm(profile, path, ii)
+	if err != nil {
+		return nil, err
+	}
 	p := &txPortal{
-		lock:              new(sync.Mutex),
-		tree:              btree.NewWith(profile.TxPortalTreeLen, utils.Int32Comparator),
-		capacity:          profile.TxPortalStartSz,
-		startRetxScale:    profile.RetxScale,
-		lastRetxScaleIncr: time.Now(),
-		lastRetxScaleDecr: time.Now(),
-		rxPortalSz:        -1,
-		closer:            closer,
-		closed:            false,
-		conn:              conn,
-		peer:              peer,
-		pool:              pool,
-		profile:           profile,
-		ii:                ii,
-	}
-	p.ready = sync.NewCond(p.lock)
-	p.monitor = newRetxMonitor(p.profile, p.conn, p.peer, p.lock, p.ii)
-	p.monitor.setRetxF(p.retx)
-	return p
+		lock:         new(sync.Mutex),
+		tree:         btree.NewWith(profile.TxPortalTreeLen, util.SeqComparator),
+		alg:          alg,
+		highestAcked: -1,
+		fastRetxSeq:  -1,
+		closer:       closer,
+		closed:       false,
+		path:         path,
+		pool:         pool,
+		profile:      profile,
+		ii:           ii,
+	}
+	p.alg.SetLock(p.lock)
+	if profile.TxPacing {
+		p.pacer = newPacer(profile.TxPacingGain, profile.TxPacingBurstSz)
+		p.paceWake = make(chan struct{}, 1)
+	}
+	p.deadline = newDeadline(func() {
+		p.lock.Lock()
+		p.interrupt()
+		p.lock.Unlock()
+	})
+	p.monitor = newRetxMonitor(p.profile, p.path, p.lock, p.alg, p.pool, p.ii)
+	p.monitor.setRetxF(p.alg.Retransmission)
+	if profile.PmtuDiscovery {
+		p.pmtud = newPmtud(profile)
+		p.monitor.setTimeoutF(p.pmtuLost)
+		p.monitor.setSegmentSzF(p.maxSegmentSz)
+		p.monitor.setProbeF(p.pmtuProbe, time.Now().Add(p.pmtuProbeInterval()))
+	}
+	return p, nil
 }
 
 func (self *txPortal) start() {
@@ -70,6 +83,16 @@ func (self *txPortal) start() {
 	}
 }
 
+// schedule drives the portal's timers from a reactor, rather than from goroutines of its own.
+func (self *txPortal) schedule(r *reactor) {
+	self.monitor.schedule(r)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.profile.SendKeepalive {
+		self.timers = append(self.timers, r.schedule(time.Now().Add(self.keepaliveInterval()), self.keepaliveTimer))
+	}
+}
+
 func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -77,23 +100,29 @@ func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 	if self.closed {
 		return -1, io.EOF
 	}
+	if self.deadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
 
 	remaining := len(p)
 	n = 0
 	for remaining > 0 {
-		segmentSz := int(math.Min(float64(remaining), float64(self.profile.MaxSegmentSz)))
-
-		var rtt *uint16
-		if time.Since(self.lastRttProbe).Milliseconds() > int64(self.profile.RttProbeMs) {
-			now := time.Now()
-			rtt = new(uint16)
-			*rtt = uint16(now.UnixNano() / int64(time.Millisecond))
-			segmentSz -= 2
-			self.lastRttProbe = now
+		maxSegmentSz := self.maxSegmentSz()
+		segmentSz := int(math.Min(float64(remaining), float64(maxSegmentSz)))
+
+		var rtt *rttProbe
+		if self.alg.ProbeRTT() {
+			rtt = newRttProbe(self.wideRtt)
+			if segmentSz > maxSegmentSz-int(rtt.sz()) {
+				segmentSz = maxSegmentSz - int(rtt.sz())
+			}
 		}
 
-		for self.availableCapacity(segmentSz) < 0 {
-			self.ready.Wait()
+		if !self.waitForCapacity(segmentSz) || !self.pace(segmentSz) {
+			if self.closed {
+				return n, io.EOF
+			}
+			return n, os.ErrDeadlineExceeded
 		}
 
 		wm, err := newData(seq.Next(), rtt, p[n:n+segmentSz], self.pool)
@@ -101,13 +130,11 @@ func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 			return 0, errors.Wrap(err, "new data")
 		}
 		self.tree.Put(wm.seq, wm)
-		self.txPortalSz += segmentSz
-		self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
 
-		if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
+		if err := self.path.write(wm); err != nil {
 			return 0, errors.Wrap(err, "tx")
 		}
-		self.ii.WireMessageTx(self.peer, wm)
+		self.ii.WireMessageTx(self.path.peer(), wm)
 		self.lastTx = time.Now()
 
 		self.monitor.add(wm)
@@ -119,13 +146,83 @@ func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 	return n, nil
 }
 
+func (self *txPortal) waitForCapacity(segmentSz int) bool {
+	if alg, ok := self.alg.(dilithium.InterruptibleTxAlgorithm); ok {
+		return alg.TxInterruptible(segmentSz, func() bool {
+			return self.closed || self.deadline.expired()
+		})
+	}
+	self.alg.Tx(segmentSz)
+	return true
+}
+
+// pace holds the transmitter to the pacing rate once the segment has portal capacity, so that segments released
+// together by an ack are still spaced out on the wire. It releases the lock while it waits so that acks continue to be
+// processed, and returns false if the portal was closed or the deadline expired while waiting.
+func (self *txPortal) pace(segmentSz int) bool {
+	if self.pacer == nil {
+		return true
+	}
+	if alg, ok := self.alg.(dilithium.PacingTxAlgorithm); ok {
+		if self.pacer.update(alg.PacingRate()) {
+			self.ii.PacingRateChanged(self.path.peer(), int(self.pacer.rate))
+		}
+	}
+	if delay := self.pacer.delay(segmentSz, time.Now()); delay > 0 && !self.closed && !self.deadline.expired() {
+		// discard any interruption from before the wait; the lock is held, so no new one can arrive until it is released
+		select {
+		case <-self.paceWake:
+		default:
+		}
+		timer := time.NewTimer(delay)
+		self.lock.Unlock()
+		select {
+		case <-timer.C:
+		case <-self.paceWake:
+			timer.Stop()
+		}
+		self.lock.Lock()
+	}
+	return !self.closed && !self.deadline.expired()
+}
+
+func (self *txPortal) interrupt() {
+	if alg, ok := self.alg.(dilithium.InterruptibleTxAlgorithm); ok {
+		alg.Interrupt()
+	}
+	if self.paceWake != nil {
+		select {
+		case self.paceWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (self *txPortal) ack(acks []Ack) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	lastTxPortalSz := self.txPortalSz
 	for _, ack := range acks {
-		for seq := ack.Start; seq <= ack.End; seq++ {
+		if util.SeqLess(ack.End, ack.Start) {
+			logrus.Errorf("invalid ack range [%d:%d]", ack.Start, ack.End)
+			continue
+		}
+		window, ok := self.window(ack)
+		if !ok || window != ack {
+			// the sequences outside the window were acked already, or never sent; count them as a single duplicate
+			// rather than walking a range that may span the whole sequence space
+			dup := ack.Start
+			if ok && window.Start == ack.Start {
+				dup = ack.End
+			}
+			self.alg.DuplicateAck()
+			self.ii.DuplicateAck(self.path.peer(), dup)
+			if !ok {
+				continue
+			}
+		}
+		for seq, last := window.Start, false; !last; seq = util.SeqNext(seq) {
+			last = seq == window.End
 			if v, found := self.tree.Get(seq); found {
 				wm := v.(*wireMessage)
 				self.monitor.remove(wm)
@@ -136,55 +233,97 @@ func (self *txPortal) ack(acks []Ack) error {
 					if err != nil {
 						return errors.Wrap(err, "internal tree error")
 					}
-					self.txPortalSz -= int(sz)
-					self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
-					self.successfulAck(int(sz))
+					self.alg.Success(int(sz))
+					if self.pmtud != nil {
+						self.pmtud.delivered(int(sz))
+					}
 
 				case CLOSE:
-					self.successfulAck(0)
+					self.alg.Success(0)
 
 				default:
 					logrus.Warnf("acked suspicious message type in tree [%d]", wm.messageType())
 				}
 				wm.buffer.unref()
+				self.updateHighestAcked(seq)
 
 			} else {
-				self.duplicateAck(seq)
+				self.alg.DuplicateAck()
+				self.ii.DuplicateAck(self.path.peer(), seq)
 			}
 		}
 	}
 
-	if self.txPortalSz != lastTxPortalSz {
-		self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
+	self.fastRetx()
+
+	return nil
+}
+
+// window bounds ack to the outstanding sequences in the tree, returning false when it falls entirely outside them.
+func (self *txPortal) window(ack Ack) (Ack, bool) {
+	oldest, newest := self.tree.LeftKey(), self.tree.RightKey()
+	if oldest == nil {
+		return ack, false
+	}
+	window := ack
+	if util.SeqLess(window.Start, oldest.(int32)) {
+		window.Start = oldest.(int32)
+	}
+	if util.SeqLess(newest.(int32), window.End) {
+		window.End = newest.(int32)
+	}
+	if util.SeqLess(window.End, window.Start) {
+		return ack, false
 	}
+	return window, true
+}
 
-	if time.Since(self.lastRetxScaleDecr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
-		self.profile.RetxScale -= self.profile.RetxEvaluationScaleDecr
-		if self.profile.RetxScale < self.profile.RetxScaleFloor {
-			self.profile.RetxScale = self.profile.RetxScaleFloor
-		}
-		self.ii.NewRetxScale(self.peer, self.profile.RetxScale)
-		self.lastRetxScaleDecr = time.Now()
+func (self *txPortal) updateHighestAcked(seq int32) {
+	if self.highestAcked < 0 || util.SeqLess(self.highestAcked, seq) {
+		self.highestAcked = seq
 	}
+}
 
-	self.ready.Broadcast()
-	return nil
+// fastRetx retransmits every outstanding segment at least FastRetxThresh sequences behind the highest acked
+// sequence, without waiting for its retransmission deadline. Each segment is fast retransmitted at most once.
+func (self *txPortal) fastRetx() {
+	if self.fastRetxSeq >= 0 {
+		// forget the last fast retransmission once every outstanding sequence follows it, so that it never falls far
+		// enough behind to compare as following them
+		if oldest := self.tree.LeftKey(); oldest == nil || util.SeqLess(self.fastRetxSeq, oldest.(int32)) {
+			self.fastRetxSeq = -1
+		}
+	}
+	if self.profile.FastRetxThresh < 1 || self.highestAcked < 0 {
+		return
+	}
+	var lost []*wireMessage
+	i := self.tree.Iterator()
+	for i.Next() {
+		seq := i.Key().(int32)
+		if util.SeqDiff(self.highestAcked, seq) < int32(self.profile.FastRetxThresh) {
+			break
+		}
+		if self.fastRetxSeq < 0 || util.SeqLess(self.fastRetxSeq, seq) {
+			lost = append(lost, i.Value().(*wireMessage))
+		}
+	}
+	for _, wm := range lost {
+		self.monitor.fastRetx(wm)
+		self.fastRetxSeq = wm.seq
+	}
 }
 
 func (self *txPortal) updateRxPortalSz(rxPortalSz int) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	self.rxPortalSz = rxPortalSz
-	self.ready.Broadcast()
-	self.ii.TxPortalRxSzChanged(self.peer, rxPortalSz)
+	self.alg.UpdateRxPortalSize(rxPortalSz)
 }
 
-func (self *txPortal) rtt(probeTs uint16) {
-	now := time.Now().UnixNano()
+func (self *txPortal) rtt(probe *rttProbe) {
+	now := time.Now()
 	self.lock.Lock()
-	clockTs := uint16(now / int64(time.Millisecond))
-	rttMs := clockTs - probeTs
-	self.monitor.updateRttMs(rttMs)
+	self.monitor.rtt(probe, now)
 	self.lock.Unlock()
 }
 
@@ -200,11 +339,11 @@ func (self *txPortal) sendClose(seq *util.Sequence) error {
 		self.tree.Put(wm.seq, wm)
 		self.monitor.add(wm)
 
-		if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
+		if err := self.path.write(wm); err != nil {
 			return errors.Wrap(err, "tx close")
 		}
-		self.closer.txCloseSeqIn <- wm.seq
-		self.ii.WireMessageTx(self.peer, wm)
+		self.closer.txClose(wm.seq)
+		self.ii.WireMessageTx(self.path.peer(), wm)
 
 		self.closeSent = true
 	}
@@ -213,95 +352,131 @@ func (self *txPortal) sendClose(seq *util.Sequence) error {
 }
 
 func (self *txPortal) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.closed = true
-	self.monitor.closed = true
-	self.monitor.ready.Broadcast()
+	self.monitor.close()
+	for _, t := range self.timers {
+		t.stop()
+	}
+	self.interrupt()
 }
 
-func (self *txPortal) successfulAck(sz int) {
-	self.successCt++
-	self.successAccum += sz
-	if self.successCt == self.profile.TxPortalIncreaseThresh {
-		newCapacity := self.capacity + int(float64(self.successAccum)*self.profile.TxPortalIncreaseScale)
-		self.updatePortalCapacity(newCapacity)
-		self.successCt = 0
-		self.successAccum = 0
+func (self *txPortal) keepaliveSender() {
+	logrus.Info("started")
+	defer logrus.Info("exited")
+
+	for {
+		time.Sleep(1 * time.Second)
+		self.lock.Lock()
+		closed := self.closed
+		self.lock.Unlock()
+		if closed {
+			return
+		}
+		self.keepalive()
 	}
 }
 
-func (self *txPortal) duplicateAck(seq int32) {
-	self.dupAckCt++
-	self.successCt = 0
-	if self.dupAckCt >= self.profile.TxPortalDupAckThresh {
-		newCapacity := int(float64(self.capacity) * self.profile.TxPortalDupAckCapacityScale)
-
-		// #93: Self-Adjusting retxMs
-		if time.Since(self.lastRetxScaleIncr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
-			self.profile.RetxScale += self.profile.RetxEvaluationScaleIncr
-			self.lastRetxScaleIncr = time.Now()
-			self.ii.NewRetxScale(self.peer, self.profile.RetxScale)
-		}
+// keepaliveTimer sends a keepalive if one is due, and then sleeps until the next one could be.
+func (self *txPortal) keepaliveTimer(now time.Time) time.Time {
+	self.keepalive()
 
-		self.updatePortalCapacity(newCapacity)
-		self.dupAckCt = 0
-		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalDupAckSuccessScale)
+	self.lock.Lock()
+	next := self.lastTx.Add(self.keepaliveInterval() + time.Millisecond)
+	self.lock.Unlock()
+	if !next.After(now) {
+		next = now.Add(time.Second)
 	}
-	self.ii.DuplicateAck(self.peer, seq)
+	return next
 }
 
-func (self *txPortal) retx() {
-	self.retxCt++
-	self.successCt = 0
-	if self.retxCt >= self.profile.TxPortalRetxThresh {
-		newCapacity := int(float64(self.capacity) * self.profile.TxPortalRetxCapacityScale)
-		self.updatePortalCapacity(newCapacity)
-		self.retxCt = 0
-		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalRetxSuccessScale)
+// keepalive sends a keepalive when nothing has been sent for half of the inactivity timeout. It carries the rxPortal's
+// current buffer size, which is what lets an idle peer blocked on an outdated size resume transmitting.
+func (self *txPortal) keepalive() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if time.Since(self.lastTx) > self.keepaliveInterval() {
+		keepalive, err := newKeepalive(self.rxPortal.size(), self.pool)
+		if err == nil {
+			if err := self.path.write(keepalive); err == nil {
+				self.lastTx = time.Now()
+
+				self.ii.WireMessageTx(self.path.peer(), keepalive)
+				self.ii.TxKeepalive(self.path.peer(), keepalive)
+
+			} else {
+				logrus.Errorf("error sending keepalive (%v)", err)
+			}
+			keepalive.buffer.unref()
+		}
 	}
 }
 
-func (self *txPortal) updatePortalCapacity(newCapacity int) {
-	oldCapacity := self.capacity
-	self.capacity = newCapacity
-	if self.capacity < self.profile.TxPortalMinSz {
-		self.capacity = self.profile.TxPortalMinSz
+func (self *txPortal) maxSegmentSz() int {
+	if self.pmtud != nil {
+		return self.pmtud.segmentSz
 	}
-	if self.capacity > self.profile.TxPortalMaxSz {
-		self.capacity = self.profile.TxPortalMaxSz
+	return self.profile.MaxSegmentSz
+}
+
+// rxPmtuProbe acknowledges a path MTU probe from the peer, or accepts the peer's acknowledgement of our own probe.
+func (self *txPortal) rxPmtuProbe(wm *wireMessage) {
+	probeSz, err := wm.asPmtuProbe()
+	if err != nil {
+		logrus.Errorf("as pmtu probe error (%v)", err)
+		return
 	}
-	if self.capacity != oldCapacity {
-		self.ii.TxPortalCapacityChanged(self.peer, self.capacity)
+	if wm.hasFlag(INLINE_ACK) {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.pmtud != nil && self.pmtud.ack(probeSz) {
+			self.ii.MaxSegmentSzChanged(self.path.peer(), self.pmtud.segmentSz)
+		}
+		return
+	}
+	ack, err := newPmtuProbeAck(probeSz, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating pmtu probe ack (%v)", err)
+		return
+	}
+	defer ack.buffer.unref()
+	if err := self.path.write(ack); err != nil {
+		logrus.Errorf("error sending pmtu probe ack (%v)", err)
+		return
 	}
+	self.ii.WireMessageTx(self.path.peer(), ack)
 }
 
-func (self *txPortal) availableCapacity(segmentSz int) int {
-	txPortalCapacity := float64(self.capacity - int(float64(self.rxPortalSz)*self.profile.TxPortalRxSzPressureScale) - (self.txPortalSz + segmentSz))
-	rxPortalCapacity := float64(self.capacity - (self.rxPortalSz + segmentSz))
-	return int(math.Min(txPortalCapacity, rxPortalCapacity))
+// pmtuLost is called with the monitor's lock held.
+func (self *txPortal) pmtuLost(segmentSz int) {
+	if self.pmtud.lost(segmentSz) {
+		self.ii.MaxSegmentSzChanged(self.path.peer(), self.pmtud.segmentSz)
+	}
 }
 
-func (self *txPortal) keepaliveSender() {
-	logrus.Info("started")
-	defer logrus.Info("exited")
-
-	for {
-		time.Sleep(1 * time.Second)
-		if self.closed {
-			return
-		}
-		if time.Since(self.lastTx).Milliseconds() > int64(self.profile.ConnectionInactiveTimeoutMs/2) {
-			keepalive, err := newKeepalive(self.rxPortalSz, self.pool)
-			if err == nil {
-				if err := writeWireMessage(keepalive, self.conn, self.peer); err == nil {
-					self.lastTx = time.Now()
+func (self *txPortal) keepaliveInterval() time.Duration {
+	return time.Duration(self.profile.ConnectionInactiveTimeoutMs/2) * time.Millisecond
+}
 
-					self.ii.WireMessageTx(self.peer, keepalive)
-					self.ii.TxKeepalive(self.peer, keepalive)
+func (self *txPortal) pmtuProbeInterval() time.Duration {
+	return time.Duration(self.profile.PmtuProbeMs) * time.Millisecond / 2
+}
 
-				} else {
-					logrus.Errorf("error sending keepalive (%v)", err)
-				}
+// pmtuProbe sends the next path MTU probe, if one is due, returning the time to check again. It is called from the
+// retx monitor's timer, with the lock held.
+func (self *txPortal) pmtuProbe(now time.Time) time.Time {
+	if probeSz := self.pmtud.next(now); probeSz > 0 {
+		probe, err := newPmtuProbe(probeSz, self.pool)
+		if err != nil {
+			logrus.Errorf("error creating pmtu probe (%v)", err)
+		} else {
+			// an oversized probe may be refused by the local stack; that is no different from losing it on the path
+			if err := self.path.write(probe); err == nil {
+				self.ii.WireMessageTx(self.path.peer(), probe)
 			}
+			probe.buffer.unref()
 		}
 	}
+	return now.Add(self.pmtuProbeInterval())
 }
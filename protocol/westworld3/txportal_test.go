@@ -0,0 +1,44 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTxPortalAckWindow(t *testing.T) {
+	conn := newEmulatedNetwork().bind(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6161}, util.NewEmulatorConfig(0))
+	p := newPath(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6262})
+	ii := &countingInstrumentInstance{}
+	txp, err := newTxPortal(p, nil, NewBaselineProfile(), newPool("test", 1024, ii), ii)
+	assert.NoError(t, err)
+
+	outstanding := func(seqs ...int32) {
+		for _, seq := range seqs {
+			wm, err := newData(seq, nil, []byte{1, 2, 3}, txp.pool)
+			assert.NoError(t, err)
+			txp.tree.Put(seq, wm)
+		}
+	}
+
+	// a range spanning half of the sequence space is bounded by the outstanding sequences
+	outstanding(10, 11, 12)
+	start := time.Now()
+	assert.NoError(t, txp.ack([]Ack{{0, math.MaxInt32 / 2}}))
+	assert.Less(t, time.Since(start).Milliseconds(), int64(100))
+	assert.Equal(t, 0, txp.tree.Size())
+	assert.Equal(t, 1, ii.dupAcks)
+
+	// nothing is outstanding, so the whole range is a duplicate
+	assert.NoError(t, txp.ack([]Ack{{11, 11}}))
+	assert.Equal(t, 2, ii.dupAcks)
+
+	// the window follows the outstanding sequences across the wrap
+	outstanding(math.MaxInt32-1, math.MaxInt32, 0)
+	assert.NoError(t, txp.ack([]Ack{{math.MaxInt32 - 1, 0}}))
+	assert.Equal(t, 0, txp.tree.Size())
+	assert.Equal(t, 2, ii.dupAcks)
+}
@@ -1,3 +1,7 @@
 package westworld3
 
-const protocolVersion = uint32(1)
+const protocolVersion = uint32(2)
+
+// protocolVersionRttUs is requested by dialers with the RttProbeUs option, and extends protocolVersion with 32-bit
+// microsecond RTT probes (RTT_US)
+const protocolVersionRttUs = uint32(3)
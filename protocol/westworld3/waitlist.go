@@ -1,71 +1,113 @@
 package westworld3
 
 import (
+	"container/heap"
 	"time"
 )
 
 type waitlist interface {
 	Add(*wireMessage, int, time.Time)
-	Update(int)
+	Update(func(*wireMessage) int)
 	Remove(*wireMessage)
 	Size() int
 	Peek() (*wireMessage, time.Time)
 	Next() (*wireMessage, time.Time)
 }
 
-type arrayWaitlist struct {
-	waitlist []*waitlistSubject
-}
-
 type waitlistSubject struct {
 	deadline time.Time
 	retxMs   int
 	wm       *wireMessage
 }
 
-func newArrayWaitlist() waitlist {
-	return &arrayWaitlist{}
+// reschedule moves the deadline by the difference between the new and the previous retransmission interval
+func (self *waitlistSubject) reschedule(retxMs int) {
+	self.deadline = self.deadline.Add(time.Duration(retxMs-self.retxMs) * time.Millisecond)
+	self.retxMs = retxMs
 }
 
-func (self *arrayWaitlist) Add(wm *wireMessage, retxMs int, t time.Time) {
-	self.waitlist = append(self.waitlist, &waitlistSubject{t, retxMs, wm})
+// heapWaitlist orders its subjects by deadline in an indexed min-heap, providing O(log n) Add, Remove and Next.
+type heapWaitlist struct {
+	heap waitlistHeap
 }
 
-func (self *arrayWaitlist) Update(retxMs int) {
-	for _, wl := range self.waitlist {
-		delta := retxMs - wl.retxMs
-		wl.deadline.Add(time.Duration(delta) * time.Millisecond)
+func newHeapWaitlist() waitlist {
+	return &heapWaitlist{heap: waitlistHeap{index: make(map[*wireMessage]int)}}
+}
+
+func (self *heapWaitlist) Add(wm *wireMessage, retxMs int, t time.Time) {
+	if i, found := self.heap.index[wm]; found {
+		self.heap.subjects[i].deadline = t
+		self.heap.subjects[i].retxMs = retxMs
+		heap.Fix(&self.heap, i)
+		return
 	}
+	heap.Push(&self.heap, &waitlistSubject{t, retxMs, wm})
 }
 
-func (self *arrayWaitlist) Remove(wm *wireMessage) {
-	i := -1
-	for i = 0; i < len(self.waitlist); i++ {
-		if self.waitlist[i].wm == wm {
-			break
-		}
+func (self *heapWaitlist) Update(retxMs func(*wireMessage) int) {
+	for _, wl := range self.heap.subjects {
+		wl.reschedule(retxMs(wl.wm))
 	}
-	if i > -1 {
-		self.waitlist = append(self.waitlist[:i], self.waitlist[i+1:]...)
+	heap.Init(&self.heap)
+}
+
+func (self *heapWaitlist) Remove(wm *wireMessage) {
+	if i, found := self.heap.index[wm]; found {
+		heap.Remove(&self.heap, i)
 	}
 }
 
-func (self *arrayWaitlist) Size() int {
-	return len(self.waitlist)
+func (self *heapWaitlist) Size() int {
+	return len(self.heap.subjects)
 }
 
-func (self *arrayWaitlist) Peek() (*wireMessage, time.Time) {
-	if len(self.waitlist) < 1 {
+func (self *heapWaitlist) Peek() (*wireMessage, time.Time) {
+	if len(self.heap.subjects) < 1 {
 		return nil, time.Time{}
 	}
-	return self.waitlist[0].wm, self.waitlist[0].deadline
+	return self.heap.subjects[0].wm, self.heap.subjects[0].deadline
 }
 
-func (self *arrayWaitlist) Next() (*wireMessage, time.Time) {
-	if len(self.waitlist) < 1 {
+func (self *heapWaitlist) Next() (*wireMessage, time.Time) {
+	if len(self.heap.subjects) < 1 {
 		return nil, time.Time{}
 	}
-	next := self.waitlist[0]
-	self.waitlist = self.waitlist[1:]
+	next := heap.Pop(&self.heap).(*waitlistSubject)
 	return next.wm, next.deadline
 }
+
+// waitlistHeap implements heap.Interface, tracking the position of each wireMessage so that it can be removed.
+type waitlistHeap struct {
+	subjects []*waitlistSubject
+	index    map[*wireMessage]int
+}
+
+func (self *waitlistHeap) Len() int {
+	return len(self.subjects)
+}
+
+func (self *waitlistHeap) Less(i, j int) bool {
+	return self.subjects[i].deadline.Before(self.subjects[j].deadline)
+}
+
+func (self *waitlistHeap) Swap(i, j int) {
+	self.subjects[i], self.subjects[j] = self.subjects[j], self.subjects[i]
+	self.index[self.subjects[i].wm] = i
+	self.index[self.subjects[j].wm] = j
+}
+
+func (self *waitlistHeap) Push(x interface{}) {
+	wl := x.(*waitlistSubject)
+	self.index[wl.wm] = len(self.subjects)
+	self.subjects = append(self.subjects, wl)
+}
+
+func (self *waitlistHeap) Pop() interface{} {
+	last := len(self.subjects) - 1
+	wl := self.subjects[last]
+	self.subjects[last] = nil
+	self.subjects = self.subjects[:last]
+	delete(self.index, wl.wm)
+	return wl
+}
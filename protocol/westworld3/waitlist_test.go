@@ -2,10 +2,63 @@ package westworld3
 
 import (
 	"github.com/stretchr/testify/assert"
+	"sort"
 	"testing"
 	"time"
 )
 
+// arrayWaitlist is the original slice-backed waitlist, kept as a reference for the benchmarks. Remove scans linearly,
+// and Add appends without ordering.
+type arrayWaitlist struct {
+	waitlist []*waitlistSubject
+}
+
+func newArrayWaitlist() waitlist {
+	return &arrayWaitlist{}
+}
+
+func (self *arrayWaitlist) Add(wm *wireMessage, retxMs int, t time.Time) {
+	self.waitlist = append(self.waitlist, &waitlistSubject{t, retxMs, wm})
+}
+
+func (self *arrayWaitlist) Update(retxMs func(*wireMessage) int) {
+	for _, wl := range self.waitlist {
+		wl.reschedule(retxMs(wl.wm))
+	}
+	sort.SliceStable(self.waitlist, func(i, j int) bool {
+		return self.waitlist[i].deadline.Before(self.waitlist[j].deadline)
+	})
+}
+
+func (self *arrayWaitlist) Remove(wm *wireMessage) {
+	for i := 0; i < len(self.waitlist); i++ {
+		if self.waitlist[i].wm == wm {
+			self.waitlist = append(self.waitlist[:i], self.waitlist[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *arrayWaitlist) Size() int {
+	return len(self.waitlist)
+}
+
+func (self *arrayWaitlist) Peek() (*wireMessage, time.Time) {
+	if len(self.waitlist) < 1 {
+		return nil, time.Time{}
+	}
+	return self.waitlist[0].wm, self.waitlist[0].deadline
+}
+
+func (self *arrayWaitlist) Next() (*wireMessage, time.Time) {
+	if len(self.waitlist) < 1 {
+		return nil, time.Time{}
+	}
+	next := self.waitlist[0]
+	self.waitlist = self.waitlist[1:]
+	return next.wm, next.deadline
+}
+
 func TestArrayWaitlist_Add_Next(t *testing.T) {
 	aw := &arrayWaitlist{}
 	deadline := time.Now().Add(200 * time.Millisecond)
@@ -33,77 +86,176 @@ func TestArrayWaitlist_Add_Remove(t *testing.T) {
 	assert.Equal(t, time.Time{}, deadlineOut)
 }
 
-func benchmarkArrayWaitlist_Add_Next(sz int, b *testing.B) {
+func TestHeapWaitlistOrdering(t *testing.T) {
+	hw := newHeapWaitlist()
+	now := time.Now()
+	wms := make([]*wireMessage, 0)
+	for _, offset := range []int{5, 1, 4, 2, 3} {
+		wm := &wireMessage{seq: int32(offset)}
+		wms = append(wms, wm)
+		hw.Add(wm, 200, now.Add(time.Duration(offset)*time.Millisecond))
+	}
+	assert.Equal(t, 5, hw.Size())
+
+	// re-queue with a later deadline, as the retx monitor does after a retransmission
+	hw.Add(wms[1], 200, now.Add(10*time.Millisecond))
+	assert.Equal(t, 5, hw.Size())
+	hw.Remove(wms[3])
+	hw.Remove(&wireMessage{seq: int32(99)})
+
+	wmOut, _ := hw.Peek()
+	assert.Equal(t, int32(3), wmOut.seq)
+	for _, seq := range []int32{3, 4, 5, 1} {
+		wmOut, _ = hw.Next()
+		assert.Equal(t, seq, wmOut.seq)
+	}
+	wmOut, deadlineOut := hw.Next()
+	assert.Nil(t, wmOut)
+	assert.Equal(t, time.Time{}, deadlineOut)
+}
+
+func TestWaitlistUpdate(t *testing.T) {
+	for name, newWaitlist := range map[string]func() waitlist{"array": newArrayWaitlist, "heap": newHeapWaitlist} {
+		t.Run(name, func(t *testing.T) {
+			wl := newWaitlist()
+			now := time.Now()
+			a := &wireMessage{seq: int32(1)}
+			b := &wireMessage{seq: int32(2)}
+			wl.Add(a, 100, now.Add(100*time.Millisecond))
+			wl.Add(b, 200, now.Add(150*time.Millisecond))
+
+			wl.Update(func(*wireMessage) int { return 50 })
+			wmOut, deadlineOut := wl.Next()
+			assert.Equal(t, b, wmOut)
+			assert.Equal(t, now, deadlineOut)
+			wmOut, deadlineOut = wl.Next()
+			assert.Equal(t, a, wmOut)
+			assert.Equal(t, now.Add(50*time.Millisecond), deadlineOut)
+		})
+	}
+}
+
+func newWaitlistSubjects(sz int) []*waitlistSubject {
 	toAdd := make([]*waitlistSubject, 0)
 	for i := 0; i < sz; i++ {
 		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
 	}
-	aw := &arrayWaitlist{}
+	return toAdd
+}
+
+func benchmarkWaitlist_Add_Next(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for i := 0; i < sz; i++ {
-			aw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
 		}
 		for i := 0; i < sz; i++ {
-			aw.Next()
+			wl.Next()
 		}
 	}
 }
-func BenchmarkArrayWaitlist_Add_Next_1024(b *testing.B)  { benchmarkArrayWaitlist_Add_Next(1024, b) }
-func BenchmarkArrayWaitlist_Add_Next_4096(b *testing.B)  { benchmarkArrayWaitlist_Add_Next(4096, b) }
-func BenchmarkArrayWaitlist_Add_Next_16384(b *testing.B) { benchmarkArrayWaitlist_Add_Next(16384, b) }
+func BenchmarkArrayWaitlist_Add_Next_1024(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newArrayWaitlist, 1024, b)
+}
+func BenchmarkArrayWaitlist_Add_Next_4096(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newArrayWaitlist, 4096, b)
+}
+func BenchmarkArrayWaitlist_Add_Next_16384(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newArrayWaitlist, 16384, b)
+}
+func BenchmarkArrayWaitlist_Add_Next_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Next_1024(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newHeapWaitlist, 1024, b)
+}
+func BenchmarkHeapWaitlist_Add_Next_4096(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newHeapWaitlist, 4096, b)
+}
+func BenchmarkHeapWaitlist_Add_Next_16384(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newHeapWaitlist, 16384, b)
+}
+func BenchmarkHeapWaitlist_Add_Next_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newHeapWaitlist, 65536, b)
+}
 
-func benchmarkArrayWaitlist_Add_Remove(sz int, b *testing.B) {
-	toAdd := make([]*waitlistSubject, 0)
-	for i := 0; i < sz; i++ {
-		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
-	}
-	aw := &arrayWaitlist{}
+func benchmarkWaitlist_Add_Remove(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for i := 0; i < sz; i++ {
-			aw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
 		}
 		for i := 0; i < sz; i++ {
-			aw.Remove(toAdd[i].wm)
+			wl.Remove(toAdd[i].wm)
 		}
 	}
 }
 func BenchmarkArrayWaitlist_Add_Remove_1024(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove(1024, b)
+	benchmarkWaitlist_Add_Remove(newArrayWaitlist, 1024, b)
 }
 func BenchmarkArrayWaitlist_Add_Remove_4096(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove(4096, b)
+	benchmarkWaitlist_Add_Remove(newArrayWaitlist, 4096, b)
 }
 func BenchmarkArrayWaitlist_Add_Remove_16384(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove(16384, b)
+	benchmarkWaitlist_Add_Remove(newArrayWaitlist, 16384, b)
+}
+func BenchmarkArrayWaitlist_Add_Remove_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_1024(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newHeapWaitlist, 1024, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_4096(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newHeapWaitlist, 4096, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_16384(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newHeapWaitlist, 16384, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newHeapWaitlist, 65536, b)
 }
 
-func benchmarkArrayWaitlist_Add_Remove_Reverse(sz int, b *testing.B) {
-	toAdd := make([]*waitlistSubject, 0)
-	for i := 0; i < sz; i++ {
-		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
-	}
-	aw := &arrayWaitlist{}
+func benchmarkWaitlist_Add_Remove_Reverse(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for i := 0; i < sz; i++ {
-			aw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
 		}
 		for i := sz - 1; i >= 0; i-- {
-			aw.Remove(toAdd[i].wm)
+			wl.Remove(toAdd[i].wm)
 		}
 	}
 }
 func BenchmarkArrayWaitlist_Add_Remove_Reverse_1024(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove_Reverse(1024, b)
+	benchmarkWaitlist_Add_Remove_Reverse(newArrayWaitlist, 1024, b)
 }
 func BenchmarkArrayWaitlist_Add_Remove_Reverse_4096(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove_Reverse(4096, b)
+	benchmarkWaitlist_Add_Remove_Reverse(newArrayWaitlist, 4096, b)
 }
 func BenchmarkArrayWaitlist_Add_Remove_Reverse_16384(b *testing.B) {
-	benchmarkArrayWaitlist_Add_Remove_Reverse(16384, b)
+	benchmarkWaitlist_Add_Remove_Reverse(newArrayWaitlist, 16384, b)
+}
+func BenchmarkArrayWaitlist_Add_Remove_Reverse_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_1024(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newHeapWaitlist, 1024, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_4096(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newHeapWaitlist, 4096, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_16384(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newHeapWaitlist, 16384, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newHeapWaitlist, 65536, b)
 }
@@ -0,0 +1,9 @@
+//go:build race
+// +build race
+
+package dilithium
+
+// raceEnabled is set when testing with the race detector, which deliberately discards some of the buffers returned to
+// a sync.Pool, and so defeats assertions about buffer recycling.
+//
+const raceEnabled = true
@@ -1,12 +1,12 @@
 package dilithium
 
 import (
+	"fmt"
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,58 +16,161 @@ type RxPortal struct {
 	tree         *btree.Tree
 	accepted     int32
 	rxs          chan *WireMessage
+	rxsPolicy    RxQueuePolicy
+	exited       chan struct{}
 	rxPortalSize int
+	advertised   int32
 	readPool     *Pool
 	ackPool      *Pool
 	txp          *TxPortal
 	seq          *util.Sequence
 	closer       *Closer
+	acks         ackCoalescer
+	ready        []*WireMessage
 	closed       bool
 	ii           InstrumentInstance
 }
 
+// RxRead is received data queued for a reader. Buf holds the unread remainder of the data, which is stored either in a
+// pooled wire buffer, or in a raw copy.
+//
 type RxRead struct {
 	Buf  []byte
 	Size int
 	Eof  bool
+	buf  *Buffer
+	raw  []byte
+}
+
+func (read *RxRead) consume(n int) {
+	read.Buf = read.Buf[n:]
+	read.Size -= n
 }
 
 func NewRxPortal(adapter Adapter, sink Sink, txp *TxPortal, seq *util.Sequence, closer *Closer, ii InstrumentInstance) *RxPortal {
 	rxp := &RxPortal{
-		adapter:  adapter,
-		sink:     sink,
-		tree:     btree.NewWith(txp.alg.Profile().MaxTreeSize, utils.Int32Comparator),
-		accepted: -1,
-		rxs:      make(chan *WireMessage, 4),
-		readPool: NewPool("readPool", uint32(txp.alg.Profile().PoolBufferSize), ii),
-		ackPool:  NewPool("ackPool", uint32(txp.alg.Profile().PoolBufferSize), ii),
-		txp:      txp,
-		seq:      seq,
-		closer:   closer,
-		ii:       ii,
+		adapter:   adapter,
+		sink:      sink,
+		tree:      btree.NewWith(txp.alg.Profile().MaxTreeSize, util.SeqComparator),
+		accepted:  -1,
+		rxs:       make(chan *WireMessage, txp.alg.Profile().RxQueueSize),
+		rxsPolicy: txp.alg.Profile().RxQueuePolicy,
+		exited:    make(chan struct{}),
+		readPool:  txp.alg.Profile().NewPool("readPool", ii),
+		ackPool:   txp.alg.Profile().NewPool("ackPool", ii),
+		txp:       txp,
+		seq:       seq,
+		closer:    closer,
+		ii:        ii,
 	}
 	go rxp.run()
 	go rxp.rxer()
 	return rxp
 }
 
+func (rxp *RxPortal) setRxPortalSize(rxPortalSize int) {
+	rxp.rxPortalSize = rxPortalSize
+	atomic.StoreInt32(&rxp.advertised, int32(rxPortalSize))
+	rxp.ii.RxPortalSzChanged(rxPortalSize)
+}
+
+// size returns the buffered out-of-order data, for advertising to the peer from outside of the RxPortal.
+//
+func (rxp *RxPortal) size() int {
+	return int(atomic.LoadInt32(&rxp.advertised))
+}
+
 func (rxp *RxPortal) SetAccepted(accepted int32) {
 	rxp.accepted = accepted
 }
 
+// RxQueuePolicy selects how RxPortal.Rx handles a received message when the queue in front of the RxPortal is full.
+//
+type RxQueuePolicy int
+
+const (
+	// RxQueueBlock blocks the receiving goroutine until the queue has room, pushing back on the adapter. While it is
+	// blocked, no acknowledgements are processed for the local TxPortal either, so a slow reader also stalls the local
+	// writer; a bidirectional connection whose reader waits on its writer can deadlock.
+	//
+	RxQueueBlock RxQueuePolicy = iota
+
+	// RxQueueDropOldest discards the message at the head of the queue to make room.
+	//
+	RxQueueDropOldest
+
+	// RxQueueDropNewest discards the received message. It is the default, keeping the receiving goroutine free to
+	// process acknowledgements while the reader catches up.
+	//
+	RxQueueDropNewest
+)
+
+func (p RxQueuePolicy) String() string {
+	switch p {
+	case RxQueueBlock:
+		return "block"
+	case RxQueueDropOldest:
+		return "drop_oldest"
+	case RxQueueDropNewest:
+		return "drop_newest"
+	default:
+		return fmt.Sprintf("RxQueuePolicy(%d)", int(p))
+	}
+}
+
+// Rx queues a wire message for processing, taking ownership of its buffer. When the queue is full, the profile's
+// RxQueuePolicy applies. Dropped messages are reported through InstrumentInstance.DroppedRx, and are never
+// acknowledged, so the peer retransmits them.
+//
 func (rxp *RxPortal) Rx(wm *WireMessage) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = errors.Wrap(err, "send on closed rxs")
+			wm.buf.Unref()
+			err = errors.New("send on closed rxs")
 		}
 	}()
 
 	select {
 	case rxp.rxs <- wm:
+		return nil
 	default:
-		logrus.Info("dropped")
 	}
-	return err
+
+	switch rxp.rxsPolicy {
+	case RxQueueDropOldest:
+		for {
+			select {
+			case rxp.rxs <- wm:
+				return nil
+			default:
+			}
+			select {
+			case oldest, ok := <-rxp.rxs:
+				if ok {
+					rxp.drop(oldest)
+				}
+			default:
+			}
+		}
+
+	case RxQueueDropNewest:
+		rxp.drop(wm)
+		return nil
+
+	default:
+		select {
+		case rxp.rxs <- wm:
+			return nil
+		case <-rxp.exited:
+			wm.buf.Unref()
+			return errors.New("rx portal exited")
+		}
+	}
+}
+
+func (rxp *RxPortal) drop(wm *WireMessage) {
+	rxp.ii.DroppedRx(wm)
+	wm.buf.Unref()
 }
 
 func (rxp *RxPortal) Close() {
@@ -81,6 +184,7 @@ func (rxp *RxPortal) Close() {
 func (rxp *RxPortal) run() {
 	logrus.Info("started")
 	defer logrus.Warn("exited")
+	defer close(rxp.exited)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -88,6 +192,7 @@ func (rxp *RxPortal) run() {
 		}
 	}()
 
+	var ackDelay <-chan time.Time
 	for {
 		var wm *WireMessage
 		var ok bool
@@ -100,16 +205,24 @@ func (rxp *RxPortal) run() {
 			//case <-time.After(time.Duration(rxp.txp.alg.Profile().ConnectionTimeout) * time.Millisecond):
 			// rxp.Closer.timeout()
 			//return
+
+		case <-ackDelay:
+			ackDelay = nil
+			rxp.flushAcks()
+			continue
 		}
 
 		switch wm.messageType() {
 		case DATA:
 			_, found := rxp.tree.Get(wm.Seq)
-			if !found && (wm.Seq > rxp.accepted || (wm.Seq == 0 && rxp.accepted == math.MaxInt32)) {
+			duplicate := true
+			kept := false
+			if !found && util.SeqLess(rxp.accepted, wm.Seq) {
+				duplicate = false
 				if size, err := wm.asDataSize(); err == nil {
 					rxp.tree.Put(wm.Seq, wm)
-					rxp.rxPortalSize += int(size)
-					rxp.ii.RxPortalSzChanged(rxp.rxPortalSize)
+					kept = true
+					rxp.setRxPortalSize(rxp.rxPortalSize + int(size))
 				} else {
 					logrus.Errorf("unexpected as data size (%v)", err)
 				}
@@ -124,30 +237,19 @@ func (rxp *RxPortal) run() {
 				}
 			}
 
-			if ack, err := newAck([]Ack{{wm.Seq, wm.Seq}}, int32(rxp.rxPortalSize), rtt, rxp.ackPool); err == nil {
-				if err := writeWireMessage(ack, rxp.adapter); err != nil {
-					logrus.Errorf("error sending ack (%v)", err)
-					rxp.ii.WriteError(err)
-				} else {
-					rxp.ii.WireMessageTx(ack)
-					rxp.ii.TxAck(ack)
-				}
-				ack.buf.Unref()
-			}
-
-			if found {
+			// the tree owns the buffer of a newly received payload; duplicates are released immediately
+			seq := wm.Seq
+			if !kept {
 				wm.buf.Unref()
 			}
 
-			if rxp.tree.Size() > 0 {
-				startingRxPortalSize := rxp.rxPortalSize
-
-				var next int32
-				if rxp.accepted < math.MaxInt32 {
-					next = rxp.accepted + 1
-				} else {
-					next = 0
-				}
+			// Take the in-order payloads out of the tree ahead of delivering them, so that the ack advertises the
+			// rxPortalSize that follows delivery.
+			buffered := rxp.tree.Size() > 0
+			startingRxPortalSize := rxp.rxPortalSize
+			ready := rxp.ready[:0]
+			if buffered {
+				next := util.SeqNext(rxp.accepted)
 
 				keys := rxp.tree.Keys()
 				for _, key := range keys {
@@ -155,56 +257,70 @@ func (rxp *RxPortal) run() {
 						v, _ := rxp.tree.Get(key)
 						wm := v.(*WireMessage)
 						if data, _, err := wm.asData(); err == nil {
-							if err := rxp.sink.Accept(data); err != nil {
-								logrus.WithError(err).Error("write to data sink failed, exiting rx loop")
-								return
-							}
+							ready = append(ready, wm)
 
 							rxp.tree.Remove(key)
-							rxp.rxPortalSize -= len(data)
-							rxp.ii.RxPortalSzChanged(rxp.rxPortalSize)
-							wm.buf.Unref()
+							rxp.setRxPortalSize(rxp.rxPortalSize - len(data))
 							rxp.accepted = next
-							if next < math.MaxInt32 {
-								next++
-							} else {
-								next = 0
-							}
+							next = util.SeqNext(next)
 						} else {
 							logrus.Errorf("unexpected mt [%d]", wm.Mt)
 						}
 					}
 				}
+			}
 
-				// Send "pacing" KEEPALIVE?
-				if rxp.txp.alg.RxPortalPacing(startingRxPortalSize, rxp.rxPortalSize) {
-					if keepalive, err := newKeepalive(rxp.rxPortalSize, rxp.ackPool); err == nil {
-						if err := writeWireMessage(keepalive, rxp.adapter); err != nil {
-							logrus.Errorf("error sending pacing keepalive (%v)", err)
-							rxp.ii.WriteError(err)
-						} else {
-							rxp.ii.WireMessageTx(keepalive)
-							rxp.ii.TxKeepalive(keepalive)
-						}
-						keepalive.buf.Unref()
+			// Ack before delivering to the sink, which may block on a slow reader; that must not hold back the acks for
+			// data that has already arrived.
+			if rxp.txp.alg.Profile().AckDelayMs > 0 {
+				rxp.acks.add(seq, rtt)
+				// Duplicates and gaps are acked immediately, so the transmitter learns of loss without delay. RTT probes are
+				// acked immediately, so they measure the path rather than the ack delay.
+				if duplicate || rtt != nil || rxp.tree.Size() > 0 || rxp.acks.Full(rxp.txp.alg.Profile().AckCoalesceThreshold) {
+					ackDelay = nil
+					rxp.flushAcks()
+				} else if ackDelay == nil {
+					ackDelay = time.After(time.Duration(rxp.txp.alg.Profile().AckDelayMs) * time.Millisecond)
+				}
+			} else {
+				rxp.sendAck([]Ack{{seq, seq}}, rtt)
+			}
+
+			// Send "pacing" KEEPALIVE?
+			if buffered && rxp.txp.alg.RxPortalPacing(startingRxPortalSize, rxp.rxPortalSize) {
+				if keepalive, err := newKeepalive(rxp.rxPortalSize, rxp.ackPool); err == nil {
+					if err := writeWireMessage(keepalive, rxp.adapter); err != nil {
+						logrus.Errorf("error sending pacing keepalive (%v)", err)
+						rxp.ii.WriteError(err)
+					} else {
+						rxp.ii.WireMessageTx(keepalive)
+						rxp.ii.TxKeepalive(keepalive)
 					}
+					keepalive.buf.Unref()
 				}
 			}
 
+			for i, wm := range ready {
+				data, _, _ := wm.asData()
+				if err := rxp.deliver(wm, data); err != nil {
+					logrus.WithError(err).Error("write to data sink failed, exiting rx loop")
+					return
+				}
+				wm.buf.Unref()
+				ready[i] = nil
+			}
+			rxp.ready = ready
+
 		case KEEPALIVE:
 			wm.buf.Unref()
 
 		case CLOSE:
-			if closeAck, err := newAck([]Ack{{wm.Seq, wm.Seq}}, int32(rxp.rxPortalSize), nil, rxp.ackPool); err == nil {
-				if err := writeWireMessage(closeAck, rxp.adapter); err != nil {
-					logrus.Errorf("error writing close ack (%v)", err)
-					rxp.ii.WriteError(err)
-				} else {
-					rxp.ii.WireMessageTx(closeAck)
-					rxp.ii.TxAck(closeAck)
-				}
-			} else {
-				logrus.Errorf("error creating close ack (%v)", err)
+			ackDelay = nil
+			rxp.flushAcks()
+			rxp.sendAck([]Ack{{wm.Seq, wm.Seq}}, nil)
+			select {
+			case rxp.closer.rxCloseSeqIn <- wm.Seq:
+			default:
 			}
 			wm.buf.Unref()
 
@@ -215,6 +331,39 @@ func (rxp *RxPortal) run() {
 	}
 }
 
+// deliver hands in-order data to the sink, sharing the wire buffer rather than copying it when the sink is a
+// BufferSink.
+//
+func (rxp *RxPortal) deliver(wm *WireMessage, data []byte) error {
+	if bs, ok := rxp.sink.(BufferSink); ok {
+		return bs.AcceptBuffer(wm.buf, data)
+	}
+	return rxp.sink.Accept(data)
+}
+
+func (rxp *RxPortal) flushAcks() {
+	if rxp.acks.Pending() {
+		acks, rtt := rxp.acks.take()
+		rxp.sendAck(acks, rtt)
+	}
+}
+
+func (rxp *RxPortal) sendAck(acks []Ack, rtt *uint16) {
+	ack, err := newAck(acks, int32(rxp.rxPortalSize), rtt, rxp.ackPool)
+	if err != nil {
+		logrus.Errorf("error creating ack (%v)", err)
+		return
+	}
+	if err := writeWireMessage(ack, rxp.adapter); err != nil {
+		logrus.Errorf("error sending ack (%v)", err)
+		rxp.ii.WriteError(err)
+	} else {
+		rxp.ii.WireMessageTx(ack)
+		rxp.ii.TxAck(ack)
+	}
+	ack.buf.Unref()
+}
+
 func (rxp *RxPortal) rxer() {
 	logrus.Info("started")
 	defer logrus.Warn("exited")
@@ -240,17 +389,16 @@ func (rxp *RxPortal) rxer() {
 			acks, rxPortalSz, rttTs, err := wm.asAck()
 			if err != nil {
 				logrus.Errorf("as ack error (%v)", err)
+				wm.buf.Unref()
 				continue
 			}
 			if rttTs != nil {
-				now := time.Now().UnixNano()
-				clockTs := uint16(now / int64(time.Millisecond))
-				rttMs := clockTs - *rttTs
-				rxp.txp.alg.UpdateRTT(int(rttMs))
+				rxp.txp.rtt(*rttTs)
 			}
-			rxp.txp.alg.UpdateRxPortalSize(int(rxPortalSz))
+			rxp.txp.updateRxPortalSize(int(rxPortalSz))
 			if err := rxp.txp.ack(acks); err != nil {
 				logrus.Errorf("error acking (%v)", err)
+				wm.buf.Unref()
 				continue
 			}
 			rxp.ii.RxAck(wm)
@@ -260,15 +408,15 @@ func (rxp *RxPortal) rxer() {
 			rxPortalSz, err := wm.asKeepalive()
 			if err != nil {
 				logrus.Errorf("as keepalive error (%v)", err)
+				wm.buf.Unref()
 				continue
 			}
-			rxp.txp.alg.UpdateRxPortalSize(rxPortalSz)
+			rxp.txp.updateRxPortalSize(rxPortalSz)
+			rxp.ii.RxKeepalive(wm)
 			if err := rxp.Rx(wm); err != nil {
 				logrus.Errorf("error forwarding keepalive to rxPortal (%v)", err)
 				continue
 			}
-			rxp.ii.RxKeepalive(wm)
-			wm.buf.Unref()
 
 		case CLOSE:
 			if err := rxp.Rx(wm); err != nil {
@@ -277,8 +425,8 @@ func (rxp *RxPortal) rxer() {
 
 		default:
 			logrus.Errorf("unexpected message type: %d", wm.messageType())
-			wm.buf.Unref()
 			rxp.ii.UnexpectedMessageType(wm.messageType())
+			wm.buf.Unref()
 		}
 	}
 }
@@ -0,0 +1,131 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestRxPortal(policy RxQueuePolicy, ii InstrumentInstance) *RxPortal {
+	return &RxPortal{
+		rxs:       make(chan *WireMessage, 2),
+		rxsPolicy: policy,
+		exited:    make(chan struct{}),
+		ii:        ii,
+	}
+}
+
+func queuedSeqs(rxp *RxPortal) []int32 {
+	var seqs []int32
+	for len(rxp.rxs) > 0 {
+		wm := <-rxp.rxs
+		seqs = append(seqs, wm.Seq)
+		wm.buf.Unref()
+	}
+	return seqs
+}
+
+func TestRxPortalRxDropPolicies(t *testing.T) {
+	for policy, expected := range map[RxQueuePolicy][]int32{RxQueueDropOldest: {1, 2}, RxQueueDropNewest: {0, 1}} {
+		ii := &countingInstrumentInstance{}
+		pool := NewDebugPool("test", 1024, ii)
+		rxp := newTestRxPortal(policy, ii)
+		for seq := int32(0); seq < 3; seq++ {
+			wm, err := newData(seq, nil, []byte{0x01}, pool)
+			assert.NoError(t, err)
+			assert.NoError(t, rxp.Rx(wm))
+		}
+		assert.Equal(t, expected, queuedSeqs(rxp), policy.String())
+		assert.Equal(t, 1, ii.droppedRx, policy.String())
+	}
+}
+
+func TestRxPortalRxBlocks(t *testing.T) {
+	ii := &countingInstrumentInstance{}
+	pool := NewDebugPool("test", 1024, ii)
+	rxp := newTestRxPortal(RxQueueBlock, ii)
+	rx := func(seq int32) chan error {
+		wm, err := newData(seq, nil, []byte{0x01}, pool)
+		assert.NoError(t, err)
+		done := make(chan error, 1)
+		go func() { done <- rxp.Rx(wm) }()
+		return done
+	}
+	for seq := int32(0); seq < 2; seq++ {
+		assert.NoError(t, <-rx(seq))
+	}
+
+	// a full queue blocks the receiver until the portal makes room
+	done := rx(2)
+	select {
+	case <-done:
+		t.Fatal("rx did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	wm := <-rxp.rxs
+	wm.buf.Unref()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rx still blocked")
+	}
+	assert.Equal(t, []int32{1, 2}, queuedSeqs(rxp))
+	assert.Equal(t, 0, ii.droppedRx)
+
+	// and fails, rather than blocking forever, once the portal has exited
+	for seq := int32(3); seq < 5; seq++ {
+		assert.NoError(t, <-rx(seq))
+	}
+	done = rx(5)
+	close(rxp.exited)
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rx still blocked")
+	}
+	assert.Equal(t, []int32{3, 4}, queuedSeqs(rxp))
+}
+
+func TestRxPortalAcksAheadOfBlockedSink(t *testing.T) {
+	a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(21), util.NewEmulatorConfig(22))
+	defer func() { _ = a.Close() }()
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.ReadsQueueSize = 1
+	profile.Txpf.AckDelayMs = 0
+	bc, err := newConn(b, profile, &NilInstrumentInstance{})
+	assert.NoError(t, err)
+	bc.start(-1)
+
+	// nothing is read; the first payload fills the reads queue, and the portal blocks delivering the second
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+	for seq := int32(0); seq < 2; seq++ {
+		wm, err := newData(seq, nil, []byte{0x01}, pool)
+		assert.NoError(t, err)
+		assert.NoError(t, writeWireMessage(wm, a))
+		wm.buf.Unref()
+	}
+	acked := make(chan []Ack, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			wm, err := readWireMessage(a, pool)
+			if err != nil {
+				return
+			}
+			if acks, _, _, err := wm.asAck(); err == nil {
+				acked <- acks
+			}
+			wm.buf.Unref()
+		}
+	}()
+	for seq := int32(0); seq < 2; seq++ {
+		select {
+		case acks := <-acked:
+			assert.Equal(t, []Ack{{seq, seq}}, acks)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no ack for %d", seq)
+		}
+	}
+}
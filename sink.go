@@ -1,10 +1,10 @@
 package dilithium
 
 import (
-	"bytes"
-	"github.com/pkg/errors"
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 type Sink interface {
@@ -12,84 +12,163 @@ type Sink interface {
 	Close()
 }
 
-func NewReadSinkAdapter(profile WestworldAlgorithm) Sink {
+// BufferSink is optionally implemented by a Sink that is able to hold on to received buffers, rather than copying the
+// data out of them. RxPortal delivers data through AcceptBuffer when it is available.
+//
+type BufferSink interface {
+	// AcceptBuffer receives data held in buf. The sink takes its own reference to buf, and releases it once the data has
+	// been consumed.
+	//
+	AcceptBuffer(buf *Buffer, data []byte) error
+}
+
+func NewReadSinkAdapter(pf *TxProfile) *ReadSinkAdapter {
 	result := &ReadSinkAdapter{
-		reads: make(chan *RxRead, profile.Profile().ReadsQueueSize),
+		reads:    make(chan *RxRead, pf.ReadsQueueSize),
+		deadline: newDeadline(nil),
 	}
 
 	result.rawReadPool.New = func() interface{} {
-		return make([]byte, profile.Profile().PoolBufferSize)
+		return make([]byte, pf.PoolBufferSize)
 	}
 
 	return result
 }
 
+// ReadSinkAdapter queues received data for an io.Reader (or io.WriterTo) consumer. Data delivered through AcceptBuffer
+// is read straight out of the received wire buffers, so that reading costs a single copy into the caller's slice, and
+// WriteTo costs none.
+//
 type ReadSinkAdapter struct {
 	reads       chan *RxRead
-	readBuffer  bytes.Buffer
+	readLock    sync.Mutex
+	current     *RxRead
+	eof         bool
+	deadline    *deadline
 	rawReadPool sync.Pool
 }
 
 func (self *ReadSinkAdapter) Accept(data []byte) error {
-	buf := self.rawReadPool.Get().([]byte)
-	n := copy(buf, data)
-	self.reads <- &RxRead{buf, n, false}
+	raw := self.rawReadPool.Get().([]byte)
+	n := copy(raw, data)
+	self.reads <- &RxRead{Buf: raw[:n], Size: n, raw: raw}
+	return nil
+}
+
+func (self *ReadSinkAdapter) AcceptBuffer(buf *Buffer, data []byte) error {
+	buf.Ref()
+	self.reads <- &RxRead{Buf: data, Size: len(data), buf: buf}
 	return nil
 }
 
 func (self *ReadSinkAdapter) Close() {
 	// TODO: Add timeout
-	self.reads <- &RxRead{nil, 0, true}
+	self.reads <- &RxRead{Eof: true}
+}
+
+// SetDeadline sets the read deadline, after which Read and WriteTo fail with os.ErrDeadlineExceeded. A zero t clears
+// the deadline.
+//
+func (self *ReadSinkAdapter) SetDeadline(t time.Time) {
+	self.deadline.set(t)
 }
 
 func (self *ReadSinkAdapter) Read(p []byte) (int, error) {
-preread:
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
+
+	if self.deadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if self.current == nil {
+		if _, err := self.next(true); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
 	for {
-		select {
-		case read, ok := <-self.reads:
-			if !ok {
-				return 0, io.EOF
-			}
-			if !read.Eof {
-				n, err := self.readBuffer.Write(read.Buf[:read.Size])
-				if err != nil {
-					return 0, errors.Wrap(err, "buffer")
-				}
-				if n != read.Size {
-					return 0, errors.New("short buffer")
+		c := copy(p[n:], self.current.Buf)
+		n += c
+		self.current.consume(c)
+		if self.current.Size > 0 {
+			return n, nil
+		}
+		self.release()
+		// keep filling p from reads that have already arrived
+		if n == len(p) {
+			return n, nil
+		}
+		if ok, _ := self.next(false); !ok {
+			return n, nil
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, writing the received data to w until EOF or an error.
+//
+func (self *ReadSinkAdapter) WriteTo(w io.Writer) (int64, error) {
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
+
+	var n int64
+	for {
+		if self.deadline.expired() {
+			return n, os.ErrDeadlineExceeded
+		}
+		if self.current == nil {
+			if _, err := self.next(true); err != nil {
+				if err == io.EOF {
+					return n, nil
 				}
-			} else {
-				close(self.reads)
-				return 0, io.EOF
+				return n, err
 			}
-
-		default:
-			break preread
 		}
+		c, err := w.Write(self.current.Buf)
+		n += int64(c)
+		self.current.consume(c)
+		if err != nil {
+			return n, err
+		}
+		self.release()
 	}
-	if self.readBuffer.Len() > 0 {
-		return self.readBuffer.Read(p)
+}
 
+// next makes the next queued read current. Unless block is set, it returns false immediately when no read is queued.
+//
+func (self *ReadSinkAdapter) next(block bool) (bool, error) {
+	if self.eof {
+		return false, io.EOF
+	}
+	var read *RxRead
+	var ok bool
+	if block {
+		select {
+		case read, ok = <-self.reads:
+		case <-self.deadline.wait():
+			return false, os.ErrDeadlineExceeded
+		}
 	} else {
-		read, ok := <-self.reads
-		if !ok {
-			return 0, io.EOF
+		select {
+		case read, ok = <-self.reads:
+		default:
+			return false, nil
 		}
-		if !read.Eof {
-			n, err := self.readBuffer.Write(read.Buf[:read.Size])
-			if err != nil {
-				return 0, errors.Wrap(err, "buffer")
-			}
-			if n != read.Size {
-				return 0, errors.Wrap(err, "short buffer")
-			}
-			self.rawReadPool.Put(read.Buf)
-
-			return self.readBuffer.Read(p)
+	}
+	if !ok || read.Eof {
+		self.eof = true
+		return false, io.EOF
+	}
+	self.current = read
+	return true, nil
+}
 
-		} else {
-			close(self.reads)
-			return 0, io.EOF
-		}
+// release returns the storage of the fully consumed current read.
+//
+func (self *ReadSinkAdapter) release() {
+	if self.current.buf != nil {
+		self.current.buf.Unref()
+	} else if self.current.raw != nil {
+		self.rawReadPool.Put(self.current.raw)
 	}
+	self.current = nil
 }
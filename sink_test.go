@@ -0,0 +1,102 @@
+package dilithium
+
+import (
+	"bytes"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestReadSinkAdapterSharesBuffers(t *testing.T) {
+	profile := DefaultTxProfile()
+	sink := NewReadSinkAdapter(profile)
+	pool := NewDebugPool("test", 1024, &NilInstrumentInstance{})
+
+	var expected []byte
+	for i := 0; i < 4; i++ {
+		buf := pool.Get()
+		data := buf.Data[:100]
+		for j := range data {
+			data[j] = byte(i)
+		}
+		expected = append(expected, data...)
+		assert.NoError(t, sink.AcceptBuffer(buf, data))
+		// the sink holds its own reference, so the portal releases its reference as usual
+		buf.Unref()
+		assert.Equal(t, byte(i), data[0])
+	}
+	sink.Close()
+
+	// a read spanning reads returns everything queued; a released buffer would be poisoned
+	p := make([]byte, 150)
+	n, err := sink.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, n)
+	assert.Equal(t, expected[:150], p)
+
+	out := new(bytes.Buffer)
+	written, err := io.Copy(out, sink)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(250), written)
+	assert.Equal(t, expected[150:], out.Bytes())
+
+	n, err = sink.Read(p)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestReadSinkAdapterCopies(t *testing.T) {
+	sink := NewReadSinkAdapter(DefaultTxProfile())
+	data := []byte("hello")
+	assert.NoError(t, sink.Accept(data))
+	data[0] = 'j'
+	sink.Close()
+
+	received, err := io.ReadAll(sink)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+}
+
+// sinkCollector accepts writes until it holds sz bytes.
+//
+type sinkCollector struct {
+	bytes.Buffer
+	sz int
+}
+
+func (self *sinkCollector) Write(p []byte) (int, error) {
+	n, _ := self.Buffer.Write(p)
+	if self.Len() >= self.sz {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func TestConnWriteTo(t *testing.T) {
+	profile := NewBaselineWestworldProfile()
+	profile.Txpf.PoolDebug = true
+	a, b := NewEmulatedAdapterPair(util.NewEmulatorConfig(11), util.NewEmulatorConfig(12))
+	defer func() { _ = a.Close() }()
+	ac, err := newConn(a, profile, &NilInstrumentInstance{})
+	assert.NoError(t, err)
+	bc, err := newConn(b, profile, &NilInstrumentInstance{})
+	assert.NoError(t, err)
+	ac.start(-1)
+	bc.start(-1)
+
+	sz := 4 * 1024 * 1024
+	data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, err := ac.Write(data)
+		assert.NoError(t, err)
+	}()
+
+	c := &sinkCollector{sz: sz}
+	n, err := io.Copy(c, bc)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, int64(sz), n)
+	assert.True(t, bytes.Equal(data, c.Bytes()))
+}
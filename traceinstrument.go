@@ -214,6 +214,22 @@ func (self *traceInstrumentInstance) DuplicateAck(seq int32) {
 	}
 }
 
+func (self *traceInstrumentInstance) FastRetransmit(wm *WireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s FAST RETX: #%d", self.id, wm.Seq))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TimeoutRetransmit(wm *WireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TIMEOUT RETX: #%d", self.id, wm.Seq))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * rxPortal
  */
@@ -233,6 +249,14 @@ func (self *traceInstrumentInstance) DuplicateRx(wm *WireMessage) {
 	}
 }
 
+func (self *traceInstrumentInstance) DroppedRx(wm *WireMessage) {
+	if self.i.config.RxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s DROPPED RX: #%d", self.id, wm.Seq))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * allocation
  */
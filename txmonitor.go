@@ -1,8 +1,8 @@
 package dilithium
 
 import (
-	"github.com/openziti/dilithium/util"
 	"github.com/sirupsen/logrus"
+	"math"
 	"sync"
 	"time"
 )
@@ -10,14 +10,17 @@ import (
 // TxMonitor is responsible for managing in-flight payloads, retransmitting payloads when their timeout expires.
 //
 type TxMonitor struct {
-	lock         *sync.Mutex
-	ready        *sync.Cond
-	alg          TxAlgorithm
-	adapter      Adapter
-	waitlist     waitlist
-	closed       bool
-	retxCallback func(int)
-	ii           InstrumentInstance
+	lock           *sync.Mutex
+	ready          *sync.Cond
+	alg            TxAlgorithm
+	adapter        Adapter
+	waitlist       waitlist
+	closed         bool
+	backoff        map[*WireMessage]uint
+	probes         map[uint16]*WireMessage
+	retxCallback   func(int)
+	peerAckDelayMs int
+	ii             InstrumentInstance
 }
 
 func newTxMonitor(lock *sync.Mutex, alg TxAlgorithm, adapter Adapter, ii InstrumentInstance) *TxMonitor {
@@ -26,7 +29,9 @@ func newTxMonitor(lock *sync.Mutex, alg TxAlgorithm, adapter Adapter, ii Instrum
 		ready:    sync.NewCond(lock),
 		alg:      alg,
 		adapter:  adapter,
-		waitlist: newArrayWaitlist(),
+		waitlist: newHeapWaitlist(),
+		backoff:  make(map[*WireMessage]uint),
+		probes:   make(map[uint16]*WireMessage),
 		ii:       ii,
 	}
 }
@@ -40,13 +45,44 @@ func (txm *TxMonitor) start() {
 }
 
 func (txm *TxMonitor) add(wm *WireMessage) {
-	retxMs, deadline := txm.retxDeadline()
+	if ts, ok := wm.rttProbe(); ok {
+		txm.probes[ts] = wm
+	}
+	retxMs, deadline := txm.retxDeadline(wm)
 	txm.waitlist.Add(wm, retxMs, deadline)
 	txm.ready.Broadcast()
 }
 
 func (txm *TxMonitor) remove(wm *WireMessage) {
 	txm.waitlist.Remove(wm)
+	delete(txm.backoff, wm)
+	txm.forgetProbe(wm)
+}
+
+func (txm *TxMonitor) forgetProbe(wm *WireMessage) {
+	if ts, ok := wm.rttProbe(); ok && txm.probes[ts] == wm {
+		delete(txm.probes, ts)
+	}
+}
+
+// rtt samples the round-trip time of an echoed probe timestamp. Samples are only taken from payloads that have not
+// been retransmitted (Karn's algorithm), as the echo cannot be attributed to a specific transmission.
+//
+func (txm *TxMonitor) rtt(probeTs uint16, now time.Time) {
+	if _, found := txm.probes[probeTs]; found {
+		delete(txm.probes, probeTs)
+		clockTs := uint16(now.UnixNano() / int64(time.Millisecond))
+		txm.updateRtt(time.Duration(clockTs-probeTs) * time.Millisecond)
+	}
+}
+
+// updateRtt feeds a round-trip time probe result to the algorithm, and re-times the in-flight payloads against the
+// resulting retransmission timeout. As in RFC 6298, a fresh RTT sample replaces any backed-off timeouts.
+//
+func (txm *TxMonitor) updateRtt(rtt time.Duration) {
+	txm.alg.UpdateRTT(rtt)
+	txm.backoff = make(map[*WireMessage]uint)
+	txm.waitlist.Update(txm.retxMs)
 }
 
 func (txm *TxMonitor) close() {
@@ -54,12 +90,51 @@ func (txm *TxMonitor) close() {
 	txm.ready.Broadcast()
 }
 
-func (txm *TxMonitor) retxDeadline() (int, time.Time) {
-	retxMs := txm.alg.RetxMs()
+func (txm *TxMonitor) retxDeadline(wm *WireMessage) (int, time.Time) {
+	retxMs := txm.retxMs(wm)
 	deadline := time.Now().Add(time.Duration(retxMs) * time.Millisecond)
 	return retxMs, deadline
 }
 
+// retxMs allows for the peer to delay its acknowledgement by up to the AckDelayMs that it advertised in its HELLO,
+// beyond the round-trip time. The timeout doubles for every timeout retransmission of the payload, up to RetxMaxMs.
+//
+func (txm *TxMonitor) retxMs(wm *WireMessage) int {
+	retxMs := txm.alg.RetxMs() + txm.peerAckDelayMs
+	maxMs := txm.alg.Profile().RetxMaxMs
+	for i := uint(0); i < txm.backoff[wm] && retxMs < maxMs; i++ {
+		retxMs = int(math.Min(float64(retxMs*2), float64(maxMs)))
+	}
+	return retxMs
+}
+
+// fastRetx retransmits a payload ahead of its timeout, when the receiver has acknowledged later payloads.
+//
+func (txm *TxMonitor) fastRetx(wm *WireMessage) {
+	txm.waitlist.Remove(wm)
+	txm.retx(wm)
+	txm.ii.FastRetransmit(wm)
+	retxMs, deadline := txm.retxDeadline(wm)
+	txm.waitlist.Add(wm, retxMs, deadline)
+}
+
+func (txm *TxMonitor) retx(wm *WireMessage) {
+	txm.forgetProbe(wm)
+
+	if err := writeWireMessage(wm, txm.adapter); err != nil {
+		logrus.Errorf("retx (%v)", err)
+		txm.ii.WriteError(err)
+	} else {
+		txm.ii.WireMessageRetx(wm)
+	}
+
+	if txm.retxCallback != nil {
+		if sz, err := wm.asDataSize(); err == nil {
+			txm.retxCallback(int(sz))
+		}
+	}
+}
+
 func (txm *TxMonitor) run() {
 	logrus.Info("started")
 	defer logrus.Warn("exited")
@@ -96,24 +171,11 @@ func (txm *TxMonitor) run() {
 					delta := t.Sub(headline).Milliseconds()
 					if delta <= int64(txm.alg.Profile().RetxBatchMs) {
 						wm, _ := txm.waitlist.Next()
-						if wm.hasFlag(RTT) {
-							util.WriteUint16(wm.buf.Data[dataStart:], uint16(time.Now().UnixNano()/int64(time.Millisecond)))
-						}
-
-						if err := writeWireMessage(wm, txm.adapter); err != nil {
-							logrus.Errorf("retx (%v)", err)
-							txm.ii.WriteError(err)
-						} else {
-							txm.ii.WireMessageRetx(wm)
-						}
-
-						if txm.retxCallback != nil {
-							if sz, err := wm.asDataSize(); err == nil {
-								txm.retxCallback(int(sz))
-							}
-						}
-
-						retxMs, deadline := txm.retxDeadline()
+						txm.retx(wm)
+						txm.ii.TimeoutRetransmit(wm)
+						txm.backoff[wm]++
+
+						retxMs, deadline := txm.retxDeadline(wm)
 						txm.waitlist.Add(wm, retxMs, deadline)
 
 					} else {
@@ -2,12 +2,12 @@ package dilithium
 
 import (
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
 	"math"
+	"os"
 	"sync"
 	"time"
 )
@@ -17,30 +17,41 @@ import (
 // implementations, while ensuring reliability.
 //
 type TxPortal struct {
-	lock      *sync.Mutex
-	tree      *btree.Tree
-	lastTx    time.Time
-	adapter   Adapter
-	alg       TxAlgorithm
-	monitor   *TxMonitor
-	closer    *Closer
-	closeSent bool
-	closed    bool
-	pool      *Pool
-	ii        InstrumentInstance
+	lock         *sync.Mutex
+	tree         *btree.Tree
+	lastTx       time.Time
+	adapter      Adapter
+	alg          TxAlgorithm
+	monitor      *TxMonitor
+	highestAcked int32
+	fastRetxSeq  int32
+	closer       *Closer
+	rxp          *RxPortal
+	deadline     *deadline
+	closeSent    bool
+	closed       bool
+	pool         *Pool
+	ii           InstrumentInstance
 }
 
 func NewTxPortal(adapter Adapter, alg TxAlgorithm, closer *Closer, ii InstrumentInstance) *TxPortal {
 	txp := &TxPortal{
-		lock:    new(sync.Mutex),
-		tree:    btree.NewWith(alg.Profile().MaxTreeSize, utils.Int32Comparator),
-		adapter: adapter,
-		alg:     alg,
-		closer:  closer,
-		pool:    alg.Profile().NewPool("tx", ii),
-		ii:      ii,
+		lock:         new(sync.Mutex),
+		tree:         btree.NewWith(alg.Profile().MaxTreeSize, util.SeqComparator),
+		adapter:      adapter,
+		alg:          alg,
+		highestAcked: -1,
+		fastRetxSeq:  -1,
+		closer:       closer,
+		pool:         alg.Profile().NewPool("tx", ii),
+		ii:           ii,
 	}
 	txp.alg.SetLock(txp.lock)
+	txp.deadline = newDeadline(func() {
+		txp.lock.Lock()
+		txp.interrupt()
+		txp.lock.Unlock()
+	})
 	txp.monitor = newTxMonitor(txp.lock, txp.alg, txp.adapter, ii)
 	txp.monitor.setRetxCallback(func(size int) {
 		txp.alg.Retransmission(size)
@@ -62,6 +73,9 @@ func (txp *TxPortal) Tx(p []byte, seq *util.Sequence) (n int, err error) {
 	if txp.closed {
 		return -1, io.EOF
 	}
+	if txp.deadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
 
 	remaining := len(p)
 	n = 0
@@ -77,7 +91,12 @@ func (txp *TxPortal) Tx(p []byte, seq *util.Sequence) (n int, err error) {
 			}
 		}
 
-		txp.alg.Tx(segmentSize)
+		if !txp.waitForCapacity(segmentSize) {
+			if txp.closed {
+				return n, io.EOF
+			}
+			return n, os.ErrDeadlineExceeded
+		}
 
 		if sendRtt {
 			now := time.Now()
@@ -107,12 +126,57 @@ func (txp *TxPortal) Tx(p []byte, seq *util.Sequence) (n int, err error) {
 	return n, nil
 }
 
+// SetDeadline sets the write deadline, after which Tx fails with os.ErrDeadlineExceeded, including while it is blocked
+// waiting for capacity. A zero t clears the deadline.
+//
+func (txp *TxPortal) SetDeadline(t time.Time) {
+	txp.deadline.set(t)
+}
+
+// waitForCapacity blocks until the algorithm admits segmentSize, returning false if the portal was closed or the write
+// deadline expired first. Algorithms that are not interruptible block regardless.
+//
+func (txp *TxPortal) waitForCapacity(segmentSize int) bool {
+	if alg, ok := txp.alg.(InterruptibleTxAlgorithm); ok {
+		return alg.TxInterruptible(segmentSize, func() bool {
+			return txp.closed || txp.deadline.expired()
+		})
+	}
+	txp.alg.Tx(segmentSize)
+	return true
+}
+
+func (txp *TxPortal) interrupt() {
+	if alg, ok := txp.alg.(InterruptibleTxAlgorithm); ok {
+		alg.Interrupt()
+	}
+}
+
 func (txp *TxPortal) ack(acks []Ack) error {
 	txp.lock.Lock()
 	defer txp.lock.Unlock()
 
 	for _, ack := range acks {
-		for seq := ack.Start; seq <= ack.End; seq++ {
+		if util.SeqLess(ack.End, ack.Start) {
+			logrus.Errorf("invalid ack range [%d:%d]", ack.Start, ack.End)
+			continue
+		}
+		window, ok := txp.window(ack)
+		if !ok || window != ack {
+			// the sequences outside the window were acknowledged already, or never sent; count them as a single
+			// duplicate rather than walking a range that may span the whole sequence space
+			dup := ack.Start
+			if ok && window.Start == ack.Start {
+				dup = ack.End
+			}
+			txp.alg.DuplicateAck()
+			txp.ii.DuplicateAck(dup)
+			if !ok {
+				continue
+			}
+		}
+		for seq, last := window.Start, false; !last; seq = util.SeqNext(seq) {
+			last = seq == window.End
 			if v, found := txp.tree.Get(seq); found {
 				wm := v.(*WireMessage)
 				txp.monitor.remove(wm)
@@ -133,6 +197,7 @@ func (txp *TxPortal) ack(acks []Ack) error {
 					logrus.Warnf("acked suspicious message type in tree [%d]", wm.messageType())
 				}
 				wm.buf.Unref()
+				txp.updateHighestAcked(seq)
 
 			} else {
 				txp.alg.DuplicateAck()
@@ -140,9 +205,82 @@ func (txp *TxPortal) ack(acks []Ack) error {
 			}
 		}
 	}
+	txp.fastRetx()
 	return nil
 }
 
+// window bounds ack to the outstanding sequences in the tree, returning false when it falls entirely outside them.
+//
+func (txp *TxPortal) window(ack Ack) (Ack, bool) {
+	oldest, newest := txp.tree.LeftKey(), txp.tree.RightKey()
+	if oldest == nil {
+		return ack, false
+	}
+	window := ack
+	if util.SeqLess(window.Start, oldest.(int32)) {
+		window.Start = oldest.(int32)
+	}
+	if util.SeqLess(newest.(int32), window.End) {
+		window.End = newest.(int32)
+	}
+	if util.SeqLess(window.End, window.Start) {
+		return ack, false
+	}
+	return window, true
+}
+
+func (txp *TxPortal) updateHighestAcked(seq int32) {
+	if txp.highestAcked < 0 || util.SeqLess(txp.highestAcked, seq) {
+		txp.highestAcked = seq
+	}
+}
+
+// fastRetx retransmits every outstanding payload at least FastRetxThreshold sequences behind the highest acknowledged
+// sequence, without waiting for its timeout. Each payload is fast retransmitted at most once, after which its timeout
+// applies as usual.
+//
+func (txp *TxPortal) fastRetx() {
+	threshold := txp.alg.Profile().FastRetxThreshold
+	if txp.fastRetxSeq >= 0 {
+		// forget the last fast retransmission once every outstanding sequence follows it, so that it never falls far
+		// enough behind to compare as following them
+		if oldest := txp.tree.LeftKey(); oldest == nil || util.SeqLess(txp.fastRetxSeq, oldest.(int32)) {
+			txp.fastRetxSeq = -1
+		}
+	}
+	if threshold < 1 || txp.highestAcked < 0 {
+		return
+	}
+	var lost []*WireMessage
+	i := txp.tree.Iterator()
+	for i.Next() {
+		seq := i.Key().(int32)
+		if util.SeqDiff(txp.highestAcked, seq) < int32(threshold) {
+			break
+		}
+		if txp.fastRetxSeq < 0 || util.SeqLess(txp.fastRetxSeq, seq) {
+			lost = append(lost, i.Value().(*WireMessage))
+		}
+	}
+	for _, wm := range lost {
+		txp.monitor.fastRetx(wm)
+		txp.fastRetxSeq = wm.Seq
+	}
+}
+
+func (txp *TxPortal) updateRxPortalSize(rxPortalSize int) {
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	txp.alg.UpdateRxPortalSize(rxPortalSize)
+}
+
+func (txp *TxPortal) rtt(probeTs uint16) {
+	now := time.Now()
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	txp.monitor.rtt(probeTs, now)
+}
+
 func (txp *TxPortal) sendClose(seq *util.Sequence) error {
 	txp.lock.Lock()
 	defer txp.lock.Unlock()
@@ -168,30 +306,49 @@ func (txp *TxPortal) sendClose(seq *util.Sequence) error {
 }
 
 func (txp *TxPortal) close() {
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
 	txp.closed = true
 	txp.monitor.close()
+	txp.interrupt()
 }
 
+// keepaliveSender transmits a KEEPALIVE once the connection has been idle for half of ConnectionTimeout. Each
+// keepalive carries the local RxPortal's buffered size, so the peer's TxAlgorithm tracks this side's backlog.
+//
 func (txp *TxPortal) keepaliveSender() {
 	logrus.Info("started")
 	defer logrus.Info("exited")
 
 	for {
 		time.Sleep(1 * time.Second)
-		if txp.closed {
+		if !txp.keepalive() {
 			return
 		}
-		if time.Since(txp.lastTx).Milliseconds() >= txp.alg.Profile().ConnectionTimeout.Milliseconds()/2 {
-			if keepalive, err := newKeepalive(txp.alg.RxPortalSize(), txp.pool); err == nil {
-				if err := writeWireMessage(keepalive, txp.adapter); err == nil {
-					txp.lastTx = time.Now()
-					txp.ii.WireMessageTx(keepalive)
-					txp.ii.TxKeepalive(keepalive)
-				} else {
-					logrus.Errorf("error sending keepalive (%v)", err)
-					txp.ii.WriteError(err)
-				}
+	}
+}
+
+// keepalive sends a KEEPALIVE if one is due, returning false once the portal is closed.
+//
+func (txp *TxPortal) keepalive() bool {
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+
+	if txp.closed {
+		return false
+	}
+	if time.Since(txp.lastTx).Milliseconds() >= txp.alg.Profile().ConnectionTimeout.Milliseconds()/2 {
+		if keepalive, err := newKeepalive(txp.rxp.size(), txp.pool); err == nil {
+			if err := writeWireMessage(keepalive, txp.adapter); err == nil {
+				txp.lastTx = time.Now()
+				txp.ii.WireMessageTx(keepalive)
+				txp.ii.TxKeepalive(keepalive)
+			} else {
+				logrus.Errorf("error sending keepalive (%v)", err)
+				txp.ii.WriteError(err)
 			}
+			keepalive.buf.Unref()
 		}
 	}
+	return true
 }
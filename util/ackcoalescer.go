@@ -0,0 +1,53 @@
+package util
+
+// MaxAckRanges is the largest number of ranges that an AckCoalescer accumulates for a single ACK.
+const MaxAckRanges = 127
+
+// SeqRange is an inclusive range of sequence numbers.
+type SeqRange struct {
+	Start int32
+	End   int32
+}
+
+// AckCoalescer accumulates received sequence numbers into the ranges of a single ACK. It is shared by the protocol
+// implementations, which each add their own round-trip time probe to the ACK.
+type AckCoalescer struct {
+	ranges []SeqRange
+	ct     int
+}
+
+// Add records the receipt of seq, extending the last range when seq follows it.
+func (self *AckCoalescer) Add(seq int32) {
+	self.ct++
+
+	if len(self.ranges) > 0 {
+		last := &self.ranges[len(self.ranges)-1]
+		if seq == SeqNext(last.End) {
+			last.End = seq
+			return
+		}
+		for _, r := range self.ranges {
+			if SeqInRange(seq, r.Start, r.End) {
+				return
+			}
+		}
+	}
+	self.ranges = append(self.ranges, SeqRange{seq, seq})
+}
+
+// Full returns true once threshold sequences have been added, or the ACK holds MaxAckRanges ranges.
+func (self *AckCoalescer) Full(threshold int) bool {
+	return self.ct >= threshold || len(self.ranges) >= MaxAckRanges
+}
+
+func (self *AckCoalescer) Pending() bool {
+	return len(self.ranges) > 0
+}
+
+// Take returns the accumulated ranges, and starts a new ACK.
+func (self *AckCoalescer) Take() []SeqRange {
+	ranges := self.ranges
+	self.ranges = nil
+	self.ct = 0
+	return ranges
+}
@@ -0,0 +1,277 @@
+package util
+
+import (
+	"container/heap"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EmulatorConfig describes the network weather applied by an EmulatedLink. All probabilities are expressed in the
+// range [0.0, 1.0]. Impairment decisions are drawn from a random source seeded with Seed, so a given sequence of sends
+// always experiences the same losses, duplications and reorderings. Datagrams larger than a non-zero MaxDatagramSz are
+// dropped, as on a path with a smaller MTU that does not fragment.
+type EmulatorConfig struct {
+	Seed           int64
+	LossRate       float64
+	DuplicateRate  float64
+	ReorderRate    float64
+	ReorderDelayMs int
+	DelayMs        int
+	JitterMs       int
+	BandwidthBps   int64
+	QueueLen       int
+	MaxDatagramSz  int
+}
+
+func NewEmulatorConfig(seed int64) *EmulatorConfig {
+	return &EmulatorConfig{
+		Seed:           seed,
+		ReorderDelayMs: 10,
+		QueueLen:       4096,
+	}
+}
+
+type EmulatedDatagram struct {
+	Data   []byte
+	Source net.Addr
+}
+
+type EmulatorStats struct {
+	Sent       int64
+	Dropped    int64
+	Duplicated int64
+	Reordered  int64
+	Delivered  int64
+}
+
+// EmulatedLink is a uni-directional, in-memory datagram link that applies loss, duplication, reordering, delay, jitter
+// and bandwidth constraints to the datagrams sent across it.
+type EmulatedLink struct {
+	cfg       *EmulatorConfig
+	lock      *sync.Mutex
+	ready     *sync.Cond
+	rng       *rand.Rand
+	maxSz     int
+	pending   emulatedQueue
+	order     int64
+	nextFree  time.Time
+	delivered chan *EmulatedDatagram
+	closed    bool
+	stats     EmulatorStats
+}
+
+func NewEmulatedLink(cfg *EmulatorConfig) *EmulatedLink {
+	deliveredLen := cfg.QueueLen
+	if deliveredLen < 1 {
+		deliveredLen = 1024
+	}
+	l := &EmulatedLink{
+		cfg:       cfg,
+		lock:      new(sync.Mutex),
+		rng:       rand.New(rand.NewSource(cfg.Seed)),
+		maxSz:     cfg.MaxDatagramSz,
+		delivered: make(chan *EmulatedDatagram, deliveredLen),
+	}
+	l.ready = sync.NewCond(l.lock)
+	go l.run()
+	return l
+}
+
+// Send copies data onto the link. Send never blocks; datagrams that exceed the link's queue are dropped.
+func (self *EmulatedLink) Send(data []byte, source net.Addr) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return io.ErrClosedPipe
+	}
+	atomic.AddInt64(&self.stats.Sent, 1)
+
+	if self.maxSz > 0 && len(data) > self.maxSz {
+		atomic.AddInt64(&self.stats.Dropped, 1)
+		return nil
+	}
+	if self.rng.Float64() < self.cfg.LossRate {
+		atomic.AddInt64(&self.stats.Dropped, 1)
+		return nil
+	}
+	copies := 1
+	if self.rng.Float64() < self.cfg.DuplicateRate {
+		atomic.AddInt64(&self.stats.Duplicated, 1)
+		copies++
+	}
+
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		if self.cfg.QueueLen > 0 && len(self.pending) >= self.cfg.QueueLen {
+			atomic.AddInt64(&self.stats.Dropped, 1)
+			continue
+		}
+
+		deliverAt := now
+		if self.cfg.BandwidthBps > 0 {
+			if self.nextFree.Before(now) {
+				self.nextFree = now
+			}
+			self.nextFree = self.nextFree.Add(time.Duration(int64(len(data)) * 8 * int64(time.Second) / self.cfg.BandwidthBps))
+			deliverAt = self.nextFree
+		}
+		delayMs := self.cfg.DelayMs
+		if self.cfg.JitterMs > 0 {
+			delayMs += self.rng.Intn(2*self.cfg.JitterMs+1) - self.cfg.JitterMs
+		}
+		if self.rng.Float64() < self.cfg.ReorderRate {
+			atomic.AddInt64(&self.stats.Reordered, 1)
+			delayMs += self.cfg.ReorderDelayMs
+		}
+		if delayMs > 0 {
+			deliverAt = deliverAt.Add(time.Duration(delayMs) * time.Millisecond)
+		}
+
+		dataCopy := make([]byte, len(data))
+		copy(dataCopy, data)
+		heap.Push(&self.pending, &emulatedDelivery{
+			datagram:  &EmulatedDatagram{Data: dataCopy, Source: source},
+			deliverAt: deliverAt,
+			order:     self.order,
+		})
+		self.order++
+	}
+	self.ready.Broadcast()
+
+	return nil
+}
+
+// Receive blocks until the next datagram is delivered by the link, or until the deadline expires (a zero deadline
+// never expires). It returns io.EOF once the link is closed.
+func (self *EmulatedLink) Receive(deadline time.Time) (*EmulatedDatagram, error) {
+	if deadline.IsZero() {
+		datagram, ok := <-self.delivered
+		if !ok {
+			return nil, io.EOF
+		}
+		return datagram, nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case datagram, ok := <-self.delivered:
+		if !ok {
+			return nil, io.EOF
+		}
+		return datagram, nil
+	case <-timer.C:
+		return nil, EmulatorTimeoutError{}
+	}
+}
+
+// SetMaxDatagramSz changes the largest datagram that the link delivers, as when a route change moves traffic onto a path
+// with a smaller MTU. Zero removes the limit.
+func (self *EmulatedLink) SetMaxDatagramSz(sz int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maxSz = sz
+}
+
+func (self *EmulatedLink) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		self.ready.Broadcast()
+	}
+}
+
+func (self *EmulatedLink) Stats() EmulatorStats {
+	return EmulatorStats{
+		Sent:       atomic.LoadInt64(&self.stats.Sent),
+		Dropped:    atomic.LoadInt64(&self.stats.Dropped),
+		Duplicated: atomic.LoadInt64(&self.stats.Duplicated),
+		Reordered:  atomic.LoadInt64(&self.stats.Reordered),
+		Delivered:  atomic.LoadInt64(&self.stats.Delivered),
+	}
+}
+
+// run delivers each datagram once it is due. Rather than polling, it waits on the link's condition until a timer armed
+// for the head of the queue fires, or until Send queues a datagram that may be due sooner.
+func (self *EmulatedLink) run() {
+	defer close(self.delivered)
+
+	timer := time.AfterFunc(time.Hour, func() {
+		self.lock.Lock()
+		self.ready.Broadcast()
+		self.lock.Unlock()
+	})
+	timer.Stop()
+	defer timer.Stop()
+
+	self.lock.Lock()
+	for {
+		if self.closed {
+			self.lock.Unlock()
+			return
+		}
+		if len(self.pending) < 1 {
+			self.ready.Wait()
+			continue
+		}
+		next := self.pending[0]
+		if wait := time.Until(next.deliverAt); wait > 0 {
+			timer.Reset(wait)
+			self.ready.Wait()
+			timer.Stop()
+			continue
+		}
+		heap.Pop(&self.pending)
+		self.lock.Unlock()
+
+		select {
+		case self.delivered <- next.datagram:
+			atomic.AddInt64(&self.stats.Delivered, 1)
+		default:
+			atomic.AddInt64(&self.stats.Dropped, 1)
+		}
+
+		self.lock.Lock()
+	}
+}
+
+type EmulatorTimeoutError struct{}
+
+func (self EmulatorTimeoutError) Error() string   { return "i/o timeout" }
+func (self EmulatorTimeoutError) Timeout() bool   { return true }
+func (self EmulatorTimeoutError) Temporary() bool { return true }
+
+type emulatedDelivery struct {
+	datagram  *EmulatedDatagram
+	deliverAt time.Time
+	order     int64
+}
+
+type emulatedQueue []*emulatedDelivery
+
+func (self emulatedQueue) Len() int { return len(self) }
+
+func (self emulatedQueue) Less(i, j int) bool {
+	if self[i].deliverAt.Equal(self[j].deliverAt) {
+		return self[i].order < self[j].order
+	}
+	return self[i].deliverAt.Before(self[j].deliverAt)
+}
+
+func (self emulatedQueue) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+func (self *emulatedQueue) Push(x interface{}) { *self = append(*self, x.(*emulatedDelivery)) }
+
+func (self *emulatedQueue) Pop() interface{} {
+	old := *self
+	n := len(old)
+	x := old[n-1]
+	*self = old[:n-1]
+	return x
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func emulatedDeliveries(cfg *EmulatorConfig, count int) []byte {
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	for i := 0; i < count; i++ {
+		_ = link.Send([]byte{byte(i)}, nil)
+	}
+	var out []byte
+	for {
+		datagram, err := link.Receive(time.Now().Add(100 * time.Millisecond))
+		if err != nil {
+			return out
+		}
+		out = append(out, datagram.Data[0])
+	}
+}
+
+func TestEmulatedLinkLossless(t *testing.T) {
+	out := emulatedDeliveries(NewEmulatorConfig(1), 200)
+	assert.Equal(t, 200, len(out))
+	for i, v := range out {
+		assert.Equal(t, byte(i), v)
+	}
+}
+
+func TestEmulatedLinkReproducible(t *testing.T) {
+	cfg := NewEmulatorConfig(42)
+	cfg.LossRate = 0.2
+	cfg.DuplicateRate = 0.1
+	first := emulatedDeliveries(cfg, 200)
+	second := emulatedDeliveries(cfg, 200)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, 200, len(first))
+}
+
+func TestEmulatedLinkImpairments(t *testing.T) {
+	cfg := NewEmulatorConfig(7)
+	cfg.LossRate = 0.1
+	cfg.DuplicateRate = 0.1
+	cfg.ReorderRate = 0.1
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, link.Send([]byte{byte(i)}, nil))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stats := link.Stats()
+	assert.Equal(t, int64(1000), stats.Sent)
+	assert.InDelta(t, 100, stats.Dropped, 40)
+	assert.InDelta(t, 90, stats.Duplicated, 40)
+	assert.Greater(t, stats.Reordered, int64(0))
+	assert.Equal(t, stats.Sent-stats.Dropped+stats.Duplicated, stats.Delivered)
+}
+
+func TestEmulatedLinkMaxDatagramSz(t *testing.T) {
+	cfg := NewEmulatorConfig(1)
+	cfg.MaxDatagramSz = 4
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	assert.NoError(t, link.Send(make([]byte, 5), nil))
+	assert.NoError(t, link.Send(make([]byte, 4), nil))
+	datagram, err := link.Receive(time.Now().Add(100 * time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(datagram.Data))
+	assert.Equal(t, int64(1), link.Stats().Dropped)
+
+	// a smaller path MTU drops datagrams that were deliverable before
+	link.SetMaxDatagramSz(3)
+	assert.NoError(t, link.Send(make([]byte, 4), nil))
+	_, err = link.Receive(time.Now().Add(100 * time.Millisecond))
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), link.Stats().Dropped)
+}
+
+func TestEmulatedLinkDelayAndTimeout(t *testing.T) {
+	cfg := NewEmulatorConfig(1)
+	cfg.DelayMs = 50
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	start := time.Now()
+	assert.NoError(t, link.Send([]byte{0x01}, nil))
+	_, err := link.Receive(time.Now().Add(10 * time.Millisecond))
+	assert.Error(t, err)
+	datagram, err := link.Receive(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01}, datagram.Data)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestEmulatedLinkBandwidth(t *testing.T) {
+	cfg := NewEmulatorConfig(1)
+	cfg.BandwidthBps = 8 * 1000 * 100
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, link.Send(make([]byte, 1000), nil))
+	}
+	for i := 0; i < 10; i++ {
+		_, err := link.Receive(time.Time{})
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+}
+
+func TestEmulatedLinkEarlierDeliveryNotHeldBack(t *testing.T) {
+	cfg := NewEmulatorConfig(1)
+	cfg.DelayMs = 200
+	link := NewEmulatedLink(cfg)
+	defer link.Close()
+
+	start := time.Now()
+	assert.NoError(t, link.Send([]byte{0x01}, nil))
+	cfg.DelayMs = 0
+	assert.NoError(t, link.Send([]byte{0x02}, nil))
+
+	datagram, err := link.Receive(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, datagram.Data)
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	datagram, err = link.Receive(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01}, datagram.Data)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
@@ -21,3 +21,51 @@ func (self *Sequence) Next() int32 {
 	atomic.CompareAndSwapInt32(&self.nextValue, math.MaxInt32, -1)
 	return atomic.AddInt32(&self.nextValue, 1)
 }
+
+// Sequence numbers are serial numbers (RFC 1982) in the space [0, MaxInt32]: Next wraps from MaxInt32 back to 0. Two
+// sequence numbers are ordered by the shorter distance between them, so that sequences on either side of the wrap
+// compare as expected, provided that they are less than half of the space apart.
+
+const seqHalf = 1 << 30
+
+// SeqAdd returns seq advanced by n.
+func SeqAdd(seq int32, n int32) int32 {
+	return int32((uint32(seq) + uint32(n)) & math.MaxInt32)
+}
+
+// SeqNext returns the sequence number following seq.
+func SeqNext(seq int32) int32 {
+	return SeqAdd(seq, 1)
+}
+
+// SeqDiff returns the serial distance from b to a, which is positive when a follows b.
+func SeqDiff(a, b int32) int32 {
+	d := (uint32(a) - uint32(b)) & math.MaxInt32
+	if d >= seqHalf {
+		return int32(int64(d) - (math.MaxInt32 + 1))
+	}
+	return int32(d)
+}
+
+// SeqLess returns true when a precedes b.
+func SeqLess(a, b int32) bool {
+	return SeqDiff(a, b) < 0
+}
+
+// SeqInRange returns true when seq falls within the inclusive range from start to end.
+func SeqInRange(seq, start, end int32) bool {
+	return SeqDiff(seq, start) >= 0 && SeqDiff(end, seq) >= 0
+}
+
+// SeqComparator orders int32 sequence numbers by serial order, for use with gods containers.
+func SeqComparator(a, b interface{}) int {
+	d := SeqDiff(a.(int32), b.(int32))
+	switch {
+	case d < 0:
+		return -1
+	case d > 0:
+		return 1
+	default:
+		return 0
+	}
+}
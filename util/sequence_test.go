@@ -0,0 +1,50 @@
+package util
+
+import (
+	"github.com/emirpasic/gods/trees/btree"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestSequenceWraps(t *testing.T) {
+	seq := NewSequence(math.MaxInt32 - 1)
+	assert.Equal(t, int32(math.MaxInt32-1), seq.Next())
+	assert.Equal(t, int32(math.MaxInt32), seq.Next())
+	assert.Equal(t, int32(0), seq.Next())
+	assert.Equal(t, int32(1), seq.Next())
+}
+
+func TestSeqArithmetic(t *testing.T) {
+	assert.Equal(t, int32(0), SeqNext(math.MaxInt32))
+	assert.Equal(t, int32(0), SeqNext(-1))
+	assert.Equal(t, int32(9), SeqAdd(math.MaxInt32-10, 20))
+
+	assert.Equal(t, int32(2), SeqDiff(1, math.MaxInt32))
+	assert.Equal(t, int32(-2), SeqDiff(math.MaxInt32, 1))
+	assert.Equal(t, int32(seqHalf-1), SeqDiff(seqHalf-1, 0))
+	assert.Equal(t, int32(-seqHalf), SeqDiff(seqHalf, 0))
+
+	assert.True(t, SeqLess(math.MaxInt32, 0))
+	assert.False(t, SeqLess(0, math.MaxInt32))
+	assert.True(t, SeqLess(100, 200))
+	assert.False(t, SeqLess(200, 200))
+
+	assert.True(t, SeqInRange(0, math.MaxInt32-1, 1))
+	assert.True(t, SeqInRange(math.MaxInt32, math.MaxInt32-1, 1))
+	assert.True(t, SeqInRange(1, math.MaxInt32-1, 1))
+	assert.False(t, SeqInRange(2, math.MaxInt32-1, 1))
+	assert.False(t, SeqInRange(math.MaxInt32-2, math.MaxInt32-1, 1))
+}
+
+func TestSeqComparatorOrdersAcrossWrap(t *testing.T) {
+	tree := btree.NewWith(4, SeqComparator)
+	for _, seq := range []int32{1, math.MaxInt32, 0, math.MaxInt32 - 2, 2, math.MaxInt32 - 1} {
+		tree.Put(seq, nil)
+	}
+	var keys []int32
+	for _, k := range tree.Keys() {
+		keys = append(keys, k.(int32))
+	}
+	assert.Equal(t, []int32{math.MaxInt32 - 2, math.MaxInt32 - 1, math.MaxInt32, 0, 1, 2}, keys)
+}
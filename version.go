@@ -0,0 +1,3 @@
+package dilithium
+
+const protocolVersion = uint32(1)
@@ -0,0 +1,231 @@
+package dilithium
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// arrayWaitlist is the original slice-backed waitlist, kept as a reference for the benchmarks. Remove scans linearly,
+// and Add appends without ordering.
+//
+type arrayWaitlist struct {
+	waitlist []*waitlistSubject
+}
+
+func newArrayWaitlist() waitlist {
+	return &arrayWaitlist{}
+}
+
+func (self *arrayWaitlist) Add(wm *WireMessage, retxMs int, t time.Time) {
+	self.waitlist = append(self.waitlist, &waitlistSubject{t, retxMs, wm})
+}
+
+func (self *arrayWaitlist) Update(retxMs func(*WireMessage) int) {
+	for _, waiter := range self.waitlist {
+		waiter.reschedule(retxMs(waiter.wm))
+	}
+	sort.SliceStable(self.waitlist, func(i, j int) bool {
+		return self.waitlist[i].deadline.Before(self.waitlist[j].deadline)
+	})
+}
+
+func (self *arrayWaitlist) Remove(wm *WireMessage) {
+	for i := 0; i < len(self.waitlist); i++ {
+		if self.waitlist[i].wm == wm {
+			self.waitlist = append(self.waitlist[:i], self.waitlist[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *arrayWaitlist) Size() int {
+	return len(self.waitlist)
+}
+
+func (self *arrayWaitlist) Peek() (*WireMessage, time.Time) {
+	if len(self.waitlist) < 1 {
+		return nil, time.Time{}
+	}
+	return self.waitlist[0].wm, self.waitlist[0].deadline
+}
+
+func (self *arrayWaitlist) Next() (*WireMessage, time.Time) {
+	if len(self.waitlist) < 1 {
+		return nil, time.Time{}
+	}
+	next := self.waitlist[0]
+	self.waitlist = self.waitlist[1:]
+	return next.wm, next.deadline
+}
+
+func TestHeapWaitlistOrdering(t *testing.T) {
+	hw := newHeapWaitlist()
+	now := time.Now()
+	wms := make([]*WireMessage, 0)
+	for _, offset := range []int{5, 1, 4, 2, 3} {
+		wm := &WireMessage{Seq: int32(offset)}
+		wms = append(wms, wm)
+		hw.Add(wm, 200, now.Add(time.Duration(offset)*time.Millisecond))
+	}
+
+	hw.Add(wms[1], 200, now.Add(10*time.Millisecond))
+	hw.Remove(wms[3])
+	hw.Remove(&WireMessage{Seq: int32(99)})
+	assert.Equal(t, 4, hw.Size())
+
+	for _, seq := range []int32{3, 4, 5, 1} {
+		wmOut, _ := hw.Next()
+		assert.Equal(t, seq, wmOut.Seq)
+	}
+	wmOut, deadlineOut := hw.Next()
+	assert.Nil(t, wmOut)
+	assert.Equal(t, time.Time{}, deadlineOut)
+}
+
+func TestWaitlistUpdate(t *testing.T) {
+	for name, newWaitlist := range map[string]func() waitlist{"array": newArrayWaitlist, "heap": newHeapWaitlist} {
+		t.Run(name, func(t *testing.T) {
+			wl := newWaitlist()
+			now := time.Now()
+			a := &WireMessage{Seq: int32(1)}
+			b := &WireMessage{Seq: int32(2)}
+			wl.Add(a, 100, now.Add(100*time.Millisecond))
+			wl.Add(b, 200, now.Add(150*time.Millisecond))
+
+			wl.Update(func(*WireMessage) int { return 50 })
+			wmOut, deadlineOut := wl.Next()
+			assert.Equal(t, b, wmOut)
+			assert.Equal(t, now, deadlineOut)
+			wmOut, deadlineOut = wl.Next()
+			assert.Equal(t, a, wmOut)
+			assert.Equal(t, now.Add(50*time.Millisecond), deadlineOut)
+		})
+	}
+}
+
+func TestTxMonitorBackoff(t *testing.T) {
+	profile := NewBaselineWestworldProfile()
+	alg := NewWestworldAlgorithm(profile, &NilInstrumentInstance{})
+	txm := newTxMonitor(new(sync.Mutex), alg, nil, &NilInstrumentInstance{})
+	wm := &WireMessage{Seq: int32(1)}
+
+	assert.Equal(t, profile.RetxStartMs, txm.retxMs(wm))
+	txm.backoff[wm] = 2
+	assert.Equal(t, 4*profile.RetxStartMs, txm.retxMs(wm))
+	txm.backoff[wm] = 64
+	assert.Equal(t, profile.Txpf.RetxMaxMs, txm.retxMs(wm))
+
+	// a fresh RTT sample replaces the backed-off timeout of the in-flight payload
+	txm.backoff[wm] = 1
+	txm.add(wm)
+	_, before := txm.waitlist.Peek()
+	txm.updateRtt(20 * time.Millisecond)
+	_, after := txm.waitlist.Peek()
+	assert.Equal(t, before.Add(time.Duration(alg.RetxMs()-2*profile.RetxStartMs)*time.Millisecond), after)
+
+	txm.remove(wm)
+	assert.Equal(t, alg.RetxMs(), txm.retxMs(wm))
+}
+
+func TestTxMonitorKarn(t *testing.T) {
+	profile := NewBaselineWestworldProfile()
+	alg := NewWestworldAlgorithm(profile, &NilInstrumentInstance{})
+	adapter, _ := NewEmulatedAdapterPair(util.NewEmulatorConfig(0), util.NewEmulatorConfig(1))
+	defer func() { _ = adapter.Close() }()
+	txm := newTxMonitor(new(sync.Mutex), alg, adapter, &NilInstrumentInstance{})
+	pool := NewPool("test", 1024, &NilInstrumentInstance{})
+
+	sent := time.Now().Add(-100 * time.Millisecond)
+	tsA := uint16(sent.UnixNano() / int64(time.Millisecond))
+	a, err := newData(1, &tsA, []byte{0x01}, pool)
+	assert.NoError(t, err)
+	txm.add(a)
+	tsB := tsA + 1
+	b, err := newData(2, &tsB, []byte{0x02}, pool)
+	assert.NoError(t, err)
+	txm.add(b)
+
+	// the retransmitted payload's echo is ambiguous, and is discarded
+	txm.retx(b)
+	txm.rtt(tsB, time.Now())
+	assert.Equal(t, profile.RetxStartMs, alg.RetxMs())
+
+	txm.rtt(tsA, time.Now())
+	assert.Greater(t, alg.RetxMs(), profile.RetxStartMs)
+	assert.Equal(t, 0, len(txm.probes))
+}
+
+func newWaitlistSubjects(sz int) []*waitlistSubject {
+	toAdd := make([]*waitlistSubject, 0)
+	for i := 0; i < sz; i++ {
+		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &WireMessage{Seq: int32(i)}})
+	}
+	return toAdd
+}
+
+func benchmarkWaitlist_Add_Next(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := 0; i < sz; i++ {
+			wl.Next()
+		}
+	}
+}
+func BenchmarkArrayWaitlist_Add_Next_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Next_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Next(newHeapWaitlist, 65536, b)
+}
+
+func benchmarkWaitlist_Add_Remove(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := 0; i < sz; i++ {
+			wl.Remove(toAdd[i].wm)
+		}
+	}
+}
+func BenchmarkArrayWaitlist_Add_Remove_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove(newHeapWaitlist, 65536, b)
+}
+
+func benchmarkWaitlist_Add_Remove_Reverse(newWaitlist func() waitlist, sz int, b *testing.B) {
+	toAdd := newWaitlistSubjects(sz)
+	wl := newWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			wl.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := sz - 1; i >= 0; i-- {
+			wl.Remove(toAdd[i].wm)
+		}
+	}
+}
+func BenchmarkArrayWaitlist_Add_Remove_Reverse_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newArrayWaitlist, 65536, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_65536(b *testing.B) {
+	benchmarkWaitlist_Add_Remove_Reverse(newHeapWaitlist, 65536, b)
+}
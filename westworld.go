@@ -1,7 +1,6 @@
 package dilithium
 
 import (
-	"github.com/sirupsen/logrus"
 	"sync"
 	"time"
 )
@@ -17,8 +16,7 @@ type WestworldAlgorithm struct {
 	dupAckCount        int
 	retxCount          int
 	lastRttProbe       time.Time
-	rttAvg             []uint16
-	retxMs             int
+	rtt                RttEstimator
 	ii                 InstrumentInstance
 
 	wpf   *WestworldProfile
@@ -37,29 +35,40 @@ func NewWestworldAlgorithm(pf *WestworldProfile, ii InstrumentInstance) TxAlgori
 		dupAckCount:        0,
 		retxCount:          0,
 		lastRttProbe:       time.Time{},
-		retxMs:             pf.RetxStartMs,
+		rtt:                NewRttEstimator(pf.RetxStartMs, pf.RetxAddMs),
 
 		wpf: pf,
 		pf:  pf.Txpf,
 		ii:  ii,
 	}
 	wa.ii.TxPortalCapacityChanged(wa.capacity)
-	wa.ii.NewRetxMs(wa.retxMs)
+	wa.ii.NewRetxMs(wa.rtt.RetxMs())
 	return wa
 }
 
 func (wa *WestworldAlgorithm) SetLock(lock *sync.Mutex) {
 	wa.lock = lock
 	wa.ready = sync.NewCond(wa.lock)
-	go wa.debug()
 }
 
 func (wa *WestworldAlgorithm) Tx(segmentSize int) {
+	wa.TxInterruptible(segmentSize, func() bool { return false })
+}
+
+func (wa *WestworldAlgorithm) TxInterruptible(segmentSize int, interrupted func() bool) bool {
 	for !wa.availableCapacity(segmentSize) {
+		if interrupted() {
+			return false
+		}
 		wa.ready.Wait()
 	}
 	wa.txPortalSize += segmentSize
 	wa.ii.TxPortalSzChanged(wa.txPortalSize)
+	return true
+}
+
+func (wa *WestworldAlgorithm) Interrupt() {
+	wa.ready.Broadcast()
 }
 
 func (wa *WestworldAlgorithm) Success(segmentSize int) {
@@ -103,25 +112,13 @@ func (wa *WestworldAlgorithm) ProbeRTT() bool {
 	return false
 }
 
-func (wa *WestworldAlgorithm) UpdateRTT(rttMs int) {
-	wa.rttAvg = append(wa.rttAvg, uint16(rttMs))
-	if len(wa.rttAvg) > wa.wpf.RttProbeAvg {
-		wa.rttAvg = wa.rttAvg[1:]
-	}
-	if len(wa.rttAvg) == wa.wpf.RttProbeAvg {
-		accum := 0
-		for _, rttMs := range wa.rttAvg {
-			accum += int(rttMs)
-		}
-		accum /= len(wa.rttAvg)
-		wa.retxMs = accum + wa.wpf.RetxAddMs
-		wa.ii.NewRetxMs(wa.retxMs)
-	}
+func (wa *WestworldAlgorithm) UpdateRTT(rtt time.Duration) {
+	wa.rtt.Update(rtt)
+	wa.ii.NewRetxMs(wa.rtt.RetxMs())
 }
 
 func (wa *WestworldAlgorithm) RetxMs() int {
-	// TODO: This needs to consider RTT. This is just hard-coded for the sake of plumbing development.
-	return wa.retxMs
+	return wa.rtt.RetxMs()
 }
 
 func (wa *WestworldAlgorithm) RxPortalSize() int {
@@ -143,6 +140,10 @@ func (wa *WestworldAlgorithm) Profile() *TxProfile {
 	return wa.pf
 }
 
+func (wa *WestworldAlgorithm) PacingRate() float64 {
+	return wa.rtt.Rate(wa.capacity)
+}
+
 func (wa *WestworldAlgorithm) availableCapacity(segmentSize int) bool {
 	txPortalCapacity := wa.capacity - int(float64(wa.rxPortalSize)*wa.wpf.RxSizePressureScale) - (wa.txPortalSize + segmentSize)
 	return txPortalCapacity > 0
@@ -159,18 +160,6 @@ func (wa *WestworldAlgorithm) updateCapacity(capacity int) {
 	wa.ii.TxPortalCapacityChanged(wa.capacity)
 }
 
-func (wa *WestworldAlgorithm) debug() {
-	logrus.Info("started")
-	defer logrus.Info("exited")
-
-	for {
-		time.Sleep(1 * time.Second)
-		wa.lock.Lock()
-		logrus.Infof("WestworldAlgorithm = {\n\tcapacity: %d\n\ttxPortalSize: %d\n\trxPortalSize: %d\n}", wa.capacity, wa.txPortalSize, wa.rxPortalSize)
-		wa.lock.Unlock()
-	}
-}
-
 type WestworldProfile struct {
 	StartSize           int
 	MinSize             int
@@ -187,7 +176,7 @@ type WestworldProfile struct {
 	RetxSuccessScale    float64
 	RxSizePressureScale float64
 	RttProbeMs          int
-	RttProbeAvg         int
+	RttProbeAvg         int // Deprecated: ignored; RetxMs is derived from the smoothed RTT
 	Txpf                *TxProfile
 }
 